@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useACL writes body to an ACL file and loads it for the test.
+func useACL(t *testing.T, s *Server, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.ACLFile = path
+	if err := s.reloadACL(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouteACL(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveLoopback(t, s)
+	gw := dialAgent(t, addr, "gateway:eu")
+	app := dialAgent(t, addr, "bot:app")
+	db := dialAgent(t, addr, "db:orders")
+	for _, a := range []*testAgent{gw, app, db} {
+		a.call(&Packet{Dst: "server"})
+	}
+
+	// No rules: everything is allowed.
+	app.send(&Packet{Dst: "db:orders", Body: "open"})
+	if got := db.recv(); got.Body != "open" {
+		t.Fatalf("default allow: db got %v", got)
+	}
+
+	useACL(t, s, `{"rules": [
+		{"src": "gateway:*", "dst": "db:*", "action": "allow"},
+		{"src": "*", "dst": "db:*", "action": "deny"}
+	]}`)
+	gw.send(&Packet{Dst: "db:orders", Body: "allowed"})
+	if got := db.recv(); got.Body != "allowed" {
+		t.Fatalf("allowed pair: db got %v", got)
+	}
+	if resp := app.call(&Packet{Id: "d", Dst: "db:orders", Body: "denied"}); resp.Body != "error:forbidden" || resp.Id != "d" {
+		t.Fatalf("denied pair: got %q (id %q), want error:forbidden", resp.Body, resp.Id)
+	}
+	expectNothing(t, db)
+	// Pairs no rule mentions fall through to the default.
+	db.send(&Packet{Dst: "bot:app", Body: "unmatched"})
+	if got := app.recv(); got.Body != "unmatched" {
+		t.Fatalf("unmatched pair: app got %v", got)
+	}
+	if n := s.aclDenied.Load(); n != 1 {
+		t.Errorf("aclDenied = %d, want 1", n)
+	}
+	var m strings.Builder
+	s.writeMetrics(&m)
+	if !strings.Contains(m.String(), "keep_acl_denied_total 1\n") {
+		t.Error("metrics missing keep_acl_denied_total 1")
+	}
+
+	// A reload replaces the rules; a bad file keeps the previous ones.
+	useACL(t, s, `{"default": "deny", "rules": [{"src": "bot:app", "dst": "*", "action": "allow"}]}`)
+	app.send(&Packet{Dst: "db:orders", Body: "after reload"})
+	if got := db.recv(); got.Body != "after reload" {
+		t.Fatalf("after reload: db got %v", got)
+	}
+	if resp := gw.call(&Packet{Dst: "bot:app"}); resp.Body != "error:forbidden" {
+		t.Fatalf("default deny: got %q", resp.Body)
+	}
+	if err := os.WriteFile(s.cfg.ACLFile, []byte(`{"rules": [{"src": "*", "dst": "*", "action": "maybe"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadACL(); err == nil {
+		t.Fatal("reload accepted an invalid action")
+	}
+	if resp := gw.call(&Packet{Dst: "bot:app"}); resp.Body != "error:forbidden" {
+		t.Fatalf("after a bad reload: got %q", resp.Body)
+	}
+
+	// Server endpoints are not subject to the ACL.
+	if resp := gw.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("server endpoint: got %q", resp.Body)
+	}
+}
+
+func TestAnycastACL(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveLoopback(t, s)
+	app := dialAgent(t, addr, "bot:app")
+	app.call(&Packet{Dst: "server"})
+	db := dialAgent(t, addr, "db:orders")
+	worker := dialAgent(t, addr, "bot:worker")
+	for _, m := range []*testAgent{db, worker} {
+		if resp := m.call(&Packet{Dst: "subscribe:jobs"}); status(resp) != "done" {
+			t.Fatalf("%s subscribe: got %q", m.src, resp.Body)
+		}
+	}
+	useACL(t, s, `{"rules": [{"src": "bot:app", "dst": "db:*", "action": "deny"}]}`)
+
+	// The longest-subscribed member is denied, so the next one gets it.
+	app.send(&Packet{Dst: "any:jobs", Body: "job 1"})
+	if got := worker.recv(); got.Body != "job 1" {
+		t.Fatalf("worker got %v, want job 1", got)
+	}
+	expectNothing(t, db)
+
+	// With only denied members left, the sender is told so.
+	worker.call(&Packet{Dst: "unsubscribe:jobs"})
+	if resp := app.call(&Packet{Id: "a", Dst: "any:jobs", Body: "job 2"}); resp.Body != "error:forbidden" || resp.Id != "a" {
+		t.Fatalf("all members denied: got %q (id %q), want error:forbidden", resp.Body, resp.Id)
+	}
+	expectNothing(t, db)
+	if n := s.aclDenied.Load(); n != 1 {
+		t.Errorf("aclDenied = %d, want 1", n)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "bot:a", true},
+		{"db:*", "db:orders", true},
+		{"db:*", "xdb:orders", false},
+		{"*:eu", "gateway:eu", true},
+		{"*:eu", "gateway:eu-2", false},
+		{"bot:*-*", "bot:a-b", true},
+		{"bot:*-*", "bot:ab", false},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	} {
+		if got := globMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
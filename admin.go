@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// The admin listener (-admin-listen, off by default) gathers the HTTP
+// endpoints operators use, apart from the protocol port:
+//
+//	/metrics                Prometheus metrics, as on -metrics-listen
+//	/livez, /readyz         health probes (see probes.go)
+//	/debug/pprof/           Go profiling
+//	/admin/config           the running flags, as discover:config
+//	/admin/kick?identity=   POST: close an identity's connections, as kick:
+//	/admin/directive?identity=
+//	                        POST: push a directive to an identity or *, as directive:
+//	/admin/snapshot         the routing table as JSON (see snapshot.go)
+//
+// With -admin-token set, every path but the probes needs an
+// "Authorization: Bearer <token>" header and answers 401 without it;
+// orchestrators polling the probes usually can't send one. The listener and
+// its connections close with the server.
+
+// startAdmin serves the admin endpoints on addr.
+func (s *Server) startAdmin(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.Handle("/metrics", s.adminAuth(http.HandlerFunc(s.metricsHandler)))
+	mux.Handle("/debug/pprof/", s.adminAuth(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", s.adminAuth(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", s.adminAuth(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", s.adminAuth(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", s.adminAuth(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/admin/config", s.adminAuth(http.HandlerFunc(s.adminConfigHandler)))
+	mux.Handle("/admin/kick", s.adminAuth(http.HandlerFunc(s.adminKickHandler)))
+	mux.Handle("/admin/directive", s.adminAuth(http.HandlerFunc(s.adminDirectiveHandler)))
+	mux.Handle("/admin/snapshot", s.adminAuth(http.HandlerFunc(s.adminSnapshotHandler)))
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-s.done
+		srv.Close()
+	}()
+	auth := "no token"
+	if s.cfg.AdminToken != "" {
+		auth = "bearer token"
+	}
+	s.log.Printf("Admin on http://%s (%s)", l.Addr(), auth)
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Printf("Admin server: %v", err)
+		}
+	}()
+	return nil
+}
+
+// adminAuth wraps h to require -admin-token, if set, as a bearer token.
+func (s *Server) adminAuth(h http.Handler) http.Handler {
+	if s.cfg.AdminToken == "" {
+		return h
+	}
+	want := []byte("Bearer " + s.cfg.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="keep-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"flags":           s.cfg.snapshot(),
+		"version":         ServerVersion,
+		"max_packet_size": wire.MaxPacketSize,
+	})
+}
+
+func (s *Server) adminKickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	identity := strings.TrimSpace(r.URL.Query().Get("identity"))
+	if identity == "" {
+		http.Error(w, "identity required", http.StatusBadRequest)
+		return
+	}
+	conns := s.kick(identity)
+	s.log.Printf("Kicked %q from the admin listener (%s): closing %d connections", identity, r.RemoteAddr, len(conns))
+	for _, ci := range conns {
+		ci.sayClose(closeKicked)
+		ci.Close()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kickAck{Status: "done", Kicked: identity, Closed: len(conns)})
+}
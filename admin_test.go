@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminListener(t *testing.T) {
+	admin := freeAddr(t)
+	s, addr := startServer(t, func(c *Config) {
+		c.AdminAddr = admin
+		c.AdminToken = "s3cret"
+	})
+	do := func(method, path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+admin+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, path := range []string{"/metrics", "/debug/pprof/", "/admin/config", "/admin/snapshot"} {
+		if code, _ := do("GET", path, ""); code != http.StatusUnauthorized {
+			t.Errorf("%s without a token: %d, want 401", path, code)
+		}
+		if code, _ := do("GET", path, "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("%s with the wrong token: %d, want 401", path, code)
+		}
+		if code, _ := do("GET", path, "s3cret"); code != http.StatusOK {
+			t.Errorf("%s with the token: %d, want 200", path, code)
+		}
+	}
+	if code, _ := do("GET", "/livez", ""); code != http.StatusOK {
+		t.Errorf("livez without a token: %d, want 200", code)
+	}
+	if _, body := do("GET", "/admin/config", "s3cret"); strings.Contains(body, "s3cret") {
+		t.Error("/admin/config shows the admin token")
+	}
+
+	a := dialAgent(t, addr, "bot:admin-kicked")
+	a.call(&Packet{Dst: "server"})
+	if code, _ := do("POST", "/admin/kick?identity=bot:admin-kicked", ""); code != http.StatusUnauthorized {
+		t.Fatalf("kick without a token: %d", code)
+	}
+	if code, body := do("POST", "/admin/kick?identity=bot:admin-kicked", "s3cret"); code != http.StatusOK || !strings.Contains(body, `"closed":1`) {
+		t.Fatalf("kick: %d %q", code, body)
+	}
+	if registered(s, "bot:admin-kicked") {
+		t.Error("kicked identity still registered")
+	}
+	expectClosedWith(t, a.conn, closeKicked)
+
+	// It goes down with the server.
+	s.Shutdown(context.Background())
+	if _, err := http.Get("http://" + admin + "/livez"); err == nil {
+		t.Error("admin listener still answering after shutdown")
+	}
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	admin := freeAddr(t)
+	_, addr := startServer(t, func(c *Config) {
+		c.AdminAddr = admin
+	})
+	a := dialAgent(t, addr, "bot:snap-a")
+	a.call(&Packet{Dst: "server"})
+	a.call(&Packet{Dst: "server"})
+	b := dialAgent(t, addr, "bot:snap-b")
+	b.call(&Packet{Dst: "server"})
+
+	resp, err := http.Get("http://" + admin + "/admin/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var snap routingSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Connections != 2 {
+		t.Errorf("connections = %d, want 2", snap.Connections)
+	}
+	if len(snap.Identities) != 2 {
+		t.Fatalf("identities = %+v, want bot:snap-a and bot:snap-b", snap.Identities)
+	}
+	for i, want := range []struct {
+		agent   *testAgent
+		packets int64
+	}{{a, 2}, {b, 1}} {
+		got := snap.Identities[i]
+		if got.Identity != want.agent.src || got.Addr != want.agent.conn.LocalAddr().String() || got.Standby {
+			t.Errorf("entry %d = %+v, want %s from %s", i, got, want.agent.src, want.agent.conn.LocalAddr())
+		}
+		if pk := hex.EncodeToString(want.agent.priv.Public().(ed25519.PublicKey)); got.PublicKey != pk {
+			t.Errorf("%s pk = %s, want %s", got.Identity, got.PublicKey, pk)
+		}
+		if got.PacketsIn != want.packets || got.BytesIn == 0 || got.BytesOut == 0 {
+			t.Errorf("%s counters = %+v, want %d packets in and bytes both ways", got.Identity, got, want.packets)
+		}
+		if got.Connected.IsZero() || got.Connected.After(snap.Time) {
+			t.Errorf("%s connected at %v, snapshot at %v", got.Identity, got.Connected, snap.Time)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit outcomes recorded for each packet.
+const (
+	outcomeDroppedUnsigned   = "dropped_unsigned"
+	outcomeDroppedInvalidSig = "dropped_invalid_sig"
+	outcomeRejected          = "rejected"
+	outcomeMalformed         = "malformed"
+	outcomeDiscover          = "discover"
+	outcomeHandshake         = "handshake"
+	outcomeDone              = "done"
+	outcomeOffline           = "offline"
+	outcomeRouted            = "routed"
+	outcomeDeliveryFailed    = "delivery_failed"
+	outcomeGoodbye           = "goodbye"
+	outcomePong              = "pong"
+	outcomeStream            = "stream"
+	outcomeExpired           = "expired"
+	outcomeDuplicate         = "duplicate"
+	outcomeScheduled         = "scheduled"
+)
+
+// auditEntry is one JSON line of the audit log. Hash is the SHA-256 of the
+// entry with Hash and Sig cleared; since that includes Prev (the previous
+// entry's Hash), editing, inserting, or deleting any line breaks the chain.
+// Sig is the server key's ed25519 signature of Hash, so the chain can't be
+// rewritten and rehashed by anyone who can only write the file.
+type auditEntry struct {
+	Seq      uint64            `json:"seq"`
+	Time     string            `json:"ts"`
+	Src      string            `json:"src"`
+	Dst      string            `json:"dst"`
+	Typ      uint32            `json:"typ"`
+	Outcome  string            `json:"outcome"`
+	SigValid bool              `json:"sig_valid"`
+	Tags     map[string]string `json:"tags,omitempty"` // the -log-tags present on the packet
+	Prev     string            `json:"prev"`
+	Hash     string            `json:"hash"`
+	Sig      string            `json:"sig"`
+}
+
+func (e auditEntry) computeHash() string {
+	e.Hash, e.Sig = "", ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// check reports why e is not an intact entry signed by pub, or nil.
+func (e auditEntry) check(pub ed25519.PublicKey) error {
+	if e.Hash != e.computeHash() {
+		return fmt.Errorf("entry %d hash mismatch", e.Seq)
+	}
+	sig, err := hex.DecodeString(e.Sig)
+	if err != nil || !ed25519.Verify(pub, []byte(e.Hash), sig) {
+		return fmt.Errorf("entry %d bad signature", e.Seq)
+	}
+	return nil
+}
+
+// MaxAuditField bounds the src, dst and each tag value recorded for a
+// packet. They come from the sender, even for packets dropped unsigned, so
+// unbounded they would let one frame write a line of any length.
+const MaxAuditField = 256
+
+// clipAuditField cuts v to MaxAuditField bytes, noting its full length.
+func clipAuditField(v string) string {
+	if len(v) <= MaxAuditField {
+		return v
+	}
+	return fmt.Sprintf("%s... (%d bytes)", v[:MaxAuditField], len(v))
+}
+
+// auditLog is an append-only, hash-chained and signed record of routing
+// decisions. A nil *auditLog is valid and records nothing.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	key      ed25519.PrivateKey
+	f        *os.File
+	size     int64
+	seq      uint64
+	prev     string
+	torn     int // bytes of a partly written last line dropped on open
+}
+
+// openAuditLog opens (or creates) the audit log at path, resuming the chain
+// from its last entry, and signs entries with key. The file is rotated once
+// it grows past maxBytes; maxBytes <= 0 disables rotation.
+func openAuditLog(path string, maxBytes int64, key ed25519.PrivateKey) (*auditLog, error) {
+	a := &auditLog{path: path, maxBytes: maxBytes, key: key}
+	if err := a.resume(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.f = f
+	a.size = st.Size()
+	return a, nil
+}
+
+// resume reads the last entry of an existing log to continue its chain,
+// checking that it is intact and signed by a.key. A last line without its
+// newline was cut short by a crash mid-write; it is dropped from the file so
+// the chain continues from the entry before it.
+func (a *auditLog) resume() error {
+	f, err := os.OpenFile(a.path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var last []byte
+	var end int64 // offset just past the last complete line
+	err = readAuditLines(f, func(line []byte, complete bool) error {
+		if !complete {
+			a.torn = len(line)
+			return nil
+		}
+		last = append(last[:0], line...)
+		end += int64(len(line)) + 1
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("audit log %s: %w", a.path, err)
+	}
+	if a.torn > 0 {
+		if err := f.Truncate(end); err != nil {
+			return fmt.Errorf("audit log %s: dropping torn entry: %w", a.path, err)
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	var e auditEntry
+	if err := json.Unmarshal(last, &e); err != nil {
+		return fmt.Errorf("audit log %s: last entry: %w", a.path, err)
+	}
+	if err := e.check(a.key.Public().(ed25519.PublicKey)); err != nil {
+		return fmt.Errorf("audit log %s: %w", a.path, err)
+	}
+	a.seq = e.Seq
+	a.prev = e.Hash
+	return nil
+}
+
+// readAuditLines calls fn with each line of r, without its newline, however
+// long. complete is false for a last line with no newline.
+func readAuditLines(r io.Reader, fn func(line []byte, complete bool) error) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			complete := line[len(line)-1] == '\n'
+			if ferr := fn(bytes.TrimSuffix(line, []byte("\n")), complete); ferr != nil {
+				return ferr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// record appends one entry for p, with the tags the server logs.
+func (a *auditLog) record(p *Packet, outcome string, sigValid bool, tags map[string]string) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var clipped map[string]string
+	if len(tags) > 0 {
+		clipped = make(map[string]string, len(tags))
+		for k, v := range tags {
+			clipped[k] = clipAuditField(v)
+		}
+	}
+	e := auditEntry{
+		Seq:      a.seq + 1,
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Src:      clipAuditField(p.Src),
+		Dst:      clipAuditField(p.Dst),
+		Typ:      p.Typ,
+		Outcome:  outcome,
+		SigValid: sigValid,
+		Tags:     clipped,
+		Prev:     a.prev,
+	}
+	e.Hash = e.computeHash()
+	e.Sig = hex.EncodeToString(ed25519.Sign(a.key, []byte(e.Hash)))
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.seq = e.Seq
+	a.prev = e.Hash
+	return nil
+}
+
+// rotate moves the current file aside as <path>.<last seq> and starts a new
+// one. The chain carries over: the new file's first entry links to the last
+// entry of the rotated file.
+func (a *auditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.path, fmt.Sprintf("%s.%d", a.path, a.seq)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	a.f = f
+	a.size = 0
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// verifyAuditLog walks the chain across the given files, oldest first,
+// checking each entry's signature against pub, and returns the number of
+// entries checked. The first entry may link to a file that is no longer
+// present (it was rotated away) unless it is entry 1.
+func verifyAuditLog(pub ed25519.PublicKey, paths ...string) (int, error) {
+	var (
+		n       int
+		prev    string
+		prevSeq uint64
+	)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return n, err
+		}
+		line := 0
+		err = readAuditLines(f, func(data []byte, _ bool) error {
+			line++
+			var e auditEntry
+			if err := json.Unmarshal(data, &e); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			if err := e.check(pub); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			first := n == 0
+			if (first && e.Seq == 1 && e.Prev != "") || (!first && (e.Prev != prev || e.Seq != prevSeq+1)) {
+				return fmt.Errorf("%s:%d: entry %d breaks the chain", path, line, e.Seq)
+			}
+			prev, prevSeq = e.Hash, e.Seq
+			n++
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// auditPublicKey returns the key audit entries are checked against: pkHex
+// if given, or else the public half of the key file at keyPath.
+func auditPublicKey(pkHex, keyPath string) (ed25519.PublicKey, error) {
+	if pkHex != "" {
+		pk, err := hex.DecodeString(pkHex)
+		if err != nil || len(pk) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("-audit-pk: want %d hex-encoded bytes", ed25519.PublicKeySize)
+		}
+		return pk, nil
+	}
+	if keyPath == "" {
+		return nil, errors.New("-audit-pk or -server-key is required")
+	}
+	priv, err := loadPrivateKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return priv.Public().(ed25519.PublicKey), nil
+}
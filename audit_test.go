@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// auditKey returns a server key for signing audit entries, and its public
+// half.
+func auditKey(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestAuditLogChainAcrossRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key, pub := auditKey(t)
+
+	// Small enough that every few entries force a rotation.
+	a, err := openAuditLog(path, 900, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Packet{Src: "bot:a", Dst: "bot:b", Typ: 0}
+	for i := 0; i < 5; i++ {
+		if err := a.record(p, outcomeRouted, true, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	// Reopening resumes the chain rather than starting a new one.
+	a, err = openAuditLog(path, 900, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := a.record(p, outcomeOffline, true, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) == 0 {
+		t.Fatalf("expected rotated files")
+	}
+	sortBySuffix(rotated)
+	n, err := verifyAuditLog(pub, append(rotated, path)...)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if n != 10 {
+		t.Fatalf("verified %d entries, want 10", n)
+	}
+
+	// Any single file verifies on its own as a chain fragment.
+	if _, err := verifyAuditLog(pub, path); err != nil {
+		t.Fatalf("verify current file: %v", err)
+	}
+}
+
+func TestAuditLogDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key, pub := auditKey(t)
+	a, err := openAuditLog(path, 0, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []string{"bot:b", "bot:c", "bot:d"} {
+		if err := a.record(&Packet{Src: "bot:a", Dst: dst}, outcomeRouted, true, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := strings.Replace(string(data), `"dst":"bot:c"`, `"dst":"bot:x"`, 1)
+	os.WriteFile(path, []byte(tampered), 0o600)
+	if _, err := verifyAuditLog(pub, path); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Fatalf("modified entry not detected: %v", err)
+	}
+
+	// Deleting a whole line leaves every remaining hash valid but breaks the links.
+	lines := strings.SplitAfter(string(data), "\n")
+	os.WriteFile(path, []byte(lines[0]+lines[2]), 0o600)
+	if _, err := verifyAuditLog(pub, path); err == nil || !strings.Contains(err.Error(), "breaks the chain") {
+		t.Fatalf("deleted entry not detected: %v", err)
+	}
+
+	// Rewriting the last entry and recomputing its hash needs the key too,
+	// and a server resuming the log checks the tail before appending.
+	lines = lines[:len(lines)-1] // the empty string after the last newline
+	var e auditEntry
+	json.Unmarshal([]byte(lines[2]), &e)
+	e.Outcome = outcomeOffline
+	e.Hash = e.computeHash()
+	forged, _ := json.Marshal(e)
+	os.WriteFile(path, []byte(lines[0]+lines[1]+string(forged)+"\n"), 0o600)
+	if _, err := verifyAuditLog(pub, path); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("rehashed entry not detected: %v", err)
+	}
+	if _, err := openAuditLog(path, 0, key); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("resumed from a forged tail: %v", err)
+	}
+}
+
+func TestAuditLogBoundedAndTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key, pub := auditKey(t)
+	a, err := openAuditLog(path, 0, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unsigned frame can carry a dst of nearly the whole frame.
+	huge := strings.Repeat("\x01", 60000)
+	a.record(&Packet{Src: "bot:a", Dst: huge, Tags: map[string]string{"trace_id": huge}}, outcomeDroppedUnsigned, false, map[string]string{"trace_id": huge})
+	a.record(&Packet{Src: "bot:a", Dst: "bot:b"}, outcomeRouted, true, nil)
+	a.Close()
+	data, _ := os.ReadFile(path)
+	if len(data) > 4096 {
+		t.Fatalf("two entries took %d bytes", len(data))
+	}
+
+	// A crash mid-write leaves a line without its newline.
+	good := len(data)
+	os.WriteFile(path, append(data, `{"seq":3,"ts":"20`...), 0o600)
+	a, err = openAuditLog(path, 0, key)
+	if err != nil {
+		t.Fatalf("reopen after a torn write: %v", err)
+	}
+	if a.torn == 0 || a.seq != 2 {
+		t.Fatalf("torn %d bytes, seq %d; want the torn line dropped and seq 2", a.torn, a.seq)
+	}
+	a.record(&Packet{Src: "bot:a", Dst: "bot:c"}, outcomeRouted, true, nil)
+	a.Close()
+	if n, err := verifyAuditLog(pub, path); n != 3 || err != nil {
+		t.Fatalf("verified %d entries (%v), want 3", n, err)
+	}
+	if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data[good:]), `{"seq":3,`) {
+		t.Fatalf("entry 3 not appended where the torn line was")
+	}
+}
+
+// sortBySuffix orders rotated audit files by their numeric sequence suffix.
+func sortBySuffix(paths []string) {
+	seq := func(p string) int {
+		n, _ := strconv.Atoi(p[strings.LastIndex(p, ".")+1:])
+		return n
+	}
+	sort.Slice(paths, func(i, j int) bool { return seq(paths[i]) < seq(paths[j]) })
+}
+
+func TestAuditLogNeedsServerKey(t *testing.T) {
+	c := defaultConfig()
+	c.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	if _, err := New(c); err == nil || !strings.Contains(err.Error(), "-server-key") {
+		t.Fatalf("New without -server-key: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// An agent managing many identities can register them all with one packet to
+// "register" whose body is a JSON array of the identities. They are bound to
+// the sending connection under the key that signed the packet, each as if
+// the connection had sent a packet as it, but all or nothing: if any is
+// refused (reserved, malformed, held under another key, in use under
+// -reregister reject-new, past -max-identities) none is registered. The reply
+// is a bulkRegistrationAck listing what became of each identity.
+
+// MaxBulkIdentities bounds the identities in one bulk registration.
+const MaxBulkIdentities = 1024
+
+// bulkRegistrationAck is the JSON body of a reply to a bulk registration.
+// Status is "done" if every identity was registered and "rejected" if none
+// was.
+type bulkRegistrationAck struct {
+	Status  string       `json:"status"`
+	Results []bulkResult `json:"results"`
+}
+
+// bulkResult is what became of one identity: registered, replaced (moved
+// from another connection), shared (under -reregister allow-both) or
+// unchanged (already held here); or the error it was refused with; or, when
+// another was refused, skipped.
+type bulkResult struct {
+	Identity string `json:"identity"`
+	Status   string `json:"status"`
+}
+
+var bulkStatus = map[registration]string{
+	regUnchanged: "unchanged",
+	regNew:       "registered",
+	regReplaced:  "replaced",
+	regShared:    "shared",
+}
+
+// registerBulk registers every identity on ci, or none if any is refused. It
+// returns each identity's outcome and whether they were registered.
+func (s *Server) registerBulk(identities []string, ci *connInfo) ([]registration, bool) {
+	regs := make([]registration, len(identities))
+	vetted := make([]bool, len(identities))
+	ok := true
+	for i, identity := range identities {
+		if regs[i], vetted[i] = s.vetIdentity(identity); !vetted[i] {
+			ok = false
+		}
+	}
+
+	pk := ci.pk()
+	s.routeMu.Lock()
+	if ci.retired.Load() {
+		s.routeMu.Unlock()
+		for i := range regs {
+			regs[i] = regRetired
+		}
+		return regs, false
+	}
+	// Every identity is checked, so the reply names every conflict
+	adding := 0
+	for i, identity := range identities {
+		if !vetted[i] {
+			continue
+		}
+		regs[i] = s.admitLocked(identity, ci, pk, adding)
+		switch {
+		case rejectReason[regs[i]] != "":
+			ok = false
+		case regs[i] == regNew:
+			adding++
+		}
+	}
+	if !ok {
+		s.routeMu.Unlock()
+		return regs, false
+	}
+	for i, identity := range identities {
+		if regs[i] != regUnchanged {
+			s.takeLocked(identity, ci, pk, regs[i])
+		}
+	}
+	s.routeMu.Unlock()
+
+	for i, identity := range identities {
+		if regs[i] == regNew {
+			s.announce("fed:register", identity)
+		}
+	}
+	return regs, true
+}
+
+// handleBulkRegister answers a packet to "register" from c.
+func (s *Server) handleBulkRegister(c *connInfo, p *Packet) error {
+	var identities []string
+	if err := json.Unmarshal([]byte(p.Body), &identities); err != nil || len(identities) == 0 {
+		return reply(c, p, "error:invalid_identities")
+	}
+	if len(identities) > MaxBulkIdentities {
+		return reply(c, p, "error:too_many_identities")
+	}
+	// Naming an identity twice is naming it once
+	seen := make(map[string]bool, len(identities))
+	unique := identities[:0]
+	for _, identity := range identities {
+		if !seen[identity] {
+			seen[identity] = true
+			unique = append(unique, identity)
+		}
+	}
+	identities = unique
+
+	regs, ok := s.registerBulk(identities, c)
+	ack := bulkRegistrationAck{Status: "done", Results: make([]bulkResult, len(identities))}
+	if !ok {
+		ack.Status = "rejected"
+	}
+	var refused []string
+	for i, identity := range identities {
+		status := bulkStatus[regs[i]]
+		if reason := rejectReason[regs[i]]; reason != "" {
+			status = reason
+			refused = append(refused, clipIdentity(identity)+" "+reason)
+		} else if !ok {
+			status = "skipped"
+		}
+		ack.Results[i] = bulkResult{Identity: identity, Status: status}
+	}
+	if ok {
+		s.log.Printf("Registered %d identities for %s at once", len(identities), c.addr)
+	} else {
+		s.log.Printf("REJECTED bulk registration of %d identities from %s (src=%s): %s", len(identities), c.addr, p.Src, strings.Join(refused, ", "))
+	}
+	body, _ := json.Marshal(ack)
+	return reply(c, p, string(body))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// bulkRegister sends a bulk registration of identities from a.
+func bulkRegister(t *testing.T, a *testAgent, identities ...string) bulkRegistrationAck {
+	t.Helper()
+	body, _ := json.Marshal(identities)
+	resp := a.call(&Packet{Dst: "register", Body: string(body)})
+	var ack bulkRegistrationAck
+	if err := json.Unmarshal([]byte(resp.Body), &ack); err != nil {
+		t.Fatalf("got %q", resp.Body)
+	}
+	return ack
+}
+
+// results maps each identity in ack to its status.
+func results(ack bulkRegistrationAck) map[string]string {
+	m := make(map[string]string)
+	for _, r := range ack.Results {
+		m[r.Identity] = r.Status
+	}
+	return m
+}
+
+func TestBulkRegister(t *testing.T) {
+	s, addr := startServer(t)
+	mgr := dialAgent(t, addr, "bot:bulk-mgr")
+	mgr.call(&Packet{Dst: "server"})
+
+	ack := bulkRegister(t, mgr, "bot:bulk-1", "bot:bulk-2", "bot:bulk-mgr", "bot:bulk-1")
+	want := map[string]string{"bot:bulk-1": "registered", "bot:bulk-2": "registered", "bot:bulk-mgr": "unchanged"}
+	if got := results(ack); ack.Status != "done" || len(ack.Results) != 3 || len(got) != 3 ||
+		got["bot:bulk-1"] != want["bot:bulk-1"] || got["bot:bulk-2"] != want["bot:bulk-2"] || got["bot:bulk-mgr"] != want["bot:bulk-mgr"] {
+		t.Fatalf("got %+v, want done with %v", ack, want)
+	}
+
+	// The identities route to the manager's connection.
+	other := dialAgent(t, addr, "bot:bulk-other")
+	other.call(&Packet{Dst: "server"})
+	for _, identity := range []string{"bot:bulk-1", "bot:bulk-2"} {
+		other.send(&Packet{Dst: identity, Body: "hi " + identity})
+		if p := mgr.recv(); p.Dst != identity {
+			t.Fatalf("manager got %v, want the packet for %s", p, identity)
+		}
+	}
+	if holder := s.lookupAgent("bot:bulk-2"); holder == nil || holder.addr != mgr.conn.LocalAddr().String() {
+		t.Fatalf("bot:bulk-2 held by %v", holder)
+	}
+
+	for _, body := range []string{"", "bot:bulk-3", "[]", `{"identities":["bot:bulk-3"]}`} {
+		if resp := mgr.call(&Packet{Dst: "register", Body: body}); resp.Body != "error:invalid_identities" {
+			t.Errorf("body %q: got %q, want error:invalid_identities", body, resp.Body)
+		}
+	}
+}
+
+func TestBulkRegisterAllOrNothing(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.Reregister = "reject-new" })
+	holder := dialAgent(t, addr, "bot:bulk-held")
+	holder.call(&Packet{Dst: "server"})
+	mgr := dialAgent(t, addr, "bot:bulk-mgr")
+	mgr.priv = holder.priv // same owner, so only the policy stands in the way
+	mgr.call(&Packet{Dst: "server"})
+
+	ack := bulkRegister(t, mgr, "bot:bulk-free", "bot:bulk-held", "discover:x")
+	got := results(ack)
+	if ack.Status != "rejected" || got["bot:bulk-free"] != "skipped" ||
+		got["bot:bulk-held"] != "error:identity_in_use" || got["discover:x"] != "error:reserved_identity" {
+		t.Fatalf("got %+v", ack)
+	}
+	if registered(s, "bot:bulk-free") {
+		t.Fatal("bot:bulk-free registered despite the conflict")
+	}
+	if h := s.lookupAgent("bot:bulk-held"); h == nil || h.addr != holder.conn.LocalAddr().String() {
+		t.Fatal("bot:bulk-held moved")
+	}
+
+	// Without the conflict the same batch goes through.
+	if ack := bulkRegister(t, mgr, "bot:bulk-free", "bot:bulk-free-2"); ack.Status != "done" {
+		t.Fatalf("got %+v", ack)
+	}
+	if !registered(s, "bot:bulk-free") || !registered(s, "bot:bulk-free-2") {
+		t.Fatal("identities not registered")
+	}
+}
+
+func TestBulkRegisterRespectsMaxIdentities(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.MaxIdentities = 3 })
+	mgr := dialAgent(t, addr, "bot:bulk-mgr")
+	mgr.call(&Packet{Dst: "server"})
+
+	// One registered plus three new would be four.
+	ack := bulkRegister(t, mgr, "bot:bulk-a", "bot:bulk-b", "bot:bulk-c")
+	if got := results(ack); ack.Status != "rejected" || got["bot:bulk-c"] != "error:registry_full" || got["bot:bulk-a"] != "skipped" {
+		t.Fatalf("got %+v", ack)
+	}
+	if registered(s, "bot:bulk-a") {
+		t.Fatal("bot:bulk-a registered past the limit")
+	}
+	if ack := bulkRegister(t, mgr, "bot:bulk-a", "bot:bulk-b"); ack.Status != "done" {
+		t.Fatalf("got %+v", ack)
+	}
+}
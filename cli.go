@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// Key files hold a single hex-encoded line: the 32-byte ed25519 seed in
+// <name>.key (mode 0600) and the 32-byte public key in <name>.pub.
+
+const cliUsage = `usage:
+  keep [flags]                 run the server (see keep -h)
+  keep keygen [-out name]      write name.key and name.pub
+  keep sign -key name.key [-src ...] [-dst ...] [-body ...] [-typ n] [-id ...] [-fee n] [-ttl n] [-expires d] [-reply-to ...] [-channel ...] [-json] [-hex] [-line]
+                               sign a packet and write it framed to stdout;
+                               with -json the packet is read as JSON from stdin;
+                               without an id it gets a new UUIDv7
+  keep verify [-hex] [file]    verify a framed packet read from file or stdin
+`
+
+// runCommand runs a CLI subcommand and returns the process exit code.
+func runCommand(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	switch name {
+	case "keygen":
+		err = cmdKeygen(args, stdout)
+	case "sign":
+		err = cmdSign(args, stdin, stdout)
+	case "verify":
+		err = cmdVerify(args, stdin, stdout)
+	default:
+		fmt.Fprintf(stderr, "keep: unknown command %q\n\n%s", name, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "keep %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func cmdKeygen(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	out := fs.String("out", "keep", "write <out>.key and <out>.pub")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out+".key", []byte(hex.EncodeToString(priv.Seed())+"\n"), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "wrote %s.key and %s.pub (pk %s)\n", *out, *out, hex.EncodeToString(pub))
+	return nil
+}
+
+// loadPrivateKey reads a key file written by keygen.
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: expected %d-byte seed, got %d", path, ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// newPacketID returns a fresh packet id: a UUIDv7 (RFC 9562). The first 48
+// bits are the Unix time in milliseconds, so ids sort by creation time, and
+// 74 of the rest are random, so ids minted independently by any number of
+// clients don't collide in practice. Servers only echo ids; any string unique
+// per sender among its outstanding requests works, and this is one.
+func newPacketID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	ms := uint64(time.Now().UnixMilli())
+	b[0], b[1], b[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	b[3], b[4], b[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// packetJSON is the JSON form of a Packet. Byte fields are hex-encoded.
+type packetJSON struct {
+	Sig  string `json:"sig,omitempty"`
+	Pk   string `json:"pk,omitempty"`
+	Typ  uint32 `json:"typ"`
+	Id   string `json:"id"`
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	Body string `json:"body"`
+	Fee  uint64 `json:"fee,omitempty"`
+	Ttl  uint32 `json:"ttl,omitempty"`
+	Scar string `json:"scar,omitempty"`
+
+	ReplyTo string `json:"reply_to,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Alg     string `json:"alg,omitempty"`
+
+	Tags   map[string]string `json:"tags,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	ExpiresAt uint64 `json:"expires_at,omitempty"` // Unix milliseconds
+	DeliverAt uint64 `json:"deliver_at,omitempty"` // Unix milliseconds
+	Priority  uint32 `json:"priority,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"` // set by the server; not signed
+
+	MaxPacketSize uint32 `json:"max_packet_size,omitempty"`
+}
+
+func (j *packetJSON) toPacket() (*Packet, error) {
+	p := &Packet{Typ: j.Typ, Id: j.Id, Src: j.Src, Dst: j.Dst, Body: j.Body, Fee: j.Fee, Ttl: j.Ttl, ReplyTo: j.ReplyTo, Channel: j.Channel, Alg: j.Alg, Tags: j.Tags, Labels: j.Labels, ExpiresAt: j.ExpiresAt, DeliverAt: j.DeliverAt, Priority: j.Priority, Seq: j.Seq, MaxPacketSize: j.MaxPacketSize}
+	var err error
+	if p.Sig, err = hex.DecodeString(j.Sig); err != nil {
+		return nil, fmt.Errorf("sig: %w", err)
+	}
+	if p.Pk, err = hex.DecodeString(j.Pk); err != nil {
+		return nil, fmt.Errorf("pk: %w", err)
+	}
+	if p.Scar, err = hex.DecodeString(j.Scar); err != nil {
+		return nil, fmt.Errorf("scar: %w", err)
+	}
+	return p, nil
+}
+
+func packetToJSON(p *Packet) packetJSON {
+	return packetJSON{
+		Sig:  hex.EncodeToString(p.Sig),
+		Pk:   hex.EncodeToString(p.Pk),
+		Typ:  p.Typ,
+		Id:   p.Id,
+		Src:  p.Src,
+		Dst:  p.Dst,
+		Body: p.Body,
+		Fee:  p.Fee,
+		Ttl:  p.Ttl,
+		Scar: hex.EncodeToString(p.Scar),
+
+		ReplyTo: p.ReplyTo,
+		Channel: p.Channel,
+		Alg:     p.Alg,
+
+		Tags:   p.Tags,
+		Labels: p.Labels,
+
+		ExpiresAt: p.ExpiresAt,
+		DeliverAt: p.DeliverAt,
+		Priority:  p.Priority,
+		Seq:       p.Seq,
+
+		MaxPacketSize: p.MaxPacketSize,
+	}
+}
+
+func cmdSign(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	keyPath := fs.String("key", "keep.key", "private key file from keygen")
+	fromJSON := fs.Bool("json", false, "read the packet as JSON from stdin")
+	asHex := fs.Bool("hex", false, "write the frame hex-encoded instead of raw bytes")
+	asLine := fs.Bool("line", false, "write the packet as one JSON line, for a -json-listen listener, instead of a frame")
+	var j packetJSON
+	fs.StringVar(&j.Src, "src", "", "sender identity")
+	fs.StringVar(&j.Dst, "dst", "server", "destination")
+	fs.StringVar(&j.Body, "body", "", "body")
+	fs.StringVar(&j.Id, "id", "", "packet id (default: a new UUIDv7)")
+	fs.StringVar(&j.ReplyTo, "reply-to", "", "identity replies should be routed to")
+	fs.StringVar(&j.Channel, "channel", "", "logical channel")
+	typ := fs.Uint("typ", 0, "packet type")
+	fee := fs.Uint64("fee", 0, "fee")
+	ttl := fs.Uint("ttl", 0, "hop limit")
+	expires := fs.Duration("expires", 0, "discard the packet if still undelivered this long after signing (0 = never)")
+	priority := fs.Uint("priority", PriorityInteractive, "delivery class: 0 interactive, 1 control, 2 bulk")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	j.Typ, j.Fee, j.Ttl, j.Priority = uint32(*typ), *fee, uint32(*ttl), uint32(*priority)
+	if *expires > 0 {
+		j.ExpiresAt = uint64(time.Now().Add(*expires).UnixMilli())
+	}
+
+	priv, err := loadPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	if *fromJSON {
+		j = packetJSON{}
+		if err := json.NewDecoder(stdin).Decode(&j); err != nil {
+			return fmt.Errorf("decode packet JSON: %w", err)
+		}
+	}
+	p, err := j.toPacket()
+	if err != nil {
+		return err
+	}
+	if p.Id == "" {
+		p.Id = newPacketID()
+	}
+	if err := wire.Sign(p, priv); err != nil {
+		return err
+	}
+
+	if *asLine {
+		line, err := encodeJSONLine(p)
+		if err != nil {
+			return err
+		}
+		_, err = stdout.Write(line)
+		return err
+	}
+	if *asHex {
+		var buf bytes.Buffer
+		if err := wire.WritePacket(&buf, p); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(stdout, hex.EncodeToString(buf.Bytes()))
+		return err
+	}
+	return wire.WritePacket(stdout, p)
+}
+
+func cmdVerify(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fromHex := fs.Bool("hex", false, "input is hex-encoded")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	in := stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if *fromHex {
+		text, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		raw, err := hex.DecodeString(strings.TrimSpace(string(text)))
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(raw)
+	}
+
+	p, err := wire.ReadPacket(in)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(packetToJSON(p), "", "  ")
+	fmt.Fprintln(stdout, string(out))
+	if err := wire.Verify(p); err != nil {
+		return fmt.Errorf("signature INVALID: %v", err)
+	}
+	fmt.Fprintln(stdout, "signature OK")
+	return nil
+}
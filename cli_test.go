@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func run(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code := runCommand(args[0], args[1:], strings.NewReader(stdin), &out, &errOut)
+	return out.String() + errOut.String(), code
+}
+
+func TestCLIKeygenSignVerify(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "agent")
+	if out, code := run(t, "", "keygen", "-out", base); code != 0 {
+		t.Fatalf("keygen: %s", out)
+	}
+	if st, err := os.Stat(base + ".key"); err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("private key file: %v %v", st, err)
+	}
+
+	frame, code := run(t, "", "sign", "-key", base+".key", "-src", "bot:cli", "-dst", "server", "-body", "hi", "-id", "c1")
+	if code != 0 {
+		t.Fatalf("sign: %s", frame)
+	}
+	p, err := wire.ReadPacket(strings.NewReader(frame))
+	if err != nil {
+		t.Fatalf("sign output is not a frame: %v", err)
+	}
+	if p.Src != "bot:cli" || p.Body != "hi" || wire.Verify(p) != nil {
+		t.Fatalf("signed packet does not verify: %v", p)
+	}
+	pub, _ := os.ReadFile(base + ".pub")
+	if got := strings.TrimSpace(string(pub)); got != packetToJSON(p).Pk {
+		t.Fatalf("packet pk %s does not match %s.pub %s", packetToJSON(p).Pk, base, got)
+	}
+
+	if out, code := run(t, frame, "verify"); code != 0 || !strings.Contains(out, "signature OK") {
+		t.Fatalf("verify: code %d: %s", code, out)
+	}
+
+	// Flip a body byte: verify must fail.
+	tampered := strings.Replace(frame, "hi", "ho", 1)
+	if out, code := run(t, tampered, "verify"); code == 0 || !strings.Contains(out, "INVALID") {
+		t.Fatalf("tampered packet verified: %s", out)
+	}
+}
+
+func TestCLISignJSONHex(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "k")
+	run(t, "", "keygen", "-out", base)
+
+	hexFrame, code := run(t, `{"src":"bot:json","dst":"bot:other","body":"from stdin","ttl":30,"scar":"beef"}`,
+		"sign", "-key", base+".key", "-json", "-hex")
+	if code != 0 {
+		t.Fatalf("sign: %s", hexFrame)
+	}
+	out, code := run(t, hexFrame, "verify", "-hex")
+	if code != 0 {
+		t.Fatalf("verify: %s", out)
+	}
+	for _, want := range []string{`"dst": "bot:other"`, `"scar": "beef"`, `"ttl": 30`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("verify output missing %s:\n%s", want, out)
+		}
+	}
+
+	if _, code := run(t, "", "bogus"); code != 2 {
+		t.Errorf("unknown command exit code = %d, want 2", code)
+	}
+}
+
+func TestNewPacketID(t *testing.T) {
+	uuidV7 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	const workers, each = 8, 2000
+	ids := make(chan string, workers*each)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range each {
+				ids <- newPacketID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, workers*each)
+	for id := range ids {
+		if !uuidV7.MatchString(id) {
+			t.Fatalf("%q is not a UUIDv7", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+
+	// Ids minted a millisecond or more apart sort in minting order.
+	var seq []string
+	for range 3 {
+		seq = append(seq, newPacketID())
+		time.Sleep(2 * time.Millisecond)
+	}
+	if !sort.StringsAreSorted(seq) {
+		t.Errorf("ids out of order: %v", seq)
+	}
+
+	// keep sign fills in an id when none is given.
+	base := filepath.Join(t.TempDir(), "k")
+	run(t, "", "keygen", "-out", base)
+	frame, _ := run(t, "", "sign", "-key", base+".key", "-src", "bot:cli")
+	if p, err := wire.ReadPacket(strings.NewReader(frame)); err != nil || !uuidV7.MatchString(p.Id) {
+		t.Fatalf("sign without -id: packet %v, %v", p, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "time"
+
+// Before the server closes a connection on its own initiative, it sends a
+// final goodbye (typ 3, src -reply-src) whose body says why, so a client can
+// tell a reason to reconnect at once from one to back off or stop:
+//
+//	shutdown               the server is going away; reconnect, elsewhere if possible
+//	kicked                 an admin closed the identity (kick:); don't reconnect unattended
+//	replaced               another connection registered the identity; don't reconnect
+//	idle_timeout           nothing was sent for -idle-timeout; reconnect when there is work
+//	pong_timeout           -pong-misses heartbeats went unanswered; reconnect
+//	registration_required  the first packet was not a registration (-require-registration)
+//	frame_too_large        a frame exceeded the size limit; fix the client before retrying
+//	protocol_error         a frame could not be decoded; fix the client before retrying
+//
+// The notice is best-effort: it gets closeNoticeTimeout to leave, and a
+// connection closed because its writes stalled (-write-timeout) or failed
+// gets none.
+const (
+	closeShutdown             = "shutdown"
+	closeKicked               = "kicked"
+	closeReplaced             = "replaced"
+	closeIdleTimeout          = "idle_timeout"
+	closePongTimeout          = "pong_timeout"
+	closeRegistrationRequired = "registration_required"
+	closeFrameTooLarge        = "frame_too_large"
+	closeProtocolError        = "protocol_error"
+)
+
+// closeNoticeTimeout bounds the write of a close notice.
+const closeNoticeTimeout = 500 * time.Millisecond
+
+// closeNotice is the goodbye telling the peer why its connection is closing.
+func (ci *connInfo) closeNotice(reason string) *Packet {
+	p := &Packet{Typ: TypeGoodbye, Src: ci.srv.cfg.ReplySrc, Body: reason}
+	ci.signReply(p)
+	return p
+}
+
+// sayClose sends the close notice for reason, best-effort. The caller closes
+// the connection.
+func (ci *connInfo) sayClose(reason string) {
+	if err := ci.sendWithin(ci.closeNotice(reason), closeNoticeTimeout); err != nil {
+		ci.srv.log.Printf("Close notice %q to %s failed: %v", reason, ci.addr, err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// discover:cluster-stats fans a fed:stats-request out to every linked peer
+// and merges the fed:stats-reply bodies with this server's own stats. Peers
+// answer with their local stats only; the request is not relayed further.
+
+// serverStats is one server's discover:stats snapshot.
+type serverStats struct {
+	Agents            []string         `json:"agents,omitempty"`
+	TotalPackets      int64            `json:"total_packets"`
+	PacketsByTyp      map[string]int64 `json:"packets_by_typ"`
+	ScarExchanges     map[string]int64 `json:"scar_exchanges"`
+	DroppedUnsigned   int64            `json:"dropped_unsigned"`
+	DroppedInvalidSig int64            `json:"dropped_invalid_sig"`
+	Routed            int64            `json:"routed"`
+	Offline           int64            `json:"offline"`
+	Queued            int64            `json:"queued"`               // forwards that waited their turn, and packets scheduled
+	Handlers          int64            `json:"handlers"`             // connection handler goroutines running
+	OpenConns         int64            `json:"open_conns"`           // their connections not yet closed
+	ScarStore         *scarStoreStats  `json:"scar_store,omitempty"` // nil unless -scar-store-bytes is set
+
+	Compression map[string]codecStats `json:"compression,omitempty"` // by codec name
+}
+
+// clusterStats is the discover:cluster-stats reply: totals summed across the
+// servers that responded, agent lists unioned, and per-server detail.
+// Missing lists peers that were linked at some point but did not answer
+// within -cluster-stats-timeout.
+type clusterStats struct {
+	serverStats
+	Servers   map[string]serverStats `json:"servers"`
+	Responded []string               `json:"responded"`
+	Missing   []string               `json:"missing"`
+}
+
+type statsReply struct {
+	server string
+	stats  serverStats
+}
+
+// localStats snapshots this server's counters, with the agent list if
+// withAgents is set.
+func (s *Server) localStats(withAgents bool) serverStats {
+	s.scarCountMu.Lock()
+	exchanges := make(map[string]int64, len(s.scarCount))
+	for k, v := range s.scarCount {
+		exchanges[k] = v
+	}
+	s.scarCountMu.Unlock()
+
+	st := serverStats{
+		TotalPackets:      s.totalPackets.Load(),
+		PacketsByTyp:      s.typCounts(),
+		ScarExchanges:     exchanges,
+		DroppedUnsigned:   s.droppedUnsigned.Load(),
+		DroppedInvalidSig: s.droppedInvalidSig.Load(),
+		Routed:            s.routedPackets.Load(),
+		Offline:           s.offlinePackets.Load(),
+		Queued:            s.queuedPackets.Load(),
+		Handlers:          s.liveHandlers.Load(),
+		OpenConns:         int64(s.openConns()),
+		ScarStore:         s.scars.snapshot(),
+		Compression:       s.codecSnapshot(),
+	}
+	if withAgents {
+		st.Agents = s.localIdentities()
+		sort.Strings(st.Agents)
+	}
+	return st
+}
+
+// add accumulates o into s. Agents are appended; the caller deduplicates.
+func (s *serverStats) add(o serverStats) {
+	s.Agents = append(s.Agents, o.Agents...)
+	s.TotalPackets += o.TotalPackets
+	s.DroppedUnsigned += o.DroppedUnsigned
+	s.DroppedInvalidSig += o.DroppedInvalidSig
+	s.Routed += o.Routed
+	s.Offline += o.Offline
+	s.Queued += o.Queued
+	s.Handlers += o.Handlers
+	s.OpenConns += o.OpenConns
+	for k, v := range o.PacketsByTyp {
+		s.PacketsByTyp[k] += v
+	}
+	for k, v := range o.ScarExchanges {
+		s.ScarExchanges[k] += v
+	}
+	if o.ScarStore != nil {
+		if s.ScarStore == nil {
+			s.ScarStore = &scarStoreStats{}
+		}
+		s.ScarStore.add(*o.ScarStore)
+	}
+	for name, st := range o.Compression {
+		if s.Compression == nil {
+			s.Compression = map[string]codecStats{}
+		}
+		sum := s.Compression[name]
+		sum.add(st)
+		s.Compression[name] = sum
+	}
+}
+
+// gatherClusterStats asks every linked peer for its stats and waits up to
+// -cluster-stats-timeout for the answers.
+func (s *Server) gatherClusterStats() clusterStats {
+	s.fedMu.RLock()
+	links := make([]*peerLink, 0, len(s.peers))
+	for _, l := range s.peers {
+		links = append(links, l)
+	}
+	s.fedMu.RUnlock()
+
+	id := fmt.Sprintf("%s-%d", s.cfg.ServerID, s.statsSeq.Add(1))
+	replies := make(chan statsReply, len(links))
+	s.statsMu.Lock()
+	s.statsWaiters[id] = replies
+	s.statsMu.Unlock()
+	defer func() {
+		s.statsMu.Lock()
+		delete(s.statsWaiters, id)
+		s.statsMu.Unlock()
+	}()
+
+	asked := 0
+	for _, l := range links {
+		if err := l.send(&Packet{Src: s.cfg.ServerID, Dst: "fed:stats-request", Id: id}); err != nil {
+			s.log.Printf("Peer %q stats request failed: %v", l.name, err)
+			continue
+		}
+		asked++
+	}
+
+	out := clusterStats{
+		serverStats: serverStats{PacketsByTyp: map[string]int64{}, ScarExchanges: map[string]int64{}},
+		Servers:     map[string]serverStats{s.cfg.ServerID: s.localStats(true)},
+		Missing:     []string{},
+	}
+	timeout := time.NewTimer(s.cfg.ClusterStatsTimeout)
+	defer timeout.Stop()
+collect:
+	for asked > 0 {
+		select {
+		case r := <-replies:
+			out.Servers[r.server] = r.stats
+			asked--
+		case <-timeout.C:
+			break collect
+		}
+	}
+
+	seen := make(map[string]bool)
+	for name, st := range out.Servers {
+		out.Responded = append(out.Responded, name)
+		out.add(st)
+		for _, a := range st.Agents {
+			seen[a] = true
+		}
+	}
+	out.Agents = out.Agents[:0]
+	for a := range seen {
+		out.Agents = append(out.Agents, a)
+	}
+	s.knownPeersMu.Lock()
+	for name := range s.knownPeers {
+		if _, ok := out.Servers[name]; !ok {
+			out.Missing = append(out.Missing, name)
+		}
+	}
+	s.knownPeersMu.Unlock()
+
+	sort.Strings(out.Agents)
+	sort.Strings(out.Responded)
+	sort.Strings(out.Missing)
+	return out
+}
+
+// handleStatsRequest answers a peer's fed:stats-request with local stats.
+func (s *Server) handleStatsRequest(from *peerLink, p *Packet) {
+	data, _ := json.Marshal(s.localStats(true))
+	if err := from.send(&Packet{Src: s.cfg.ServerID, Dst: "fed:stats-reply", Id: p.Id, Body: string(data)}); err != nil {
+		s.log.Printf("Peer %q stats reply failed: %v", from.name, err)
+	}
+}
+
+// handleStatsReply hands a peer's fed:stats-reply to the waiting query, if
+// it has not already timed out.
+func (s *Server) handleStatsReply(from *peerLink, p *Packet) {
+	var st serverStats
+	if err := json.Unmarshal([]byte(p.Body), &st); err != nil {
+		s.log.Printf("Peer %q stats reply: %v", from.name, err)
+		return
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if ch, ok := s.statsWaiters[p.Id]; ok {
+		select {
+		case ch <- statsReply{server: from.name, stats: st}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/proto"
+)
+
+// handshake negotiates a codec for a and switches the agent to it.
+func (a *testAgent) handshake(codecs ...string) string {
+	a.t.Helper()
+	body, _ := json.Marshal(handshakeRequest{Version: ServerVersion, Codecs: codecs})
+	resp := a.call(&Packet{Id: "hs", Dst: "handshake", Body: string(body)})
+	var hr handshakeReply
+	if err := json.Unmarshal([]byte(resp.Body), &hr); err != nil {
+		a.t.Fatalf("handshake reply %q: %v", resp.Body, err)
+	}
+	a.codec = frameCodecs[hr.Codec]
+	return hr.Codec
+}
+
+func TestHandshakeCodecRoundTrip(t *testing.T) {
+	_, addr := startServer(t)
+
+	cases := []struct {
+		offer []string
+		want  string
+	}{
+		{nil, "none"},
+		{[]string{"gzip"}, "gzip"},
+		{[]string{"zstd", "gzip"}, "gzip"},
+		{[]string{"zstd"}, "none"},
+	}
+	for i, tc := range cases {
+		t.Run(strings.Join(tc.offer, ","), func(t *testing.T) {
+			// A fresh identity per case: the last case's may still be
+			// registered, bound to another key.
+			a := dialAgent(t, addr, "bot:codec-"+strconv.Itoa(i))
+			if got := a.handshake(tc.offer...); got != tc.want {
+				t.Fatalf("negotiated %q, want %q", got, tc.want)
+			}
+
+			big := strings.Repeat("compressible ", 2000)
+			resp := a.call(&Packet{Id: "p1", Dst: "server", Body: big})
+			if status(resp) != "done" || resp.Id != "p1" {
+				t.Fatalf("reply %q id %q", resp.Body, resp.Id)
+			}
+
+			// A plain agent receives a forwarded packet uncompressed, and its
+			// signature still verifies.
+			plain := dialAgent(t, addr, "bot:plain-"+strconv.Itoa(i))
+			plain.call(&Packet{Dst: "server"})
+			a.send(&Packet{Dst: plain.src, Body: big})
+			got := plain.recv()
+			if got.Body != big || wire.Verify(got) != nil {
+				t.Fatalf("forwarded packet corrupted (sig ok=%v)", wire.Verify(got) == nil)
+			}
+		})
+	}
+}
+
+func TestCodecStats(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:codec-stats-a")
+	b := dialAgent(t, addr, "bot:codec-stats-b")
+	a.handshake("gzip")
+	b.handshake("gzip")
+	b.call(&Packet{Dst: "server"})
+
+	// The handshake replies left uncompressed; b's ack and whatever follows
+	// is counted.
+	before := s.localStats(false).Compression["gzip"]
+	big := strings.Repeat("compressible ", 2000)
+	a.send(&Packet{Dst: b.src, Body: big})
+	if got := b.recv(); got.Body != big {
+		t.Fatal("forwarded packet corrupted")
+	}
+
+	st := s.localStats(false).Compression["gzip"]
+	if st.FramesIn-before.FramesIn != 1 || st.FramesOut-before.FramesOut != 1 {
+		t.Fatalf("frames in %d out %d, want 1 each: %+v", st.FramesIn-before.FramesIn, st.FramesOut-before.FramesOut, st)
+	}
+	for dir, d := range map[string][2]int64{
+		"in":  {st.RawIn - before.RawIn, st.WireIn - before.WireIn},
+		"out": {st.RawOut - before.RawOut, st.WireOut - before.WireOut},
+	} {
+		if raw, wire := d[0], d[1]; raw < int64(len(big)) || wire*10 > raw {
+			t.Errorf("%s: %d raw bytes, %d on the wire; want at least %d raw, compressed tenfold", dir, raw, wire, len(big))
+		}
+	}
+	if st.Ratio < 10 {
+		t.Errorf("ratio %g, want at least 10", st.Ratio)
+	}
+
+	var m strings.Builder
+	s.writeMetrics(&m)
+	want := "keep_codec_raw_bytes_total{codec=\"gzip\",direction=\"out\"} " + strconv.FormatInt(st.RawOut, 10) + "\n"
+	if !strings.Contains(m.String(), want) {
+		t.Errorf("metrics missing %q", want)
+	}
+}
+
+func TestHandshakeFeatures(t *testing.T) {
+	s, addr := startServer(t)
+	serverPK := s.key.Public().(ed25519.PublicKey)
+
+	negotiate := func(a *testAgent, offer uint64) uint64 {
+		t.Helper()
+		body, _ := json.Marshal(handshakeRequest{Version: ServerVersion, Features: offer})
+		resp := a.call(&Packet{Id: "hs", Dst: "handshake", Body: string(body)})
+		var hr handshakeReply
+		if err := json.Unmarshal([]byte(resp.Body), &hr); err != nil {
+			t.Fatalf("handshake reply %q: %v", resp.Body, err)
+		}
+		return hr.Features
+	}
+
+	cases := []struct {
+		name        string
+		offer, want uint64
+	}{
+		{"none", 0, 0},
+		{"signed", FeatureSignedReplies, FeatureSignedReplies},
+		// Reserved and unknown bits are never granted, whatever the client asks.
+		{"unsupported", FeatureFrameCRC | FeatureTypedErrors | 1<<40, 0},
+		{"intersection", FeatureSignedReplies | FeatureFrameCRC | 1<<40, FeatureSignedReplies},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := dialAgent(t, addr, "bot:features-"+tc.name)
+			if got := negotiate(a, tc.offer); got != tc.want {
+				t.Fatalf("offered %#x, granted %#x, want %#x", tc.offer, got, tc.want)
+			}
+
+			signed := tc.want&FeatureSignedReplies != 0
+			for _, dst := range []string{"server", "discover:info", "bot:nobody"} {
+				resp := a.call(&Packet{Dst: dst})
+				if got := len(resp.Sig) > 0; got != signed {
+					t.Fatalf("%s reply signed = %v, want %v", dst, got, signed)
+				}
+				if signed && (wire.Verify(resp) != nil || !bytes.Equal(resp.Pk, serverPK)) {
+					t.Fatalf("%s reply not signed by the server key", dst)
+				}
+			}
+		})
+	}
+
+	// Without a server key there is nothing to sign with, so the feature
+	// is not granted.
+	s.key = nil
+	a := dialAgent(t, addr, "bot:features-keyless")
+	if got := negotiate(a, FeatureSignedReplies); got != 0 {
+		t.Fatalf("granted %#x without a server key", got)
+	}
+}
+
+func TestGzipDecodeBounded(t *testing.T) {
+	bomb, err := gzipCodec{}.encode(make([]byte, 4*wire.MaxPacketSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (gzipCodec{}).decode(bomb); err == nil {
+		t.Fatalf("oversize decompressed frame accepted")
+	}
+}
+
+func BenchmarkFrameCodec(b *testing.B) {
+	p := &Packet{
+		Sig:  make([]byte, 64),
+		Pk:   make([]byte, 32),
+		Id:   "0190f5c2-7d0e-7c3a-9a3f-4b8e2d1c0f00",
+		Src:  "bot:weather",
+		Dst:  "bot:planner",
+		Body: strings.Repeat(`{"city":"Lisbon","temp_c":21.5,"conditions":"clear"},`, 40),
+		Ttl:  60,
+	}
+	raw, _ := proto.Marshal(p)
+
+	for _, name := range []string{"none", "gzip"} {
+		codec := frameCodecs[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var size int
+			for i := 0; i < b.N; i++ {
+				data := raw
+				if codec != nil {
+					enc, err := codec.encode(raw)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if data, err = codec.decode(enc); err != nil {
+						b.Fatal(err)
+					}
+					size = len(enc)
+				} else {
+					size = len(data)
+				}
+			}
+			b.ReportMetric(float64(size), "frame-bytes")
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// With -dedup-window set, the server remembers each packet it handles by the
+// key that signed it, its src and its id, for that long. A packet that
+// repeats one (a client resending after a flaky disconnect, on the same
+// connection or a new one) is not routed again: it gets the reply the
+// original got, if any, and is counted in keep_dedup_hits_total. Packets
+// without an id are never deduplicated, so ids must be unique per key and
+// src for the window, as UUIDv7 ids are. src is part of the key so that
+// unsigned packets on a trusted listener, which share the empty key, don't
+// collide.
+//
+// Only successes are remembered. A packet refused with an error:* reply is
+// forgotten, so a resend, say once the recipient is back online, is handled
+// afresh. Only data packets are deduplicated at all, the ones forwarded to
+// agents (see dedupable); a packet for the server itself reads or changes
+// state, often the state of the connection it arrives on, so a resend is
+// handled as if new.
+//
+// The table holds at most MaxDedupEntries; past that the oldest entries are
+// forgotten early, so a flood of packets can only shorten the window, not
+// grow memory.
+
+// MaxDedupEntries bounds the -dedup-window table.
+const MaxDedupEntries = 100000
+
+type dedupKey struct {
+	pk, src, id string
+}
+
+// dedupEntry is what is remembered about a handled packet.
+type dedupEntry struct {
+	seen    time.Time
+	result  string // the first reply body sent for it
+	replied bool
+}
+
+// dedupRef is a dedupKey in insertion order, with the time it was entered so
+// a key entered again after expiring isn't dropped by its older ref.
+type dedupRef struct {
+	key  dedupKey
+	seen time.Time
+}
+
+// checkDedup records p as handled at now. It reports whether p repeats a
+// packet handled within -dedup-window and, if the original has been
+// answered, the reply to give it.
+func (s *Server) checkDedup(p *Packet, now time.Time) (dup bool, result string, replied bool) {
+	if s.cfg.DedupWindow <= 0 || p.Id == "" || !dedupable(p) {
+		return false, "", false
+	}
+	key := dedupKey{string(p.Pk), p.Src, p.Id}
+
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+	s.expireDedupLocked(now)
+	if e, ok := s.dedup[key]; ok {
+		return true, e.result, e.replied
+	}
+	for len(s.dedupOrder) >= MaxDedupEntries {
+		s.dropOldestDedupLocked()
+	}
+	s.dedup[key] = &dedupEntry{seen: now}
+	s.dedupOrder = append(s.dedupOrder, dedupRef{key, now})
+	return false, "", false
+}
+
+// dedupable reports whether repeats of p are answered from the table: p is
+// forwarded to agents, directly or through any:, sample: or multi:. Every
+// other server dst is handled afresh. Discovery describes the server as it
+// is now; a handshake, registration, subscription, deregistration or stream
+// offer changes the connection it arrives on, which after a reconnect is not
+// the one the original changed; a server ack reports whether src is
+// registered now; kick: and directive: act on other connections.
+func dedupable(p *Packet) bool {
+	if reservedIdentities[p.Dst] {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(p.Dst, prefix) {
+			return prefix == "any:" || prefix == "sample:" || prefix == "multi:"
+		}
+	}
+	return true
+}
+
+// recordDedupReply notes body as the reply to p, for repeats of p to get.
+// Only the first reply is kept, and an error reply forgets p instead, so a
+// resend is handled afresh.
+func (s *Server) recordDedupReply(p *Packet, body string) {
+	if s.cfg.DedupWindow <= 0 || p.Id == "" || !dedupable(p) {
+		return
+	}
+	key := dedupKey{string(p.Pk), p.Src, p.Id}
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+	e, ok := s.dedup[key]
+	if !ok || e.replied {
+		return
+	}
+	if strings.HasPrefix(body, "error:") {
+		delete(s.dedup, key) // its ref in dedupOrder goes when it expires
+		return
+	}
+	e.result, e.replied = body, true
+}
+
+// expireDedupLocked forgets entries older than -dedup-window. dedupMu must
+// be held.
+func (s *Server) expireDedupLocked(now time.Time) {
+	for len(s.dedupOrder) > 0 && now.Sub(s.dedupOrder[0].seen) >= s.cfg.DedupWindow {
+		s.dropOldestDedupLocked()
+	}
+}
+
+// dropOldestDedupLocked forgets the oldest entry. dedupMu must be held.
+func (s *Server) dropOldestDedupLocked() {
+	ref := s.dedupOrder[0]
+	s.dedupOrder = s.dedupOrder[1:]
+	if e, ok := s.dedup[ref.key]; ok && e.seen.Equal(ref.seen) {
+		delete(s.dedup, ref.key)
+	}
+}
+
+// replayDuplicate answers p, a repeat of a packet already handled, with the
+// original's reply if it has had one, still acknowledging a registration the
+// repeat made (a resend on a fresh connection registers it).
+func (s *Server) replayDuplicate(c *connInfo, p *Packet, reg registration, result string, replied bool) error {
+	s.dedupHits.Add(1)
+	s.log.Printf("DUPLICATE %s -> %s (id=%s)", p.Src, p.Dst, p.Id)
+	s.auditRecord(p, outcomeDuplicate, true)
+	c.cork()
+	if replied {
+		if err := reply(c, p, result); err != nil {
+			c.uncork()
+			return err
+		}
+	}
+	if reg == regNew || reg == regReplaced || reg == regShared {
+		if err := s.ackRegistration(c, p, reg == regReplaced); err != nil {
+			c.uncork()
+			return err
+		}
+	}
+	return c.uncork()
+}
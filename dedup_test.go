@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupWindow(t *testing.T) {
+	const window = 300 * time.Millisecond
+	s, addr := startServer(t, func(c *Config) { c.DedupWindow = window })
+
+	sink := dialAgent(t, addr, "bot:dedup-sink")
+	sink.call(&Packet{Dst: "server"})
+	sender := dialAgent(t, addr, "bot:dedup-sender")
+	sender.call(&Packet{Dst: "server"})
+
+	sender.send(&Packet{Id: "m1", Dst: "bot:dedup-sink", Body: "once"})
+	if p := sink.recv(); p.Id != "m1" {
+		t.Fatalf("sink got %v, want m1", p)
+	}
+	if resp := sender.call(&Packet{Id: "m2", Dst: "bot:dedup-nobody"}); resp.Body != "error:offline" {
+		t.Fatalf("m2 got %q, want error:offline", resp.Body)
+	}
+
+	// The sender drops and reconnects with the same key, then resends both.
+	sender.conn.Close()
+	resent := dialAgent(t, addr, "bot:dedup-sender")
+	resent.priv = sender.priv
+	resent.send(&Packet{Id: "m1", Dst: "bot:dedup-sink", Body: "once"})
+	expectNothing(t, sink)
+	// m2 was refused, so it wasn't remembered: now that its recipient is
+	// online, the resend goes through.
+	nobody := dialAgent(t, addr, "bot:dedup-nobody")
+	nobody.call(&Packet{Dst: "server"})
+	resent.send(&Packet{Id: "m2", Dst: "bot:dedup-nobody"})
+	if p := nobody.recv(); p.Id != "m2" {
+		t.Fatalf("recipient got %v, want the resent m2", p)
+	}
+	if n := s.dedupHits.Load(); n != 1 {
+		t.Errorf("keep_dedup_hits_total = %d, want 1", n)
+	}
+	// Discovery is answered every time, not replayed.
+	for range 2 {
+		if resp := resent.call(&Packet{Id: "d1", Dst: "discover:info"}); resp.Id != "d1" || !strings.Contains(resp.Body, `"version"`) {
+			t.Fatalf("discover:info got %v", resp)
+		}
+	}
+	if n := s.dedupHits.Load(); n != 1 {
+		t.Errorf("keep_dedup_hits_total = %d after discovery, want 1", n)
+	}
+	// The resend registered the identity on the new connection all the same.
+	sink.send(&Packet{Dst: "bot:dedup-sender", Body: "hello"})
+	if p := resent.recv(); p.Body != "hello" {
+		t.Fatalf("sender got %q, want hello", p.Body)
+	}
+
+	// Another key's packet with the same id is its own.
+	other := dialAgent(t, addr, "bot:dedup-other")
+	other.send(&Packet{Id: "m1", Dst: "bot:dedup-sink", Body: "other"})
+	if p := sink.recv(); p.Body != "other" {
+		t.Fatalf("sink got %q, want other's m1", p.Body)
+	}
+
+	// Once the window has passed, the resend is handled fresh.
+	time.Sleep(window)
+	resent.send(&Packet{Id: "m1", Dst: "bot:dedup-sink", Body: "again"})
+	if p := sink.recv(); p.Id != "m1" || p.Body != "again" {
+		t.Fatalf("sink got %v, want m1 delivered again", p)
+	}
+}
+
+func TestDedupTableBounded(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.DedupWindow = time.Hour })
+	now := time.Now()
+	first := &Packet{Id: "first", Pk: []byte("k")}
+	s.checkDedup(first, now)
+	for i := range MaxDedupEntries {
+		s.checkDedup(&Packet{Id: strconv.Itoa(i), Pk: []byte("k")}, now)
+	}
+	if n := len(s.dedup); n != MaxDedupEntries {
+		t.Fatalf("table holds %d entries, want %d", n, MaxDedupEntries)
+	}
+	if dup, _, _ := s.checkDedup(first, now); dup {
+		t.Error("oldest entry kept past MaxDedupEntries")
+	}
+}
+
+func TestDedupKeyIncludesSrc(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.DedupWindow = time.Hour })
+	now := time.Now()
+	// Unsigned packets on a trusted listener all have an empty pk.
+	s.checkDedup(&Packet{Id: "1", Src: "bot:a", Dst: "bot:c"}, now)
+	if dup, _, _ := s.checkDedup(&Packet{Id: "1", Src: "bot:b", Dst: "bot:c"}, now); dup {
+		t.Error("another src's packet taken for a repeat")
+	}
+	if dup, _, _ := s.checkDedup(&Packet{Id: "1", Src: "bot:a", Dst: "bot:c"}, now); !dup {
+		t.Error("repeat not recognized")
+	}
+}
+
+func TestDedupOnlyDataPackets(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.DedupWindow = time.Hour })
+
+	w := dialAgent(t, addr, "bot:dedup-worker")
+	if resp := w.call(&Packet{Id: "s1", Dst: "subscribe:jobs"}); status(resp) != "done" {
+		t.Fatalf("subscribe got %q", resp.Body)
+	}
+	// A resend of the subscription after a reconnect subscribes the new
+	// connection instead of replaying the first one's done.
+	w.conn.Close()
+	again := dialAgent(t, addr, "bot:dedup-worker")
+	again.priv = w.priv
+	if resp := again.call(&Packet{Id: "s1", Dst: "subscribe:jobs"}); status(resp) != "done" {
+		t.Fatalf("resent subscribe got %q", resp.Body)
+	}
+	dialAgent(t, addr, "bot:dedup-boss").send(&Packet{Dst: "any:jobs", Body: "job"})
+	if p := again.recv(); p.Body != "job" {
+		t.Fatalf("resubscribed worker got %v", p)
+	}
+	if n := s.dedupHits.Load(); n != 0 {
+		t.Errorf("keep_dedup_hits_total = %d, want 0", n)
+	}
+
+	for _, dst := range []string{"server", "handshake", "register", "discover:info", "subscribe:jobs",
+		"unsubscribe:jobs", "deregister:bot:x", "kick:bot:x", "directive:*", "stream:bot:x"} {
+		if dedupable(&Packet{Dst: dst}) {
+			t.Errorf("%s is deduplicated", dst)
+		}
+	}
+	for _, dst := range []string{"bot:x", "any:jobs", "sample:jobs", "multi:jobs"} {
+		if !dedupable(&Packet{Dst: dst}) {
+			t.Errorf("%s is not deduplicated", dst)
+		}
+	}
+}
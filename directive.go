@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// An operator can push a directive to connected agents: a packet of typ 6
+// (TypeDirective) from -reply-src, signed with the server key like a
+// heartbeat, so an agent can check it against server_pk in discover:info
+// before acting on it. Only the server sends typ 6; a client packet with it
+// is refused with error:forbidden, so a directive can't be mistaken for data
+// or forged by a peer.
+//
+// An -admin-keys holder sends directive:<identity>, which reaches every
+// connection holding identity, or directive:*, which reaches every
+// registered connection once however many identities it holds. POST
+// /admin/directive?identity= does the same from the admin listener. The
+// request body is JSON naming the directive and its args:
+//
+//	{"directive":"throttle","args":{"rate":5}}
+//
+// and the pushed packet's body is the same with seq and ts added, seq
+// counting directives for the life of the server as heartbeats do:
+//
+//	throttle    send at most args.rate packets a second; 0 lifts the limit
+//	rotate_key  generate a new key and register with it
+//	reconnect   close and reconnect, after args.delay_ms if given
+//
+// The server only delivers a directive; carrying it out is up to the agent,
+// which ignores directives it doesn't know.
+
+// directiveArgs checks the args of each directive an operator may push.
+var directiveArgs = map[string]func(args json.RawMessage) bool{
+	"throttle": func(args json.RawMessage) bool {
+		var a struct {
+			Rate *float64 `json:"rate"`
+		}
+		return json.Unmarshal(args, &a) == nil && a.Rate != nil && *a.Rate >= 0
+	},
+	"rotate_key": func(json.RawMessage) bool { return true },
+	"reconnect": func(args json.RawMessage) bool {
+		var a struct {
+			DelayMS int64 `json:"delay_ms"`
+		}
+		return len(args) == 0 || json.Unmarshal(args, &a) == nil && a.DelayMS >= 0
+	},
+}
+
+// directive is the body of a directive request and of the packet pushed.
+type directive struct {
+	Directive string          `json:"directive"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	TS        int64           `json:"ts,omitempty"` // Unix milliseconds
+}
+
+// directiveAck is the JSON body of a directive request's reply.
+type directiveAck struct {
+	Status    string `json:"status"`
+	Directive string `json:"directive"`
+	Target    string `json:"target"`           // the identity, or "*"
+	Delivered int    `json:"delivered"`        // connections written to
+	Failed    int    `json:"failed,omitempty"` // connections whose write failed
+}
+
+// parseDirective reads a directive request body, returning the error reply
+// for one that names no known directive or has bad args.
+func parseDirective(body []byte) (directive, string) {
+	var d directive
+	if err := json.Unmarshal(body, &d); err != nil {
+		return d, "error:invalid_directive"
+	}
+	check, ok := directiveArgs[d.Directive]
+	if !ok {
+		return d, "error:unknown_directive"
+	}
+	if !check(d.Args) {
+		return d, "error:invalid_directive"
+	}
+	d.Seq, d.TS = 0, 0 // the server's to set
+	return d, ""
+}
+
+// pushDirective signs d and sends it to the connections holding target, or
+// to every registered connection if target is "*".
+func (s *Server) pushDirective(target string, d directive) directiveAck {
+	ack := directiveAck{Status: "done", Directive: d.Directive, Target: target}
+	d.Seq, d.TS = s.directiveSeq.Add(1), time.Now().UnixMilli()
+	body, _ := json.Marshal(d)
+	p := &Packet{Typ: TypeDirective, Src: s.cfg.ReplySrc, Body: string(body)}
+	if err := wire.Sign(p, s.key); err != nil {
+		s.log.Printf("Directive sign failed: %v", err)
+		return ack
+	}
+
+	var conns []*connInfo
+	s.routeMu.RLock()
+	if target == "*" {
+		for ci := range s.connSrc {
+			conns = append(conns, ci)
+		}
+	} else if holder, ok := s.agents[target]; ok {
+		conns = append(slices.Clone(s.standby[target]), holder)
+	}
+	s.routeMu.RUnlock()
+
+	for _, ci := range conns {
+		if err := ci.send(p); err != nil {
+			s.log.Printf("Directive %s to %s failed: %v", d.Directive, ci.addr, err)
+			ack.Failed++
+			continue
+		}
+		ack.Delivered++
+	}
+	s.log.Printf("Directive %s (seq %d) to %q: %d delivered, %d failed", d.Directive, d.Seq, target, ack.Delivered, ack.Failed)
+	return ack
+}
+
+// handleDirective answers a directive:<identity> or directive:* packet from
+// c. Only -admin-keys may push directives.
+func (s *Server) handleDirective(c *connInfo, p *Packet) error {
+	target := strings.TrimPrefix(p.Dst, "directive:")
+	if !s.isAdmin(p) {
+		s.log.Printf("REJECTED error:forbidden from %s (src=%s): directive to %q without an admin key", c.addr, p.Src, target)
+		return reply(c, p, "error:forbidden")
+	}
+	d, refusal := parseDirective([]byte(p.Body))
+	if refusal != "" {
+		s.log.Printf("REJECTED %s from %s (src=%s): directive %q", refusal, c.addr, p.Src, d.Directive)
+		return reply(c, p, refusal)
+	}
+	body, _ := json.Marshal(s.pushDirective(target, d))
+	return reply(c, p, string(body))
+}
+
+func (s *Server) adminDirectiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	target := strings.TrimSpace(r.URL.Query().Get("identity"))
+	if target == "" {
+		http.Error(w, "identity required", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, wire.MaxPacketSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d, refusal := parseDirective(body)
+	if refusal != "" {
+		http.Error(w, refusal, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.pushDirective(target, d))
+}
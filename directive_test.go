@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// expectDirective reads a directive from a and returns its body.
+func expectDirective(t *testing.T, s *Server, a *testAgent, name string) directive {
+	t.Helper()
+	p := a.recv()
+	var d directive
+	if p.Typ != TypeDirective || p.Src != s.cfg.ReplySrc || json.Unmarshal([]byte(p.Body), &d) != nil || d.Directive != name {
+		t.Fatalf("%s got typ %d from %q: %q, want directive %s", a.src, p.Typ, p.Src, p.Body, name)
+	}
+	if wire.Verify(p) != nil || !bytes.Equal(p.Pk, s.key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("%s: directive not signed by the server key", a.src)
+	}
+	return d
+}
+
+func TestDirectives(t *testing.T) {
+	s, addr := startServer(t)
+	admin := dialAgent(t, addr, "bot:dir-admin")
+	s.cfg.AdminKeys = []string{hex.EncodeToString(admin.priv.Public().(ed25519.PublicKey))}
+	admin.call(&Packet{Dst: "server"})
+	var agents []*testAgent
+	for _, id := range []string{"bot:dir-a", "bot:dir-b", "bot:dir-c"} {
+		a := dialAgent(t, addr, id)
+		a.call(&Packet{Dst: "server"})
+		agents = append(agents, a)
+	}
+
+	// Targeted: only the named agent hears it.
+	resp := admin.call(&Packet{Id: "d1", Dst: "directive:bot:dir-b", Body: `{"directive":"throttle","args":{"rate":5}}`})
+	if resp.Id != "d1" || resp.Body != `{"status":"done","directive":"throttle","target":"bot:dir-b","delivered":1}` {
+		t.Fatalf("targeted: got %q for %q", resp.Body, resp.Id)
+	}
+	if d := expectDirective(t, s, agents[1], "throttle"); string(d.Args) != `{"rate":5}` || d.Seq != 1 || d.TS == 0 {
+		t.Fatalf("targeted directive %+v", d)
+	}
+	expectNothing(t, agents[0])
+	expectNothing(t, agents[2])
+
+	// Broadcast: every registered connection, the admin's included, whose
+	// copy goes out before the reply.
+	admin.send(&Packet{Dst: "directive:*", Body: `{"directive":"reconnect","args":{"delay_ms":250}}`})
+	expectDirective(t, s, admin, "reconnect")
+	if resp := admin.recv(); !strings.Contains(resp.Body, `"target":"*","delivered":4`) {
+		t.Fatalf("broadcast: got %q", resp.Body)
+	}
+	for _, a := range agents {
+		if d := expectDirective(t, s, a, "reconnect"); d.Seq != 2 {
+			t.Fatalf("%s: seq %d, want 2", a.src, d.Seq)
+		}
+	}
+
+	for _, tc := range []struct {
+		from *testAgent
+		p    *Packet
+		want string
+	}{
+		{agents[0], &Packet{Dst: "directive:*", Body: `{"directive":"rotate_key"}`}, "error:forbidden"},
+		{admin, &Packet{Dst: "directive:bot:dir-a", Body: `{"directive":"self_destruct"}`}, "error:unknown_directive"},
+		{admin, &Packet{Dst: "directive:bot:dir-a", Body: `{"directive":"throttle","args":{"rate":-1}}`}, "error:invalid_directive"},
+		{admin, &Packet{Dst: "directive:bot:dir-a", Body: "throttle"}, "error:invalid_directive"},
+		// An agent can't pose as the server by sending typ 6 itself.
+		{agents[0], &Packet{Typ: TypeDirective, Dst: "bot:dir-b", Body: `{"directive":"rotate_key"}`}, "error:forbidden"},
+	} {
+		if resp := tc.from.call(tc.p); resp.Body != tc.want {
+			t.Errorf("%s to %s: got %q, want %q", tc.p.Body, tc.p.Dst, resp.Body, tc.want)
+		}
+	}
+	expectNothing(t, agents[0])
+	expectNothing(t, agents[1])
+}
+
+func TestAdminDirective(t *testing.T) {
+	admin := freeAddr(t)
+	s, addr := startServer(t, func(c *Config) { c.AdminAddr = admin })
+	a := dialAgent(t, addr, "bot:dir-http")
+	a.call(&Packet{Dst: "server"})
+
+	post := func(query, body string) (int, string) {
+		t.Helper()
+		resp, err := http.Post("http://"+admin+"/admin/directive"+query, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, body := post("?identity=bot:dir-http", `{"directive":"rotate_key"}`); code != http.StatusOK || !strings.Contains(body, `"delivered":1`) {
+		t.Fatalf("push: %d %q", code, body)
+	}
+	expectDirective(t, s, a, "rotate_key")
+	if code, _ := post("", `{"directive":"rotate_key"}`); code != http.StatusBadRequest {
+		t.Fatalf("no identity: %d, want 400", code)
+	}
+	if code, body := post("?identity=*", `{"directive":"nap"}`); code != http.StatusBadRequest || !strings.Contains(body, "error:unknown_directive") {
+		t.Fatalf("unknown directive: %d %q", code, body)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+// Discovery replies are cheap for a client to ask for and not free to build:
+// info and agents walk the routing table under routeMu, and stats gathers
+// every counter, all re-marshaled per query. Two options bound the cost:
+//
+// -discover-cache-ttl serves info, agents and stats from a reply built at
+// most that long ago, rebuilding it on the first query after it goes stale.
+// Their numbers, uptime_sec included, may lag by up to the TTL. Other
+// queries depend on who asks or what they ask for and are never cached.
+//
+// -discover-rate caps discovery queries per source identity per second. A
+// query over the cap is answered error:rate_limited and counted in
+// keep_discover_throttled_total. Like quotas, windows are fixed and open at
+// the source's first query.
+
+// discoverCacheable are the discovery queries whose replies may be cached:
+// they take no argument and answer every caller alike.
+var discoverCacheable = map[string]bool{"info": true, "agents": true, "stats": true}
+
+// cachedReply is a discovery reply body and when it was built.
+type cachedReply struct {
+	body  string
+	built time.Time
+}
+
+// discoverBody returns the reply to discover:<suffix> from build, or from
+// the cache if a fresh one is there. A reply build fails to encode is not
+// cached.
+func (s *Server) discoverBody(suffix string, build func() (string, error)) (string, error) {
+	ttl := s.cfg.DiscoverCacheTTL
+	if ttl <= 0 || !discoverCacheable[suffix] {
+		return build()
+	}
+	now := time.Now()
+	s.discoverMu.Lock()
+	cached, ok := s.discoverCache[suffix]
+	s.discoverMu.Unlock()
+	if ok && now.Sub(cached.built) < ttl {
+		s.discoverCacheHits.Add(1)
+		return cached.body, nil
+	}
+	body, err := build()
+	if err != nil {
+		return "", err
+	}
+	s.discoverMu.Lock()
+	s.discoverCache[suffix] = cachedReply{body: body, built: now}
+	s.discoverMu.Unlock()
+	return body, nil
+}
+
+// discoverWindow is a source's discovery queries in its current second.
+type discoverWindow struct {
+	start time.Time
+	n     int
+}
+
+// allowDiscover counts a discovery query from src and reports whether it is
+// within -discover-rate.
+func (s *Server) allowDiscover(src string, now time.Time) bool {
+	if s.cfg.DiscoverRate <= 0 {
+		return true
+	}
+	s.discoverMu.Lock()
+	defer s.discoverMu.Unlock()
+	w := s.discoverUse[src]
+	if w == nil || now.Sub(w.start) >= time.Second {
+		if w == nil && len(s.discoverUse) >= MaxUsageEntries {
+			for id, w := range s.discoverUse {
+				if now.Sub(w.start) >= time.Second {
+					delete(s.discoverUse, id)
+				}
+			}
+		}
+		w = &discoverWindow{start: now}
+		s.discoverUse[src] = w
+	}
+	if w.n >= s.cfg.DiscoverRate {
+		return false
+	}
+	w.n++
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoverCache(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.DiscoverCacheTTL = time.Hour })
+	a := dialAgent(t, addr, "bot:cache-a")
+	first := a.call(&Packet{Dst: "discover:agents"})
+	if !strings.Contains(first.Body, "bot:cache-a") {
+		t.Fatalf("first reply %q", first.Body)
+	}
+
+	// A new agent doesn't show up while the cached reply is fresh.
+	dialAgent(t, addr, "bot:cache-b").call(&Packet{Dst: "server"})
+	for range 5 {
+		if resp := a.call(&Packet{Dst: "discover:agents"}); resp.Body != first.Body {
+			t.Fatalf("got %q, want the cached %q", resp.Body, first.Body)
+		}
+	}
+	if n := s.discoverCacheHits.Load(); n != 5 {
+		t.Errorf("%d cache hits, want 5", n)
+	}
+
+	// Once it goes stale, the next query rebuilds it.
+	s.discoverMu.Lock()
+	s.discoverCache["agents"] = cachedReply{body: first.Body, built: time.Now().Add(-2 * time.Hour)}
+	s.discoverMu.Unlock()
+	if resp := a.call(&Packet{Dst: "discover:agents"}); !strings.Contains(resp.Body, "bot:cache-b") {
+		t.Fatalf("stale reply not rebuilt: %q", resp.Body)
+	}
+
+	// Replies that depend on the query aren't cached.
+	a.call(&Packet{Dst: "discover:usage", Body: "bot:cache-a"})
+	if n := s.discoverCacheHits.Load(); n != 5 {
+		t.Errorf("%d cache hits after uncached queries, want 5", n)
+	}
+}
+
+func TestDiscoverEncodeFailure(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.DiscoverCacheTTL = time.Hour })
+	logs := captureLog(t, s)
+	a := dialAgent(t, addr, "bot:encode")
+	a.call(&Packet{Dst: "server"})
+
+	encode := marshalDiscovery
+	t.Cleanup(func() { marshalDiscovery = encode })
+	marshalDiscovery = func(any) (string, error) { return "", errors.New("unsupported value") }
+
+	for _, query := range []string{"info", "agents", "agents?label=region:eu", "agent", "stats", "usage", "ring", "nonsense"} {
+		if resp := a.call(&Packet{Id: "q", Dst: "discover:" + query}); resp.Body != "error:internal" || resp.Id != "q" {
+			t.Errorf("discover:%s: got %q (id %q), want error:internal", query, resp.Body, resp.Id)
+		}
+	}
+	if !strings.Contains(logs.String(), "Discover bot:encode -> info: encoding the reply failed: unsupported value") {
+		t.Errorf("failure not logged:\n%s", logs)
+	}
+
+	// The failure wasn't cached in place of an answer.
+	marshalDiscovery = encode
+	if resp := a.call(&Packet{Dst: "discover:agents"}); !strings.Contains(resp.Body, "bot:encode") {
+		t.Fatalf("after encoding recovered: got %q", resp.Body)
+	}
+}
+
+func TestDiscoverRateLimit(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.DiscoverRate = 3 })
+	flooder := dialAgent(t, addr, "bot:flooder")
+	for i := range 3 {
+		if resp := flooder.call(&Packet{Dst: "discover:info"}); strings.HasPrefix(resp.Body, "error:") {
+			t.Fatalf("query %d: got %q", i, resp.Body)
+		}
+	}
+	if resp := flooder.call(&Packet{Id: "q4", Dst: "discover:info"}); resp.Id != "q4" || resp.Body != "error:rate_limited" {
+		t.Fatalf("over the rate: got %q for %q", resp.Body, resp.Id)
+	}
+
+	// Other sources have their own allowance, and the flooder's comes back
+	// with the next window.
+	if resp := dialAgent(t, addr, "bot:polite").call(&Packet{Dst: "discover:info"}); strings.HasPrefix(resp.Body, "error:") {
+		t.Fatalf("another source: got %q", resp.Body)
+	}
+	s.discoverMu.Lock()
+	s.discoverUse["bot:flooder"].start = time.Now().Add(-time.Second)
+	s.discoverMu.Unlock()
+	if resp := flooder.call(&Packet{Dst: "discover:info"}); strings.HasPrefix(resp.Body, "error:") {
+		t.Fatalf("next window: got %q", resp.Body)
+	}
+	if n := s.discoverThrottled.Load(); n != 1 {
+		t.Errorf("%d throttled, want 1", n)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// An agent that cannot take packets as large as the server allows says so
+// with max_packet_size on its registration packet. Like its labels, each
+// registration replaces the limit and one without it clears it.
+// discover:agent shows the limit, so a sender can size a packet before
+// sending it, and a forward over it is refused with error:dst_too_large
+// instead of handing the agent a frame it would drop. The check is made as
+// the packet is written (see forwardInLine), so it holds on every path to an
+// agent: direct, anycast, sampled, multicast, scheduled, federated and stream
+// offers. The size compared is that of the packet's encoding as its sender
+// signed it, before the server stamps seq.
+
+// errDstTooLarge is returned by forward for a packet over the limit its
+// destination advertised.
+var errDstTooLarge = errors.New("over the destination's max_packet_size")
+
+// overDstLimit returns p's size and whether it exceeds the limit target
+// advertised.
+func overDstLimit(target *connInfo, p *Packet) (int, bool) {
+	limit := target.maxPacketSize.Load()
+	if limit == 0 {
+		return 0, false
+	}
+	size := proto.Size(p)
+	return size, size > int(limit)
+}
+
+// rejectDstTooLarge refuses p for exceeding the limit dst advertised.
+func (s *Server) rejectDstTooLarge(c *connInfo, p *Packet, dst string) error {
+	s.auditRecord(p, outcomeRejected, true)
+	s.log.Printf("REJECTED error:dst_too_large from %s (src=%s dst=%s): %d bytes", c.addr, p.Src, dst, proto.Size(p))
+	if err := reply(c, p, "error:dst_too_large"); err != nil {
+		s.log.Printf("Write error to %s: %v", c.addr, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDstMaxPacketSize(t *testing.T) {
+	_, addr := startServer(t)
+	small := dialAgent(t, addr, "bot:size-small")
+	if resp := small.call(&Packet{Typ: TypeRegister, Dst: "server", MaxPacketSize: 300}); status(resp) != "done" {
+		t.Fatalf("register: got %q", resp.Body)
+	}
+	sender := dialAgent(t, addr, "bot:size-sender")
+	sender.call(&Packet{Dst: "server"})
+
+	// discover:agent shows the limit to senders, and nothing for an agent
+	// that advertised none.
+	if got := discoverJSONBody(t, sender, "agent", "bot:size-small"); got["max_packet_size"] != float64(300) {
+		t.Fatalf("agent bot:size-small: %v", got)
+	}
+	if got := discoverJSONBody(t, sender, "agent", "bot:size-sender"); got["max_packet_size"] != nil {
+		t.Fatalf("agent bot:size-sender: %v", got)
+	}
+
+	sender.send(&Packet{Dst: "bot:size-small", Body: "fits"})
+	if p := small.recv(); p.Body != "fits" {
+		t.Fatalf("got %q", p.Body)
+	}
+	big := strings.Repeat("x", 300)
+	if resp := sender.call(&Packet{Id: "big", Dst: "bot:size-small", Body: big}); resp.Body != "error:dst_too_large" {
+		t.Fatalf("over the limit: got %q", resp.Body)
+	}
+	expectNothing(t, small)
+
+	// Registering again without it lifts the limit.
+	small.call(&Packet{Typ: TypeRegister, Dst: "server"})
+	sender.send(&Packet{Dst: "bot:size-small", Body: big})
+	if p := small.recv(); p.Body != big {
+		t.Fatalf("after lifting the limit: got %d bytes", len(p.Body))
+	}
+}
+
+func TestDstMaxPacketSizeEveryPath(t *testing.T) {
+	_, addr := startServer(t)
+	small := dialAgent(t, addr, "bot:size-tiny")
+	small.call(&Packet{Typ: TypeRegister, Dst: "server", MaxPacketSize: 300})
+	roomy := dialAgent(t, addr, "bot:size-roomy")
+	roomy.call(&Packet{Dst: "server"})
+	for _, g := range []string{"subscribe:mixed", "subscribe:tiny"} {
+		small.call(&Packet{Dst: g})
+	}
+	roomy.call(&Packet{Dst: "subscribe:mixed"})
+	sender := dialAgent(t, addr, "bot:size-from")
+	sender.call(&Packet{Dst: "server"})
+	big := strings.Repeat("x", 300)
+
+	// Anycast passes over a member the packet is too large for.
+	sender.send(&Packet{Dst: "any:mixed", Body: big})
+	if p := roomy.recv(); p.Body != big {
+		t.Fatalf("roomy member got %d bytes", len(p.Body))
+	}
+	if resp := sender.call(&Packet{Id: "a2", Dst: "any:tiny", Body: big}); resp.Body != "error:dst_too_large" {
+		t.Fatalf("any: with no member that fits: got %q", resp.Body)
+	}
+
+	// Multicast reports it as failed.
+	resp := sender.call(&Packet{Id: "m1", Dst: "multi:bot:size-tiny,bot:size-roomy", Body: big})
+	var r deliveryReport
+	if err := json.Unmarshal([]byte(resp.Body), &r); err != nil || !slices.Equal(r.Failed, []string{"bot:size-tiny"}) || !slices.Equal(r.Delivered, []string{"bot:size-roomy"}) {
+		t.Fatalf("multi: got %q", resp.Body)
+	}
+	roomy.recv()
+
+	// A scheduled packet is checked when it is delivered.
+	at := uint64(time.Now().Add(100 * time.Millisecond).UnixMilli())
+	if resp := sender.call(&Packet{Id: "s1", Dst: "bot:size-tiny", Body: big, DeliverAt: at}); scheduleStatus(resp) != "scheduled" {
+		t.Fatalf("schedule: got %q", resp.Body)
+	}
+	time.Sleep(200 * time.Millisecond)
+	expectNothing(t, small)
+}
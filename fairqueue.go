@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With -fair-workers set, verified packets are not routed by the connection
+// that read them but queued per source and routed by a pool of workers that
+// take turns between sources by deficit round robin. Each visit credits a
+// source fairQuantum bytes times its weight (-fair-weights, else
+// -fair-default-weight), and a packet runs once its source has credit for
+// its framed size. A source sending three times its share only delays itself:
+// its queue fills, its connection stops being read, and TCP pushes back.
+// The backlog is per source; -max-inflight also bounds a connection's packets
+// across all the sources it sends as (see connInfo.acquireInFlight).
+//
+// A source has at most one packet in flight, so its packets are routed in
+// the order they arrived.
+const (
+	fairQuantum = 4096 // bytes credited per visit at weight 1
+
+	// FairBacklog is how many packets a source may have queued before its
+	// connection's reader blocks.
+	FairBacklog = 64
+)
+
+// fairItem is one queued routing job.
+type fairItem struct {
+	cost int64 // framed wire bytes
+	run  func()
+}
+
+// fairFlow is one source's queue.
+type fairFlow struct {
+	key     string
+	weight  int64
+	deficit int64
+	queue   []fairItem
+	busy    bool // a worker is running this flow's previous item
+}
+
+// fairQueue schedules routing jobs across sources.
+type fairQueue struct {
+	mu    sync.Mutex
+	ready *sync.Cond // a flow gained work or was released
+	space *sync.Cond // a flow's backlog shrank
+
+	flows  map[string]*fairFlow
+	active []*fairFlow // flows with queued or running work, in visiting order
+	next   int         // index into active of the flow being visited
+
+	weights       map[string]int
+	defaultWeight int
+	stopped       bool
+}
+
+func newFairQueue(weights map[string]int, defaultWeight int) *fairQueue {
+	if defaultWeight <= 0 {
+		defaultWeight = 1
+	}
+	q := &fairQueue{
+		flows:         make(map[string]*fairFlow),
+		weights:       weights,
+		defaultWeight: defaultWeight,
+	}
+	q.ready = sync.NewCond(&q.mu)
+	q.space = sync.NewCond(&q.mu)
+	return q
+}
+
+// queued returns the number of packets waiting in the queue.
+func (q *fairQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, f := range q.active {
+		n += len(f.queue)
+	}
+	return n
+}
+
+// parseFairWeights parses -fair-weights entries of the form identity=weight.
+func parseFairWeights(list []string) (map[string]int, error) {
+	weights := make(map[string]int, len(list))
+	for _, item := range list {
+		identity, w, ok := strings.Cut(item, "=")
+		if !ok || identity == "" {
+			return nil, fmt.Errorf("%q: want identity=weight", item)
+		}
+		n, err := strconv.Atoi(w)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%q: weight must be a positive integer", item)
+		}
+		weights[identity] = n
+	}
+	return weights, nil
+}
+
+// start runs n workers until stop is called.
+func (q *fairQueue) start(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				f, it, ok := q.take()
+				if !ok {
+					return
+				}
+				it.run()
+				q.done(f)
+			}
+		}()
+	}
+}
+
+// stop makes the workers exit once their current item is done. Queued items
+// are dropped and blocked pushes return.
+func (q *fairQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.ready.Broadcast()
+	q.space.Broadcast()
+}
+
+// push queues run under key, blocking while key's backlog is full.
+func (q *fairQueue) push(key string, cost int64, run func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var f *fairFlow
+	for {
+		if q.stopped {
+			return
+		}
+		// Look the flow up again after waiting: it may have drained and
+		// been dropped in the meantime.
+		f = q.flows[key]
+		if f == nil {
+			w := q.weights[key]
+			if w <= 0 {
+				w = q.defaultWeight
+			}
+			f = &fairFlow{key: key, weight: int64(w)}
+			q.flows[key] = f
+			q.active = append(q.active, f)
+		}
+		if len(f.queue) < FairBacklog {
+			break
+		}
+		q.space.Wait()
+	}
+	f.queue = append(f.queue, fairItem{cost: cost, run: run})
+	q.ready.Signal()
+}
+
+// take blocks until some flow may run its next item and returns it. ok is
+// false once the queue is stopped.
+func (q *fairQueue) take() (f *fairFlow, it fairItem, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.stopped {
+			return nil, fairItem{}, false
+		}
+		// Visit flows in turn, crediting each that can't yet afford its
+		// head. Flows with an item in flight are skipped without credit.
+		// Credit only grows, so this ends once any flow is runnable.
+		runnable := false
+		for i := 0; i < len(q.active); i++ {
+			f = q.active[q.next]
+			if f.busy || len(f.queue) == 0 {
+				q.next = (q.next + 1) % len(q.active)
+				continue
+			}
+			runnable = true
+			if head := f.queue[0]; f.deficit >= head.cost {
+				f.deficit -= head.cost
+				f.queue = f.queue[1:]
+				f.busy = true
+				q.space.Broadcast()
+				return f, head, true
+			}
+			f.deficit += fairQuantum * f.weight
+			q.next = (q.next + 1) % len(q.active)
+		}
+		if !runnable {
+			q.ready.Wait()
+		}
+	}
+}
+
+// done releases f after a worker has run its item. A flow left with nothing
+// queued is dropped along with its unused credit, as deficit round robin
+// requires, so an idle source can't bank a burst.
+func (q *fairQueue) done(f *fairFlow) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f.busy = false
+	if len(f.queue) > 0 {
+		q.ready.Signal()
+		return
+	}
+	delete(q.flows, f.key)
+	for i, g := range q.active {
+		if g != f {
+			continue
+		}
+		q.active = append(q.active[:i], q.active[i+1:]...)
+		if i < q.next {
+			q.next--
+		}
+		if q.next >= len(q.active) {
+			q.next = 0
+		}
+		break
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drain runs the queue's items one at a time, as a single worker would, and
+// returns the key of each in the order they ran.
+func drain(q *fairQueue, n int) []string {
+	var order []string
+	for i := 0; i < n; i++ {
+		f, it, _ := q.take()
+		it.run()
+		order = append(order, f.key)
+		q.done(f)
+	}
+	return order
+}
+
+func TestFairQueueModestSourceNotStarved(t *testing.T) {
+	q := newFairQueue(nil, 1)
+	// The flooder's whole backlog is queued before the modest source sends
+	// anything; in arrival order the modest packets would run last.
+	for i := 0; i < 50; i++ {
+		q.push("bot:flood", 1000, func() {})
+	}
+	for i := 0; i < 5; i++ {
+		q.push("bot:modest", 1000, func() {})
+	}
+
+	order := drain(q, 55)
+	last := 0
+	for i, key := range order {
+		if key == "bot:modest" {
+			last = i
+		}
+	}
+	// Equal weights share bytes equally: four 1000-byte packets per
+	// 4096-byte turn each, so the modest five are done by the fourth turn.
+	if last >= 16 {
+		t.Errorf("modest source finished at position %d of 55: %v", last, order)
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	q := newFairQueue(map[string]int{"bot:vip": 3}, 1)
+	for i := 0; i < 60; i++ {
+		q.push("bot:bulk", 1024, func() {})
+		q.push("bot:vip", 1024, func() {})
+	}
+
+	counts := map[string]int{}
+	for _, key := range drain(q, 32) {
+		counts[key]++
+	}
+	if counts["bot:vip"] != 3*counts["bot:bulk"] {
+		t.Errorf("first 32 packets: vip %d, bulk %d; want 3:1", counts["bot:vip"], counts["bot:bulk"])
+	}
+}
+
+func TestFairQueueKeepsPerSourceOrder(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) { c.FairWorkers = 4 })
+
+	sink := dialAgent(t, addr, "bot:fair-sink")
+	sink.call(&Packet{Dst: "server"})
+	a := dialAgent(t, addr, "bot:fair-a")
+	b := dialAgent(t, addr, "bot:fair-b")
+	for i := 0; i < 20; i++ {
+		a.send(&Packet{Dst: "bot:fair-sink", Body: "a" + strconv.Itoa(i)})
+		b.send(&Packet{Dst: "bot:fair-sink", Body: "b" + strconv.Itoa(i)})
+	}
+
+	next := map[byte]int{}
+	for i := 0; i < 40; i++ {
+		p := sink.recv()
+		src, n := p.Body[0], p.Body[1:]
+		if n != strconv.Itoa(next[src]) {
+			t.Fatalf("from %c got %s, want %d", src, p.Body, next[src])
+		}
+		next[src]++
+	}
+
+	// Server replies go through the queue too.
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("got %q, want done", resp.Body)
+	}
+}
+
+func TestFairQueueDropsExpired(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.FairWorkers = 1 })
+	sink := dialAgent(t, addr, "bot:expiry-sink")
+	sink.call(&Packet{Dst: "server"})
+	a := dialAgent(t, addr, "bot:expiry-a")
+	a.call(&Packet{Dst: "server"})
+
+	// Already past its deadline on arrival.
+	if resp := a.call(&Packet{Dst: "bot:expiry-sink", ExpiresAt: 1}); resp.Body != "error:expired" {
+		t.Fatalf("stale on arrival: got %q", resp.Body)
+	}
+
+	// Stall the worker on an anycast lookup so the next packets queue
+	// behind it, then let the first one's deadline pass while it waits.
+	deadline := time.Now().Add(300 * time.Millisecond)
+	s.groupsMu.Lock()
+	a.send(&Packet{Id: "plug", Dst: "any:expiry-plug"})
+	a.send(&Packet{Id: "stale", Dst: "bot:expiry-sink", Body: "stale", ExpiresAt: uint64(deadline.UnixMilli())})
+	a.send(&Packet{Id: "fresh", Dst: "bot:expiry-sink", Body: "fresh", ExpiresAt: uint64(time.Now().Add(time.Hour).UnixMilli())})
+	waitFor(t, "packets to queue", func() bool {
+		s.fair.mu.Lock()
+		defer s.fair.mu.Unlock()
+		f := s.fair.flows["bot:expiry-a"]
+		return f != nil && len(f.queue) == 2
+	})
+	time.Sleep(time.Until(deadline))
+	s.groupsMu.Unlock()
+
+	if resp := a.recv(); resp.Id != "plug" || resp.Body != "error:offline" {
+		t.Fatalf("plug: got %q for %q", resp.Body, resp.Id)
+	}
+	if resp := a.recv(); resp.Id != "stale" || resp.Body != "error:expired" {
+		t.Fatalf("stale: got %q for %q", resp.Body, resp.Id)
+	}
+	if p := sink.recv(); p.Body != "fresh" {
+		t.Fatalf("sink got %q, want only the fresh packet", p.Body)
+	}
+	expectNothing(t, sink)
+
+	var m strings.Builder
+	s.writeMetrics(&m)
+	if !strings.Contains(m.String(), "keep_expired_total 2\n") {
+		t.Error("metrics do not count both expired packets")
+	}
+}
+
+func TestMaxInFlightPausesReads(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.FairWorkers = 1
+		c.MaxInFlight = 2
+	})
+	sink := dialAgent(t, addr, "bot:inflight-sink")
+	sink.call(&Packet{Dst: "server"})
+	a := dialAgent(t, addr, "bot:pipeliner")
+	a.call(&Packet{Dst: "server"})
+	c := s.lookupAgent("bot:pipeliner")
+
+	// Hold the sink's connection so the worker stalls writing the first
+	// packet, and pipeline more than the cap behind it.
+	target := s.lookupAgent("bot:inflight-sink")
+	target.sendQ.acquire(&Packet{})
+	for i := range 5 {
+		a.send(&Packet{Id: strconv.Itoa(i), Dst: "bot:inflight-sink", Body: strconv.Itoa(i)})
+	}
+	// One packet being routed and one queued fill the cap; the reader has
+	// read a third and waits to hand it over instead of reading on.
+	waitFor(t, "reads to pause", func() bool { return s.inflightPauses.Load() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := c.packetsIn.Load(); n != 1+3 {
+		t.Fatalf("read %d packets with reads paused, want 4 counting the registration", n)
+	}
+	if n := len(c.inflight); n != 2 {
+		t.Fatalf("%d in flight, want 2", n)
+	}
+
+	// Once the sink drains, reading resumes and everything arrives in order.
+	target.sendQ.release()
+	for i := range 5 {
+		if p := sink.recv(); p.Body != strconv.Itoa(i) {
+			t.Fatalf("sink got %q, want %d", p.Body, i)
+		}
+	}
+	waitFor(t, "slots to free", func() bool { return len(c.inflight) == 0 })
+	if n := c.packetsIn.Load(); n != 1+5 {
+		t.Errorf("read %d packets, want 6", n)
+	}
+}
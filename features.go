@@ -0,0 +1,59 @@
+package main
+
+import "github.com/teacrawford/keep-protocol/wire"
+
+// Connection features are negotiated in the handshake as a bitmask: the
+// client sends the features it supports, the server answers with the subset
+// it will use on that connection, and from the next frame on both sides
+// behave accordingly. Bits the server doesn't know or doesn't implement are
+// never granted, so clients may offer them freely.
+const (
+	// FeatureSignedReplies: the server signs its replies (done, errors,
+	// discovery) with its key, published as server_pk in discover:info.
+	FeatureSignedReplies uint64 = 1 << iota
+
+	// FeatureFrameCRC and FeatureTypedErrors are reserved for frame
+	// checksums and error-typed replies. This server does not implement them.
+	FeatureFrameCRC
+	FeatureTypedErrors
+
+	// FeatureRegistrationAck: when a packet registers the connection's
+	// identity, the server follows its reply with a signed registration ack.
+	FeatureRegistrationAck
+
+	// FeatureResume: the handshake reply carries a resumption token, and a
+	// later handshake may present it to take back the connection's
+	// identities, groups and labels (see resume.go).
+	FeatureResume
+)
+
+// supportedFeatures returns the features this server can grant.
+func (s *Server) supportedFeatures() uint64 {
+	var f uint64
+	if s.key != nil {
+		f |= FeatureSignedReplies | FeatureRegistrationAck
+		if s.cfg.ResumeWindow > 0 {
+			f |= FeatureResume
+		}
+	}
+	return f
+}
+
+// negotiateFeatures returns the features to enable for a client offering
+// offered.
+func (s *Server) negotiateFeatures(offered uint64) uint64 {
+	return offered & s.supportedFeatures()
+}
+
+// has reports whether feature f was negotiated for the connection.
+func (ci *connInfo) has(f uint64) bool {
+	return ci.features.Load()&f != 0
+}
+
+// signReply signs a server-originated reply bound for ci if ci negotiated
+// FeatureSignedReplies. A signing failure leaves the reply unsigned.
+func (ci *connInfo) signReply(p *Packet) {
+	if key := ci.srv.key; ci.has(FeatureSignedReplies) && key != nil {
+		wire.Sign(p, key)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Federation lets several keep servers act as one routing domain. Servers
+// link over a dedicated federation port and exchange server-to-server
+// control packets, distinguished by a "fed:" dst:
+//
+//	fed:hello       first packet on a link; src names the sending server, pk
+//	                is its server key and body a hex challenge for the peer
+//	fed:auth        body is the handshake transcript (see fedTranscript);
+//	                signed with the server key
+//	fed:register    body is an identity now hosted by the sender
+//	fed:unregister  body is an identity no longer hosted by the sender
+//	fed:forward     scar holds an agent's signed packet, unmodified; ttl is
+//	                the remaining hop budget; body, if set, is the identity
+//	                to deliver to instead of the packet's dst
+//	fed:stats-request  asks for the receiver's local stats; id correlates
+//	fed:stats-reply    body is the sender's stats JSON, id from the request
+//	fed:expired     body is the src of a packet that expired in transit; id
+//	                and channel are the packet's, ttl the remaining hop budget
+//
+// A packet whose dst is not registered locally is wrapped in fed:forward and
+// sent to the peer that announced the identity. The agent's packet is never
+// modified, so its signature verifies end-to-end; the hop budget lives in the
+// envelope instead of the signed ttl. Forwarding is fire-and-forget: the
+// sender hears nothing back unless the local hop fails, or the packet expires
+// or runs out of hops on the way, which sends fed:expired back towards the
+// sender's server to become an error:expired reply (see notifyExpired).
+//
+// With -ring-vnodes set, servers form a consistent-hash ring instead of
+// gossiping full tables: each identity is announced only to its ring owner,
+// and a server that doesn't host a destination forwards to the destination's
+// owner, which hosts it or knows which peer does.
+//
+// With -peer-keys set, a peer must be one of the listed server keys and prove
+// it holds that key by signing the transcript of the handshake, both
+// challenges and our server id, before anything else it sends is accepted. A
+// signature is only good for the link it was made on and the server it was
+// made for, so it can't be replayed or reflected back at its maker. The
+// accepting server proves itself first and whether or not it checks its own
+// peers; the dialing server answers only once the peer's proof verifies, so
+// it never signs for a server that has not proven its key. This keeps rogue
+// servers from joining and injecting routes. It authenticates the link when
+// it opens, not each packet, so the federation port should still only be
+// reachable by trusted peers.
+const (
+	// MaxFederationHops caps the hop budget of a forwarded packet. A packet
+	// with ttl 0 (or larger than the cap) gets the full budget.
+	MaxFederationHops = 8
+
+	peerRedialInterval = 5 * time.Second
+)
+
+// peerLink is a connection to another keep server.
+type peerLink struct {
+	*connInfo
+	name string // remote server id, set by its fed:hello
+}
+
+// startFederation accepts peer links on -federation-listen and keeps a link
+// open to every configured peer until the server closes.
+func (s *Server) startFederation() error {
+	if s.cfg.RingVnodes > 0 {
+		s.ring = newHashRing(s.cfg.RingVnodes)
+		s.ring.add(s.cfg.ServerID)
+	}
+	if s.cfg.FederationAddr != "" {
+		l, err := net.Listen("tcp", s.cfg.FederationAddr)
+		if err != nil {
+			return err
+		}
+		if !s.track(l) {
+			return ErrServerClosed
+		}
+		s.log.Printf("Federation %q listening on %s", s.cfg.ServerID, l.Addr())
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					continue
+				}
+				s.tuneConn(conn)
+				go s.handlePeer(conn, false)
+			}
+		}()
+	}
+	for _, addr := range s.cfg.Peers {
+		go s.dialPeer(addr)
+	}
+	return nil
+}
+
+// dialPeer maintains an outbound link to addr, redialing when it drops,
+// until the server closes.
+func (s *Server) dialPeer(addr string) {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, peerRedialInterval)
+		if err != nil {
+			s.log.Printf("Peer %s unreachable: %v", addr, err)
+		} else {
+			s.tuneConn(conn)
+			s.handlePeer(conn, true)
+		}
+		select {
+		case <-time.After(peerRedialInterval):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// handlePeer runs one peer link, dialed by us or accepted: the two servers
+// exchange fed:hello (and prove their keys), gossip their local routing
+// tables, then apply each other's control packets until the link drops.
+func (s *Server) handlePeer(conn net.Conn, dialed bool) {
+	defer conn.Close()
+	link := &peerLink{connInfo: s.newConnInfo(conn)}
+
+	var nonce [32]byte
+	rand.Read(nonce[:])
+	challenge := hex.EncodeToString(nonce[:])
+	hello := &Packet{Src: s.cfg.ServerID, Dst: "fed:hello", Body: challenge, Pk: s.key.Public().(ed25519.PublicKey)}
+	if err := link.send(hello); err != nil {
+		s.log.Printf("Peer %s hello failed: %v", link.addr, err)
+		return
+	}
+
+	defer s.dropPeer(link)
+	var peerPK []byte        // the key the peer's hello presented
+	var peerChallenge string // the challenge the peer's hello asked us to sign
+	joined := false
+	for {
+		p, err := wire.ReadPacket(link)
+		if err != nil {
+			if err != io.EOF {
+				s.log.Printf("Peer %s read error: %v", link.addr, err)
+			}
+			return
+		}
+
+		if link.name == "" {
+			if p.Dst != "fed:hello" || p.Src == "" || p.Src == s.cfg.ServerID {
+				s.log.Printf("Peer %s sent %q before hello, closing", link.addr, p.Dst)
+				return
+			}
+			if len(s.cfg.PeerKeys) > 0 && !s.peerKeyAllowed(p.Pk) {
+				s.log.Printf("Peer %q (%s) presented key %x, not in -peer-keys, closing", p.Src, link.addr, p.Pk)
+				return
+			}
+			link.name, peerPK, peerChallenge = p.Src, p.Pk, p.Body
+			if dialed {
+				continue // answered and joined once it proves its key
+			}
+			if !s.answerPeer(link, peerChallenge, challenge) {
+				return
+			}
+			if len(s.cfg.PeerKeys) > 0 {
+				continue // joined once it answers our challenge
+			}
+			if joined = s.joinPeer(link); !joined {
+				return
+			}
+			continue
+		}
+
+		if !joined {
+			want := fedTranscript(challenge, peerChallenge, s.cfg.ServerID)
+			if p.Dst != "fed:auth" || p.Src != link.name || p.Body != want || !bytes.Equal(p.Pk, peerPK) || wire.Verify(p) != nil {
+				s.log.Printf("Peer %q (%s) failed to prove its key, closing", link.name, link.addr)
+				return
+			}
+			s.log.Printf("Peer %q authenticated with key %x", link.name, peerPK)
+			if dialed && !s.answerPeer(link, peerChallenge, challenge) {
+				return
+			}
+			if joined = s.joinPeer(link); !joined {
+				return
+			}
+			continue
+		}
+
+		switch p.Dst {
+		case "fed:auth":
+			// The peer's answer to our challenge, unchecked without -peer-keys
+
+		case "fed:register":
+			s.fedMu.Lock()
+			s.peerRoutes[p.Body] = link
+			s.fedMu.Unlock()
+
+		case "fed:unregister":
+			s.fedMu.Lock()
+			if s.peerRoutes[p.Body] == link {
+				delete(s.peerRoutes, p.Body)
+			}
+			s.fedMu.Unlock()
+
+		case "fed:forward":
+			s.handleFederatedForward(link, p)
+
+		case "fed:expired":
+			s.notifyExpired(&Packet{Id: p.Id, Src: p.Body, Channel: p.Channel}, p.Ttl)
+
+		case "fed:stats-request":
+			s.handleStatsRequest(link, p)
+
+		case "fed:stats-reply":
+			s.handleStatsReply(link, p)
+
+		default:
+			s.log.Printf("Peer %q sent unknown control %q", link.name, p.Dst)
+		}
+	}
+}
+
+// fedTranscript is the fed:auth body a server signs to prove its key to
+// verifier: the challenge verifier sent, then the prover's own challenge,
+// then verifier's server id. The prover's id is the signed src.
+func fedTranscript(verifierChallenge, proverChallenge, verifier string) string {
+	return verifierChallenge + ":" + proverChallenge + ":" + verifier
+}
+
+// answerPeer proves our key to link by signing the handshake transcript for
+// its challenge. A hello without a challenge asks for no proof. It reports
+// false if the link should close instead.
+func (s *Server) answerPeer(link *peerLink, peerChallenge, challenge string) bool {
+	if peerChallenge == "" {
+		return true
+	}
+	auth := &Packet{Src: s.cfg.ServerID, Dst: "fed:auth", Body: fedTranscript(peerChallenge, challenge, link.name)}
+	if err := wire.Sign(auth, s.key); err != nil {
+		s.log.Printf("Peer %q auth sign failed: %v", link.name, err)
+		return false
+	}
+	if err := link.send(auth); err != nil {
+		s.log.Printf("Peer %q auth failed: %v", link.name, err)
+		return false
+	}
+	return true
+}
+
+// peerKeyAllowed reports whether pk is one of -peer-keys.
+func (s *Server) peerKeyAllowed(pk []byte) bool {
+	k := hex.EncodeToString(pk)
+	for _, allowed := range s.cfg.PeerKeys {
+		if len(pk) > 0 && strings.EqualFold(allowed, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinPeer makes link the route to its server and sends it our routing
+// table. It reports false if the link should close instead.
+func (s *Server) joinPeer(link *peerLink) bool {
+	s.fedMu.Lock()
+	if s.isClosing() {
+		// Too late to join: close only closes links it can see.
+		s.fedMu.Unlock()
+		return false
+	}
+	if old, exists := s.peers[link.name]; exists {
+		old.Close()
+	}
+	s.peers[link.name] = link
+	s.fedMu.Unlock()
+	s.knownPeersMu.Lock()
+	s.knownPeers[link.name] = true
+	s.knownPeersMu.Unlock()
+	if s.ring != nil {
+		s.ring.add(link.name)
+	}
+	s.log.Printf("Peer %q linked via %s", link.name, link.addr)
+
+	// Gossip after joining peers so no registration falls between
+	// the snapshot and subsequent announcements. In ring mode the new
+	// peer only needs the identities it now owns.
+	for _, identity := range s.localIdentities() {
+		if s.ring != nil && s.ring.lookup(identity) != link.name {
+			continue
+		}
+		if err := link.send(&Packet{Src: s.cfg.ServerID, Dst: "fed:register", Body: identity}); err != nil {
+			s.log.Printf("Peer %q gossip failed: %v", link.name, err)
+			return false
+		}
+	}
+	return true
+}
+
+// dropPeer forgets a closed link and every identity it hosted. In ring mode
+// the peer also leaves the ring, and local identities it owned are announced
+// to their new owners.
+func (s *Server) dropPeer(link *peerLink) {
+	s.fedMu.Lock()
+	current := s.peers[link.name] == link
+	if current {
+		delete(s.peers, link.name)
+		s.log.Printf("Peer %q unlinked", link.name)
+	}
+	for identity, l := range s.peerRoutes {
+		if l == link {
+			delete(s.peerRoutes, identity)
+		}
+	}
+	s.fedMu.Unlock()
+
+	if s.ring == nil || !current {
+		return
+	}
+	var orphaned []string
+	for _, identity := range s.localIdentities() {
+		if s.ring.lookup(identity) == link.name {
+			orphaned = append(orphaned, identity)
+		}
+	}
+	s.ring.remove(link.name)
+	for _, identity := range orphaned {
+		s.announce("fed:register", identity)
+	}
+}
+
+// handleFederatedForward delivers a packet relayed by a peer, or passes it on
+// if this server does not host the destination either.
+func (s *Server) handleFederatedForward(from *peerLink, env *Packet) {
+	var p Packet
+	if err := proto.Unmarshal(env.Scar, &p); err != nil {
+		s.log.Printf("Peer %q forward: unmarshal: %v", from.name, err)
+		return
+	}
+	if err := wire.Verify(&p); err != nil {
+		s.log.Printf("DROPPED federated packet with invalid sig from peer %q (src=%s): %v", from.name, p.Src, err)
+		return
+	}
+	if expired(&p, time.Now()) {
+		s.expiredPackets.Add(1)
+		s.log.Printf("Federated %s -> %s via %q: expired", p.Src, p.Dst, from.name)
+		s.notifyExpired(&p, MaxFederationHops)
+		return
+	}
+
+	dst := p.Dst
+	if env.Body != "" {
+		dst = env.Body
+	}
+	s.routeMu.RLock()
+	target, exists := s.agents[dst]
+	s.routeMu.RUnlock()
+	if exists {
+		if err := s.forward(target, &p); errors.Is(err, errExpired) {
+			s.expiredPackets.Add(1)
+			s.log.Printf("Federated %s -> %s via %q: expired while queued", p.Src, dst, from.name)
+			s.notifyExpired(&p, MaxFederationHops)
+			return
+		} else if err != nil {
+			s.log.Printf("Federated %s -> %s via %q: delivery failed: %v", p.Src, dst, from.name, err)
+			return
+		}
+		if s.routeLog.ok() {
+			s.log.Printf("Federated %s -> %s via %q", p.Src, dst, from.name)
+		}
+		return
+	}
+
+	if env.Ttl == 0 {
+		s.log.Printf("Federated %s -> %s via %q: hop limit reached", p.Src, dst, from.name)
+		s.notifyExpired(&p, MaxFederationHops)
+		return
+	}
+	if ok, err := s.relayToPeer(&p, env.Scar, dst, env.Ttl); !ok || err != nil {
+		s.log.Printf("Federated %s -> %s via %q: not deliverable (%v)", p.Src, dst, from.name, err)
+	}
+}
+
+// notifyExpired tells p's sender that p expired or ran out of hops before
+// delivery: with an error:expired reply if the sender is connected here, or
+// else by passing fed:expired towards its server, spending one of hops. Only
+// p's id, src and channel are used. Nothing is sent with -quiet-expiry, or
+// if the sender can't be found; the notice is best-effort like forwarding.
+func (s *Server) notifyExpired(p *Packet, hops uint32) {
+	if s.cfg.QuietExpiry {
+		return
+	}
+	if c := s.lookupAgent(p.Src); c != nil {
+		if err := reply(c, &Packet{Id: p.Id, Src: p.Src, Channel: p.Channel}, "error:expired"); err != nil {
+			s.log.Printf("Expiry notice %s for %s failed: %v", p.Id, p.Src, err)
+		}
+		return
+	}
+	if hops == 0 {
+		return
+	}
+	if link := s.peerFor(p.Src); link != nil {
+		link.send(&Packet{Id: p.Id, Src: s.cfg.ServerID, Dst: "fed:expired", Body: p.Src, Channel: p.Channel, Ttl: hops - 1})
+	}
+}
+
+// forwardToPeer relays a locally received packet to the peer hosting dst,
+// which is p.Dst unless the packet is redirected (a reply, say). ok is false
+// if no peer has announced the destination.
+func (s *Server) forwardToPeer(p *Packet, dst string) (ok bool, err error) {
+	hops := p.Ttl
+	if hops == 0 || hops > MaxFederationHops {
+		hops = MaxFederationHops
+	}
+	raw, err := proto.Marshal(p)
+	if err != nil {
+		return true, err
+	}
+	return s.relayToPeer(p, raw, dst, hops)
+}
+
+// relayToPeer sends raw (the marshaled p) to the peer hosting dst, spending
+// one hop of the budget. A dst other than p.Dst travels in the envelope's
+// body.
+func (s *Server) relayToPeer(p *Packet, raw []byte, dst string, hops uint32) (ok bool, err error) {
+	link := s.peerFor(dst)
+	if link == nil {
+		return false, nil
+	}
+	env := &Packet{
+		Src:  s.cfg.ServerID,
+		Dst:  "fed:forward",
+		Ttl:  hops - 1,
+		Scar: raw,
+	}
+	if dst != p.Dst {
+		env.Body = dst
+	}
+	return true, link.send(env)
+}
+
+// peerFor returns the link to forward a packet for identity over: the peer
+// known to host it or, in ring mode, the identity's ring owner. It returns
+// nil if neither is linked or this server is the owner.
+func (s *Server) peerFor(identity string) *peerLink {
+	s.fedMu.RLock()
+	defer s.fedMu.RUnlock()
+
+	if link, ok := s.peerRoutes[identity]; ok {
+		return link
+	}
+	if s.ring != nil {
+		if owner := s.ring.lookup(identity); owner != s.cfg.ServerID {
+			return s.peers[owner]
+		}
+	}
+	return nil
+}
+
+// announce tells linked peers that identity was registered or released here:
+// every peer, or in ring mode only the identity's owner. It must be called
+// without routeMu held.
+func (s *Server) announce(dst, identity string) {
+	s.fedMu.RLock()
+	links := make([]*peerLink, 0, len(s.peers))
+	if s.ring != nil {
+		if l, ok := s.peers[s.ring.lookup(identity)]; ok {
+			links = append(links, l)
+		}
+	} else {
+		for _, l := range s.peers {
+			links = append(links, l)
+		}
+	}
+	s.fedMu.RUnlock()
+
+	for _, l := range links {
+		if err := l.send(&Packet{Src: s.cfg.ServerID, Dst: dst, Body: identity}); err != nil {
+			s.log.Printf("Peer %q %s %s failed: %v", l.name, dst, identity, err)
+		}
+	}
+}
+
+// localIdentities snapshots the identities registered on this server.
+func (s *Server) localIdentities() []string {
+	s.routeMu.RLock()
+	defer s.routeMu.RUnlock()
+	list := make([]string, 0, len(s.agents))
+	for identity := range s.agents {
+		list = append(list, identity)
+	}
+	return list
+}
+
+// splitList parses a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFederatedRouting(t *testing.T) {
+	addrA, fedA := freeAddr(t), freeAddr(t)
+	addrB := freeAddr(t)
+	startProcess(t, addrA, "-server-id", "a", "-federation-listen", fedA)
+	startProcess(t, addrB, "-server-id", "b", "-peers", fedA)
+
+	bob := dialAgent(t, addrB, "bot:bob")
+	bob.call(&Packet{Dst: "server"})
+	alice := dialAgent(t, addrA, "bot:alice")
+	alice.call(&Packet{Dst: "server"})
+
+	// Retry until B's registration gossip reaches A; a routed packet gets
+	// no reply, so silence means it left A.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		alice.send(&Packet{Id: "m1", Dst: "bot:bob", Body: "hello across", Ttl: 60})
+		alice.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		resp, err := wire.ReadPacket(alice.conn)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			t.Fatalf("alice read: %v", err)
+		}
+		if resp.Body != "error:offline" {
+			t.Fatalf("unexpected reply %q", resp.Body)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bot:bob never became routable from server a")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	got := bob.recv()
+	if got.Src != "bot:alice" || got.Body != "hello across" || got.Ttl != 60 {
+		t.Fatalf("unexpected packet at bob: %v", got)
+	}
+	if wire.Verify(got) != nil {
+		t.Fatalf("signature did not survive the federation hop")
+	}
+}
+
+func TestClusterStats(t *testing.T) {
+	addrA, fedA := freeAddr(t), freeAddr(t)
+	addrB, addrC := freeAddr(t), freeAddr(t)
+	startProcess(t, addrA, "-server-id", "a", "-federation-listen", fedA, "-cluster-stats-timeout", "300ms")
+	startProcess(t, addrB, "-server-id", "b", "-peers", fedA)
+	procC := startProcess(t, addrC, "-server-id", "c", "-peers", fedA)
+
+	dialAgent(t, addrB, "bot:bob").call(&Packet{Dst: "server"})
+	dialAgent(t, addrC, "bot:carol").call(&Packet{Dst: "server"})
+	alice := dialAgent(t, addrA, "bot:alice")
+	alice.call(&Packet{Dst: "server"})
+
+	query := func() clusterStats {
+		t.Helper()
+		resp := alice.call(&Packet{Id: "cs", Dst: "discover:cluster-stats"})
+		var cs clusterStats
+		if err := json.Unmarshal([]byte(resp.Body), &cs); err != nil {
+			t.Fatalf("decode %q: %v", resp.Body, err)
+		}
+		return cs
+	}
+
+	var cs clusterStats
+	waitFor(t, "b and c to link to a", func() bool {
+		cs = query()
+		return len(cs.Responded) == 3
+	})
+	if want := []string{"bot:alice", "bot:bob", "bot:carol"}; !reflect.DeepEqual(cs.Agents, want) {
+		t.Errorf("agents = %v, want %v", cs.Agents, want)
+	}
+	var sum int64
+	for _, s := range cs.Servers {
+		sum += s.TotalPackets
+	}
+	if cs.TotalPackets != sum || cs.Servers["b"].TotalPackets != 1 || cs.Servers["c"].TotalPackets != 1 {
+		t.Errorf("total_packets %d is not the sum of %+v", cs.TotalPackets, cs.Servers)
+	}
+	if len(cs.Missing) != 0 {
+		t.Errorf("missing = %v, want none", cs.Missing)
+	}
+
+	// A linked peer that never answers is reported missing once the
+	// timeout passes; the others still count.
+	slow, err := net.Dial("tcp", fedA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	if err := wire.WritePacket(slow, &Packet{Src: "slow", Dst: "fed:hello"}); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, slow)
+
+	// A peer that went down is reported missing too.
+	procC.Process.Kill()
+	procC.Wait()
+
+	waitFor(t, "c and slow to be reported missing", func() bool {
+		cs = query()
+		return reflect.DeepEqual(cs.Missing, []string{"c", "slow"})
+	})
+	if want := []string{"a", "b"}; !reflect.DeepEqual(cs.Responded, want) {
+		t.Errorf("responded = %v, want %v", cs.Responded, want)
+	}
+	if want := []string{"bot:alice", "bot:bob"}; !reflect.DeepEqual(cs.Agents, want) {
+		t.Errorf("agents = %v, want %v", cs.Agents, want)
+	}
+}
+
+func TestPeerAuthentication(t *testing.T) {
+	trustedPub, trustedPriv, _ := ed25519.GenerateKey(nil)
+	_, roguePriv, _ := ed25519.GenerateKey(nil)
+	fed := freeAddr(t)
+	s, addr := startServer(t, func(c *Config) {
+		c.ServerID = "hub"
+		c.FederationAddr = fed
+		c.PeerKeys = []string{hex.EncodeToString(trustedPub)}
+	})
+	dialAgent(t, addr, "bot:hub-local").call(&Packet{Dst: "server"})
+	linked := func(name string) bool {
+		s.fedMu.RLock()
+		defer s.fedMu.RUnlock()
+		return s.peers[name] != nil
+	}
+
+	// dialHub opens a federation link to s as server name presenting pk,
+	// and returns it with s's hello.
+	dialHub := func(name string, pk ed25519.PublicKey, challenge string) (net.Conn, *Packet) {
+		t.Helper()
+		conn, err := net.Dial("tcp", fed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		hello, err := wire.ReadPacket(conn)
+		if err != nil || hello.Dst != "fed:hello" || hello.Body == "" {
+			t.Fatalf("hello %v: %v", hello, err)
+		}
+		if err := wire.WritePacket(conn, &Packet{Src: name, Dst: "fed:hello", Body: challenge, Pk: pk}); err != nil {
+			t.Fatal(err)
+		}
+		return conn, hello
+	}
+	expectClosed := func(conn net.Conn) {
+		t.Helper()
+		for {
+			if _, err := wire.ReadPacket(conn); err != nil {
+				if err != io.EOF {
+					t.Fatalf("read: %v, want the hub to hang up", err)
+				}
+				return
+			}
+		}
+	}
+	answer := func(conn net.Conn, name, body string, priv ed25519.PrivateKey) {
+		t.Helper()
+		p := &Packet{Src: name, Dst: "fed:auth", Body: body}
+		wire.Sign(p, priv)
+		if err := wire.WritePacket(conn, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		conn, hello := dialHub("spoke", trustedPub, "c0ffee")
+		auth, err := wire.ReadPacket(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "c0ffee:" + hello.Body + ":spoke"
+		if auth.Dst != "fed:auth" || auth.Src != "hub" || auth.Body != want || !bytes.Equal(auth.Pk, hello.Pk) || wire.Verify(auth) != nil {
+			t.Fatalf("hub's proof %v does not check out", auth)
+		}
+		if linked("spoke") {
+			t.Fatal("linked before proving its key")
+		}
+		answer(conn, "spoke", hello.Body+":c0ffee:hub", trustedPriv)
+		if reg, err := wire.ReadPacket(conn); err != nil || reg.Dst != "fed:register" || reg.Body != "bot:hub-local" {
+			t.Fatalf("gossip %v: %v", reg, err)
+		}
+		waitFor(t, "spoke to link", func() bool { return linked("spoke") })
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		conn, _ := dialHub("rogue", roguePriv.Public().(ed25519.PublicKey), "c0ffee")
+		expectClosed(conn)
+	})
+
+	t.Run("key not proven", func(t *testing.T) {
+		conn, hello := dialHub("impostor", trustedPub, "c0ffee")
+		wire.ReadPacket(conn) // the hub's proof
+		answer(conn, "impostor", hello.Body+":c0ffee:hub", roguePriv)
+		expectClosed(conn)
+	})
+
+	t.Run("bare challenge", func(t *testing.T) {
+		// Signing only the hub's challenge, as a reflected or replayed
+		// proof would, is not enough.
+		conn, hello := dialHub("replayer", trustedPub, "c0ffee")
+		wire.ReadPacket(conn) // the hub's proof
+		answer(conn, "replayer", hello.Body, trustedPriv)
+		expectClosed(conn)
+	})
+
+	t.Run("routes before proof", func(t *testing.T) {
+		conn, _ := dialHub("eager", trustedPub, "")
+		wire.WritePacket(conn, &Packet{Src: "eager", Dst: "fed:register", Body: "bot:hijacked"})
+		expectClosed(conn)
+		s.fedMu.RLock()
+		defer s.fedMu.RUnlock()
+		if s.peerRoutes["bot:hijacked"] != nil {
+			t.Error("unauthenticated peer injected a route")
+		}
+	})
+
+	for _, name := range []string{"rogue", "impostor", "replayer", "eager"} {
+		if linked(name) {
+			t.Errorf("%s linked", name)
+		}
+	}
+}
+
+func TestPeerAuthenticationDialing(t *testing.T) {
+	peerPub, peerPriv, _ := ed25519.GenerateKey(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, addr := startServer(t, func(c *Config) {
+		c.ServerID = "spoke"
+		c.Peers = []string{l.Addr().String()}
+		c.PeerKeys = []string{hex.EncodeToString(peerPub)}
+	})
+	dialAgent(t, addr, "bot:spoke-local").call(&Packet{Dst: "server"})
+
+	// Answer the spoke's link as server "hub".
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	hello, err := wire.ReadPacket(conn)
+	if err != nil || hello.Dst != "fed:hello" || hello.Body == "" {
+		t.Fatalf("hello %v: %v", hello, err)
+	}
+	if err := wire.WritePacket(conn, &Packet{Src: "hub", Dst: "fed:hello", Body: "c0ffee", Pk: peerPub}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The spoke signs nothing for a peer that has not proven its key.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		proof := &Packet{Src: "hub", Dst: "fed:auth", Body: hello.Body + ":c0ffee:spoke"}
+		wire.Sign(proof, peerPriv)
+		wire.WritePacket(conn, proof)
+	}()
+	start := time.Now()
+	auth, err := wire.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("spoke sent %v before the hub proved its key", auth)
+	}
+	if want := "c0ffee:" + hello.Body + ":hub"; auth.Dst != "fed:auth" || auth.Src != "spoke" || auth.Body != want || wire.Verify(auth) != nil {
+		t.Fatalf("spoke's proof %v does not check out", auth)
+	}
+	if reg, err := wire.ReadPacket(conn); err != nil || reg.Dst != "fed:register" || reg.Body != "bot:spoke-local" {
+		t.Fatalf("gossip %v: %v", reg, err)
+	}
+}
+
+func TestFederatedExpiryNack(t *testing.T) {
+	fed := freeAddr(t)
+	_, addr := startServer(t, func(c *Config) {
+		c.ServerID = "hub"
+		c.FederationAddr = fed
+	})
+	alice := dialAgent(t, addr, "bot:hub-alice")
+	alice.call(&Packet{Dst: "server"})
+
+	// Link to the hub as server "spoke", hosting bot:spoke-bob.
+	peer, err := net.Dial("tcp", fed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+	if hello, err := wire.ReadPacket(peer); err != nil || hello.Dst != "fed:hello" {
+		t.Fatalf("hello %v: %v", hello, err)
+	}
+	wire.WritePacket(peer, &Packet{Src: "spoke", Dst: "fed:hello"})
+	if reg, err := wire.ReadPacket(peer); err != nil || reg.Dst != "fed:register" || reg.Body != "bot:hub-alice" {
+		t.Fatalf("gossip %v: %v", reg, err)
+	}
+	wire.WritePacket(peer, &Packet{Src: "spoke", Dst: "fed:register", Body: "bot:spoke-bob"})
+
+	// A packet from bob that expired on its way to alice is refused back
+	// across the link, towards bob's server.
+	_, bobPriv, _ := ed25519.GenerateKey(nil)
+	stale := &Packet{Id: "late", Src: "bot:spoke-bob", Dst: "bot:hub-alice", Channel: "jobs", ExpiresAt: 1}
+	wire.Sign(stale, bobPriv)
+	raw, _ := proto.Marshal(stale)
+	wire.WritePacket(peer, &Packet{Src: "spoke", Dst: "fed:forward", Ttl: MaxFederationHops - 1, Scar: raw})
+	nack, err := wire.ReadPacket(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nack.Dst != "fed:expired" || nack.Body != "bot:spoke-bob" || nack.Id != "late" || nack.Channel != "jobs" || nack.Ttl != MaxFederationHops-1 {
+		t.Fatalf("got %v, want fed:expired for bob's packet", nack)
+	}
+	expectNothing(t, alice)
+
+	// One for alice's packet becomes error:expired on her connection.
+	wire.WritePacket(peer, &Packet{Src: "spoke", Dst: "fed:expired", Id: "m7", Body: "bot:hub-alice", Channel: "ops", Ttl: 3})
+	if resp := alice.recv(); resp.Body != "error:expired" || resp.Id != "m7" || resp.Channel != "ops" {
+		t.Fatalf("alice got %v, want error:expired for m7", resp)
+	}
+}
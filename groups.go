@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Agents join an anycast group by sending a packet to "subscribe:<group>"
+// and leave it with "unsubscribe:<group>" or by disconnecting. A packet to
+// "any:<group>" is delivered to exactly one member: the longest-subscribed
+// member that accepts the write. A member whose write fails is skipped and
+// the next is tried, so delivery follows failures rather than rotating; the
+// sender gets error:offline only when every member has failed. A sender
+// subscribed to the group is not one of its own candidates, and nor is a
+// member the route ACL denies it: one holding no identity the sender may
+// send to. If the ACL denies every member, the sender gets error:forbidden.
+//
+// Groups are local to a server and are not announced to federation peers.
+
+// subscribe adds ci to group. Joining a group twice keeps the first place.
+func (s *Server) subscribe(group string, ci *connInfo) {
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+	for _, m := range s.groups[group] {
+		if m == ci {
+			return
+		}
+	}
+	s.groups[group] = append(s.groups[group], ci)
+}
+
+// unsubscribe removes ci from group.
+func (s *Server) unsubscribe(group string, ci *connInfo) {
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+	s.removeMember(group, ci)
+}
+
+// leaveGroups removes ci from every group, when its connection closes.
+func (s *Server) leaveGroups(ci *connInfo) {
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+	for group := range s.groups {
+		s.removeMember(group, ci)
+	}
+}
+
+// removeMember must be called with groupsMu held.
+func (s *Server) removeMember(group string, ci *connInfo) {
+	members := s.groups[group]
+	for i, m := range members {
+		if m == ci {
+			members = append(members[:i:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(s.groups, group)
+	} else {
+		s.groups[group] = members
+	}
+}
+
+// groupMembers snapshots group's members in join order.
+func (s *Server) groupMembers(group string) []*connInfo {
+	s.groupsMu.RLock()
+	defer s.groupsMu.RUnlock()
+	return append([]*connInfo(nil), s.groups[group]...)
+}
+
+// handleSubscription applies a subscribe:<group> or unsubscribe:<group>
+// packet from c and acknowledges it.
+func (s *Server) handleSubscription(c *connInfo, p *Packet) error {
+	op, group, _ := strings.Cut(p.Dst, ":")
+	if group == "" {
+		return reply(c, p, "error:invalid_group")
+	}
+	if op == "subscribe" {
+		s.subscribe(group, c)
+		s.log.Printf("Subscribed %s to %q", p.Src, group)
+	} else {
+		s.unsubscribe(group, c)
+		s.log.Printf("Unsubscribed %s from %q", p.Src, group)
+	}
+	return reply(c, p, s.serverAck(p, c))
+}
+
+// memberAllowed reports whether the route ACL lets src send to one of the
+// identities m holds.
+func (s *Server) memberAllowed(src string, m *connInfo) bool {
+	if s.acl.Load() == nil {
+		return true
+	}
+	s.routeMu.RLock()
+	defer s.routeMu.RUnlock()
+	for identity := range s.connSrc[m] {
+		if s.routeAllowed(src, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeAnycast delivers an any:<group> packet from c to the first group
+// member that takes it, replying error:offline if none does. The sender's
+// own connection and members the route ACL denies it are passed over, the
+// first unless -allow-self-route is set; if the ACL denies every member the
+// reply is error:forbidden. Members whose max_packet_size p exceeds are
+// passed over too, and if that leaves none the reply is error:dst_too_large.
+// A packet that expires while it waits for a member is dropped as expired.
+func (s *Server) routeAnycast(c *connInfo, p *Packet, received time.Time) error {
+	group := strings.TrimPrefix(p.Dst, "any:")
+	var allowed, denied, tooLarge int
+	for _, m := range s.groupMembers(group) {
+		if m == c && !s.cfg.AllowSelfRoute {
+			continue
+		}
+		if !s.memberAllowed(p.Src, m) {
+			denied++
+			continue
+		}
+		allowed++
+		err := s.forward(m, p)
+		if errors.Is(err, errExpired) {
+			return s.dropExpired(c, p, received)
+		}
+		if errors.Is(err, errDstTooLarge) {
+			tooLarge++
+		}
+		if err != nil {
+			s.log.Printf("Route %s -> %s: member %s failed, trying next: %v", p.Src, p.Dst, m.addr, err)
+			continue
+		}
+		s.routeLatencyLocal.observe(time.Since(received))
+		s.routedPackets.Add(1)
+		s.auditRecord(p, outcomeRouted, true)
+		if s.routeLog.ok() {
+			s.log.Printf("Routed %s -> %s via %s", p.Src, p.Dst, m.addr)
+		}
+		return nil
+	}
+
+	if denied > 0 && allowed == 0 {
+		s.aclDenied.Add(1)
+		s.auditRecord(p, outcomeRejected, true)
+		s.log.Printf("REJECTED error:forbidden from %s (src=%s dst=%s): every member denied by ACL", c.addr, p.Src, p.Dst)
+		if err := reply(c, p, "error:forbidden"); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		return nil
+	}
+	if tooLarge > 0 {
+		return s.rejectDstTooLarge(c, p, p.Dst)
+	}
+	s.offlinePackets.Add(1)
+	s.auditRecord(p, outcomeOffline, true)
+	if err := reply(c, p, "error:offline"); err != nil {
+		s.log.Printf("Write error to %s: %v", c.addr, err)
+		return err
+	}
+	s.log.Printf("Route %s -> %s: no member took it", p.Src, p.Dst)
+	return nil
+}
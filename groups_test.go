@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// deadMember subscribes a connection whose peer is gone, so every write to
+// it fails, to group.
+func deadMember(t *testing.T, s *Server, group string) {
+	t.Helper()
+	a, b := net.Pipe()
+	b.Close()
+	t.Cleanup(func() { a.Close() })
+	s.subscribe(group, s.newConnInfo(a))
+}
+
+func TestAnycastFirstAvailable(t *testing.T) {
+	_, addr := startServer(t)
+
+	w1 := dialAgent(t, addr, "bot:worker-1")
+	w2 := dialAgent(t, addr, "bot:worker-2")
+	for _, w := range []*testAgent{w1, w2} {
+		if resp := w.call(&Packet{Dst: "subscribe:jobs"}); status(resp) != "done" {
+			t.Fatalf("%s subscribe: got %q", w.src, resp.Body)
+		}
+	}
+	client := dialAgent(t, addr, "bot:boss")
+
+	// No rotation: while the first member takes writes, it gets everything.
+	for i := 0; i < 3; i++ {
+		client.send(&Packet{Dst: "any:jobs", Body: "job"})
+		if got := w1.recv(); got.Body != "job" || wire.Verify(got) != nil {
+			t.Fatalf("first member got %v", got)
+		}
+	}
+	expectNothing(t, w2)
+
+	// After leaving, the next member takes over.
+	w1.call(&Packet{Dst: "unsubscribe:jobs"})
+	client.send(&Packet{Dst: "any:jobs", Body: "next"})
+	if got := w2.recv(); got.Body != "next" {
+		t.Fatalf("second member got %v", got)
+	}
+	expectNothing(t, w1)
+}
+
+func TestAnycastSkipsDeadMember(t *testing.T) {
+	s, addr := startServer(t)
+
+	deadMember(t, s, "jobs")
+	w := dialAgent(t, addr, "bot:worker")
+	w.call(&Packet{Dst: "subscribe:jobs"})
+	client := dialAgent(t, addr, "bot:boss")
+
+	client.send(&Packet{Dst: "any:jobs", Body: "job"})
+	if got := w.recv(); got.Body != "job" {
+		t.Fatalf("live member got %v", got)
+	}
+	expectNothing(t, client)
+}
+
+func TestAnycastExhausted(t *testing.T) {
+	s, addr := startServer(t)
+	deadMember(t, s, "jobs")
+	deadMember(t, s, "jobs")
+	client := dialAgent(t, addr, "bot:boss")
+
+	for _, dst := range []string{"any:jobs", "any:nobody"} {
+		if resp := client.call(&Packet{Id: "j", Dst: dst}); resp.Body != "error:offline" || resp.Id != "j" {
+			t.Errorf("%s: got %q (id %q), want error:offline", dst, resp.Body, resp.Id)
+		}
+	}
+	if resp := client.call(&Packet{Dst: "subscribe:"}); resp.Body != "error:invalid_group" {
+		t.Errorf("empty group: got %q", resp.Body)
+	}
+}
+
+func TestGroupsForgetClosedConnections(t *testing.T) {
+	s, addr := startServer(t)
+	w := dialAgent(t, addr, "bot:worker")
+	w.call(&Packet{Dst: "subscribe:jobs"})
+	w.call(&Packet{Dst: "subscribe:other"})
+	w.conn.Close()
+
+	waitFor(t, "groups to empty", func() bool {
+		s.groupsMu.RLock()
+		defer s.groupsMu.RUnlock()
+		return len(s.groups) == 0
+	})
+}
+
+func TestAnycastSkipsSender(t *testing.T) {
+	_, addr := startServer(t)
+
+	// The sender subscribed first, so it would be the member chosen.
+	client := dialAgent(t, addr, "bot:self-boss")
+	client.call(&Packet{Dst: "subscribe:self-jobs"})
+	w := dialAgent(t, addr, "bot:self-worker")
+	w.call(&Packet{Dst: "subscribe:self-jobs"})
+
+	client.send(&Packet{Dst: "any:self-jobs", Body: "job"})
+	if got := w.recv(); got.Body != "job" {
+		t.Fatalf("member got %v", got)
+	}
+	expectNothing(t, client)
+
+	// Alone in the group, the sender finds no one.
+	w.call(&Packet{Dst: "unsubscribe:self-jobs"})
+	if resp := client.call(&Packet{Dst: "any:self-jobs"}); resp.Body != "error:offline" {
+		t.Fatalf("sender alone: got %q, want error:offline", resp.Body)
+	}
+}
+
+func TestAnycastExpiresWhileQueued(t *testing.T) {
+	s, addr := startServer(t)
+
+	// A pipe-backed member: the first packet's write blocks until we read.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	s.subscribe("slow-jobs", s.newConnInfo(srv))
+	deadMember(t, s, "slow-jobs") // would take the packet if it moved on
+	first := dialAgent(t, addr, "bot:slow-first")
+	late := dialAgent(t, addr, "bot:slow-late")
+
+	first.send(&Packet{Dst: "any:slow-jobs", Body: "one"})
+	time.Sleep(50 * time.Millisecond)
+	late.send(&Packet{Id: "e", Dst: "any:slow-jobs", ExpiresAt: uint64(time.Now().Add(100 * time.Millisecond).UnixMilli())})
+	time.Sleep(200 * time.Millisecond)
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if p, err := wire.ReadPacket(cli); err != nil || p.Body != "one" {
+		t.Fatalf("member got %v, %v", p, err)
+	}
+	if resp := late.recv(); resp.Id != "e" || resp.Body != "error:expired" {
+		t.Fatalf("got %q, want error:expired", resp.Body)
+	}
+}
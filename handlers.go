@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// handlerCheckInterval is how often -handler-leak-threshold is checked.
+const handlerCheckInterval = 10 * time.Second
+
+// openConns counts the connections with a running handler whose socket is
+// still open. A handler normally returns soon after its connection closes,
+// so the gap between liveHandlers and openConns is handlers still cleaning
+// up; one that stays wide is handlers stuck there, leaked goroutines.
+func (s *Server) openConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for conn := range s.conns {
+		if connOpen(conn) {
+			n++
+		}
+	}
+	return n
+}
+
+// connOpen reports whether conn has not been closed. Connections without a
+// file descriptor, such as net.Pipe, count as open.
+func connOpen(conn net.Conn) bool {
+	sc, ok := netConn(conn).(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	// Control fails once the descriptor is closed.
+	return rc.Control(func(uintptr) {}) == nil
+}
+
+// watchHandlers runs checkHandlers every handlerCheckInterval until the
+// server closes.
+func (s *Server) watchHandlers() {
+	ticker := time.NewTicker(handlerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkHandlers()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// checkHandlers logs when connection handlers outnumber open connections by
+// more than -handler-leak-threshold, and again once they no longer do.
+func (s *Server) checkHandlers() {
+	handlers, open := s.liveHandlers.Load(), int64(s.openConns())
+	over := handlers-open > int64(s.cfg.HandlerLeakThreshold)
+	if over == s.handlerLeak.Swap(over) {
+		return
+	}
+	if over {
+		s.handlerLeakAlerts.Add(1)
+		s.log.Printf("Possible goroutine leak: %d connection handlers running for %d open connections", handlers, open)
+	} else {
+		s.log.Printf("Connection handlers back in line: %d running for %d open connections", handlers, open)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHandlerLeakDetection(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.HandlerLeakThreshold = 1
+	})
+	logs := captureLog(t, s)
+	counts := func() (handlers, open int64) {
+		st := s.localStats(false)
+		return st.Handlers, st.OpenConns
+	}
+
+	for _, id := range []string{"bot:leak-a", "bot:leak-b", "bot:leak-c"} {
+		dialAgent(t, addr, id).call(&Packet{Dst: "server"})
+	}
+	if h, o := counts(); h != 3 || o != 3 {
+		t.Fatalf("handlers %d, open %d; want 3 and 3", h, o)
+	}
+	s.checkHandlers()
+
+	// Close every connection while its handler can't finish cleaning up:
+	// leaving groups needs the groups lock.
+	s.groupsMu.Lock()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	if h, o := counts(); h != 3 || o != 0 {
+		s.groupsMu.Unlock()
+		t.Fatalf("stuck: handlers %d, open %d; want 3 and 0", h, o)
+	}
+	s.checkHandlers()
+	s.checkHandlers() // still over: not logged again
+	var m strings.Builder
+	s.writeMetrics(&m)
+	s.groupsMu.Unlock()
+
+	for _, want := range []string{"keep_connection_handlers 3\n", "keep_open_connections 0\n", "keep_handler_leak_alerts_total 1\n"} {
+		if !strings.Contains(m.String(), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if n := strings.Count(logs.String(), "Possible goroutine leak: 3 connection handlers running for 0 open connections"); n != 1 {
+		t.Errorf("logged the leak %d times, want once", n)
+	}
+
+	// Released, the handlers return and the counts agree again.
+	waitFor(t, "handlers to return", func() bool { h, _ := counts(); return h == 0 })
+	s.checkHandlers()
+	if !strings.Contains(logs.String(), "Connection handlers back in line: 0 running for 0 open connections") {
+		t.Error("recovery not logged")
+	}
+}
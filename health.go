@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discover:health answers with one composite view of how the server is
+// doing, for dashboards that want a single signal rather than a dozen
+// metrics. Each signal is compared with a degraded and an unhealthy
+// threshold (-health-thresholds); the status is the worst any of them
+// reaches, and unhealthy whenever /readyz would fail. Everything is read from
+// counters and queues the server keeps anyway, so a query costs a walk over
+// the registered connections and nothing else.
+//
+// The error rate is the share of packets answered with an error or dropped
+// unverified, over the last one to two -health-window periods: the count
+// starts again from the latest whole window, so it reflects recent trouble
+// without swinging on a single packet.
+
+// Health statuses, from best to worst.
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// Health signals -health-thresholds can name.
+const (
+	signalErrorRate     = "error_rate"
+	signalQueued        = "queued"
+	signalSlowConsumers = "slow_consumers"
+	signalGoroutines    = "goroutines_per_conn"
+)
+
+// healthThreshold is when a signal makes the server degraded or unhealthy.
+type healthThreshold struct {
+	degraded, unhealthy float64
+}
+
+// defaultHealthThresholds apply to signals -health-thresholds leaves out.
+var defaultHealthThresholds = map[string]healthThreshold{
+	signalErrorRate:     {0.05, 0.25},
+	signalQueued:        {1000, 10000},
+	signalSlowConsumers: {5, 50},
+	signalGoroutines:    {50, 200},
+}
+
+// parseHealthThresholds parses -health-thresholds entries of the form
+// signal=degraded:unhealthy over the defaults.
+func parseHealthThresholds(list []string) (map[string]healthThreshold, error) {
+	thresholds := make(map[string]healthThreshold, len(defaultHealthThresholds))
+	for signal, t := range defaultHealthThresholds {
+		thresholds[signal] = t
+	}
+	for _, item := range list {
+		signal, levels, ok := strings.Cut(item, "=")
+		d, u, ok2 := strings.Cut(levels, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("%q: want signal=degraded:unhealthy", item)
+		}
+		if _, known := defaultHealthThresholds[signal]; !known {
+			return nil, fmt.Errorf("%q: unknown signal %q", item, signal)
+		}
+		degraded, err1 := strconv.ParseFloat(d, 64)
+		unhealthy, err2 := strconv.ParseFloat(u, 64)
+		if err1 != nil || err2 != nil || degraded <= 0 || unhealthy < degraded {
+			return nil, fmt.Errorf("%q: thresholds must be numbers with 0 < degraded <= unhealthy", item)
+		}
+		thresholds[signal] = healthThreshold{degraded, unhealthy}
+	}
+	return thresholds, nil
+}
+
+// healthSample is the packet and error counts at one time.
+type healthSample struct {
+	at              time.Time
+	packets, errors int64
+}
+
+// healthState is what discover:health keeps between queries.
+type healthState struct {
+	thresholds map[string]healthThreshold
+
+	mu        sync.Mutex
+	prev, cur healthSample // the error rate is measured from prev
+}
+
+// healthReport is the discover:health reply.
+type healthReport struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"` // the signals past a threshold, worst first
+	Ready   bool     `json:"ready"`
+
+	ErrorRate     float64 `json:"error_rate"`
+	Packets       int64   `json:"packets"` // in the error rate's period
+	Errors        int64   `json:"errors"`
+	PeriodSeconds float64 `json:"period_seconds"`
+
+	Queued        int `json:"queued"`         // forwards waiting for a connection, and packets in the fair queue
+	DeepestQueue  int `json:"deepest_queue"`  // forwards waiting for the busiest connection
+	SlowConsumers int `json:"slow_consumers"` // connections with a slow write in the last -health-window
+
+	Goroutines        int     `json:"goroutines"`
+	Connections       int     `json:"connections"`
+	GoroutinesPerConn float64 `json:"goroutines_per_conn"`
+}
+
+// healthErrors is the count of packets refused with an error or dropped.
+func (s *Server) healthErrors() int64 {
+	return s.errorReplies.Load() + s.droppedUnsigned.Load() + s.droppedInvalidSig.Load()
+}
+
+// errorRate returns the packets and errors since the start of the error
+// rate's period, and how long it has run, starting a new period once the
+// current one is a -health-window old.
+func (s *Server) errorRate(now time.Time) (packets, errors int64, period time.Duration) {
+	sample := healthSample{at: now, packets: s.totalPackets.Load(), errors: s.healthErrors()}
+	h := &s.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.cur.at) >= s.cfg.HealthWindow {
+		h.prev, h.cur = h.cur, sample
+	}
+	return sample.packets - h.prev.packets, sample.errors - h.prev.errors, now.Sub(h.prev.at)
+}
+
+// healthBody is the discover:health reply.
+func (s *Server) healthBody() (string, error) {
+	now := time.Now()
+	notReady := s.notReady()
+	r := healthReport{Ready: notReady == ""}
+	var period time.Duration
+	r.Packets, r.Errors, period = s.errorRate(now)
+	r.PeriodSeconds = period.Seconds()
+	if r.Packets > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Packets)
+	}
+
+	since := now.Add(-s.cfg.HealthWindow).UnixNano()
+	s.routeMu.RLock()
+	for ci := range s.connSrc {
+		n := ci.sendQ.depth()
+		r.Queued += n
+		r.DeepestQueue = max(r.DeepestQueue, n)
+		if ci.lastSlow.Load() > since {
+			r.SlowConsumers++
+		}
+	}
+	s.routeMu.RUnlock()
+	if s.fair != nil {
+		r.Queued += s.fair.queued()
+	}
+
+	r.Goroutines = runtime.NumGoroutine()
+	r.Connections = s.openConns()
+	r.GoroutinesPerConn = float64(r.Goroutines) / float64(max(r.Connections, 1))
+
+	r.Status = healthOK
+	if !r.Ready {
+		r.Status = healthUnhealthy
+		r.Reasons = append(r.Reasons, "not ready: "+notReady)
+	}
+	for _, sig := range []struct {
+		name  string
+		value float64
+	}{
+		{signalErrorRate, r.ErrorRate},
+		{signalQueued, float64(r.Queued)},
+		{signalSlowConsumers, float64(r.SlowConsumers)},
+		{signalGoroutines, r.GoroutinesPerConn},
+	} {
+		t := s.health.thresholds[sig.name]
+		switch {
+		case sig.value >= t.unhealthy:
+			r.Status = healthUnhealthy
+			r.Reasons = append([]string{fmt.Sprintf("%s %.4g >= %g", sig.name, sig.value, t.unhealthy)}, r.Reasons...)
+		case sig.value >= t.degraded:
+			if r.Status == healthOK {
+				r.Status = healthDegraded
+			}
+			r.Reasons = append(r.Reasons, fmt.Sprintf("%s %.4g >= %g", sig.name, sig.value, t.degraded))
+		}
+	}
+	return marshalDiscovery(r)
+}
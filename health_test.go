@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHealthDegradesOnErrors(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) {
+		// Only the error rate decides, however many goroutines the test
+		// binary has running.
+		c.HealthThresholds = []string{"error_rate=0.2:0.95", "goroutines_per_conn=1e6:1e6"}
+	})
+	a := dialAgent(t, addr, "bot:health")
+	a.call(&Packet{Dst: "server"})
+
+	health := func() healthReport {
+		t.Helper()
+		var r healthReport
+		resp := a.call(&Packet{Dst: "discover:health"})
+		if err := json.Unmarshal([]byte(resp.Body), &r); err != nil || r.Status == "" {
+			t.Fatalf("got %q", resp.Body)
+		}
+		return r
+	}
+	if r := health(); r.Status != healthOK || !r.Ready || r.Errors != 0 || r.Connections != 1 {
+		t.Fatalf("idle server: %+v", r)
+	}
+
+	// Packets to oneself are refused with error:self_route.
+	for range 10 {
+		if resp := a.call(&Packet{Dst: "bot:health"}); resp.Body != "error:self_route" {
+			t.Fatalf("got %q", resp.Body)
+		}
+	}
+	r := health()
+	if r.Status != healthDegraded || r.Errors != 10 || r.ErrorRate < 0.2 || r.ErrorRate >= 0.95 {
+		t.Fatalf("after errors: %+v", r)
+	}
+	if len(r.Reasons) != 1 || !strings.HasPrefix(r.Reasons[0], "error_rate ") {
+		t.Fatalf("reasons %q", r.Reasons)
+	}
+}
+
+func TestParseHealthThresholds(t *testing.T) {
+	got, err := parseHealthThresholds([]string{"queued=10:20"})
+	if err != nil || got[signalQueued] != (healthThreshold{10, 20}) || got[signalErrorRate] != defaultHealthThresholds[signalErrorRate] {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	for _, bad := range []string{"queued", "queued=10", "queued=x:20", "queued=20:10", "queued=0:10", "latency=1:2"} {
+		if _, err := parseHealthThresholds([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
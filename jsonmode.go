@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// A JSON listener (-json-listen, ServeJSON) speaks the protocol as text so it
+// can be driven with nc or telnet while developing: each packet is one line
+// holding the JSON form of a Packet (packetJSON, as printed by `keep verify`),
+// with sig, pk and scar hex-encoded. Blank lines are ignored. Everything else
+// is unchanged; in particular packets must still be signed, for example with
+// `keep sign -line`.
+
+// jsonLineMax bounds a JSON line. Hex doubles the byte fields, and escaping
+// can grow the strings, so it is well above wire.MaxPacketSize.
+const jsonLineMax = 4 * wire.MaxPacketSize
+
+func newLineScanner(conn net.Conn) *bufio.Scanner {
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 0, 4096), jsonLineMax)
+	return sc
+}
+
+// recvJSON reads the next packet from a JSON connection.
+func (ci *connInfo) recvJSON() (*Packet, error) {
+	for ci.lines.Scan() {
+		line := ci.lines.Bytes()
+		ci.bytesIn.Add(int64(len(line) + 1))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		p, err := decodeJSONLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", wire.ErrMalformedFrame, err)
+		}
+		return p, nil
+	}
+	if err := ci.lines.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("%w: JSON line over %d bytes", wire.ErrPacketTooLarge, jsonLineMax)
+		}
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// decodeJSONLine parses one line of a JSON connection. Unknown fields are
+// errors, so a misspelled field name is caught rather than signed around.
+func decodeJSONLine(line []byte) (*Packet, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	var j packetJSON
+	if err := dec.Decode(&j); err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+	return j.toPacket()
+}
+
+// encodeJSONLine returns p as a line for a JSON connection.
+func encodeJSONLine(p *Packet) ([]byte, error) {
+	return jsonLine(packetToJSON(p))
+}
+
+// jsonLine marshals j as a line.
+func jsonLine(j packetJSON) ([]byte, error) {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// jsonAgent is a client of a JSON listener.
+type jsonAgent struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	src  string
+	priv ed25519.PrivateKey
+}
+
+func dialJSON(t *testing.T, addr, src string) *jsonAgent {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, priv, _ := ed25519.GenerateKey(nil)
+	return &jsonAgent{t: t, conn: conn, r: bufio.NewReader(conn), src: src, priv: priv}
+}
+
+func (a *jsonAgent) send(p *Packet) {
+	a.t.Helper()
+	if p.Src == "" {
+		p.Src = a.src
+	}
+	if err := wire.Sign(p, a.priv); err != nil {
+		a.t.Fatal(err)
+	}
+	line, err := encodeJSONLine(p)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if _, err := a.conn.Write(line); err != nil {
+		a.t.Fatalf("send: %v", err)
+	}
+}
+
+func (a *jsonAgent) recv() *Packet {
+	a.t.Helper()
+	a.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := a.r.ReadBytes('\n')
+	if err != nil {
+		a.t.Fatalf("recv: %v", err)
+	}
+	p, err := decodeJSONLine(line)
+	if err != nil {
+		a.t.Fatalf("recv %q: %v", line, err)
+	}
+	return p
+}
+
+func (a *jsonAgent) call(p *Packet) *Packet {
+	a.t.Helper()
+	a.send(p)
+	return a.recv()
+}
+
+func TestJSONListener(t *testing.T) {
+	s, addr := startServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeJSON(l)
+	jsonAddr := l.Addr().String()
+
+	// Register, then route both ways with a protobuf agent.
+	j := dialJSON(t, jsonAddr, "bot:json")
+	if resp := j.call(&Packet{Id: "r1", Dst: "server", Typ: TypeRegister}); status(resp) != "done" {
+		t.Fatalf("register: got %q", resp.Body)
+	}
+	if !registered(s, "bot:json") {
+		t.Fatal("JSON agent not registered")
+	}
+	b := dialAgent(t, addr, "bot:binary")
+	b.call(&Packet{Dst: "server"})
+
+	j.send(&Packet{Dst: "bot:binary", Body: "from text", Scar: []byte{0xbe, 0xef}, Tags: map[string]string{"k": "v"}})
+	if got := b.recv(); got.Body != "from text" || string(got.Scar) != "\xbe\xef" || got.Tags["k"] != "v" || wire.Verify(got) != nil {
+		t.Fatalf("binary agent got %v", got)
+	}
+	b.send(&Packet{Dst: "bot:json", Body: "from frames"})
+	if got := j.recv(); got.Body != "from frames" || got.Src != "bot:binary" || wire.Verify(got) != nil {
+		t.Fatalf("JSON agent got %v", got)
+	}
+
+	// Discovery, with a blank line first as a telnet user might send.
+	j.conn.Write([]byte("\r\n"))
+	if resp := j.call(&Packet{Id: "d1", Dst: "discover:info"}); resp.Id != "d1" || !strings.Contains(resp.Body, `"version"`) {
+		t.Fatalf("discover:info: got %v", resp)
+	}
+
+	// A line from `keep sign -line` works as is.
+	base := filepath.Join(t.TempDir(), "k")
+	run(t, "", "keygen", "-out", base)
+	line, code := run(t, "", "sign", "-key", base+".key", "-src", "bot:cli", "-dst", "bot:binary", "-body", "signed by the CLI", "-line")
+	if code != 0 {
+		t.Fatalf("sign -line: %s", line)
+	}
+	cli := dialJSON(t, jsonAddr, "bot:cli")
+	cli.conn.Write([]byte(line))
+	if got := b.recv(); got.Body != "signed by the CLI" {
+		t.Fatalf("binary agent got %v", got)
+	}
+
+	// Signatures are still required.
+	unsigned := dialJSON(t, jsonAddr, "bot:unsigned")
+	unsigned.conn.Write([]byte(`{"src":"bot:unsigned","dst":"bot:binary","body":"no sig"}` + "\n"))
+	expectNothing(t, b)
+
+	// A misspelled field is an error, not a silently empty one.
+	typo := dialJSON(t, jsonAddr, "bot:typo")
+	typo.conn.Write([]byte(`{"src":"bot:typo","dts":"bot:binary"}` + "\n"))
+	typo.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := typo.r.ReadBytes('\n'); err != nil || !bytes.Contains(line, []byte(`"body":"protocol_error"`)) {
+		t.Fatalf("got %q, %v; want a protocol_error close notice", line, err)
+	}
+	if _, err := typo.r.ReadBytes('\n'); err == nil {
+		t.Fatal("connection survived a line with an unknown field")
+	}
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"crypto/ed25519"
-	"encoding/binary"
-	"fmt"
 	"io"
 	"log"
 	"net"
@@ -13,11 +11,10 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/teacrawford/keep-protocol/wire"
 	"google.golang.org/protobuf/proto"
 )
 
-const MaxPacketSize = 65536
-
 var (
 	agents  = make(map[string]net.Conn) // "bot:weather" -> conn
 	connSrc = make(map[net.Conn]string) // conn -> "bot:weather" (reverse)
@@ -52,67 +49,17 @@ func unregisterConn(conn net.Conn) {
 	}
 }
 
-// readPacket reads a length-prefixed protobuf Packet from conn.
-// Wire format: [4 bytes big-endian uint32 length][length bytes protobuf].
-func readPacket(conn net.Conn) (*Packet, error) {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
-		return nil, err
-	}
-	msgLen := binary.BigEndian.Uint32(lenBuf[:])
-
-	if msgLen == 0 {
-		return nil, fmt.Errorf("zero-length packet")
-	}
-	if msgLen > MaxPacketSize {
-		return nil, fmt.Errorf("packet too large: %d > %d", msgLen, MaxPacketSize)
-	}
-
-	payload := make([]byte, msgLen)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return nil, err
-	}
-
-	var p Packet
-	if err := proto.Unmarshal(payload, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal: %w", err)
-	}
-	return &p, nil
-}
-
-// writePacket serializes a Packet with a 4-byte big-endian length prefix and writes it to conn.
-func writePacket(conn net.Conn, p *Packet) error {
-	data, err := proto.Marshal(p)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
-	}
-	if len(data) > MaxPacketSize {
-		return fmt.Errorf("packet too large: %d > %d", len(data), MaxPacketSize)
-	}
-
-	var lenBuf [4]byte
-	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
-
-	if _, err := conn.Write(lenBuf[:]); err != nil {
-		return err
-	}
-	if _, err := conn.Write(data); err != nil {
-		return err
-	}
-	return nil
-}
-
 func heartbeat() {
 	ticker := time.NewTicker(60 * time.Second)
 	defer ticker.Stop()
 	for range ticker.C {
-		hb := &Packet{
-			Typ: 2,
+		hb := &wire.Packet{
+			Typ: uint32(wire.PacketType_PACKET_TYPE_HEARTBEAT),
 			Src: "server",
 		}
 		routeMu.Lock()
 		for identity, conn := range agents {
-			if err := writePacket(conn, hb); err != nil {
+			if err := wire.WritePacket(conn, hb); err != nil {
 				log.Printf("Heartbeat fail %s: %v", identity, err)
 				delete(connSrc, conn)
 				delete(agents, identity)
@@ -125,7 +72,7 @@ func heartbeat() {
 
 // verifySig checks the ed25519 signature on a Packet.
 // The signed payload is the Packet with sig and pk zeroed out, then serialized.
-func verifySig(p *Packet) bool {
+func verifySig(p *wire.Packet) bool {
 	if len(p.Sig) == 0 || len(p.Pk) == 0 {
 		return false // unsigned packet
 	}
@@ -140,7 +87,7 @@ func verifySig(p *Packet) bool {
 
 	// Reconstruct the exact bytes that were signed:
 	// a copy of the packet with sig and pk cleared.
-	signCopy := &Packet{
+	signCopy := &wire.Packet{
 		Typ:  p.Typ,
 		Id:   p.Id,
 		Src:  p.Src,
@@ -166,7 +113,7 @@ func handleConnection(c net.Conn) {
 	defer unregisterConn(c)
 
 	for {
-		p, err := readPacket(c)
+		p, err := wire.ReadPacket(c)
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("Read error from %s: %v", addr, err)
@@ -196,13 +143,13 @@ func handleConnection(c net.Conn) {
 		switch {
 		case p.Dst == "server" || p.Dst == "":
 			// Backward compatible: reply "done"
-			resp := &Packet{
+			resp := &wire.Packet{
 				Id:   p.Id,
-				Typ:  1,
+				Typ:  uint32(wire.PacketType_PACKET_TYPE_REPLY),
 				Src:  "server",
 				Body: "done",
 			}
-			if err := writePacket(c, resp); err != nil {
+			if err := wire.WritePacket(c, resp); err != nil {
 				log.Printf("Write error to %s: %v", addr, err)
 				return
 			}
@@ -214,13 +161,13 @@ func handleConnection(c net.Conn) {
 			routeMu.RUnlock()
 
 			if !exists {
-				resp := &Packet{
+				resp := &wire.Packet{
 					Id:   p.Id,
-					Typ:  1,
+					Typ:  uint32(wire.PacketType_PACKET_TYPE_REPLY),
 					Src:  "server",
 					Body: "error:offline",
 				}
-				if err := writePacket(c, resp); err != nil {
+				if err := wire.WritePacket(c, resp); err != nil {
 					log.Printf("Write error to %s: %v", addr, err)
 					return
 				}
@@ -229,14 +176,14 @@ func handleConnection(c net.Conn) {
 			}
 
 			// Forward original signed packet (preserving signature)
-			if err := writePacket(target, p); err != nil {
-				resp := &Packet{
+			if err := wire.WritePacket(target, p); err != nil {
+				resp := &wire.Packet{
 					Id:   p.Id,
-					Typ:  1,
+					Typ:  uint32(wire.PacketType_PACKET_TYPE_REPLY),
 					Src:  "server",
 					Body: "error:delivery_failed",
 				}
-				if writeErr := writePacket(c, resp); writeErr != nil {
+				if writeErr := wire.WritePacket(c, resp); writeErr != nil {
 					log.Printf("Write error to %s: %v", addr, writeErr)
 					return
 				}
@@ -1,370 +1,2079 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/ed25519"
-	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
 const (
-	MaxPacketSize = 65536
-	ServerVersion = "0.5.0"
+	ServerVersion  = "0.5.0"
 	MaxScarEntries = 1000
+
+	// ReregisterGrace bounds how long a connection displaced by
+	// re-registration may finish an in-flight write before it is closed.
+	ReregisterGrace = 2 * time.Second
 )
 
-var (
-	agents  = make(map[string]net.Conn) // "bot:weather" -> conn
-	connSrc = make(map[net.Conn]string) // conn -> "bot:weather" (reverse)
-	routeMu sync.RWMutex
+// Packet is the protocol message, generated from keep.proto into package
+// wire, which holds the framing and signature code shared with the clawhub
+// build.
+type Packet = wire.Packet
+
+// Packet typ values, as uint32 to compare with and assign to Packet.Typ.
+// They are the PacketType enum in keep.proto, whose numbers are fixed by
+// what clients already send and expect.
+const (
+	// TypeData is an ordinary packet, routed by its dst.
+	TypeData = uint32(wire.PacketType_PACKET_TYPE_DATA)
+
+	// TypeReply is a server reply: an acknowledgement, an error or a
+	// discovery answer.
+	TypeReply = uint32(wire.PacketType_PACKET_TYPE_REPLY)
+
+	// TypeHeartbeat is the liveness probe the server sends registered
+	// agents every -heartbeat-interval.
+	TypeHeartbeat = uint32(wire.PacketType_PACKET_TYPE_HEARTBEAT)
 
-	// Server metrics
-	serverStart  time.Time
-	totalPackets atomic.Int64
+	// TypeGoodbye announces that the sender is closing the connection.
+	// Either side may send it; the receiver tears down without treating
+	// the disconnect as an error.
+	TypeGoodbye = uint32(wire.PacketType_PACKET_TYPE_GOODBYE)
 
-	// Scar/barter tracking
-	scarCount   = make(map[string]int64) // src -> count of scar-bearing packets
-	scarCountMu sync.Mutex
+	// TypePong answers a heartbeat. With -pong-misses set, a connection
+	// that leaves that many heartbeats in a row unanswered is closed.
+	TypePong = uint32(wire.PacketType_PACKET_TYPE_PONG)
+
+	// TypeRegister marks a packet whose purpose is to register its src.
+	// With -require-registration, a connection's first packet must be one;
+	// otherwise it is routed like any other.
+	TypeRegister = uint32(wire.PacketType_PACKET_TYPE_REGISTER)
+
+	// TypeDirective is a configuration directive the server pushes to
+	// agents at an operator's request; see directive.go. Clients may not
+	// send it.
+	TypeDirective = uint32(wire.PacketType_PACKET_TYPE_DIRECTIVE)
 )
 
-// registerConn registers a connection under the given agent identity.
-// Last-write-wins: if the identity is already registered, the old connection is closed.
-func registerConn(identity string, conn net.Conn) {
-	routeMu.Lock()
-	defer routeMu.Unlock()
+// Config holds runtime settings, populated from command-line flags.
+type Config struct {
+	ListenAddr    string
+	ReusePort     bool   // set SO_REUSEPORT so several processes can share ListenAddr
+	ListenBacklog int    // accept queue length; 0 keeps the system default
+	ProxyProtocol bool   // TCP protocol connections open with a PROXY v1/v2 header naming the client
+	ServerID      string // names this server to federation peers
+	ReplySrc      string // src of every packet the server originates; reserved from registration
+
+	ReadCap     int    // largest frame read from TCP clients; 0 means wire.MaxPacketSize
+	UnixPath    string // also accept protocol connections on this Unix socket; empty disables
+	UnixReadCap int    // largest frame read from Unix socket clients; 0 means wire.MaxPacketSize
+
+	// Drop unsigned packets from TCP or Unix socket clients. With one off,
+	// that listener is trusted: its unsigned packets are routed unverified.
+	RequireSignature     bool
+	UnixRequireSignature bool
+
+	JSONAddr string // also accept line-delimited JSON connections here, for debugging; empty disables
+
+	HeartbeatInterval time.Duration // how often registered agents get a typ 2 heartbeat
+	PongMisses        int           // close agents that miss this many pongs in a row; 0 disables
+	ServerKeyPath     string        // key file from `keep keygen`; empty uses an ephemeral key
+
+	AdminKeys []string // hex ed25519 public keys allowed admin-only queries
+
+	FederationAddr string   // accept peer links here; empty disables
+	Peers          []string // federation addresses of peers to link to
+	PeerKeys       []string // hex ed25519 server keys allowed to link; empty accepts any peer
+	RingVnodes     int      // > 0 enables consistent-hash routing with this many points per server
+
+	ClusterStatsTimeout time.Duration // how long discover:cluster-stats waits for peers
+
+	DiscoverCacheTTL time.Duration // serve discover:info/agents/stats replies up to this old; 0 disables
+	DiscoverRate     int           // discovery queries allowed per source per second; 0 means no limit
+
+	MetricsAddr string // serve Prometheus metrics over HTTP here; empty disables
+	AdminAddr   string // serve metrics, probes, pprof and admin commands over HTTP here (see admin.go); empty disables
+	AdminToken  string // bearer token the admin listener requires; empty requires none
+
+	AuditLogPath  string // empty disables the audit log; needs ServerKeyPath to sign entries
+	AuditMaxBytes int64  // rotate the audit log past this size; <= 0 never rotates
+
+	MaxBodySize int // max len(Body) in bytes; 0 means no limit beyond the frame size
+	MaxScarSize int // max len(Scar) in bytes; 0 means no limit beyond the frame size
+	MaxTags     int // max number of tags per packet; 0 means no limit
+	MaxTagBytes int // max total bytes of tag keys and values; 0 means no limit
+
+	LogTags []string // tag keys added to receipt/route log lines and audit entries
+
+	ScarStoreBytes int64 // keep relayed scar payloads up to this many bytes; 0 disables
+
+	LogSample int         // log 1 in N receipt/route lines; <= 1 logs all
+	Logger    *log.Logger // where the server logs; nil uses the standard logger
+
+	FairWorkers       int      // > 0 routes through a weighted fair queue with this many workers
+	FairWeights       []string // identity=weight shares for the fair queue
+	FairDefaultWeight int      // fair queue share of identities not in FairWeights
+	MaxInFlight       int      // packets a connection may have queued or being routed before its reads pause; 0 means no limit
+
+	VerifyWorkers int // > 0 verifies signatures on a pool of this many goroutines instead of each connection's own
+	Secp256k1Rate int // secp256k1 signatures verified per second, server-wide; only with VerifyWorkers, and 0 refuses them
+
+	QuotaFile string // per-identity quotas (see quota.go); empty disables, reloaded on SIGHUP
+	ACLFile   string // route ACL (see acl.go); empty allows every route, reloaded on SIGHUP
+
+	ScarLimitFile string // per-source scar limits (see scarlimit.go); empty disables, reloaded on SIGHUP
+
+	KeepAlive    time.Duration // TCP keepalive period on accepted connections; <= 0 disables keepalive
+	IdleTimeout  time.Duration // close a connection that sends nothing for this long; 0 disables
+	WriteTimeout time.Duration // fail a frame write that makes no progress for this long; 0 disables
+	WriteBuffer  int           // per-connection write buffer in bytes; 0 writes each frame directly
+
+	NoDelay          bool // set TCP_NODELAY on accepted connections so small frames go out at once
+	SocketRecvBuffer int  // SO_RCVBUF for accepted connections in bytes; 0 keeps the kernel default
+	SocketSendBuffer int  // SO_SNDBUF for accepted connections in bytes; 0 keeps the kernel default
+
+	// CoalesceBroadcast marshals a packet bound for many connections
+	// (heartbeats, sample:) once for all of them rather than once each.
+	CoalesceBroadcast bool
+
+	// SlowWriteThreshold is how long a frame write may take before the
+	// connection is reported as a slow consumer, short of WriteTimeout;
+	// 0 disables.
+	SlowWriteThreshold time.Duration
+
+	// TLSHandshakeTimeout bounds the TLS handshake on connections from a
+	// listener made with tls.NewListener, apart from IdleTimeout; 0 disables.
+	TLSHandshakeTimeout time.Duration
+
+	ShutdownDelay time.Duration // on SIGTERM, report not ready for this long before closing
+	DrainTimeout  time.Duration // after the goodbyes, wait this long for agents to hang up before closing their connections
+
+	HandlerLeakThreshold int // log when connection handlers outnumber open connections by more than this; 0 disables
+
+	IdentityPattern string // identities must match this regexp in full to register; empty accepts any
+	MaxIdentityLen  int    // refuse to register identities longer than this many bytes; 0 means no limit
+
+	Reregister          string   // replace, reject-new or allow-both (see reregister.go); empty means replace
+	ReregisterOverrides []string // identity=policy exceptions to Reregister
+
+	RequireRegistration bool // a connection's first valid packet must be TypeRegister
+	RequireID           bool // refuse routable packets with an empty Id
+	QuietExpiry         bool // drop expired packets without telling their sender
+	MaxIdentities       int  // refuse to register new identities beyond this many; 0 means no limit
+	LegacyDone          bool // acknowledge server-directed packets with a bare "done"
+	AllowSelfRoute      bool // route packets whose dst is their own src, or another identity on their connection, back to the sender
+	StreamSkipVerify    bool // pipe streaming packets without checking their signatures
+
+	ForwardAttempts int           // tries per forwarded packet when the destination's buffer is full
+	ForwardBackoff  time.Duration // wait before the first retry, doubling after each
+
+	AggregateTimeout time.Duration // how long a multi: packet's delivery report waits for its writes; 0 waits for all
+
+	MaxScheduled    int           // packets one src may have held for a future deliver_at at once
+	ScheduleHorizon time.Duration // how far ahead deliver_at may be
+
+	HealthWindow     time.Duration // period discover:health measures the error rate and slow consumers over
+	HealthThresholds []string      // signal=degraded:unhealthy overrides for discover:health
+
+	ResumeWindow time.Duration // how long a closed connection's session can be resumed; 0 disables FeatureResume
+
+	DedupWindow time.Duration // answer packets repeating a (pk, src, id) seen this recently with the original reply instead of routing them; 0 disables
+}
+
+// defaultConfig returns the settings a server runs with when no flags are
+// given.
+func defaultConfig() Config {
+	return Config{
+		ListenAddr: ":9009",
+		ServerID:   defaultServerID(),
+		ReplySrc:   DefaultReplySrc,
+
+		HeartbeatInterval: 60 * time.Second,
+		AuditMaxBytes:     64 << 20,
+		KeepAlive:         15 * time.Second,
+		NoDelay:           true,
+		WriteTimeout:      10 * time.Second,
+		ForwardAttempts:   3,
+		ForwardBackoff:    25 * time.Millisecond,
+		AggregateTimeout:  2 * time.Second,
+
+		MaxScheduled:    10000,
+		ScheduleHorizon: 24 * time.Hour,
+
+		HealthWindow: time.Minute,
+
+		ResumeWindow: 30 * time.Second,
+
+		RequireSignature:     true,
+		UnixRequireSignature: true,
+
+		ClusterStatsTimeout: 2 * time.Second,
+		SlowWriteThreshold:  time.Second,
+		DrainTimeout:        10 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+
+		FairDefaultWeight: 1,
+		Secp256k1Rate:     100,
+
+		MaxTags:     16,
+		MaxTagBytes: 1024,
+
+		IdentityPattern: DefaultIdentityPattern,
+		MaxIdentityLen:  DefaultMaxIdentityLen,
+		Reregister:      reregReplace,
+	}
+}
+
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "protocol listen address")
+	fs.BoolVar(&c.ReusePort, "reuseport", c.ReusePort, "set SO_REUSEPORT on the protocol listener so several instances can share its address")
+	fs.IntVar(&c.ListenBacklog, "listen-backlog", c.ListenBacklog, "protocol listener accept backlog (0 = system default)")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "require a PROXY protocol v1 or v2 header on TCP protocol connections and use the client address it names (only behind a load balancer)")
+	fs.IntVar(&c.ReadCap, "read-cap", c.ReadCap, "close TCP clients that send a frame larger than this many bytes (0 = the 64KB frame limit)")
+	fs.StringVar(&c.UnixPath, "listen-unix", c.UnixPath, "also accept protocol connections on this Unix socket path")
+	fs.IntVar(&c.UnixReadCap, "unix-read-cap", c.UnixReadCap, "close Unix socket clients that send a frame larger than this many bytes (0 = the 64KB frame limit)")
+	fs.BoolVar(&c.RequireSignature, "require-signature", c.RequireSignature, "drop unsigned packets from TCP clients; -require-signature=false routes them unverified (trusted networks only)")
+	fs.BoolVar(&c.UnixRequireSignature, "unix-require-signature", c.UnixRequireSignature, "drop unsigned packets from Unix socket clients; -unix-require-signature=false routes them unverified")
+	fs.StringVar(&c.JSONAddr, "json-listen", c.JSONAddr, "also accept debugging connections speaking one JSON packet per line on this address (development only)")
+	fs.StringVar(&c.ServerID, "server-id", c.ServerID, "name of this server within a federation")
+	fs.StringVar(&c.ReplySrc, "reply-src", c.ReplySrc, "src of replies, heartbeats and other packets from the server; agents may not register it")
+	fs.DurationVar(&c.HeartbeatInterval, "heartbeat-interval", c.HeartbeatInterval, "interval between heartbeats to registered agents")
+	fs.IntVar(&c.PongMisses, "pong-misses", c.PongMisses, "close agents that leave this many heartbeats in a row without a typ 4 pong (0 = never)")
+	fs.StringVar(&c.ServerKeyPath, "server-key", c.ServerKeyPath, "server signing key written by `keep keygen` (default: a new key each start)")
+	fs.Var(listFlag{&c.AdminKeys}, "admin-keys", "comma-separated hex ed25519 public keys allowed admin queries such as discover:config")
+	fs.StringVar(&c.FederationAddr, "federation-listen", c.FederationAddr, "accept federation peer links on this address (trusted network only)")
+	fs.IntVar(&c.RingVnodes, "ring-vnodes", c.RingVnodes, "route federated identities by consistent hashing with this many virtual nodes per server (0 = gossip full tables)")
+	fs.Var(listFlag{&c.Peers}, "peers", "comma-separated federation addresses of peer servers to link to")
+	fs.Var(listFlag{&c.PeerKeys}, "peer-keys", "comma-separated hex ed25519 server keys (server_pk) of peers allowed to link; each must prove it holds its key (empty = accept any peer)")
+	fs.DurationVar(&c.ClusterStatsTimeout, "cluster-stats-timeout", c.ClusterStatsTimeout, "how long discover:cluster-stats waits for federation peers to answer")
+	fs.DurationVar(&c.DiscoverCacheTTL, "discover-cache-ttl", c.DiscoverCacheTTL, "answer discover:info, agents and stats from a reply up to this old (0 = build each reply)")
+	fs.IntVar(&c.DiscoverRate, "discover-rate", c.DiscoverRate, "refuse discovery queries past this many per source per second with error:rate_limited (0 = no limit)")
+	fs.StringVar(&c.MetricsAddr, "metrics-listen", c.MetricsAddr, "serve Prometheus metrics at http://<addr>/metrics")
+	fs.StringVar(&c.AdminAddr, "admin-listen", c.AdminAddr, "serve /metrics, health probes, /debug/pprof/ and /admin/ commands over HTTP on this address")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "require this bearer token on the admin listener (probes excepted)")
+	fs.StringVar(&c.AuditLogPath, "audit-log", c.AuditLogPath, "append a hash-chained audit entry per packet to this file, signed with -server-key")
+	fs.Int64Var(&c.AuditMaxBytes, "audit-max-bytes", c.AuditMaxBytes, "rotate the audit log once it exceeds this many bytes")
+	fs.IntVar(&c.MaxBodySize, "max-body", c.MaxBodySize, "reject packets whose body exceeds this many bytes (0 = no limit)")
+	fs.IntVar(&c.MaxScarSize, "max-scar", c.MaxScarSize, "reject packets whose scar exceeds this many bytes (0 = no limit)")
+	fs.IntVar(&c.MaxTags, "max-tags", c.MaxTags, "reject packets carrying more than this many tags (0 = no limit)")
+	fs.IntVar(&c.MaxTagBytes, "max-tag-bytes", c.MaxTagBytes, "reject packets whose tag keys and values total more than this many bytes (0 = no limit)")
+	fs.Var(listFlag{&c.LogTags}, "log-tags", "comma-separated tag keys, such as trace_id, to include in log lines and audit entries")
+	fs.Int64Var(&c.ScarStoreBytes, "scar-store-bytes", c.ScarStoreBytes, "keep relayed scar payloads in memory up to this many bytes, evicting the least recently used (0 = off)")
+	fs.IntVar(&c.LogSample, "log-sample", c.LogSample, "log only 1 in N per-packet receipt and route lines (drops and errors are always logged)")
+	fs.IntVar(&c.FairWorkers, "fair-workers", c.FairWorkers, "route packets through a weighted fair queue across sources with this many workers (0 = route in arrival order)")
+	fs.Var(listFlag{&c.FairWeights}, "fair-weights", "comma-separated identity=weight fair queue shares")
+	fs.IntVar(&c.FairDefaultWeight, "fair-default-weight", c.FairDefaultWeight, "fair queue share of identities not listed in -fair-weights")
+	fs.IntVar(&c.VerifyWorkers, "verify-workers", c.VerifyWorkers, "verify packet signatures on a pool of this many goroutines, bounding the crypto running at once however many connections there are (0 = each connection verifies its own)")
+	fs.IntVar(&c.Secp256k1Rate, "secp256k1-rate", c.Secp256k1Rate, "secp256k1 signatures to verify per second across all connections, dropping the rest; secp256k1 is accepted only with -verify-workers (0 = refuse secp256k1)")
+	fs.IntVar(&c.MaxInFlight, "max-inflight", c.MaxInFlight, "packets one connection may have waiting in the fair queue or being routed before the server stops reading from it (0 = no limit beyond the per-source backlog)")
+	fs.StringVar(&c.QuotaFile, "quota-file", c.QuotaFile, "JSON file of per-identity send quotas; reloaded on SIGHUP")
+	fs.StringVar(&c.ScarLimitFile, "scar-limit-file", c.ScarLimitFile, "JSON file of per-source scar byte and packet limits; reloaded on SIGHUP")
+	fs.StringVar(&c.ACLFile, "acl-file", c.ACLFile, "JSON file of allow/deny rules for which sources may address which destinations; reloaded on SIGHUP")
+	fs.DurationVar(&c.KeepAlive, "keepalive", c.KeepAlive, "TCP keepalive probe period on accepted connections (0 = disable keepalive)")
+	fs.BoolVar(&c.NoDelay, "nodelay", c.NoDelay, "set TCP_NODELAY on accepted connections; -nodelay=false lets Nagle's algorithm batch small frames")
+	fs.IntVar(&c.SocketRecvBuffer, "socket-recv-buffer", c.SocketRecvBuffer, "kernel receive buffer (SO_RCVBUF) for accepted connections in bytes (0 = system default)")
+	fs.IntVar(&c.SocketSendBuffer, "socket-send-buffer", c.SocketSendBuffer, "kernel send buffer (SO_SNDBUF) for accepted connections in bytes (0 = system default)")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "close connections that send nothing for this long (0 = never)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "drop a connection whose frame write stalls for this long (0 = never)")
+	fs.DurationVar(&c.SlowWriteThreshold, "slow-write-threshold", c.SlowWriteThreshold, "log a slow-consumer warning and count it in keep_slow_writes_total when a write to a connection takes longer than this, without closing it (0 = never)")
+	fs.BoolVar(&c.CoalesceBroadcast, "coalesce-broadcast", c.CoalesceBroadcast, "marshal heartbeats and sample: packets once and write the same bytes to every recipient, instead of marshaling per connection")
+	fs.IntVar(&c.WriteBuffer, "write-buffer", c.WriteBuffer, "buffer each connection's writes in this many bytes, so a frame or a burst of replies leaves in one write (0 = write frames directly)")
+	fs.BoolVar(&c.AllowSelfRoute, "allow-self-route", c.AllowSelfRoute, "route packets addressed to their own src, or another identity on the sending connection, back to the sender instead of rejecting them with error:self_route")
+	fs.BoolVar(&c.StreamSkipVerify, "stream-skip-verify", c.StreamSkipVerify, "pipe packets between streaming agents without verifying each signature; the pair was authenticated by its stream offers")
+	fs.BoolVar(&c.LegacyDone, "legacy-done", c.LegacyDone, `acknowledge packets addressed to the server with a bare "done" instead of JSON`)
+	fs.StringVar(&c.IdentityPattern, "identity-pattern", c.IdentityPattern, "refuse to register identities that don't match this regular expression in full (empty = accept any)")
+	fs.IntVar(&c.MaxIdentityLen, "max-identity-len", c.MaxIdentityLen, "refuse to register identities longer than this many bytes with error:identity_too_long (0 = no limit)")
+	fs.StringVar(&c.Reregister, "reregister", c.Reregister, "when a registered identity registers from another connection: replace the old connection, reject-new to keep it, or allow-both")
+	fs.Var(listFlag{&c.ReregisterOverrides}, "reregister-overrides", "comma-separated identity=policy exceptions to -reregister")
+	fs.IntVar(&c.MaxIdentities, "max-identities", c.MaxIdentities, "refuse to register new agent identities once this many are registered (0 = no limit)")
+	fs.BoolVar(&c.RequireID, "require-id", c.RequireID, "reply error:missing_id to packets without an id instead of routing them (goodbyes and pongs are exempt)")
+	fs.DurationVar(&c.DedupWindow, "dedup-window", c.DedupWindow, "remember each packet's (pk, src, id) this long and answer a resend with the original reply instead of routing it again (0 = off)")
+	fs.BoolVar(&c.QuietExpiry, "quiet-expiry", c.QuietExpiry, "drop packets that expire before delivery without replying error:expired to the sender")
+	fs.BoolVar(&c.RequireRegistration, "require-registration", c.RequireRegistration, "close connections whose first valid packet is not a typ 5 registration")
+	fs.DurationVar(&c.ShutdownDelay, "shutdown-delay", c.ShutdownDelay, "on SIGINT/SIGTERM, keep serving but fail /readyz for this long before saying goodbye")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "on shutdown, wait this long after saying goodbye for agents to disconnect before closing their connections")
+	fs.IntVar(&c.HandlerLeakThreshold, "handler-leak-threshold", c.HandlerLeakThreshold, "log a possible goroutine leak when connection handlers outnumber open connections by more than this (0 = never check)")
+	fs.IntVar(&c.ForwardAttempts, "forward-attempts", c.ForwardAttempts, "attempts to forward a packet to a destination whose receive buffer is full")
+	fs.DurationVar(&c.ForwardBackoff, "forward-backoff", c.ForwardBackoff, "wait before retrying a stalled forward, doubling per retry")
+	fs.DurationVar(&c.AggregateTimeout, "aggregate-timeout", c.AggregateTimeout, "how long a multi: delivery report waits for its writes before listing the rest as pending (0 waits for all)")
+	fs.IntVar(&c.MaxScheduled, "max-scheduled", c.MaxScheduled, "packets one src may have held for a future deliver_at at once; more get error:schedule_full")
+	fs.DurationVar(&c.ResumeWindow, "resume-window", c.ResumeWindow, "how long after a connection drops a client may resume its identities, groups and labels with the handshake's resumption token (0 = never)")
+	fs.DurationVar(&c.HealthWindow, "health-window", c.HealthWindow, "period discover:health measures the error rate and slow consumers over")
+	fs.Var(listFlag{&c.HealthThresholds}, "health-thresholds", "comma-separated signal=degraded:unhealthy discover:health thresholds (signals: error_rate, queued, slow_consumers, goroutines_per_conn)")
+	fs.DurationVar(&c.ScheduleHorizon, "schedule-horizon", c.ScheduleHorizon, "reject packets whose deliver_at is further ahead than this with error:schedule_too_far")
+}
+
+// secretFlags are flags whose values discover:config redacts.
+var secretFlags = map[string]bool{
+	"admin-keys":  true,
+	"admin-token": true,
+}
+
+// snapshot renders c as the flags that would reproduce it, keyed by flag
+// name, with secrets redacted. Reusing registerFlags keeps the snapshot in
+// step with the options the server actually has.
+func (c Config) snapshot() map[string]string {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	c.registerFlags(fs)
+	out := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "REDACTED"
+		}
+		out[f.Name] = v
+	})
+	return out
+}
+
+// listFlag is a comma-separated list flag.
+type listFlag struct{ list *[]string }
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.list = splitList(s)
+	return nil
+}
 
-	if old, exists := agents[identity]; exists && old != conn {
-		log.Printf("Identity %q re-registered, closing old connection", identity)
-		// Clean up reverse map for old connection
-		delete(connSrc, old)
-		old.Close()
+func defaultServerID() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
 	}
-	agents[identity] = conn
-	connSrc[conn] = identity
+	return "keep"
 }
 
-// unregisterConn removes a connection from the routing table.
-func unregisterConn(conn net.Conn) {
-	routeMu.Lock()
-	defer routeMu.Unlock()
+// Build metadata, injected at link time:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var commit, buildDate string
+
+// connInfo wraps an accepted connection with per-connection state.
+// All writes go through send so that frames from concurrent writers
+// (forwarders, discovery replies, heartbeat) never interleave on the wire.
+type connInfo struct {
+	net.Conn
+	addr string
+	srv  *Server // the server that accepted the connection
+
+	writeMu sync.Mutex
+	closed  bool          // guarded by writeMu; set once retire or Close has closed the conn
+	wcodec  frameCodec    // guarded by writeMu; nil sends uncompressed frames
+	wbuf    *bufio.Writer // guarded by writeMu; nil writes each frame straight to the socket
+	corked  int           // guarded by writeMu; > 0 holds frames in wbuf until uncork
+
+	rcodec frameCodec // used only by the connection's reader goroutine
+
+	json  bool           // JSON listener: one JSON packet per line instead of frames
+	lines *bufio.Scanner // the JSON listener's reader; used only by the reader goroutine
+
+	retired atomic.Bool // displaced by re-registration; may not register again
+
+	lastPK  atomic.Pointer[[]byte] // key that signed the latest verified packet
+	usageID atomic.Pointer[string] // identity its bytes count toward: the latest it registered as
+
+	features atomic.Uint64 // Feature* bits negotiated at handshake
+
+	labels atomic.Pointer[map[string]string] // set by registration packets (see labels.go)
+
+	maxPacketSize atomic.Uint32 // largest packet forwarded to it, set by registration packets; 0 for no limit (see dstsize.go)
+
+	unanswered atomic.Int32 // heartbeats sent since the last pong
+
+	stream atomic.Pointer[stream] // set once paired with another connection (see stream.go)
+
+	writeTimeout time.Duration // -write-timeout when the connection was accepted
+	readCap      int           // the accepting listener's frame limit; 0 means wire.MaxPacketSize
+
+	// Framed bytes read from and written to the wire, folded into the
+	// identity's usage total when the connection closes.
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	slowWrites  atomic.Int64 // writes over -slow-write-threshold, folded into usage with the bytes
+	lastSlowLog time.Time    // guarded by writeMu; when a slow write was last logged
+	lastSlow    atomic.Int64 // Unix nanoseconds of the last slow write, for discover:health
+	seq         uint64       // guarded by writeMu; seq of the last packet written
+
+	connected time.Time    // when the connection was accepted
+	packetsIn atomic.Int64 // packets read, whatever became of them
+
+	sendQ sendQueue // forwards waiting to be written, by priority
+
+	inflight chan struct{} // -max-inflight slots, one per packet handed to the fair queue; nil without a limit
+
+	// The session of the latest resumption token issued, and the key it is
+	// bound to; guarded by the server's resumes.mu.
+	resumeID string
+	resumePK []byte
+}
+
+func (s *Server) newConnInfo(c net.Conn) *connInfo {
+	ci := &connInfo{Conn: c, addr: c.RemoteAddr().String(), srv: s, writeTimeout: s.cfg.WriteTimeout, connected: time.Now()}
+	if s.cfg.WriteBuffer > 0 {
+		ci.wbuf = bufio.NewWriterSize(c, s.cfg.WriteBuffer)
+	}
+	return ci
+}
+
+// send writes p to the connection, serialized with all other writers.
+func (ci *connInfo) send(p *Packet) error {
+	return ci.sendWithin(p, ci.writeTimeout)
+}
+
+// sendWithin is send with its own write timeout; 0 means none.
+func (ci *connInfo) sendWithin(p *Packet, timeout time.Duration) error {
+	ci.writeMu.Lock()
+	defer ci.writeMu.Unlock()
+	return ci.sendLocked(p, timeout)
+}
+
+// sendLocked writes p with writeMu held. A failed write may leave a partial
+// frame on the wire, so the connection is closed rather than reused.
+func (ci *connInfo) sendLocked(p *Packet, timeout time.Duration) error {
+	return ci.writeLocked(p, nil, timeout, false)
+}
+
+// sendWire is send for a packet going to many connections: marshaled, if not
+// nil, is p already marshaled, which is written instead of marshaling p
+// again. marshaled is only read, so one buffer may be sent to any number of
+// connections at once.
+func (ci *connInfo) sendWire(p *Packet, marshaled []byte) error {
+	ci.writeMu.Lock()
+	defer ci.writeMu.Unlock()
+	return ci.writeLocked(p, marshaled, ci.writeTimeout, false)
+}
+
+// trySend is send for an attempt that will be retried: if not a byte of the
+// frame can be written within probe, the connection is left open and the
+// error satisfies isTransientWrite. Once the frame has started, the rest gets
+// the connection's full write timeout, so a slow reader never sees a torn
+// frame.
+// marshaled is p already marshaled, or nil; see sendWire.
+func (ci *connInfo) trySend(p *Packet, marshaled []byte, probe time.Duration) error {
+	ci.writeMu.Lock()
+	defer ci.writeMu.Unlock()
+	return ci.writeLocked(p, marshaled, probe, true)
+}
+
+// writeLocked writes p, or marshaled if it holds p already marshaled, with
+// writeMu held. With probe set, timeout only bounds the wait for the frame's
+// first byte; see trySend.
+func (ci *connInfo) writeLocked(p *Packet, marshaled []byte, timeout time.Duration, probe bool) error {
+	if ci.closed {
+		return net.ErrClosed
+	}
+	frame, err := ci.encode(p, marshaled, ci.seq+1)
+	if err != nil {
+		return err
+	}
+	// A peer that vanished without a FIN stops acking; don't let the write
+	// (and every writer queued behind writeMu) block until the kernel gives up.
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	ci.Conn.SetWriteDeadline(deadline)
+	start := time.Now()
+	switch {
+	case probe:
+		// Frames held by a cork go first, so the probe only times the new one.
+		if err = ci.flushLocked(ci.writeTimeout); err == nil {
+			ci.Conn.SetWriteDeadline(deadline)
+			err = writeFrameProbing(ci.Conn, frame, ci.writeTimeout)
+		}
+	case ci.wbuf != nil:
+		// A frame larger than the buffer is flushed in pieces; like any
+		// failed write, an error part-way closes the connection below.
+		err = wire.WriteWhole(ci.wbuf, frame)
+		if err == nil && ci.corked == 0 {
+			err = ci.wbuf.Flush()
+		}
+	default:
+		err = wire.WriteWhole(ci.Conn, frame)
+	}
+	if err != nil {
+		if !(probe && isTransientWrite(err)) {
+			ci.closed = true
+			ci.Conn.Close()
+		}
+		return err
+	}
+	ci.seq++
+	ci.bytesOut.Add(int64(len(frame)))
+	ci.checkSlowLocked(start)
+	return nil
+}
+
+// seqField is the field number of Packet.seq.
+const seqField protowire.Number = 17
+
+// encode returns p as the bytes to write to the connection: a length-prefixed
+// frame, compressed with the negotiated codec, or on a JSON listener a line.
+// It is stamped with seq, without touching p, which may be on its way to
+// other connections too. marshaled, if not nil, is p marshaled already.
+func (ci *connInfo) encode(p *Packet, marshaled []byte, seq uint64) ([]byte, error) {
+	if ci.json {
+		j := packetToJSON(p)
+		j.Seq = seq
+		return jsonLine(j)
+	}
+	data := marshaled
+	if data == nil {
+		var err error
+		if data, err = proto.Marshal(p); err != nil {
+			return nil, fmt.Errorf("marshal: %w", err)
+		}
+	} else {
+		// Shared with other writers: stamp a copy
+		data = slices.Clip(data)
+	}
+	// Of a field appearing twice the last wins, so this overrides any seq
+	// the sender set.
+	data = protowire.AppendTag(data, seqField, protowire.VarintType)
+	data = protowire.AppendVarint(data, seq)
+	if ci.wcodec != nil {
+		raw := len(data)
+		var err error
+		if data, err = ci.wcodec.encode(data); err != nil {
+			return nil, fmt.Errorf("%s encode: %w", ci.wcodec.name(), err)
+		}
+		ci.srv.codecs[ci.wcodec.name()].countOut(raw, len(data))
+	}
+	return wire.FrameBytes(data)
+}
+
+// cork holds frames sent to the connection in its write buffer until the
+// matching uncork, so a burst of writes leaves in one flush. Without
+// -write-buffer it does nothing. Corks nest.
+func (ci *connInfo) cork() {
+	ci.writeMu.Lock()
+	ci.corked++
+	ci.writeMu.Unlock()
+}
+
+// uncork releases a cork, flushing the buffer once none remain.
+func (ci *connInfo) uncork() error {
+	ci.writeMu.Lock()
+	defer ci.writeMu.Unlock()
+	ci.corked--
+	if ci.corked > 0 {
+		return nil
+	}
+	return ci.flushLocked(ci.writeTimeout)
+}
+
+// flushLocked writes out buffered frames with writeMu held, closing the
+// connection if that fails.
+func (ci *connInfo) flushLocked(timeout time.Duration) error {
+	if ci.wbuf == nil || ci.wbuf.Buffered() == 0 || ci.closed {
+		return nil
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	ci.Conn.SetWriteDeadline(deadline)
+	start := time.Now()
+	if err := ci.wbuf.Flush(); err != nil {
+		ci.closed = true
+		ci.Conn.Close()
+		return err
+	}
+	ci.checkSlowLocked(start)
+	return nil
+}
+
+// slowLogInterval spaces out slow-consumer warnings for one connection.
+const slowLogInterval = time.Minute
+
+// checkSlowLocked counts a write that began at start and took longer than
+// -slow-write-threshold, and logs it unless the connection was logged as
+// slow within slowLogInterval. The peer is still reading, just slowly, so the connection
+// stays open; -write-timeout is what gives up on it. writeMu must be held.
+func (ci *connInfo) checkSlowLocked(start time.Time) {
+	threshold := ci.srv.cfg.SlowWriteThreshold
+	if threshold <= 0 {
+		return
+	}
+	took := time.Since(start)
+	if took <= threshold {
+		return
+	}
+	n := ci.slowWrites.Add(1)
+	now := time.Now()
+	ci.lastSlow.Store(now.UnixNano())
+	if now.Sub(ci.lastSlowLog) >= slowLogInterval {
+		ci.lastSlowLog = now
+		ci.srv.log.Printf("Slow consumer %q at %s: write took %v (over %v; %d slow writes so far)", ci.usageName(), ci.addr, took.Round(time.Millisecond), threshold, n)
+	}
+}
+
+// usageName is the identity ci's bytes count toward, or "" before it
+// registers.
+func (ci *connInfo) usageName() string {
+	if id := ci.usageID.Load(); id != nil {
+		return *id
+	}
+	return ""
+}
+
+// recv reads the next packet, decoding it with the negotiated codec.
+// Only the connection's reader goroutine may call it.
+func (ci *connInfo) recv() (*Packet, error) {
+	if ci.json {
+		return ci.recvJSON()
+	}
+	payload, err := wire.ReadFrameCapped(ci.Conn, ci.readCap)
+	if err != nil {
+		return nil, err
+	}
+	ci.bytesIn.Add(int64(4 + len(payload)))
+	if ci.rcodec != nil {
+		onWire := len(payload)
+		if payload, err = ci.rcodec.decode(payload); err != nil {
+			return nil, fmt.Errorf("%w: %s decode: %w", wire.ErrMalformedFrame, ci.rcodec.name(), err)
+		}
+		ci.srv.codecs[ci.rcodec.name()].countIn(len(payload), onWire)
+	}
+	return wire.UnmarshalPacket(payload)
+}
+
+// keepAliveProbes is how many unanswered keepalive probes declare a peer dead.
+const keepAliveProbes = 9
+
+// tuneConn applies the configured TCP options to conn. Keepalive makes the
+// kernel probe idle peers, so a half-open connection (peer gone without a
+// FIN) fails its blocked read. The first probe goes out after -keepalive of
+// silence and repeats at that interval, so a dead peer is detected after
+// about (1+keepAliveProbes) * -keepalive.
+//
+// -nodelay (the default) sends each frame as soon as it is written; turned
+// off, Nagle's algorithm holds small writes until earlier data is
+// acknowledged, trading latency for fewer packets. Larger socket buffers let
+// a fast sender or a distant peer keep more data in flight, at the cost of
+// memory per connection and of queueing more behind a slow reader before
+// -write-timeout notices.
+func (s *Server) tuneConn(conn net.Conn) {
+	tc, ok := netConn(conn).(*net.TCPConn)
+	if !ok {
+		return
+	}
+	ka := net.KeepAliveConfig{Enable: false}
+	if s.cfg.KeepAlive > 0 {
+		ka = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     s.cfg.KeepAlive,
+			Interval: s.cfg.KeepAlive,
+			Count:    keepAliveProbes,
+		}
+	}
+	if err := tc.SetKeepAliveConfig(ka); err != nil {
+		s.log.Printf("Keepalive on %s: %v", tc.RemoteAddr(), err)
+	}
+	if err := tc.SetNoDelay(s.cfg.NoDelay); err != nil {
+		s.log.Printf("TCP_NODELAY on %s: %v", tc.RemoteAddr(), err)
+	}
+	if s.cfg.SocketRecvBuffer > 0 {
+		if err := tc.SetReadBuffer(s.cfg.SocketRecvBuffer); err != nil {
+			s.log.Printf("Receive buffer on %s: %v", tc.RemoteAddr(), err)
+		}
+	}
+	if s.cfg.SocketSendBuffer > 0 {
+		if err := tc.SetWriteBuffer(s.cfg.SocketSendBuffer); err != nil {
+			s.log.Printf("Send buffer on %s: %v", tc.RemoteAddr(), err)
+		}
+	}
+}
+
+// retire closes a connection that lost its identity to re-registration.
+// It takes the write lock first, so a heartbeat, reply or forward already in
+// progress finishes and the peer never sees a truncated frame, then tells the
+// peer it was replaced; anything sent after that fails cleanly. A write still
+// stuck after ReregisterGrace is cut off, which the peer sees as a short
+// read, not as a corrupted frame, and gets no close notice.
+func (ci *connInfo) retire() {
+	clean := ci.lockWrites("Retired")
+	// Replies held by a cork were meant for this peer; let them out first.
+	if err := ci.flushLocked(ReregisterGrace); err != nil {
+		ci.srv.log.Printf("Retired connection %s flush failed: %v", ci.addr, err)
+		clean = false
+	}
+	if clean {
+		if ci.writeLocked(ci.closeNotice(closeReplaced), nil, closeNoticeTimeout, false) == nil {
+			ci.flushLocked(closeNoticeTimeout)
+		}
+	}
+	ci.closed = true
+	ci.Conn.Close()
+	ci.writeMu.Unlock()
+	if clean {
+		ci.srv.log.Printf("Retired connection %s after its last whole frame", ci.addr)
+	}
+}
+
+// Close closes the connection once no write to it is in progress. A
+// forwarder that looked the connection up before it was unregistered either
+// finishes its frame first or finds it closed and gets net.ErrClosed, rather
+// than having its write cut off by a close from another goroutine. A write
+// still stuck after ReregisterGrace is cut off, as in retire.
+func (ci *connInfo) Close() error {
+	ci.lockWrites("Closing")
+	defer ci.writeMu.Unlock()
+	if ci.closed {
+		return nil
+	}
+	ci.closed = true
+	return ci.Conn.Close()
+}
+
+// lockWrites takes writeMu, waiting up to ReregisterGrace for a write in
+// progress to finish. Past that it closes the connection to unblock the
+// writer, logging why under what, and reports false.
+func (ci *connInfo) lockWrites(what string) bool {
+	locked := make(chan struct{})
+	go func() {
+		ci.writeMu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-time.After(ReregisterGrace):
+		ci.srv.log.Printf("%s connection %s still writing after %v, forcing close", what, ci.addr, ReregisterGrace)
+		ci.Conn.Close() // unblocks the stuck writer
+		<-locked
+		return false
+	}
+}
+
+// registration is the outcome of registerConn.
+type registration int
+
+const (
+	regUnchanged   registration = iota // already registered on this connection
+	regNew                             // the identity was free
+	regReplaced                        // the identity moved here from another connection
+	regShared                          // another connection keeps the identity too (allow-both)
+	regRetired                         // ci was displaced and may not register again
+	regReserved                        // the identity names a server endpoint
+	regFull                            // a new identity would exceed -max-identities
+	regKeyMismatch                     // the identity is registered under another key
+	regBadIdentity                     // the identity doesn't match -identity-pattern
+	regInUse                           // another connection holds the identity (reject-new)
+	regTooLong                         // the identity is longer than -max-identity-len
+)
+
+// DefaultIdentityPattern accepts any identity without whitespace, so only
+// clearly malformed ones are refused unless -identity-pattern tightens it,
+// for example to ^bot:[a-z0-9-]+$.
+const DefaultIdentityPattern = `\S+`
+
+// DefaultMaxIdentityLen bounds identities, which are kept in the routing
+// table and repeated in log lines, unless -max-identity-len changes it.
+const DefaultMaxIdentityLen = 256
+
+// DefaultReplySrc is the src of packets the server originates unless
+// -reply-src names another.
+const DefaultReplySrc = "server"
+
+// reservedIdentities are dst values the server answers itself. An agent
+// registered under one could never be reached. The -reply-src identity is
+// reserved too: an agent posing as it could forge server packets to its
+// peers.
+var reservedIdentities = map[string]bool{
+	"server":    true,
+	"handshake": true,
+	"register":  true,
+}
+
+// reservedPrefixes are dst prefixes the router handles itself, plus fed:,
+// which names federation control packets. An agent registered under one
+// would have its packets taken by the server instead.
+var reservedPrefixes = []string{
+	"discover:", "subscribe:", "unsubscribe:", "deregister:", "kick:",
+	"directive:", "any:", "sample:", "multi:", "stream:", "fed:",
+}
+
+// reserved reports whether identity is reserved from registration.
+func (s *Server) reserved(identity string) bool {
+	if reservedIdentities[identity] || identity == s.cfg.ReplySrc {
+		return true
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(identity, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectReason is the error reply for registrations that were refused.
+var rejectReason = map[registration]string{
+	regRetired:     "error:registration_rejected",
+	regReserved:    "error:reserved_identity",
+	regFull:        "error:registry_full",
+	regKeyMismatch: "error:key_mismatch",
+	regBadIdentity: "error:bad_identity",
+	regInUse:       "error:identity_in_use",
+	regTooLong:     "error:identity_too_long",
+}
+
+// registerConn registers a connection under the given agent identity, bound
+// to the key that signed ci's latest packet. While it stays registered, only
+// that key may use it: a packet signed by any other is refused, however
+// valid its signature. A connection may hold several identities, one per
+// src it sends as. If the identity is already registered on another
+// connection under the same key, its re-registration policy decides: by
+// default last-write-wins, and the old connection stops receiving its routes
+// immediately and, if that was its last identity, is closed once its pending
+// write drains.
+// A new identity is refused once -max-identities are registered; taking
+// over an existing one is always allowed.
+func (s *Server) registerConn(identity string, ci *connInfo) registration {
+	if reg, ok := s.vetIdentity(identity); !ok {
+		return reg
+	}
+	pk := ci.pk()
+	s.routeMu.Lock()
+	if ci.retired.Load() {
+		s.routeMu.Unlock()
+		return regRetired
+	}
+	reg := s.admitLocked(identity, ci, pk, 0)
+	switch {
+	case reg == regUnchanged:
+		ci.usageID.Store(&identity)
+		s.routeMu.Unlock()
+		return reg
+	case rejectReason[reg] != "":
+		s.routeMu.Unlock()
+		return reg
+	}
+	s.takeLocked(identity, ci, pk, reg)
+	s.routeMu.Unlock()
+
+	if reg == regNew {
+		s.announce("fed:register", identity)
+	}
+	return reg
+}
+
+// pk returns the key that signed ci's latest packet.
+func (ci *connInfo) pk() []byte {
+	if p := ci.lastPK.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// vetIdentity checks the rules an identity must meet whoever holds it. ok is
+// false, with the refusal, if it breaks one.
+func (s *Server) vetIdentity(identity string) (reg registration, ok bool) {
+	switch {
+	case s.reserved(identity):
+		return regReserved, false
+	case s.cfg.MaxIdentityLen > 0 && len(identity) > s.cfg.MaxIdentityLen:
+		return regTooLong, false
+	case s.identityRE != nil && !s.identityRE.MatchString(identity):
+		return regBadIdentity, false
+	}
+	return regNew, true
+}
+
+// admitLocked decides whether ci may take identity under pk, with adding
+// more new identities about to be registered along with it. It returns
+// regUnchanged if ci holds it already, regNew, regReplaced or regShared for
+// what taking it would do, or the refusal. routeMu must be held.
+func (s *Server) admitLocked(identity string, ci *connInfo, pk []byte, adding int) registration {
+	old, exists := s.agents[identity]
+	if exists && !bytes.Equal(s.connSrc[old][identity], pk) {
+		return regKeyMismatch
+	}
+	if _, held := s.connSrc[ci][identity]; held {
+		return regUnchanged
+	}
+	if !exists {
+		if s.cfg.MaxIdentities > 0 && len(s.agents)+adding >= s.cfg.MaxIdentities {
+			return regFull
+		}
+		return regNew
+	}
+	switch s.reregisterPolicy(identity) {
+	case reregRejectNew:
+		return regInUse
+	case reregAllowBoth:
+		return regShared
+	}
+	return regReplaced
+}
+
+// takeLocked binds identity to ci as admitLocked decided, moving it off or
+// sharing it with the connection that held it. routeMu must be held.
+func (s *Server) takeLocked(identity string, ci *connInfo, pk []byte, reg registration) {
+	switch old := s.agents[identity]; reg {
+	case regShared:
+		s.standby[identity] = append(s.standby[identity], old)
+		s.log.Printf("Identity %q registered on a second connection; %s keeps it on standby", identity, old.addr)
+	case regReplaced:
+		s.unbindLocked(identity, old)
+		if len(s.connSrc[old]) == 0 {
+			s.log.Printf("Identity %q re-registered, retiring old connection", identity)
+			old.retired.Store(true)
+			go old.retire()
+		} else {
+			s.log.Printf("Identity %q re-registered; old connection %s keeps its other identities", identity, old.addr)
+		}
+	}
+	s.bindLocked(identity, ci, pk)
+	ci.usageID.Store(&identity)
+}
+
+// clipIdentity shortens an identity too long to register for a log line.
+func clipIdentity(identity string) string {
+	const keep = 64
+	if len(identity) <= keep {
+		return identity
+	}
+	return fmt.Sprintf("%s... (%d bytes)", identity[:keep], len(identity))
+}
+
+// registrationAck is the JSON body of a registration acknowledgement.
+type registrationAck struct {
+	Registered string `json:"registered"`
+	Replaced   bool   `json:"replaced"` // another connection held the identity
+}
+
+// ackRegistration tells c, if it negotiated FeatureRegistrationAck, that p
+// registered p.Src. The ack is signed with the server key and echoes p.Id
+// and p.Channel.
+func (s *Server) ackRegistration(c *connInfo, p *Packet, replaced bool) error {
+	if !c.has(FeatureRegistrationAck) {
+		return nil
+	}
+	body, _ := json.Marshal(registrationAck{Registered: p.Src, Replaced: replaced})
+	ack := &Packet{
+		Id:      p.Id,
+		Typ:     TypeReply,
+		Src:     s.cfg.ReplySrc,
+		Dst:     p.Src,
+		Body:    string(body),
+		Channel: p.Channel,
+	}
+	if err := wire.Sign(ack, s.key); err != nil {
+		return err
+	}
+	return c.send(ack)
+}
+
+// bindLocked routes identity to ci, bound to pk. routeMu must be held.
+func (s *Server) bindLocked(identity string, ci *connInfo, pk []byte) {
+	s.agents[identity] = ci
+	ids := s.connSrc[ci]
+	if ids == nil {
+		ids = make(map[string][]byte)
+		s.connSrc[ci] = ids
+	}
+	ids[identity] = pk
+}
+
+// unbindLocked removes identity from ci's set. If ci was receiving the
+// identity's routes, the newest standby takes them over. It reports whether
+// no connection holds the identity any more. routeMu must be held.
+func (s *Server) unbindLocked(identity string, ci *connInfo) bool {
+	if _, held := s.connSrc[ci][identity]; !held {
+		return false
+	}
+	delete(s.connSrc[ci], identity)
+	if len(s.connSrc[ci]) == 0 {
+		delete(s.connSrc, ci)
+	}
+	standby := s.standby[identity]
+	if s.agents[identity] != ci {
+		standby = slices.DeleteFunc(standby, func(c *connInfo) bool { return c == ci })
+	} else if n := len(standby); n > 0 {
+		s.agents[identity] = standby[n-1]
+		standby = standby[:n-1]
+	} else {
+		delete(s.agents, identity)
+		return true
+	}
+	if len(standby) == 0 {
+		delete(s.standby, identity)
+	} else {
+		s.standby[identity] = standby
+	}
+	return false
+}
+
+// dropConnLocked removes every identity ci holds and returns those no other
+// connection holds. routeMu must be held.
+func (s *Server) dropConnLocked(ci *connInfo) []string {
+	var gone []string
+	for identity := range s.connSrc[ci] {
+		if s.unbindLocked(identity, ci) {
+			gone = append(gone, identity)
+		}
+	}
+	sort.Strings(gone)
+	return gone
+}
+
+// unregisterConn removes a connection and all its identities from the
+// routing table.
+func (s *Server) unregisterConn(ci *connInfo) {
+	s.routeMu.Lock()
+	ids := s.dropConnLocked(ci)
+	s.routeMu.Unlock()
+
+	for _, identity := range ids {
+		s.log.Printf("Unregistered %q", identity)
+		s.announce("fed:unregister", identity)
+	}
+}
+
+// deregistration is the outcome of a deregister:<identity> request.
+type deregistration int
+
+const (
+	deregDone     deregistration = iota
+	deregUnknown                 // identity not registered here
+	deregNotOwner                // registered under a different key
+)
+
+// deregister releases identity on behalf of a packet signed with pk, leaving
+// the connection that held it open. Only the key the identity is bound to
+// may release it.
+func (s *Server) deregister(identity string, pk []byte) deregistration {
+	s.routeMu.Lock()
+	holder, exists := s.agents[identity]
+	if !exists {
+		s.routeMu.Unlock()
+		return deregUnknown
+	}
+	if !bytes.Equal(s.connSrc[holder][identity], pk) {
+		s.routeMu.Unlock()
+		return deregNotOwner
+	}
+	for _, c := range slices.Clone(s.standby[identity]) {
+		s.unbindLocked(identity, c)
+	}
+	s.unbindLocked(identity, holder)
+	s.routeMu.Unlock()
+
+	s.log.Printf("Deregistered %q, connection %s stays open", identity, holder.addr)
+	s.announce("fed:unregister", identity)
+	return deregDone
+}
+
+// deregistrationAck is the JSON body of a successful deregister reply.
+type deregistrationAck struct {
+	Status       string `json:"status"`
+	Deregistered string `json:"deregistered"`
+}
+
+// handleDeregister answers a deregister:<identity> packet from c.
+func (s *Server) handleDeregister(c *connInfo, p *Packet) error {
+	identity := strings.TrimPrefix(p.Dst, "deregister:")
+	switch s.deregister(identity, p.Pk) {
+	case deregUnknown:
+		return reply(c, p, "error:offline")
+	case deregNotOwner:
+		s.log.Printf("REJECTED error:forbidden from %s (src=%s): deregister %q held by another key", c.addr, p.Src, identity)
+		return reply(c, p, "error:forbidden")
+	}
+	body, _ := json.Marshal(deregistrationAck{Status: "done", Deregistered: identity})
+	return reply(c, p, string(body))
+}
+
+// kickAck is the JSON body of a kick:<identity> reply.
+type kickAck struct {
+	Status string `json:"status"`
+	Kicked string `json:"kicked"`
+	Closed int    `json:"closed"` // connections closed; 0 if none held the identity
+}
 
-	if identity, exists := connSrc[conn]; exists {
-		delete(agents, identity)
-		delete(connSrc, conn)
-		log.Printf("Unregistered %q", identity)
+// kick unregisters every connection holding identity, with all their other
+// identities, and returns them for the caller to close.
+func (s *Server) kick(identity string) []*connInfo {
+	s.routeMu.Lock()
+	var conns []*connInfo
+	if holder, ok := s.agents[identity]; ok {
+		conns = append(slices.Clone(s.standby[identity]), holder)
 	}
-}
+	var gone []string
+	for _, ci := range conns {
+		gone = append(gone, s.dropConnLocked(ci)...)
+	}
+	s.routeMu.Unlock()
 
-// readPacket reads a length-prefixed protobuf Packet from conn.
-// Wire format: [4 bytes big-endian uint32 length][length bytes protobuf].
-func readPacket(conn net.Conn) (*Packet, error) {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
-		return nil, err
+	for _, identity := range gone {
+		s.announce("fed:unregister", identity)
 	}
-	msgLen := binary.BigEndian.Uint32(lenBuf[:])
+	return conns
+}
 
-	if msgLen == 0 {
-		return nil, fmt.Errorf("zero-length packet")
+// handleKick answers a kick:<identity> packet from c. Only -admin-keys may
+// kick. The reply goes out before the connections close, in case c is one
+// of them.
+func (s *Server) handleKick(c *connInfo, p *Packet) error {
+	identity := strings.TrimPrefix(p.Dst, "kick:")
+	if !s.isAdmin(p) {
+		s.log.Printf("REJECTED error:forbidden from %s (src=%s): kick %q without an admin key", c.addr, p.Src, identity)
+		return reply(c, p, "error:forbidden")
 	}
-	if msgLen > MaxPacketSize {
-		return nil, fmt.Errorf("packet too large: %d > %d", msgLen, MaxPacketSize)
+	conns := s.kick(identity)
+	s.log.Printf("Kicked %q at %s's request: closing %d connections", identity, p.Src, len(conns))
+	body, _ := json.Marshal(kickAck{Status: "done", Kicked: identity, Closed: len(conns)})
+	err := reply(c, p, string(body))
+	for _, ci := range conns {
+		ci.sayClose(closeKicked)
+		ci.Close()
 	}
+	return err
+}
 
-	payload := make([]byte, msgLen)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return nil, err
-	}
+// errFrameNotStarted marks a write error that happened before any byte of the
+// frame was written, so the stream is still in sync.
+var errFrameNotStarted = errors.New("frame not started")
 
-	var p Packet
-	if err := proto.Unmarshal(payload, &p); err != nil {
-		return nil, fmt.Errorf("unmarshal: %w", err)
-	}
-	return &p, nil
+// isTransientWrite reports whether err is a write that timed out without
+// writing anything, as when the peer's receive window is full. Retrying it
+// cannot corrupt the stream.
+func isTransientWrite(err error) bool {
+	return errors.Is(err, errFrameNotStarted) && errors.Is(err, os.ErrDeadlineExceeded)
 }
 
-// writePacket serializes a Packet with a 4-byte big-endian length prefix and writes it to conn.
-func writePacket(conn net.Conn, p *Packet) error {
-	data, err := proto.Marshal(p)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+// writeFrameProbing writes frame, a whole frame or JSON line, to conn, whose
+// write deadline is already set to the probe. If some but not all of it goes
+// out before the deadline, the rest is written with timeout instead (0 means
+// no deadline).
+func writeFrameProbing(conn net.Conn, frame []byte, timeout time.Duration) error {
+	n, err := conn.Write(frame)
+	if err == nil {
+		return nil
 	}
-	if len(data) > MaxPacketSize {
-		return fmt.Errorf("packet too large: %d > %d", len(data), MaxPacketSize)
+	if n == 0 {
+		return fmt.Errorf("%w: %w", errFrameNotStarted, err)
 	}
-
-	var lenBuf [4]byte
-	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
-
-	if _, err := conn.Write(lenBuf[:]); err != nil {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
 		return err
 	}
-	if _, err := conn.Write(data); err != nil {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetWriteDeadline(deadline)
+	_, err = conn.Write(frame[n:])
+	return err
+}
+
+// loadServerKey sets the server key from -server-key, or generates an
+// ephemeral key if none is configured.
+func (s *Server) loadServerKey() error {
+	if s.cfg.ServerKeyPath == "" {
+		_, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return err
+		}
+		s.key = priv
+		return nil
+	}
+	priv, err := loadPrivateKey(s.cfg.ServerKeyPath)
+	if err != nil {
 		return err
 	}
+	s.key = priv
 	return nil
 }
 
-func heartbeat() {
-	ticker := time.NewTicker(60 * time.Second)
+// heartbeatBody is the JSON body of a heartbeat. Seq increases by one per
+// broadcast for the life of the server, so a gap means missed
+// heartbeats and a reset means the server restarted.
+type heartbeatBody struct {
+	Seq uint64 `json:"seq"`
+	TS  int64  `json:"ts"` // Unix milliseconds
+}
+
+// heartbeat broadcasts every -heartbeat-interval until the server closes.
+func (s *Server) heartbeat() {
+	ticker := time.NewTicker(s.cfg.HeartbeatInterval)
 	defer ticker.Stop()
-	for range ticker.C {
-		hb := &Packet{
-			Typ: 2,
-			Src: "server",
-		}
-		routeMu.Lock()
-		for identity, conn := range agents {
-			if err := writePacket(conn, hb); err != nil {
-				log.Printf("Heartbeat fail %s: %v", identity, err)
-				delete(connSrc, conn)
-				delete(agents, identity)
-				conn.Close()
-			}
+	for {
+		select {
+		case <-ticker.C:
+			s.broadcastHeartbeat()
+		case <-s.done:
+			return
 		}
-		routeMu.Unlock()
 	}
 }
 
-// verifySig checks the ed25519 signature on a Packet.
-// The signed payload is the Packet with sig and pk zeroed out, then serialized.
-func verifySig(p *Packet) bool {
-	if len(p.Sig) == 0 || len(p.Pk) == 0 {
-		return false // unsigned packet
+// broadcastHeartbeat sends one signed heartbeat to every registered
+// connection, however many identities it holds, and drops connections that
+// can't be written to. The packet is signed once for everyone; with
+// -coalesce-broadcast it is marshaled once too and the same bytes go to every
+// connection, otherwise each write marshals it again.
+//
+// Each heartbeat expects a pong before the next one. With -pong-misses set,
+// an agent that has left that many unanswered is dropped instead: its writes
+// may still succeed into the kernel buffer long after it stopped reading.
+func (s *Server) broadcastHeartbeat() {
+	body, _ := json.Marshal(heartbeatBody{Seq: s.heartbeatSeq.Add(1), TS: time.Now().UnixMilli()})
+	hb := &Packet{
+		Typ:  TypeHeartbeat,
+		Src:  s.cfg.ReplySrc,
+		Body: string(body),
 	}
-	if len(p.Pk) != ed25519.PublicKeySize {
-		log.Printf("Malformed pk: expected %d bytes, got %d", ed25519.PublicKeySize, len(p.Pk))
-		return false
+	if err := wire.Sign(hb, s.key); err != nil {
+		s.log.Printf("Heartbeat sign failed: %v", err)
+		return
 	}
-	if len(p.Sig) != ed25519.SignatureSize {
-		log.Printf("Malformed sig: expected %d bytes, got %d", ed25519.SignatureSize, len(p.Sig))
-		return false
+	var marshaled []byte // hb marshaled once for every connection
+	if s.cfg.CoalesceBroadcast {
+		marshaled, _ = proto.Marshal(hb)
+	}
+	var (
+		dead   []string
+		sent   []*connInfo
+		silent []*connInfo // closed for -pong-misses once routeMu is released
+	)
+	s.routeMu.Lock()
+	for ci := range s.connSrc {
+		if n := ci.unanswered.Load(); s.cfg.PongMisses > 0 && n >= int32(s.cfg.PongMisses) {
+			s.log.Printf("No pong from %s for %d heartbeats, closing", ci.addr, n)
+			s.pongTimeouts.Add(1)
+			dead = append(dead, s.dropConnLocked(ci)...)
+			silent = append(silent, ci)
+			continue
+		}
+		// Buffered connections are flushed after routeMu is released.
+		ci.cork()
+		err := ci.sendWire(hb, marshaled)
+		if err == nil {
+			ci.unanswered.Add(1)
+			sent = append(sent, ci)
+			continue
+		}
+		ci.uncork()
+		s.log.Printf("Heartbeat fail %s: %v", ci.addr, err)
+		dead = append(dead, s.dropConnLocked(ci)...)
+		ci.Close()
+	}
+	s.routeMu.Unlock()
+	for _, ci := range sent {
+		if err := ci.uncork(); err != nil {
+			s.log.Printf("Heartbeat flush %s: %v", ci.addr, err)
+		}
 	}
+	for _, ci := range silent {
+		ci.sayClose(closePongTimeout)
+		ci.Close()
+	}
+	for _, identity := range dead {
+		s.announce("fed:unregister", identity)
+	}
+}
 
-	// Reconstruct the exact bytes that were signed:
-	// a copy of the packet with sig and pk cleared.
-	signCopy := &Packet{
-		Typ:  p.Typ,
-		Id:   p.Id,
-		Src:  p.Src,
-		Dst:  p.Dst,
-		Body: p.Body,
-		Fee:  p.Fee,
-		Ttl:  p.Ttl,
-		Scar: p.Scar,
-		// Sig and Pk intentionally omitted (zero value)
-	}
-	signBytes, err := proto.Marshal(signCopy)
-	if err != nil {
-		log.Printf("Marshal for verify failed: %v", err)
-		return false
+// verify checks p's signature on the -verify-workers pool, or inline
+// without one. A secp256k1 signature is checked only on the pool and within
+// -secp256k1-rate (see allowSecp256k1). It returns nil if the signature is
+// valid, else why not, for the caller to log.
+func (s *Server) verify(p *Packet) error {
+	if p.Alg == wire.AlgSecp256k1 && !s.allowSecp256k1(time.Now()) {
+		return errSecp256k1Refused
+	}
+	if s.verifier == nil {
+		return wire.Verify(p)
 	}
+	return s.verifier.verify(p)
+}
 
-	return ed25519.Verify(p.Pk, signBytes, p.Sig)
+// orUnknown substitutes "unknown" for build metadata not set via -ldflags.
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
 }
 
-// handleDiscover responds to discover:* queries with server metadata.
-func handleDiscover(c net.Conn, p *Packet) {
+// DiscoverWriteTimeout bounds a discovery reply even when -write-timeout is
+// off, so a client that queries but doesn't read can't stall its handler.
+const DiscoverWriteTimeout = 5 * time.Second
+
+// handleDiscover responds to discover:* queries with server metadata. An
+// error means the reply could not be written and the connection was closed.
+func (s *Server) handleDiscover(c *connInfo, p *Packet) error {
 	suffix := strings.TrimPrefix(p.Dst, "discover:")
+	if !s.allowDiscover(p.Src, time.Now()) {
+		s.discoverThrottled.Add(1)
+		s.log.Printf("REJECTED error:rate_limited from %s (src=%s): discover:%s", c.addr, p.Src, suffix)
+		return reply(c, p, "error:rate_limited")
+	}
 	var body string
+	var err error // the reply could not be encoded
+	var tap bool  // subscribe c to the log once the reply is sent
 
-	switch suffix {
+	// Only discover:agents takes a query
+	name, query, _ := strings.Cut(suffix, "?")
+	if name != "agents" {
+		name = suffix
+	}
+	switch name {
 	case "info":
-		routeMu.RLock()
-		online := len(agents)
-		routeMu.RUnlock()
-
-		data, _ := json.Marshal(map[string]any{
-			"version":       ServerVersion,
-			"agents_online": online,
-			"uptime_sec":    int(time.Since(serverStart).Seconds()),
-		})
-		body = string(data)
+		body, err = s.discoverBody(suffix, s.infoBody)
 
 	case "agents":
-		routeMu.RLock()
-		list := make([]string, 0, len(agents))
-		for identity := range agents {
-			list = append(list, identity)
+		if query == "" {
+			body, err = s.discoverBody(suffix, func() (string, error) { return s.agentsBody(nil) })
+			break
 		}
-		routeMu.RUnlock()
+		filter, ok := parseLabelFilter(query)
+		if !ok {
+			body, err = marshalDiscovery(map[string]string{"error": "invalid_filter", "query": suffix})
+			break
+		}
+		body, err = s.agentsBody(filter)
 
-		data, _ := json.Marshal(map[string]any{
-			"agents": list,
-		})
-		body = string(data)
+	case "agent":
+		body, err = s.agentBody(p.Body)
 
 	case "stats":
-		scarCountMu.Lock()
-		counts := make(map[string]int64, len(scarCount))
-		for k, v := range scarCount {
-			counts[k] = v
+		body, err = s.discoverBody(suffix, func() (string, error) {
+			return marshalDiscovery(s.localStats(false))
+		})
+
+	case "cluster-stats":
+		body, err = marshalDiscovery(s.gatherClusterStats())
+
+	case "usage":
+		snap := s.usageSnapshot()
+		if p.Body != "" {
+			u, ok := snap[p.Body]
+			snap = map[string]identityUsage{}
+			if ok {
+				snap[p.Body] = u
+			}
 		}
-		scarCountMu.Unlock()
+		body, err = marshalDiscovery(map[string]any{"usage": snap})
 
-		data, _ := json.Marshal(map[string]any{
-			"scar_exchanges": counts,
-			"total_packets":  totalPackets.Load(),
-		})
-		body = string(data)
+	case "config":
+		if !s.isAdmin(p) {
+			body = "error:forbidden"
+			break
+		}
+		state := map[string]any{
+			"flags":           s.cfg.snapshot(),
+			"version":         ServerVersion,
+			"max_packet_size": wire.MaxPacketSize,
+		}
+		if q := s.quotas.Load(); q != nil {
+			state["quotas"] = q
+		}
+		if q := s.scarLimits.Load(); q != nil {
+			state["scar_limits"] = q
+		}
+		if a := s.acl.Load(); a != nil {
+			state["acl"] = a
+		}
+		body, err = marshalDiscovery(state)
+
+	case "tail":
+		if !s.isAdmin(p) {
+			body = "error:forbidden"
+			break
+		}
+		body, err = marshalDiscovery(map[string]any{"tail": "subscribed", "buffer": tapBuffer})
+		tap = err == nil
+
+	case "health":
+		body, err = s.healthBody()
+
+	case "ring":
+		state := map[string]any{"enabled": s.ring != nil, "self": s.cfg.ServerID}
+		if s.ring != nil {
+			state["vnodes"] = s.ring.vnodes
+			state["nodes"] = s.ring.members()
+			if p.Body != "" {
+				state["owner"] = s.ring.lookup(p.Body)
+			}
+		}
+		body, err = marshalDiscovery(state)
 
 	default:
-		body = "error:unknown_discovery"
+		// JSON like every other discovery reply, so clients can tell an
+		// error from a payload by its "error" key.
+		body, err = marshalDiscovery(map[string]string{
+			"error": "unknown_discovery",
+			"query": suffix,
+		})
+	}
+	// An empty body would read as an answer with nothing in it
+	if err != nil {
+		s.log.Printf("Discover %s -> %s: encoding the reply failed: %v", p.Src, suffix, err)
+		body = "error:internal"
+	}
+
+	resp := &Packet{
+		Id:      p.Id,
+		Typ:     TypeReply,
+		Src:     s.cfg.ReplySrc,
+		Body:    body,
+		Channel: p.Channel,
+	}
+	c.signReply(resp)
+	timeout := s.discoverTimeout
+	if c.writeTimeout > 0 && c.writeTimeout < timeout {
+		timeout = c.writeTimeout
+	}
+	if err := c.sendWithin(resp, timeout); err != nil {
+		return fmt.Errorf("discover reply: %w", err)
+	}
+	if tap {
+		// Records follow the reply, starting with this query's log line.
+		s.startTap(c, p)
+	}
+	s.log.Printf("Discover %s -> %s: %s", p.Src, suffix, body)
+	return nil
+}
+
+// marshalDiscovery encodes a discovery reply body. It is a variable so tests
+// can make encoding fail.
+var marshalDiscovery = func(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// infoBody is the discover:info reply.
+func (s *Server) infoBody() (string, error) {
+	s.routeMu.RLock()
+	online := len(s.agents)
+	s.routeMu.RUnlock()
+
+	info := map[string]any{
+		"version":       ServerVersion,
+		"agents_online": online,
+		"uptime_sec":    int(time.Since(s.start).Seconds()),
+		"commit":        orUnknown(commit),
+		"build_date":    orUnknown(buildDate),
+		"go_version":    runtime.Version(),
+		"os":            runtime.GOOS,
+		"arch":          runtime.GOARCH,
+		"sig_algs":      s.sigAlgs(),
+	}
+	if s.key != nil {
+		info["server_pk"] = hex.EncodeToString(s.key.Public().(ed25519.PublicKey))
+	}
+	return marshalDiscovery(info)
+}
+
+// agentsBody is the discover:agents reply: the agents matching filter, or
+// all of them if it is nil, with the labels of those that have any.
+func (s *Server) agentsBody(filter labelFilter) (string, error) {
+	s.routeMu.RLock()
+	list := make([]string, 0, len(s.agents))
+	labels := make(map[string]map[string]string)
+	for identity, ci := range s.agents {
+		l := ci.getLabels()
+		if filter != nil && !filter.match(l) {
+			continue
+		}
+		list = append(list, identity)
+		if l != nil {
+			labels[identity] = l
+		}
+	}
+	s.routeMu.RUnlock()
+
+	out := map[string]any{"agents": list}
+	if len(labels) > 0 {
+		out["labels"] = labels
+	}
+	return marshalDiscovery(out)
+}
+
+// isAdmin reports whether p was signed by one of -admin-keys.
+func (s *Server) isAdmin(p *Packet) bool {
+	pk := hex.EncodeToString(p.Pk)
+	for _, k := range s.cfg.AdminKeys {
+		if strings.EqualFold(k, pk) {
+			return true
+		}
 	}
+	return false
+}
 
+// reply sends a server response to p on c, echoing p.Id and p.Channel for
+// correlation.
+// If p names a (validated) ReplyTo identity that is still registered, the
+// response goes there instead; a failure to deliver it is only logged, since
+// c itself is fine.
+func reply(c *connInfo, p *Packet, body string) error {
+	c.srv.recordDedupReply(p, body)
+	if strings.HasPrefix(body, "error:") {
+		c.srv.errorReplies.Add(1)
+	}
 	resp := &Packet{
-		Id:   p.Id,
-		Typ:  1,
-		Src:  "server",
-		Body: body,
+		Id:      p.Id,
+		Typ:     TypeReply,
+		Src:     c.srv.cfg.ReplySrc,
+		Body:    body,
+		Channel: p.Channel,
+	}
+	if p.ReplyTo != "" && p.ReplyTo != p.Src {
+		if target := c.srv.lookupAgent(p.ReplyTo); target != nil {
+			target.signReply(resp)
+			if err := target.send(resp); err != nil {
+				c.srv.log.Printf("Reply %s for %s -> %s failed: %v", p.Id, p.Src, p.ReplyTo, err)
+			}
+			return nil
+		}
 	}
-	if err := writePacket(c, resp); err != nil {
-		log.Printf("Write error (discover): %v", err)
+	c.signReply(resp)
+	return c.send(resp)
+}
+
+// checkRequiredFields rejects signed packets whose fields can't be routed,
+// returning the error reply or "" if p is well formed. A packet needs a
+// non-empty Src naming the sender and a non-empty Dst, which is "server" for
+// the server itself; only a pong or goodbye, addressed to the server by its
+// typ, may leave Dst empty. A payload that proto.Unmarshal accepts but that
+// lacks these (a stray or truncated message, say) gets error:malformed
+// instead of being routed as if it came from nobody, and a Priority outside
+// the defined classes gets error:bad_priority. Sig and Pk are checked by the
+// unsigned drop and wire.Verify.
+func checkRequiredFields(p *Packet) string {
+	if strings.TrimSpace(p.Src) == "" {
+		return "error:malformed"
+	}
+	if p.Dst == "" && p.Typ != TypePong && p.Typ != TypeGoodbye {
+		return "error:malformed"
+	}
+	if p.Priority >= uint32(len(priorityRank)) {
+		return "error:bad_priority"
+	}
+	return ""
+}
+
+// checkFieldLimits enforces the configured Body, Scar and tag limits and the
+// label limits, returning the error reply for an oversize field or "" if p
+// is within policy.
+func (s *Server) checkFieldLimits(p *Packet) string {
+	if s.cfg.MaxBodySize > 0 && len(p.Body) > s.cfg.MaxBodySize {
+		return "error:body_too_large"
+	}
+	if s.cfg.MaxScarSize > 0 && len(p.Scar) > s.cfg.MaxScarSize {
+		return "error:scar_too_large"
+	}
+	if reason := checkLabels(p); reason != "" {
+		return reason
+	}
+	return s.checkTags(p)
+}
+
+// expired reports whether p's expires_at deadline has passed at now.
+// Packets without one never expire.
+func expired(p *Packet, now time.Time) bool {
+	return p.ExpiresAt != 0 && uint64(now.UnixMilli()) >= p.ExpiresAt
+}
+
+// errExpired is returned by forward for a packet whose deadline passed while
+// it waited for the destination's send queue.
+var errExpired = errors.New("expired before it could be written")
+
+// dropExpired discards p, which expired before it could be delivered, and
+// tells the sender unless -quiet-expiry is set.
+func (s *Server) dropExpired(c *connInfo, p *Packet, received time.Time) error {
+	s.expiredPackets.Add(1)
+	s.log.Printf("EXPIRED %s -> %s (id=%s, %v after receipt)", p.Src, p.Dst, p.Id, time.Since(received).Round(time.Millisecond))
+	s.auditRecord(p, outcomeExpired, true)
+	if s.cfg.QuietExpiry {
+		return nil
+	}
+	return reply(c, p, "error:expired")
+}
+
+// logSampler thins out a high-volume log line to 1 in every, starting with
+// the first. Counters and the audit log never sample.
+type logSampler struct {
+	every atomic.Int64 // <= 1 logs all
+	n     atomic.Uint64
+}
+
+func (s *logSampler) ok() bool {
+	every := s.every.Load()
+	if every <= 1 {
+		return true
+	}
+	return (s.n.Add(1)-1)%uint64(every) == 0
+}
+
+// setLogSample applies -log-sample. The rate lives in the samplers rather
+// than being read from the config because route lines are logged after the
+// write they report, when nothing orders them against a config change.
+func (s *Server) setLogSample(every int) {
+	s.receiptLog.every.Store(int64(every))
+	s.routeLog.every.Store(int64(every))
+}
+
+// auditRecord appends p's routing outcome to the audit log, if enabled.
+func (s *Server) auditRecord(p *Packet, outcome string, sigValid bool) {
+	if err := s.audit.record(p, outcome, sigValid, s.loggedTags(p)); err != nil {
+		s.log.Printf("Audit log write failed: %v", err)
 	}
-	log.Printf("Discover %s -> %s: %s", p.Src, suffix, body)
 }
 
-func handleConnection(c net.Conn) {
+func (s *Server) handleConnection(conn net.Conn, opts listenerOpts) {
+	c := s.newConnInfo(conn)
 	defer c.Close()
-	addr := c.RemoteAddr().String()
-	defer unregisterConn(c)
+	c.readCap = opts.readCap
+	if s.fair != nil && s.cfg.MaxInFlight > 0 {
+		c.inflight = make(chan struct{}, s.cfg.MaxInFlight)
+	}
+	if opts.json {
+		c.json = true
+		c.lines = newLineScanner(conn)
+	}
+	addr := c.addr
+	var identity string // last src this connection registered as
+	defer func() { s.foldUsage(identity, c) }()
+	defer s.observeConnEnd(c)
+	defer s.unregisterConn(c)
+	defer s.leaveGroups(c)
+	defer s.endStream(c)
+	defer s.stopTap(c)
+	defer s.suspendSession(c) // before it leaves its groups and identities
+	idle := s.cfg.IdleTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	for {
-		p, err := readPacket(c)
+		// Keepalive only catches a dead peer; the idle timeout also drops a
+		// live one that has gone quiet.
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		before := c.bytesIn.Load()
+		p, err := c.recv()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Read error from %s: %v", addr, err)
+			switch {
+			case err == io.EOF, errors.Is(err, net.ErrClosed):
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				s.log.Printf("Idle timeout from %s after %v", addr, idle)
+				c.sayClose(closeIdleTimeout)
+			case errors.Is(err, wire.ErrPacketTooLarge), errors.Is(err, wire.ErrReadCap):
+				s.log.Printf("Read error from %s: %v", addr, err)
+				c.sayClose(closeFrameTooLarge)
+			case errors.Is(err, wire.ErrMalformedFrame):
+				s.log.Printf("Read error from %s: %v", addr, err)
+				c.sayClose(closeProtocolError)
+			default:
+				s.log.Printf("Read error from %s: %v", addr, err)
 			}
 			return
 		}
+		received := time.Now()
+		size := c.bytesIn.Load() - before // framed wire bytes of p
+		c.packetsIn.Add(1)
 
-		// Signature is REQUIRED — unsigned packets are logged and dropped
-		if len(p.Sig) == 0 && len(p.Pk) == 0 {
-			log.Printf("DROPPED unsigned packet from %s (src=%s body=%q)", addr, p.Src, p.Body)
+		// A streaming connection just pipes to its peer
+		if st := c.stream.Load(); st != nil {
+			if s.pipeStream(c, st, p) != nil {
+				return
+			}
 			continue
 		}
 
-		if !verifySig(p) {
-			log.Printf("DROPPED invalid sig from %s (src=%s)", addr, p.Src)
+		// Signature is REQUIRED — unsigned packets are logged and dropped,
+		// unless the listener is trusted to send them
+		unsigned := len(p.Sig) == 0 && len(p.Pk) == 0
+		if unsigned && !opts.trusted {
+			s.log.Printf("DROPPED unsigned packet from %s (src=%s body=%q)", addr, p.Src, p.Body)
+			s.droppedUnsigned.Add(1)
+			s.auditRecord(p, outcomeDroppedUnsigned, false)
 			continue
 		}
 
-		// Register agent identity from first valid packet's src field
-		if p.Src != "" {
-			registerConn(p.Src, c)
+		// Cheap structural checks before the signature is verified
+		if reason := checkRequiredFields(p); reason != "" {
+			s.log.Printf("REJECTED %s from %s (src=%q dst=%q)", reason, addr, p.Src, p.Dst)
+			s.auditRecord(p, outcomeMalformed, false)
+			if err := reply(c, &Packet{Id: p.Id, Channel: p.Channel}, reason); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+
+		if !unsigned {
+			if err := s.verify(p); err != nil {
+				s.log.Printf("DROPPED invalid sig from %s (src=%s): %v", addr, p.Src, err)
+				s.droppedInvalidSig.Add(1)
+				s.auditRecord(p, outcomeDroppedInvalidSig, false)
+				continue
+			}
 		}
 
-		totalPackets.Add(1)
+		c.lastPK.Store(&p.Pk)
 
-		// Log scar/barter exchanges
-		if len(p.Scar) > 0 {
-			log.Printf("SCAR %s -> %s (%d bytes)", p.Src, p.Dst, len(p.Scar))
-			scarCountMu.Lock()
-			if len(scarCount) < MaxScarEntries {
-				scarCount[p.Src]++
-			} else if _, exists := scarCount[p.Src]; exists {
-				scarCount[p.Src]++
+		if p.ReplyTo != "" && !s.validReplyTo(p) {
+			s.log.Printf("REJECTED error:invalid_reply_to from %s (src=%s reply_to=%s)", addr, p.Src, p.ReplyTo)
+			s.auditRecord(p, outcomeRejected, true)
+			// Answer the sender itself, not the identity it tried to name.
+			if err := reply(c, &Packet{Id: p.Id, Channel: p.Channel}, "error:invalid_reply_to"); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
 			}
-			scarCountMu.Unlock()
+			continue
 		}
 
-		log.Printf("From %s (typ %d): %s -> %s", p.Src, p.Typ, p.Body, p.Dst)
+		if reason := s.checkFieldLimits(p); reason != "" {
+			s.log.Printf("REJECTED %s from %s (src=%s body=%d scar=%d tags=%d)", reason, addr, p.Src, len(p.Body), len(p.Scar), len(p.Tags))
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, reason); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
 
-		// Route based on dst field
-		switch {
-		case strings.HasPrefix(p.Dst, "discover:"):
-			handleDiscover(c, p)
+		if p.Typ == TypeGoodbye {
+			s.log.Printf("Goodbye from %s (src=%s)", addr, p.Src)
+			s.auditRecord(p, outcomeGoodbye, true)
+			return
+		}
 
-		case p.Dst == "server" || p.Dst == "":
-			// Backward compatible: reply "done"
-			resp := &Packet{
-				Id:   p.Id,
-				Typ:  1,
-				Src:  "server",
-				Body: "done",
+		// Identity first: nothing is routed before a registration packet
+		if s.cfg.RequireRegistration && identity == "" && p.Typ != TypeRegister {
+			s.log.Printf("REJECTED error:expected_registration from %s (src=%s typ=%d), closing", addr, p.Src, p.Typ)
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, "error:expected_registration"); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
 			}
-			if err := writePacket(c, resp); err != nil {
-				log.Printf("Write error to %s: %v", addr, err)
+			c.sayClose(closeRegistrationRequired)
+			return
+		}
+
+		// A pong only proves the connection is alive; it is not routed
+		if p.Typ == TypePong {
+			c.unanswered.Store(0)
+			s.auditRecord(p, outcomePong, true)
+			continue
+		}
+
+		// Directives come only from the server
+		if p.Typ == TypeDirective {
+			s.log.Printf("REJECTED error:forbidden from %s (src=%s): typ %d is the server's", addr, p.Src, p.Typ)
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, "error:forbidden"); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
 				return
 			}
+			continue
+		}
 
-		default:
-			// Forward to registered agent
-			routeMu.RLock()
-			target, exists := agents[p.Dst]
-			routeMu.RUnlock()
-
-			if !exists {
-				resp := &Packet{
-					Id:   p.Id,
-					Typ:  1,
-					Src:  "server",
-					Body: "error:offline",
-				}
-				if err := writePacket(c, resp); err != nil {
-					log.Printf("Write error to %s: %v", addr, err)
-					return
-				}
-				log.Printf("Route %s -> %s: offline", p.Src, p.Dst)
-				continue
+		// Replies echo the id; without one they can't be matched up
+		if s.cfg.RequireID && p.Id == "" {
+			s.log.Printf("REJECTED error:missing_id from %s (src=%s dst=%s)", addr, p.Src, p.Dst)
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, "error:missing_id"); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+
+		// Past its deadline already: not worth a quota charge or a route
+		if expired(p, received) {
+			if err := s.dropExpired(c, p, received); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+
+		// Register agent identity from first valid packet's src field
+		reg := s.registerConn(p.Src, c)
+		if reason := rejectReason[reg]; reason != "" {
+			s.log.Printf("REJECTED %s from %s (src=%s)", reason, addr, clipIdentity(p.Src))
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, reason); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+		identity = p.Src
+		if p.Typ == TypeRegister {
+			c.setLabels(p.Labels)
+			c.maxPacketSize.Store(p.MaxPacketSize)
+		}
+
+		// Charged only once src is known to be the sender's, so a packet
+		// naming someone else's identity can't spend their quota
+		if !s.chargeQuota(p.Src, size, received) {
+			s.log.Printf("REJECTED error:quota_exceeded from %s (src=%s)", addr, p.Src)
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, "error:quota_exceeded"); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+
+		if !s.chargeScar(p, received) {
+			s.scarLimited.Add(1)
+			s.log.Printf("REJECTED error:scar_limit from %s (src=%s scar=%d)", addr, p.Src, len(p.Scar))
+			s.auditRecord(p, outcomeRejected, true)
+			if err := reply(c, p, "error:scar_limit"); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+
+		// A resend of a packet already handled gets the original's reply
+		if dup, result, replied := s.checkDedup(p, received); dup {
+			if err := s.replayDuplicate(c, p, reg, result, replied); err != nil {
+				s.log.Printf("Write error to %s: %v", addr, err)
+				return
+			}
+			continue
+		}
+
+		s.totalPackets.Add(1)
+		s.countTyp(p.Typ)
+
+		// Log scar/barter exchanges
+		if len(p.Scar) > 0 {
+			if s.scars != nil && s.scars.seen(p.Scar) {
+				s.log.Printf("SCAR %s -> %s (%d bytes, repeat)", p.Src, p.Dst, len(p.Scar))
+			} else {
+				s.log.Printf("SCAR %s -> %s (%d bytes)", p.Src, p.Dst, len(p.Scar))
+			}
+			s.scarCountMu.Lock()
+			if len(s.scarCount) < MaxScarEntries {
+				s.scarCount[p.Src]++
+			} else if _, exists := s.scarCount[p.Src]; exists {
+				s.scarCount[p.Src]++
 			}
+			s.scarCountMu.Unlock()
+		}
+
+		if s.receiptLog.ok() {
+			s.log.Printf("From %s (typ %d): %s -> %s%s", p.Src, p.Typ, p.Body, p.Dst, s.tagFields(p))
+		}
 
-			// Forward original signed packet (preserving signature)
-			if err := writePacket(target, p); err != nil {
-				resp := &Packet{
-					Id:   p.Id,
-					Typ:  1,
-					Src:  "server",
-					Body: "error:delivery_failed",
+		// Route based on dst field, then acknowledge a new registration.
+		// The ack follows the reply so that a handshake packet, which
+		// registers before it negotiates the ack, still gets one.
+		// With -write-buffer, the reply and ack leave in one flush before
+		// the handler goes back to reading.
+		handle := func() error {
+			c.cork()
+			if err := s.router.Route(withReceived(ctx, received), p, c); err != nil {
+				c.uncork()
+				return err
+			}
+			if reg == regNew || reg == regReplaced || reg == regShared {
+				if err := s.ackRegistration(c, p, reg == regReplaced); err != nil {
+					c.uncork()
+					return err
 				}
-				if writeErr := writePacket(c, resp); writeErr != nil {
-					log.Printf("Write error to %s: %v", addr, writeErr)
+			}
+			return c.uncork()
+		}
+		// Take turns with other sources when the fair queue is on
+		if s.fair != nil {
+			if !c.acquireInFlight() {
+				return
+			}
+			s.fair.push(p.Src, size, func() {
+				defer c.releaseInFlight()
+				// It may have expired while it waited its turn
+				if expired(p, time.Now()) {
+					if s.dropExpired(c, p, received) != nil {
+						c.Close()
+					}
 					return
 				}
-				log.Printf("Route %s -> %s: delivery failed: %v", p.Src, p.Dst, err)
-				continue
-			}
-			log.Printf("Routed %s -> %s", p.Src, p.Dst)
+				if handle() != nil {
+					c.Close()
+				}
+			})
+			continue
+		}
+		if handle() != nil {
+			return
+		}
+	}
+}
+
+// acquireInFlight takes one of the connection's -max-inflight slots. With
+// none free, it pauses the connection's reader, and so TCP pushes back on the
+// sender, until a packet it queued has been handled. It reports false if the
+// server closed while it waited.
+func (c *connInfo) acquireInFlight() bool {
+	if c.inflight == nil {
+		return true
+	}
+	select {
+	case c.inflight <- struct{}{}:
+		return true
+	default:
+	}
+	c.srv.inflightPauses.Add(1)
+	select {
+	case c.inflight <- struct{}{}:
+		return true
+	case <-c.srv.done:
+		return false
+	}
+}
+
+// releaseInFlight frees a slot taken by acquireInFlight.
+func (c *connInfo) releaseInFlight() {
+	if c.inflight != nil {
+		<-c.inflight
+	}
+}
+
+// observeConnEnd records a closing connection's lifetime and packet count.
+func (s *Server) observeConnEnd(c *connInfo) {
+	s.connLifetime.observe(time.Since(c.connected))
+	s.connPackets.observeN(c.packetsIn.Load())
+}
+
+// sayGoodbye notifies every registered agent that the server is going away.
+func (s *Server) sayGoodbye() {
+	s.routeMu.RLock()
+	conns := make([]*connInfo, 0, len(s.connSrc))
+	for ci := range s.connSrc {
+		conns = append(conns, ci)
+	}
+	s.routeMu.RUnlock()
+
+	for _, ci := range conns {
+		if err := ci.send(ci.closeNotice(closeShutdown)); err != nil {
+			s.log.Printf("Goodbye to %s failed: %v", ci.addr, err)
 		}
 	}
 }
 
 func main() {
-	serverStart = time.Now()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	verify := flag.String("verify-audit", "", "verify the audit log chain in the given file(s), comma-separated oldest first, and exit")
+	auditPK := flag.String("audit-pk", "", "hex server_pk to check -verify-audit signatures against (default: the public half of -server-key)")
+	cfg := defaultConfig()
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *verify != "" {
+		pub, err := auditPublicKey(*auditPK, cfg.ServerKeyPath)
+		if err != nil {
+			log.Fatalf("-verify-audit: %v", err)
+		}
+		n, err := verifyAuditLog(pub, strings.Split(*verify, ",")...)
+		if err != nil {
+			log.Fatalf("Audit log verification failed after %d entries: %v", n, err)
+		}
+		log.Printf("Audit log OK: %d entries", n)
+		return
+	}
 
-	l, err := net.Listen("tcp", ":9009")
+	s, err := New(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("keep %s listening on :9009", ServerVersion)
 
-	go heartbeat()
+	l, err := systemdListener()
+	if err != nil {
+		log.Fatalf("socket activation: %v", err)
+	}
+	if l != nil {
+		log.Printf("keep %s listening on %s (socket-activated)", ServerVersion, l.Addr())
+	} else {
+		if l, err = listenProtocol(&cfg); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("keep %s listening on %s", ServerVersion, cfg.ListenAddr)
+	}
+	if !cfg.RequireSignature {
+		log.Printf("Accepting unsigned packets on %s unverified (-require-signature=false)", l.Addr())
+	}
+	if cfg.UnixPath != "" {
+		ul, err := listenUnix(cfg.UnixPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("keep %s listening on unix:%s", ServerVersion, cfg.UnixPath)
+		if !cfg.UnixRequireSignature {
+			log.Printf("Accepting unsigned packets on unix:%s unverified (-unix-require-signature=false)", cfg.UnixPath)
+		}
+		go s.Serve(ul)
+	}
+	if cfg.JSONAddr != "" {
+		jl, err := net.Listen("tcp", cfg.JSONAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("keep %s listening for JSON (debugging only) on %s", ServerVersion, cfg.JSONAddr)
+		go s.ServeJSON(jl)
+	}
+	go s.Serve(l)
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		<-sig
-		log.Println("Shutdown")
-		os.Exit(0)
+		for range hup {
+			if err := s.reloadQuotas(); err != nil {
+				log.Printf("Quota reload failed, keeping previous quotas: %v", err)
+			}
+			if err := s.reloadScarLimits(); err != nil {
+				log.Printf("Scar limit reload failed, keeping previous limits: %v", err)
+			}
+			if err := s.reloadACL(); err != nil {
+				log.Printf("ACL reload failed, keeping previous ACL: %v", err)
+			}
+		}
 	}()
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			continue
-		}
-		go handleConnection(conn)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Println("Shutdown")
+	if err := s.Shutdown(context.Background()); err != nil {
+		log.Printf("Shutdown: %v", err)
 	}
 }
@@ -1,205 +0,0 @@
-// Code generated by protoc-gen-go. DO NOT EDIT.
-// versions:
-// 	protoc-gen-go v1.36.11
-// 	protoc        v5.29.4
-// source: keep.proto
-
-package main
-
-import (
-	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
-	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
-	reflect "reflect"
-	sync "sync"
-	unsafe "unsafe"
-)
-
-const (
-	// Verify that this generated code is sufficiently up-to-date.
-	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
-	// Verify that runtime/protoimpl is sufficiently up-to-date.
-	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
-)
-
-type Packet struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Sig           []byte                 `protobuf:"bytes,1,opt,name=sig,proto3" json:"sig,omitempty"`
-	Pk            []byte                 `protobuf:"bytes,2,opt,name=pk,proto3" json:"pk,omitempty"`
-	Typ           uint32                 `protobuf:"varint,3,opt,name=typ,proto3" json:"typ,omitempty"`
-	Id            string                 `protobuf:"bytes,4,opt,name=id,proto3" json:"id,omitempty"`
-	Src           string                 `protobuf:"bytes,5,opt,name=src,proto3" json:"src,omitempty"`
-	Dst           string                 `protobuf:"bytes,6,opt,name=dst,proto3" json:"dst,omitempty"`
-	Body          string                 `protobuf:"bytes,7,opt,name=body,proto3" json:"body,omitempty"`
-	Fee           uint64                 `protobuf:"varint,8,opt,name=fee,proto3" json:"fee,omitempty"`
-	Ttl           uint32                 `protobuf:"varint,9,opt,name=ttl,proto3" json:"ttl,omitempty"`
-	Scar          []byte                 `protobuf:"bytes,10,opt,name=scar,proto3" json:"scar,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
-}
-
-func (x *Packet) Reset() {
-	*x = Packet{}
-	mi := &file_keep_proto_msgTypes[0]
-	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-	ms.StoreMessageInfo(mi)
-}
-
-func (x *Packet) String() string {
-	return protoimpl.X.MessageStringOf(x)
-}
-
-func (*Packet) ProtoMessage() {}
-
-func (x *Packet) ProtoReflect() protoreflect.Message {
-	mi := &file_keep_proto_msgTypes[0]
-	if x != nil {
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		if ms.LoadMessageInfo() == nil {
-			ms.StoreMessageInfo(mi)
-		}
-		return ms
-	}
-	return mi.MessageOf(x)
-}
-
-// Deprecated: Use Packet.ProtoReflect.Descriptor instead.
-func (*Packet) Descriptor() ([]byte, []int) {
-	return file_keep_proto_rawDescGZIP(), []int{0}
-}
-
-func (x *Packet) GetSig() []byte {
-	if x != nil {
-		return x.Sig
-	}
-	return nil
-}
-
-func (x *Packet) GetPk() []byte {
-	if x != nil {
-		return x.Pk
-	}
-	return nil
-}
-
-func (x *Packet) GetTyp() uint32 {
-	if x != nil {
-		return x.Typ
-	}
-	return 0
-}
-
-func (x *Packet) GetId() string {
-	if x != nil {
-		return x.Id
-	}
-	return ""
-}
-
-func (x *Packet) GetSrc() string {
-	if x != nil {
-		return x.Src
-	}
-	return ""
-}
-
-func (x *Packet) GetDst() string {
-	if x != nil {
-		return x.Dst
-	}
-	return ""
-}
-
-func (x *Packet) GetBody() string {
-	if x != nil {
-		return x.Body
-	}
-	return ""
-}
-
-func (x *Packet) GetFee() uint64 {
-	if x != nil {
-		return x.Fee
-	}
-	return 0
-}
-
-func (x *Packet) GetTtl() uint32 {
-	if x != nil {
-		return x.Ttl
-	}
-	return 0
-}
-
-func (x *Packet) GetScar() []byte {
-	if x != nil {
-		return x.Scar
-	}
-	return nil
-}
-
-var File_keep_proto protoreflect.FileDescriptor
-
-const file_keep_proto_rawDesc = "" +
-	"\n" +
-	"\n" +
-	"keep.proto\"\xbc\x01\n" +
-	"\x06Packet\x12\x10\n" +
-	"\x03sig\x18\x01 \x01(\fR\x03sig\x12\x0e\n" +
-	"\x02pk\x18\x02 \x01(\fR\x02pk\x12\x10\n" +
-	"\x03typ\x18\x03 \x01(\rR\x03typ\x12\x0e\n" +
-	"\x02id\x18\x04 \x01(\tR\x02id\x12\x10\n" +
-	"\x03src\x18\x05 \x01(\tR\x03src\x12\x10\n" +
-	"\x03dst\x18\x06 \x01(\tR\x03dst\x12\x12\n" +
-	"\x04body\x18\a \x01(\tR\x04body\x12\x10\n" +
-	"\x03fee\x18\b \x01(\x04R\x03fee\x12\x10\n" +
-	"\x03ttl\x18\t \x01(\rR\x03ttl\x12\x12\n" +
-	"\x04scar\x18\n" +
-	" \x01(\fR\x04scarB+Z)github.com/teacrawford/keep-protocol;mainb\x06proto3"
-
-var (
-	file_keep_proto_rawDescOnce sync.Once
-	file_keep_proto_rawDescData []byte
-)
-
-func file_keep_proto_rawDescGZIP() []byte {
-	file_keep_proto_rawDescOnce.Do(func() {
-		file_keep_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_keep_proto_rawDesc), len(file_keep_proto_rawDesc)))
-	})
-	return file_keep_proto_rawDescData
-}
-
-var file_keep_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
-var file_keep_proto_goTypes = []any{
-	(*Packet)(nil), // 0: Packet
-}
-var file_keep_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
-}
-
-func init() { file_keep_proto_init() }
-func file_keep_proto_init() {
-	if File_keep_proto != nil {
-		return
-	}
-	type x struct{}
-	out := protoimpl.TypeBuilder{
-		File: protoimpl.DescBuilder{
-			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
-			RawDescriptor: unsafe.Slice(unsafe.StringData(file_keep_proto_rawDesc), len(file_keep_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   1,
-			NumExtensions: 0,
-			NumServices:   0,
-		},
-		GoTypes:           file_keep_proto_goTypes,
-		DependencyIndexes: file_keep_proto_depIdxs,
-		MessageInfos:      file_keep_proto_msgTypes,
-	}.Build()
-	File_keep_proto = out.File
-	file_keep_proto_goTypes = nil
-	file_keep_proto_depIdxs = nil
-}
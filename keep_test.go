@@ -0,0 +1,1760 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// TestMain lets a test re-exec the test binary as a standalone server (see
+// startProcess), so multi-server scenarios each get their own process state.
+func TestMain(m *testing.M) {
+	if os.Getenv("KEEP_TEST_SERVER") == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// startProcess runs a server in a child process with the given flags and
+// waits until listenAddr accepts connections. The process is killed when the
+// test ends, or earlier by the caller.
+func startProcess(t *testing.T, listenAddr string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-listen", listenAddr}, args...)...)
+	cmd.Env = append(os.Environ(), "KEEP_TEST_SERVER=1")
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	waitFor(t, listenAddr+" to accept", func() bool {
+		c, err := net.Dial("tcp", listenAddr)
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	})
+	return cmd
+}
+
+// freeAddr returns a loopback address with a currently unused port.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// testAgent is a signing client connected to a test server.
+type testAgent struct {
+	t    *testing.T
+	conn net.Conn
+	src  string
+	priv ed25519.PrivateKey
+
+	codec frameCodec // negotiated frame codec; nil means uncompressed
+}
+
+// newTestServer returns a server with the default config, adjusted by each
+// configure func, that is shut down when the test ends. It accepts nothing
+// until given a listener.
+func newTestServer(t testing.TB, configure ...func(*Config)) *Server {
+	t.Helper()
+	c := defaultConfig()
+	c.Logger = log.New(os.Stderr, "", log.LstdFlags) // its own, for captureLog
+	for _, f := range configure {
+		f(&c)
+	}
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// serveLoopback serves s on a new loopback listener and returns its address.
+func serveLoopback(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// startServer runs a new test server on a loopback listener and returns it
+// with its address.
+func startServer(t *testing.T, configure ...func(*Config)) (*Server, string) {
+	t.Helper()
+	s := newTestServer(t, configure...)
+	return s, serveLoopback(t, s)
+}
+
+// dialAgent connects to addr as src with a fresh ed25519 key.
+func dialAgent(t *testing.T, addr, src string) *testAgent {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, priv, _ := ed25519.GenerateKey(nil)
+	return &testAgent{t: t, conn: conn, src: src, priv: priv}
+}
+
+// sign fills in Src (if unset) and signs p with the agent's key.
+func (a *testAgent) sign(p *Packet) *Packet {
+	if p.Src == "" {
+		p.Src = a.src
+	}
+	if err := wire.Sign(p, a.priv); err != nil {
+		a.t.Fatal(err)
+	}
+	return p
+}
+
+// send signs and writes p.
+func (a *testAgent) send(p *Packet) {
+	a.t.Helper()
+	data, err := proto.Marshal(a.sign(p))
+	if err == nil && a.codec != nil {
+		data, err = a.codec.encode(data)
+	}
+	if err == nil {
+		err = wire.WriteFrame(a.conn, data)
+	}
+	if err != nil {
+		a.t.Fatalf("send: %v", err)
+	}
+}
+
+// recv reads the next packet, failing the test after two seconds.
+func (a *testAgent) recv() *Packet {
+	a.t.Helper()
+	a.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	payload, err := wire.ReadFrame(a.conn)
+	if err == nil && a.codec != nil {
+		payload, err = a.codec.decode(payload)
+	}
+	var p *Packet
+	if err == nil {
+		p, err = wire.UnmarshalPacket(payload)
+	}
+	if err != nil {
+		a.t.Fatalf("recv: %v", err)
+	}
+	return p
+}
+
+// call sends p and returns the next packet received.
+func (a *testAgent) call(p *Packet) *Packet {
+	a.t.Helper()
+	a.send(p)
+	return a.recv()
+}
+
+// status returns "done" if p is the server's JSON acknowledgement of the
+// packet with p's id, and p's body otherwise.
+func status(p *Packet) string {
+	var a ack
+	if json.Unmarshal([]byte(p.Body), &a) == nil && a.Status == "done" && a.ID == p.Id {
+		return "done"
+	}
+	return p.Body
+}
+
+// syncBuffer is a goroutine-safe log sink for asserting on server logs.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects s's logger for the duration of the test.
+func captureLog(t *testing.T, s *Server) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	s.cfg.Logger.SetOutput(buf)
+	t.Cleanup(func() { s.cfg.Logger.SetOutput(os.Stderr) })
+	return buf
+}
+
+// waitFor polls cond until it holds or a two-second deadline passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// registered reports whether identity is in s's routing table.
+func registered(s *Server, identity string) bool {
+	return s.lookupAgent(identity) != nil
+}
+
+// expectClosedWith reads the close notice for reason from conn, then expects
+// the server to hang up.
+func expectClosedWith(t *testing.T, conn net.Conn, reason string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := wire.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("want a %s close notice, got %v", reason, err)
+	}
+	if p.Typ != TypeGoodbye || p.Body != reason {
+		t.Fatalf("got %v, want a %s close notice", p, reason)
+	}
+	if _, err := wire.ReadPacket(conn); err == nil {
+		t.Fatalf("connection still open after the %s notice", reason)
+	}
+}
+
+func TestReregisterDrainsInFlightReply(t *testing.T) {
+	s := newTestServer(t)
+
+	oldSrv, oldCli := net.Pipe()
+	newSrv, newCli := net.Pipe()
+	defer oldCli.Close()
+	defer newCli.Close()
+
+	old := s.newConnInfo(oldSrv)
+	nw := s.newConnInfo(newSrv)
+	s.registerConn("bot:a", old)
+
+	// net.Pipe writes block until read, so the reply stays in flight
+	// until the test consumes it.
+	reply := &Packet{Id: "r1", Typ: TypeReply, Src: "server", Body: "done"}
+	sent := make(chan error, 1)
+	go func() { sent <- old.send(reply) }()
+
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(oldCli, lenBuf[:]); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+
+	// Re-register mid-frame.
+	s.registerConn("bot:a", nw)
+
+	s.routeMu.RLock()
+	current := s.agents["bot:a"]
+	_, oldStillMapped := s.connSrc[old]
+	s.routeMu.RUnlock()
+	if current != nw {
+		t.Fatalf("bot:a should route to the new connection")
+	}
+	if oldStillMapped {
+		t.Fatalf("old connection should be removed from the reverse map")
+	}
+
+	got, err := readPacketBody(oldCli, lenBuf)
+	if err != nil {
+		t.Fatalf("reply lost mid-frame: %v", err)
+	}
+	if got.Id != "r1" || got.Body != "done" {
+		t.Fatalf("unexpected reply: %v", got)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// Once drained, the old connection is told why and closed, and further
+	// sends fail.
+	expectClosedWith(t, oldCli, closeReplaced)
+	if err := old.send(reply); err == nil {
+		t.Fatalf("send on retired connection should fail")
+	}
+
+	// A retired connection cannot win its identity back.
+	s.registerConn("bot:a", old)
+	s.routeMu.RLock()
+	current = s.agents["bot:a"]
+	s.routeMu.RUnlock()
+	if current != nw {
+		t.Fatalf("retired connection re-registered")
+	}
+}
+
+func TestReregisterDuringHeartbeats(t *testing.T) {
+	s, addr := startServer(t)
+	logs := captureLog(t, s)
+
+	stop := make(chan struct{})
+	beating := make(chan struct{})
+	go func() {
+		defer close(beating)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.broadcastHeartbeat()
+			}
+		}
+	}()
+	defer func() { close(stop); <-beating }()
+
+	const rounds = 20
+	prev := dialAgent(t, addr, "bot:hammered")
+	prev.call(&Packet{Dst: "server"})
+	for i := range rounds {
+		next := dialAgent(t, addr, "bot:hammered")
+		next.priv = prev.priv
+		next.send(&Packet{Dst: "server"})
+
+		// Every frame the old connection got is whole, up to a clean EOF.
+		for {
+			_, err := wire.ReadPacket(prev.conn)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("round %d: old connection: %v", i, err)
+			}
+		}
+		prev = next
+	}
+	waitFor(t, "every retirement to be logged", func() bool {
+		return strings.Count(logs.String(), "after its last whole frame") == rounds
+	})
+}
+
+// readPacketBody finishes reading a frame whose length prefix was already consumed.
+func readPacketBody(r io.Reader, lenBuf [4]byte) (*Packet, error) {
+	buf := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	var p Packet
+	if err := proto.Unmarshal(buf, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// discoverJSON runs a discover:<suffix> query against handleDiscover over an
+// in-memory pipe and decodes the JSON reply body.
+func discoverJSON(t *testing.T, s *Server, suffix string) map[string]any {
+	t.Helper()
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go s.handleDiscover(s.newConnInfo(srv), &Packet{Id: "q1", Src: "bot:test", Dst: "discover:" + suffix})
+
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := wire.ReadPacket(cli)
+	if err != nil {
+		t.Fatalf("read discover reply: %v", err)
+	}
+	if resp.Id != "q1" {
+		t.Fatalf("reply id = %q, want q1", resp.Id)
+	}
+	var out map[string]any
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatalf("decode %q: %v", resp.Body, err)
+	}
+	return out
+}
+
+func TestDiscoverInfoBuildMetadata(t *testing.T) {
+	s := newTestServer(t)
+
+	info := discoverJSON(t, s, "info")
+	for _, key := range []string{"version", "agents_online", "uptime_sec", "commit", "build_date", "go_version", "os", "arch"} {
+		if _, ok := info[key]; !ok {
+			t.Errorf("discover:info missing %q", key)
+		}
+	}
+	if info["commit"] != "unknown" || info["build_date"] != "unknown" {
+		t.Errorf("unset build metadata should report unknown, got commit=%v build_date=%v", info["commit"], info["build_date"])
+	}
+	if info["go_version"] != runtime.Version() {
+		t.Errorf("go_version = %v, want %s", info["go_version"], runtime.Version())
+	}
+
+	commit = "abc1234"
+	defer func() { commit = "" }()
+	if got := discoverJSON(t, s, "info")["commit"]; got != "abc1234" {
+		t.Errorf("commit = %v, want abc1234", got)
+	}
+}
+
+func TestDiscoverUnknownQuery(t *testing.T) {
+	s := newTestServer(t)
+
+	// discoverJSON already checks the id is echoed and the body is JSON.
+	got := discoverJSON(t, s, "foobar")
+	want := map[string]any{"error": "unknown_discovery", "query": "foobar"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discover:foobar = %v, want %v", got, want)
+	}
+}
+
+func TestFieldSizeLimits(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.MaxBodySize = 8
+		c.MaxScarSize = 4
+	})
+
+	a := dialAgent(t, addr, "bot:limits")
+	cases := []struct {
+		body string
+		scar []byte
+		want string
+	}{
+		{body: "12345678", want: "done"},
+		{body: "123456789", want: "error:body_too_large"},
+		{scar: []byte("1234"), want: "done"},
+		{scar: []byte("12345"), want: "error:scar_too_large"},
+	}
+	for _, tc := range cases {
+		resp := a.call(&Packet{Id: "x", Dst: "server", Body: tc.body, Scar: tc.scar})
+		if status(resp) != tc.want || resp.Id != "x" {
+			t.Errorf("body=%d scar=%d: got %q (id %q), want %q", len(tc.body), len(tc.scar), resp.Body, resp.Id, tc.want)
+		}
+	}
+
+	// Zero means unlimited.
+	s.cfg.MaxBodySize, s.cfg.MaxScarSize = 0, 0
+	if resp := a.call(&Packet{Dst: "server", Body: string(make([]byte, 1024)), Scar: make([]byte, 1024)}); status(resp) != "done" {
+		t.Errorf("unlimited: got %q", resp.Body)
+	}
+}
+
+func TestRequireRegistration(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.RequireRegistration = true
+	})
+	addr := serveLoopback(t, s)
+
+	a := dialAgent(t, addr, "bot:reg-ok")
+	if resp := a.call(&Packet{Typ: TypeRegister, Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("registration: got %q, want done", resp.Body)
+	}
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("after registration: got %q, want done", resp.Body)
+	}
+
+	b := dialAgent(t, addr, "bot:reg-skip")
+	if resp := b.call(&Packet{Dst: "bot:reg-ok", Body: "sneak"}); resp.Body != "error:expected_registration" {
+		t.Fatalf("got %q, want error:expected_registration", resp.Body)
+	}
+	expectClosedWith(t, b.conn, closeRegistrationRequired)
+	expectNothing(t, a)
+	if registered(s, "bot:reg-skip") {
+		t.Error("non-compliant connection was registered")
+	}
+}
+
+func TestGoodbyeIsQuietTeardown(t *testing.T) {
+	s, addr := startServer(t)
+	logs := captureLog(t, s)
+
+	a := dialAgent(t, addr, "bot:leaving")
+	a.call(&Packet{Dst: "server"})
+	a.send(&Packet{Typ: TypeGoodbye})
+
+	a.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := wire.ReadPacket(a.conn); err != io.EOF {
+		t.Fatalf("expected server to close after goodbye, got %v", err)
+	}
+	waitFor(t, "bot:leaving to unregister", func() bool { return !registered(s, "bot:leaving") })
+	if !strings.Contains(logs.String(), "Goodbye from") {
+		t.Errorf("goodbye not logged")
+	}
+	if strings.Contains(logs.String(), "Read error") {
+		t.Errorf("goodbye logged as an error:\n%s", logs)
+	}
+
+	// An abrupt disconnect mid-frame is still reported.
+	b := dialAgent(t, addr, "bot:abrupt")
+	b.call(&Packet{Dst: "server"})
+	b.conn.Write([]byte{0, 0, 0, 10, 1})
+	b.conn.Close()
+	waitFor(t, "bot:abrupt to unregister", func() bool { return !registered(s, "bot:abrupt") })
+	if !strings.Contains(logs.String(), "Read error") {
+		t.Errorf("abrupt disconnect not logged as an error")
+	}
+}
+
+func TestShutdownSaysGoodbye(t *testing.T) {
+	s, addr := startServer(t)
+
+	a := dialAgent(t, addr, "bot:staying")
+	a.call(&Packet{Dst: "server"})
+	s.sayGoodbye()
+
+	if p := a.recv(); p.Typ != TypeGoodbye || p.Src != "server" || p.Body != closeShutdown {
+		t.Fatalf("expected a shutdown goodbye from server, got %v", p)
+	}
+}
+
+func TestIdleTimeoutClosesSilentConnection(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.IdleTimeout = 100 * time.Millisecond
+	})
+	addr := serveLoopback(t, s)
+	logs := captureLog(t, s)
+
+	a := dialAgent(t, addr, "bot:silent")
+	a.call(&Packet{Dst: "server"})
+
+	// Stay silent: the server's read deadline fires and it hangs up.
+	expectClosedWith(t, a.conn, closeIdleTimeout)
+	waitFor(t, "bot:silent to unregister", func() bool { return !registered(s, "bot:silent") })
+	if !strings.Contains(logs.String(), "Idle timeout") {
+		t.Errorf("idle timeout not logged:\n%s", logs)
+	}
+}
+
+func TestSlowConsumerWarning(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.SlowWriteThreshold = 30 * time.Millisecond
+		c.WriteTimeout = 5 * time.Second
+	})
+	logs := captureLog(t, s)
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	ci := s.newConnInfo(srv)
+	s.registerConn("bot:sluggish", ci)
+
+	// net.Pipe writes block until read: a reader that waits makes the write
+	// slow without reaching the write timeout.
+	read := func(delay time.Duration) {
+		time.Sleep(delay)
+		if _, err := wire.ReadPacket(cli); err != nil {
+			t.Error(err)
+		}
+	}
+	for range 2 {
+		go read(100 * time.Millisecond)
+		if err := ci.send(&Packet{Body: "slowly"}); err != nil {
+			t.Fatalf("slow write failed: %v", err)
+		}
+	}
+	go read(0)
+	if err := ci.send(&Packet{Body: "promptly"}); err != nil {
+		t.Fatalf("connection closed after slow writes: %v", err)
+	}
+
+	if n := ci.slowWrites.Load(); n != 2 {
+		t.Errorf("%d slow writes, want 2", n)
+	}
+	if n := strings.Count(logs.String(), `Slow consumer "bot:sluggish"`); n != 1 {
+		t.Errorf("warned %d times, want once per interval", n)
+	}
+	var m strings.Builder
+	s.writeMetrics(&m)
+	if !strings.Contains(m.String(), `keep_slow_writes_total{identity="bot:sluggish"} 2`) {
+		t.Error("slow writes missing from metrics")
+	}
+}
+
+func TestWriteTimeoutUnblocksStalledPeer(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.WriteTimeout = 50 * time.Millisecond
+	})
+
+	// Nobody reads the client end, as with a peer that vanished without a FIN.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	ci := s.newConnInfo(srv)
+
+	done := make(chan error, 1)
+	go func() { done <- ci.send(&Packet{Typ: TypeHeartbeat, Src: "server"}) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("send = %v, want deadline exceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("send to stalled peer did not time out")
+	}
+}
+
+// shortConn accepts only the first limit bytes written to it, reporting a
+// short write with no error, as a misbehaving writer might.
+type shortConn struct {
+	net.Conn
+	limit  int
+	writes int
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	c.writes++
+	n := min(len(b), c.limit)
+	c.limit -= n
+	c.Conn.Write(b[:n])
+	return n, nil
+}
+
+func TestShortWriteClosesConnection(t *testing.T) {
+	s := newTestServer(t)
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	sc := &shortConn{Conn: srv, limit: 6} // the prefix and two bytes of payload
+	ci := s.newConnInfo(sc)
+
+	read := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(cli)
+		read <- data
+	}()
+	if err := ci.send(&Packet{Src: "server", Body: "torn"}); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("send = %v, want io.ErrShortWrite", err)
+	}
+	if sc.writes != 1 {
+		t.Errorf("frame written in %d calls, want 1", sc.writes)
+	}
+	// Torn down, not left open for a later frame to follow the torn one.
+	if err := ci.send(&Packet{Src: "server", Body: "next"}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("send after short write = %v, want net.ErrClosed", err)
+	}
+	select {
+	case data := <-read:
+		if len(data) != 6 {
+			t.Fatalf("peer read %d bytes then EOF, want the 6 written", len(data))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection left open after a short write")
+	}
+}
+
+func TestForwardRetriesStalledWrite(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.ForwardAttempts = 3
+		c.ForwardBackoff = 50 * time.Millisecond
+	})
+
+	// Nobody reads until after the first attempt has timed out, as with a
+	// destination whose receive buffer is momentarily full.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	ci := s.newConnInfo(srv)
+	got := make(chan *Packet, 1)
+	go func() {
+		time.Sleep(80 * time.Millisecond)
+		p, err := wire.ReadPacket(cli)
+		if err != nil {
+			t.Errorf("read: %v", err)
+		}
+		got <- p
+	}()
+
+	retries := s.forwardRetries.Load()
+	if err := s.forward(ci, &Packet{Src: "bot:a", Body: "second time lucky"}); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if p := <-got; p == nil || p.Body != "second time lucky" {
+		t.Fatalf("destination got %v", p)
+	}
+	if s.forwardRetries.Load() == retries {
+		t.Error("no retry recorded")
+	}
+}
+
+func TestForwardSlowReaderGetsWholeFrame(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.ForwardAttempts = 3
+		c.ForwardBackoff = 20 * time.Millisecond
+	})
+
+	// The reader takes the length prefix at once but the body only after
+	// the probe deadline has passed. The frame has started, so the write
+	// must finish rather than tear it and close the connection.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	ci := s.newConnInfo(srv)
+	got := make(chan string, 1)
+	go func() {
+		var hdr [4]byte
+		if _, err := io.ReadFull(cli, hdr[:]); err != nil {
+			got <- err.Error()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		body := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(cli, body); err != nil {
+			got <- err.Error()
+			return
+		}
+		p, err := wire.UnmarshalPacket(body)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- p.Body
+	}()
+
+	if err := s.forward(ci, &Packet{Src: "bot:a", Body: "slow but whole"}); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if body := <-got; body != "slow but whole" {
+		t.Fatalf("destination got %q", body)
+	}
+	ci.writeMu.Lock()
+	closed := ci.closed
+	ci.writeMu.Unlock()
+	if closed {
+		t.Fatal("connection was closed by the slow forward")
+	}
+}
+
+func TestForwardClosedDestinationFailsFast(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.ForwardAttempts = 5
+		c.ForwardBackoff = time.Second
+	})
+
+	srv, cli := net.Pipe()
+	cli.Close()
+	ci := s.newConnInfo(srv)
+	retries := s.forwardRetries.Load()
+
+	start := time.Now()
+	if err := s.forward(ci, &Packet{Src: "bot:a"}); err == nil || isTransientWrite(err) {
+		t.Fatalf("forward to closed destination = %v, want a hard error", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("forward to closed destination took %v", d)
+	}
+	if s.forwardRetries.Load() != retries {
+		t.Error("closed destination was retried")
+	}
+	// The failed send closed the connection; later sends fail at once too.
+	if err := s.forward(ci, &Packet{Src: "bot:a"}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("second forward = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestDiscoverConfigAdminOnly(t *testing.T) {
+	s, addr := startServer(t)
+	admin := dialAgent(t, addr, "bot:admin")
+	other := dialAgent(t, addr, "bot:other")
+	s.cfg.AdminKeys = []string{hex.EncodeToString(admin.priv.Public().(ed25519.PublicKey))}
+	s.cfg.MaxBodySize = 123
+
+	if resp := other.call(&Packet{Dst: "discover:config"}); resp.Body != "error:forbidden" {
+		t.Fatalf("non-admin got %q", resp.Body)
+	}
+
+	query := func() map[string]string {
+		t.Helper()
+		resp := admin.call(&Packet{Dst: "discover:config"})
+		var out struct {
+			Flags         map[string]string `json:"flags"`
+			MaxPacketSize int               `json:"max_packet_size"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+			t.Fatalf("decode %q: %v", resp.Body, err)
+		}
+		if out.MaxPacketSize != wire.MaxPacketSize {
+			t.Errorf("max_packet_size = %d", out.MaxPacketSize)
+		}
+		return out.Flags
+	}
+	flags := query()
+	for name, want := range map[string]string{
+		"listen":             s.cfg.ListenAddr,
+		"max-body":           "123",
+		"heartbeat-interval": "1m0s",
+		"admin-keys":         "REDACTED",
+	} {
+		if flags[name] != want {
+			t.Errorf("%s = %q, want %q", name, flags[name], want)
+		}
+	}
+
+	s.cfg.MaxBodySize = 456
+	s.cfg.Peers = []string{"10.0.0.1:9010", "10.0.0.2:9010"}
+	flags = query()
+	if flags["max-body"] != "456" || flags["peers"] != "10.0.0.1:9010,10.0.0.2:9010" {
+		t.Errorf("config change not reflected: max-body=%q peers=%q", flags["max-body"], flags["peers"])
+	}
+}
+
+func TestHeartbeatSignedAndSequenced(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:pulse")
+	a.call(&Packet{Dst: "server"})
+
+	serverPK := discoverJSON(t, s, "info")["server_pk"]
+	var last uint64
+	for i := 0; i < 3; i++ {
+		s.broadcastHeartbeat()
+		hb := a.recv()
+		if hb.Typ != TypeHeartbeat || hb.Src != "server" {
+			t.Fatalf("expected heartbeat, got %v", hb)
+		}
+		if wire.Verify(hb) != nil || hex.EncodeToString(hb.Pk) != serverPK {
+			t.Fatalf("heartbeat not signed by the server key %v", serverPK)
+		}
+		var body heartbeatBody
+		if err := json.Unmarshal([]byte(hb.Body), &body); err != nil {
+			t.Fatalf("heartbeat body %q: %v", hb.Body, err)
+		}
+		if i > 0 && body.Seq != last+1 {
+			t.Errorf("seq %d after %d", body.Seq, last)
+		}
+		if age := time.Since(time.UnixMilli(body.TS)); age < 0 || age > time.Second {
+			t.Errorf("heartbeat ts %d is %v old", body.TS, age)
+		}
+		last = body.Seq
+	}
+}
+
+func TestCoalescedBroadcastIdentical(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.CoalesceBroadcast = true })
+	agents := make([]*testAgent, 3)
+	for i := range agents {
+		agents[i] = dialAgent(t, addr, fmt.Sprintf("bot:coalesce-%d", i))
+		// Different histories, so different next sequence numbers
+		for j := 0; j <= i; j++ {
+			agents[i].call(&Packet{Dst: "server"})
+		}
+	}
+	gz := dialAgent(t, addr, "bot:coalesce-gzip")
+	gz.handshake("gzip") // compresses its own copy of the shared bytes
+
+	s.broadcastHeartbeat()
+	var first []byte
+	for i, a := range agents {
+		a.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		payload, err := wire.ReadFrame(a.conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb, err := wire.UnmarshalPacket(payload)
+		if err != nil || hb.Typ != TypeHeartbeat || hb.Seq != uint64(i+2) || wire.Verify(hb) != nil {
+			t.Fatalf("agent %d got %v (%v), want a signed heartbeat with seq %d", i, hb, err, i+2)
+		}
+		// All that differs is the seq stamped at the end.
+		tail := protowire.AppendVarint(protowire.AppendTag(nil, seqField, protowire.VarintType), hb.Seq)
+		shared, ok := bytes.CutSuffix(payload, tail)
+		if !ok {
+			t.Fatalf("agent %d: payload doesn't end with its seq", i)
+		}
+		if first == nil {
+			first = shared
+		} else if !bytes.Equal(shared, first) {
+			t.Fatalf("agent %d got different bytes", i)
+		}
+	}
+	hb := gz.recv()
+	hb.Seq = 0
+	var want Packet
+	if err := proto.Unmarshal(first, &want); err != nil || !proto.Equal(hb, &want) {
+		t.Fatalf("gzip agent got %v, want %v", hb, &want)
+	}
+}
+
+func TestPongMissesClosesSilentAgent(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.PongMisses = 2
+	})
+
+	live := dialAgent(t, addr, "bot:live")
+	live.call(&Packet{Dst: "server"})
+	silent := dialAgent(t, addr, "bot:silent")
+	silent.call(&Packet{Dst: "server"})
+
+	for i := 1; i <= 3; i++ {
+		s.broadcastHeartbeat()
+		hb := live.recv()
+		live.send(&Packet{Typ: TypePong, Dst: "server", Body: hb.Body})
+		// Replies are in order, so the pong has been handled once this
+		// returns.
+		live.call(&Packet{Dst: "server"})
+		if i < 3 {
+			if hb := silent.recv(); hb.Typ != TypeHeartbeat {
+				t.Fatalf("heartbeat %d: got typ %d", i, hb.Typ)
+			}
+			if !registered(s, "bot:silent") {
+				t.Fatalf("silent agent dropped after %d missed pongs", i)
+			}
+		}
+	}
+
+	if registered(s, "bot:silent") {
+		t.Error("silent agent still registered after 2 missed pongs")
+	}
+	if !registered(s, "bot:live") {
+		t.Error("ponging agent was dropped")
+	}
+	expectClosedWith(t, silent.conn, closePongTimeout)
+}
+
+func TestDiscoverSlowReaderDoesNotStall(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.WriteTimeout = 0 // the discovery bound applies on its own
+	})
+	s.discoverTimeout = 100 * time.Millisecond
+	logs := captureLog(t, s)
+
+	// net.Pipe has no buffering: a client that never reads blocks every write.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	done := make(chan struct{})
+	go func() {
+		s.handleConnection(srv, listenerOpts{})
+		close(done)
+	}()
+
+	a := &testAgent{t: t, conn: cli, src: "bot:slow-reader"}
+	_, a.priv, _ = ed25519.GenerateKey(nil)
+	a.send(&Packet{Dst: "discover:agents"})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still blocked on a discovery reply nobody reads")
+	}
+	if !strings.Contains(logs.String(), "discover reply") {
+		t.Errorf("stalled discovery reply not logged:\n%s", logs)
+	}
+	if registered(s, "bot:slow-reader") {
+		t.Error("stalled client still registered")
+	}
+}
+
+func TestMalformedPacketsRejected(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:malformed")
+	before := s.totalPackets.Load()
+
+	// Signed, but no src: answered, never routed or registered.
+	for _, src := range []string{"", "  "} {
+		p := &Packet{Id: "m", Src: src, Dst: "bot:malformed"}
+		if err := wire.Sign(p, a.priv); err != nil {
+			t.Fatal(err)
+		}
+		if err := wire.WritePacket(a.conn, p); err != nil {
+			t.Fatal(err)
+		}
+		if resp := a.recv(); resp.Body != "error:malformed" || resp.Id != "m" {
+			t.Fatalf("src %q: got %q (id %q), want error:malformed", src, resp.Body, resp.Id)
+		}
+	}
+
+	// Signed, with a src but no dst: not taken for a packet to the server.
+	if resp := a.call(&Packet{Id: "m", Body: "where to?"}); resp.Body != "error:malformed" || resp.Id != "m" {
+		t.Fatalf("empty dst: got %q (id %q), want error:malformed", resp.Body, resp.Id)
+	}
+
+	// A payload that unmarshals to an empty Packet (only an unknown field)
+	// carries no signature and is dropped silently.
+	unsigned := s.droppedUnsigned.Load()
+	if err := wire.WriteFrame(a.conn, []byte{0x98, 0x06, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "empty packet to be dropped", func() bool { return s.droppedUnsigned.Load() > unsigned })
+	expectNothing(t, a)
+
+	if n := s.totalPackets.Load(); n != before {
+		t.Errorf("malformed packets were routed: total_packets %d -> %d", before, n)
+	}
+	if registered(s, "") || registered(s, "  ") {
+		t.Error("empty identity registered")
+	}
+
+	// The connection is still usable.
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("got %q after malformed packets", resp.Body)
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.LogSample = 10
+	})
+
+	a := dialAgent(t, addr, "bot:chatty")
+	b := dialAgent(t, addr, "bot:sink")
+	a.call(&Packet{Dst: "server"})
+	b.call(&Packet{Dst: "server"})
+	s.receiptLog.n.Store(0)
+	s.routeLog.n.Store(0)
+	routed := s.routedPackets.Load()
+	logs := captureLog(t, s)
+
+	for i := 0; i < 100; i++ {
+		a.send(&Packet{Dst: "bot:sink", Body: strconv.Itoa(i)})
+		if got := b.recv(); got.Body != strconv.Itoa(i) {
+			t.Fatalf("packet %d: got %q", i, got.Body)
+		}
+	}
+	// Offline routes are errors and must never be sampled away.
+	for i := 0; i < 5; i++ {
+		if resp := a.call(&Packet{Dst: "bot:nobody"}); resp.Body != "error:offline" {
+			t.Fatalf("got %q, want error:offline", resp.Body)
+		}
+	}
+
+	count := func(s string) int { return strings.Count(logs.String(), s) }
+	waitFor(t, "offline lines", func() bool { return count(": offline") == 5 })
+	if n := count("Routed bot:chatty -> bot:sink"); n != 10 {
+		t.Errorf("logged %d of 100 routes at 1-in-10, want 10", n)
+	}
+	if n := count("From bot:chatty"); n != 11 {
+		t.Errorf("logged %d of 105 receipts at 1-in-10, want 11", n)
+	}
+	if n := s.routedPackets.Load() - routed; n != 100 {
+		t.Errorf("routed counter moved by %d, want 100", n)
+	}
+}
+
+func TestChannelsShareOneSocket(t *testing.T) {
+	_, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:mux")
+	b := dialAgent(t, addr, "bot:mux-peer")
+	if resp := a.call(&Packet{Dst: "server", Channel: "orders"}); status(resp) != "done" || resp.Channel != "orders" {
+		t.Fatalf("server reply = %q on channel %q, want done on orders", resp.Body, resp.Channel)
+	}
+	b.call(&Packet{Dst: "server"})
+
+	// Interleave two logical channels on one connection; each packet arrives
+	// with its channel intact, and server replies are echoed on the channel
+	// of the request.
+	for i, ch := range []string{"orders", "chat", "orders", "chat"} {
+		a.send(&Packet{Dst: "bot:mux-peer", Channel: ch, Body: strconv.Itoa(i)})
+		got := b.recv()
+		if got.Channel != ch || got.Body != strconv.Itoa(i) || wire.Verify(got) != nil {
+			t.Fatalf("packet %d: got %q on channel %q, want %q on %q", i, got.Body, got.Channel, strconv.Itoa(i), ch)
+		}
+	}
+	if resp := a.call(&Packet{Dst: "discover:info", Channel: "chat"}); resp.Channel != "chat" {
+		t.Errorf("discover reply on channel %q, want chat", resp.Channel)
+	}
+	if resp := a.call(&Packet{Dst: "bot:gone", Channel: "chat"}); resp.Body != "error:offline" || resp.Channel != "chat" {
+		t.Errorf("offline reply = %q on channel %q, want error:offline on chat", resp.Body, resp.Channel)
+	}
+
+	// Without a channel, nothing changes.
+	if resp := a.call(&Packet{Dst: "server"}); resp.Channel != "" {
+		t.Errorf("reply to a channel-less packet carries channel %q", resp.Channel)
+	}
+
+	// The channel is signed: relabelling a packet breaks its signature.
+	p := a.sign(&Packet{Dst: "bot:mux-peer", Channel: "orders"})
+	p.Channel = "chat"
+	if wire.Verify(p) == nil {
+		t.Error("channel is not covered by the signature")
+	}
+}
+
+func TestPerDestinationOrdering(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		t.Run("fair-workers="+strconv.Itoa(workers), func(t *testing.T) {
+			_, addr := startServer(t, func(c *Config) {
+				c.FairWorkers = workers
+			})
+			sink := dialAgent(t, addr, "bot:order-sink")
+			sink.call(&Packet{Dst: "server"})
+
+			// Several senders contend for the sink's connection; each one's
+			// packets must still arrive in the order it sent them.
+			const senders, perSender = 4, 200
+			for s := 0; s < senders; s++ {
+				a := dialAgent(t, addr, "bot:order-"+strconv.Itoa(s))
+				go func() {
+					for i := 0; i < perSender; i++ {
+						p := a.sign(&Packet{Dst: "bot:order-sink", Body: strconv.Itoa(i)})
+						if err := wire.WritePacket(a.conn, p); err != nil {
+							t.Errorf("%s send: %v", a.src, err)
+							return
+						}
+					}
+				}()
+			}
+
+			next := map[string]int{}
+			for i := 0; i < senders*perSender; i++ {
+				p := sink.recv()
+				if want := strconv.Itoa(next[p.Src]); p.Body != want {
+					t.Fatalf("from %s got %s, want %s", p.Src, p.Body, want)
+				}
+				next[p.Src]++
+			}
+		})
+	}
+}
+
+func TestRegistrationAck(t *testing.T) {
+	s, addr := startServer(t)
+	serverPK := s.key.Public().(ed25519.PublicKey)
+
+	// The handshake packet registers the identity and asks for acks; the
+	// ack follows the handshake reply.
+	register := func(a *testAgent) registrationAck {
+		t.Helper()
+		body, _ := json.Marshal(handshakeRequest{Version: ServerVersion, Features: FeatureRegistrationAck})
+		a.call(&Packet{Id: "reg-" + a.src, Dst: "handshake", Body: string(body)})
+		ack := a.recv()
+		if ack.Id != "reg-"+a.src || ack.Dst != a.src || ack.Src != "server" {
+			t.Fatalf("ack id=%q dst=%q src=%q", ack.Id, ack.Dst, ack.Src)
+		}
+		if wire.Verify(ack) != nil || !bytes.Equal(ack.Pk, serverPK) {
+			t.Fatal("ack not signed by the server key")
+		}
+		var ra registrationAck
+		if err := json.Unmarshal([]byte(ack.Body), &ra); err != nil {
+			t.Fatalf("ack body %q: %v", ack.Body, err)
+		}
+		return ra
+	}
+
+	first := dialAgent(t, addr, "bot:acked")
+	if ra := register(first); ra != (registrationAck{Registered: "bot:acked"}) {
+		t.Fatalf("first ack = %+v", ra)
+	}
+	// Only a new registration is acked.
+	if resp := first.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("got %q, want done", resp.Body)
+	}
+	expectNothing(t, first)
+
+	second := dialAgent(t, addr, "bot:acked")
+	second.priv = first.priv // the same agent reconnecting
+	if ra := register(second); ra != (registrationAck{Registered: "bot:acked", Replaced: true}) {
+		t.Fatalf("second ack = %+v", ra)
+	}
+
+	// Without the feature nothing changes on the wire.
+	plain := dialAgent(t, addr, "bot:unacked")
+	plain.call(&Packet{Dst: "server"})
+	expectNothing(t, plain)
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	s, addr := startServer(t)
+
+	a := dialAgent(t, addr, "server")
+	if resp := a.call(&Packet{Id: "r", Dst: "bot:someone"}); resp.Body != "error:reserved_identity" || resp.Id != "r" {
+		t.Fatalf("got %q (id %q), want error:reserved_identity", resp.Body, resp.Id)
+	}
+	if registered(s, "server") {
+		t.Fatal("reserved identity registered")
+	}
+
+	// A connection displaced by re-registration may not register again.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	ci := s.newConnInfo(srv)
+	ci.retired.Store(true)
+	if reg := s.registerConn("bot:displaced", ci); reg != regRetired {
+		t.Fatalf("registerConn on a retired connection = %v, want regRetired", reg)
+	}
+	if registered(s, "bot:displaced") {
+		t.Fatal("retired connection registered")
+	}
+}
+
+func TestReservedPrefixRejected(t *testing.T) {
+	s, addr := startServer(t)
+	for _, prefix := range reservedPrefixes {
+		identity := prefix + "myservice"
+		a := dialAgent(t, addr, identity)
+		if resp := a.call(&Packet{Id: "r", Dst: "server"}); resp.Body != "error:reserved_identity" {
+			t.Errorf("%s: got %q, want error:reserved_identity", identity, resp.Body)
+		}
+		if registered(s, identity) {
+			t.Errorf("%s registered", identity)
+		}
+	}
+
+	// The prefix must be the whole namespace; lookalikes are ordinary names.
+	if resp := dialAgent(t, addr, "bot:discover").call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("bot:discover got %q", resp.Body)
+	}
+}
+
+func TestIdentityPattern(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.IdentityPattern = `bot:[a-z0-9-]+`
+	})
+	sink := dialAgent(t, addr, "bot:sink")
+	sink.call(&Packet{Dst: "server"})
+
+	// The pattern must match the whole identity.
+	for _, identity := range []string{"Bot:upper", "bot:under_score", "xbot:prefixed", "bot:ok suffix"} {
+		a := dialAgent(t, addr, identity)
+		if resp := a.call(&Packet{Id: "b", Dst: "bot:sink", Body: "hi"}); resp.Body != "error:bad_identity" || resp.Id != "b" {
+			t.Fatalf("%q: got %q (id %q), want error:bad_identity", identity, resp.Body, resp.Id)
+		}
+		if registered(s, identity) {
+			t.Fatalf("%q registered", identity)
+		}
+	}
+	expectNothing(t, sink)
+
+	ok := dialAgent(t, addr, "bot:weather-2")
+	ok.send(&Packet{Dst: "bot:sink", Body: "hi"})
+	if got := sink.recv(); got.Body != "hi" || got.Src != "bot:weather-2" {
+		t.Fatalf("sink got %v", got)
+	}
+
+	// The default refuses only identities with whitespace.
+	s = newTestServer(t)
+	for identity, want := range map[string]registration{
+		"bot:weather":       regNew,
+		"agent/eu-1@fleet":  regNew,
+		"émoji:☂":           regNew,
+		"bot:two words":     regBadIdentity,
+		"bot:trailing\n":    regBadIdentity,
+		"\tbot:leading-tab": regBadIdentity,
+	} {
+		srv, cli := net.Pipe()
+		defer cli.Close()
+		if reg := s.registerConn(identity, s.newConnInfo(srv)); reg != want {
+			t.Errorf("%q: registerConn = %v, want %v", identity, reg, want)
+		}
+	}
+
+	if _, err := New(Config{IdentityPattern: "bot:("}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestMaxIdentityLen(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.MaxIdentityLen = 16 })
+	sink := dialAgent(t, addr, "bot:sink")
+	sink.call(&Packet{Dst: "server"})
+
+	atLimit := "bot:" + strings.Repeat("a", 12)
+	a := dialAgent(t, addr, atLimit)
+	a.send(&Packet{Dst: "bot:sink", Body: "hi"})
+	if got := sink.recv(); got.Src != atLimit {
+		t.Fatalf("sink got %v", got)
+	}
+
+	over := atLimit + "b"
+	if resp := dialAgent(t, addr, over).call(&Packet{Id: "l", Dst: "bot:sink", Body: "hi"}); resp.Body != "error:identity_too_long" || resp.Id != "l" {
+		t.Fatalf("got %q (id %q), want error:identity_too_long", resp.Body, resp.Id)
+	}
+	if registered(s, over) {
+		t.Fatal("over-length identity registered")
+	}
+	expectNothing(t, sink)
+
+	// The default allows ordinary identities and keeps huge ones out of the
+	// routing table and, beyond a prefix, out of the log.
+	s, addr = startServer(t)
+	logs := captureLog(t, s)
+	huge := "bot:" + strings.Repeat("x", 4096)
+	if resp := dialAgent(t, addr, huge).call(&Packet{Dst: "server"}); resp.Body != "error:identity_too_long" {
+		t.Fatalf("default limit: got %q", resp.Body)
+	}
+	if strings.Contains(logs.String(), huge) || !strings.Contains(logs.String(), "(4100 bytes)") {
+		t.Error("rejection logged the whole identity")
+	}
+	if resp := dialAgent(t, addr, "bot:"+strings.Repeat("n", DefaultMaxIdentityLen-4)).call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("identity at the default limit: got %q", resp.Body)
+	}
+}
+
+func TestRequireID(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.RequireID = true
+	})
+	sink := dialAgent(t, addr, "bot:id-sink")
+	sink.call(&Packet{Id: "s", Dst: "server"})
+	a := dialAgent(t, addr, "bot:id-less")
+
+	for _, dst := range []string{"server", "discover:info", "bot:id-sink"} {
+		if resp := a.call(&Packet{Dst: dst}); resp.Body != "error:missing_id" {
+			t.Fatalf("to %s without an id: got %q, want error:missing_id", dst, resp.Body)
+		}
+	}
+	expectNothing(t, sink)
+	if registered(s, "bot:id-less") {
+		t.Error("packet without an id registered its src")
+	}
+
+	a.send(&Packet{Id: newPacketID(), Dst: "bot:id-sink", Body: "with id"})
+	if got := sink.recv(); got.Body != "with id" {
+		t.Fatalf("sink got %v", got)
+	}
+	// Pongs need no id.
+	a.send(&Packet{Typ: TypePong})
+	expectNothing(t, a)
+
+	// Off by default.
+	_, addr = startServer(t)
+	b := dialAgent(t, addr, "bot:id-default")
+	if resp := b.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("default server: got %q", resp.Body)
+	}
+}
+
+func TestKeyMismatch(t *testing.T) {
+	s, addr := startServer(t)
+	owner := dialAgent(t, addr, "bot:owned")
+	owner.call(&Packet{Dst: "server"})
+	peer := dialAgent(t, addr, "bot:owned-peer")
+	peer.call(&Packet{Dst: "server"})
+
+	// A valid signature under another key can't claim the identity, from a
+	// new connection or from the owner's own.
+	impostor := dialAgent(t, addr, "bot:owned")
+	if resp := impostor.call(&Packet{Id: "k", Dst: "bot:owned-peer", Body: "forged"}); resp.Body != "error:key_mismatch" || resp.Id != "k" {
+		t.Fatalf("new connection: got %q (id %q), want error:key_mismatch", resp.Body, resp.Id)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	p := &Packet{Id: "k2", Src: "bot:owned", Dst: "bot:owned-peer", Body: "forged"}
+	if err := wire.Sign(p, other); err != nil {
+		t.Fatal(err)
+	}
+	wire.WritePacket(owner.conn, p)
+	if resp := owner.recv(); resp.Body != "error:key_mismatch" || resp.Id != "k2" {
+		t.Fatalf("owner's connection: got %q (id %q), want error:key_mismatch", resp.Body, resp.Id)
+	}
+	expectNothing(t, peer)
+	if s.lookupAgent("bot:owned") == nil {
+		t.Fatal("owner lost its registration")
+	}
+	owner.send(&Packet{Dst: "bot:owned-peer", Body: "genuine"})
+	if got := peer.recv(); got.Body != "genuine" {
+		t.Fatalf("peer got %q, want the owner's packet", got.Body)
+	}
+
+	// The binding lasts only while the identity is registered.
+	owner.send(&Packet{Typ: TypeGoodbye})
+	waitFor(t, "owner to unregister", func() bool { return !registered(s, "bot:owned") })
+	if resp := impostor.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("after the owner left: got %q, want done", resp.Body)
+	}
+}
+
+func TestRegistryFull(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.MaxIdentities = 2
+	})
+	addr := serveLoopback(t, s)
+
+	a := dialAgent(t, addr, "bot:first")
+	b := dialAgent(t, addr, "bot:second")
+	a.call(&Packet{Dst: "server"})
+	b.call(&Packet{Dst: "server"})
+
+	c := dialAgent(t, addr, "bot:third")
+	if resp := c.call(&Packet{Id: "f", Dst: "bot:first", Body: "hi"}); resp.Body != "error:registry_full" || resp.Id != "f" {
+		t.Fatalf("got %q (id %q), want error:registry_full", resp.Body, resp.Id)
+	}
+	expectNothing(t, a)
+	if registered(s, "bot:third") {
+		t.Fatal("identity registered past the ceiling")
+	}
+
+	// Taking over a registered identity doesn't grow the table.
+	a2 := dialAgent(t, addr, "bot:first")
+	a2.priv = a.priv
+	if resp := a2.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("re-registration: got %q", resp.Body)
+	}
+	b.send(&Packet{Dst: "bot:first", Body: "to the new connection"})
+	if got := a2.recv(); got.Body != "to the new connection" {
+		t.Fatalf("got %v", got)
+	}
+
+	// A freed slot can be taken.
+	b.conn.Close()
+	waitFor(t, "bot:second to unregister", func() bool { return !registered(s, "bot:second") })
+	if resp := c.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("after a slot freed: got %q", resp.Body)
+	}
+}
+
+func TestBufferedWritesRoundTrip(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.WriteBuffer = 512
+	})
+
+	a := dialAgent(t, addr, "bot:buffered-a")
+	b := dialAgent(t, addr, "bot:buffered-b")
+	a.call(&Packet{Dst: "server"})
+	b.call(&Packet{Dst: "server"})
+
+	// Frames smaller and larger than the buffer, and a reply-producing
+	// packet between forwards, all arrive whole and in order.
+	for i, body := range []string{"small", strings.Repeat("x", 2000), "after"} {
+		a.send(&Packet{Dst: b.src, Body: body})
+		if got := b.recv(); got.Body != body || wire.Verify(got) != nil {
+			t.Fatalf("packet %d: got %d bytes (sig ok=%v)", i, len(got.Body), wire.Verify(got) == nil)
+		}
+		if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+			t.Fatalf("packet %d: reply %q", i, resp.Body)
+		}
+	}
+
+	// Heartbeats are buffered during the broadcast and flushed after it.
+	s.broadcastHeartbeat()
+	if hb := a.recv(); hb.Typ != TypeHeartbeat {
+		t.Fatalf("got typ %d, want heartbeat", hb.Typ)
+	}
+}
+
+func TestCorkHoldsFramesUntilUncork(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.WriteBuffer = 4096
+	})
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	ci := s.newConnInfo(srv)
+
+	ci.cork()
+	for _, body := range []string{"one", "two"} {
+		if err := ci.send(&Packet{Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := wire.ReadPacket(cli); err == nil {
+		t.Fatal("frame left while corked")
+	}
+
+	// The handler uncorks once it is done with a packet, before reading the
+	// next one.
+	go ci.uncork()
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"one", "two"} {
+		p, err := wire.ReadPacket(cli)
+		if err != nil || p.Body != want {
+			t.Fatalf("got %v, %v; want %q", p, err, want)
+		}
+	}
+}
+
+// BenchmarkBroadcast measures a heartbeat broadcast to many agents with each
+// frame written directly and through a write buffer, marshaled per agent and
+// once for all of them.
+func BenchmarkBroadcast(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	const agentCount = 200
+	for _, bc := range []struct {
+		buffer   int
+		coalesce bool
+	}{{0, false}, {0, true}, {4096, false}, {4096, true}} {
+		b.Run(fmt.Sprintf("buffer=%d/coalesce=%v", bc.buffer, bc.coalesce), func(b *testing.B) {
+			s := newTestServer(b, func(c *Config) {
+				c.WriteBuffer = bc.buffer
+				c.CoalesceBroadcast = bc.coalesce
+			})
+			for i := 0; i < agentCount; i++ {
+				client, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer client.Close()
+				go io.Copy(io.Discard, client)
+				conn, err := l.Accept()
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer conn.Close()
+				s.registerConn(fmt.Sprintf("bot:bench-%d", i), s.newConnInfo(conn))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.broadcastHeartbeat()
+			}
+		})
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:dereg-a")
+	a.call(&Packet{Dst: "server"})
+	other := dialAgent(t, addr, "bot:dereg-other")
+	other.call(&Packet{Dst: "server"})
+
+	// Someone else's identity stays put.
+	if resp := other.call(&Packet{Dst: "deregister:bot:dereg-a"}); resp.Body != "error:forbidden" {
+		t.Fatalf("foreign deregister: got %q", resp.Body)
+	}
+	if !registered(s, "bot:dereg-a") {
+		t.Fatal("foreign deregister released the identity")
+	}
+	if resp := other.call(&Packet{Dst: "deregister:bot:dereg-nobody"}); resp.Body != "error:offline" {
+		t.Fatalf("unknown identity: got %q", resp.Body)
+	}
+
+	resp := a.call(&Packet{Id: "d1", Dst: "deregister:bot:dereg-a"})
+	if resp.Id != "d1" || resp.Body != `{"status":"done","deregistered":"bot:dereg-a"}` {
+		t.Fatalf("deregister: got %q for %q", resp.Body, resp.Id)
+	}
+	if registered(s, "bot:dereg-a") {
+		t.Fatal("identity still registered")
+	}
+	if resp := other.call(&Packet{Dst: "bot:dereg-a", Body: "hello?"}); resp.Body != "error:offline" {
+		t.Fatalf("packet to released identity: got %q", resp.Body)
+	}
+
+	// The connection stays open and can take on another role.
+	if resp := a.call(&Packet{Src: "bot:dereg-a2", Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("new role: got %q", resp.Body)
+	}
+	other.send(&Packet{Dst: "bot:dereg-a2", Body: "hi"})
+	if p := a.recv(); p.Body != "hi" {
+		t.Fatalf("new role received %q", p.Body)
+	}
+}
+
+func TestKick(t *testing.T) {
+	s, addr := startServer(t)
+	admin := dialAgent(t, addr, "bot:kick-admin")
+	s.cfg.AdminKeys = []string{hex.EncodeToString(admin.priv.Public().(ed25519.PublicKey))}
+	target := dialAgent(t, addr, "bot:kick-target")
+	target.call(&Packet{Dst: "server"})
+
+	if resp := target.call(&Packet{Dst: "kick:bot:kick-admin"}); resp.Body != "error:forbidden" {
+		t.Fatalf("non-admin kick: got %q", resp.Body)
+	}
+
+	resp := admin.call(&Packet{Id: "k1", Dst: "kick:bot:kick-target"})
+	if resp.Id != "k1" || resp.Body != `{"status":"done","kicked":"bot:kick-target","closed":1}` {
+		t.Fatalf("kick: got %q for %q", resp.Body, resp.Id)
+	}
+	expectClosedWith(t, target.conn, closeKicked)
+	if resp := admin.call(&Packet{Dst: "bot:kick-target", Body: "still there?"}); resp.Body != "error:offline" {
+		t.Fatalf("packet to kicked identity: got %q", resp.Body)
+	}
+	if resp := admin.call(&Packet{Dst: "kick:bot:kick-nobody"}); !strings.Contains(resp.Body, `"closed":0`) {
+		t.Fatalf("kicking an unknown identity: got %q", resp.Body)
+	}
+}
+
+func TestMultipleIdentitiesPerConnection(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:multi-weather")
+	a.call(&Packet{Dst: "server"})
+	if resp := a.call(&Packet{Src: "bot:multi-news", Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("second identity: got %q", resp.Body)
+	}
+	if a1, a2 := s.lookupAgent("bot:multi-weather"), s.lookupAgent("bot:multi-news"); a1 == nil || a1 != a2 {
+		t.Fatal("both identities should route to the one connection")
+	}
+
+	other := dialAgent(t, addr, "bot:multi-other")
+	other.call(&Packet{Dst: "server"})
+	for _, dst := range []string{"bot:multi-weather", "bot:multi-news"} {
+		other.send(&Packet{Dst: dst, Body: "for " + dst})
+		if p := a.recv(); p.Dst != dst || p.Body != "for "+dst {
+			t.Fatalf("sent to %s, received %q for %s", dst, p.Body, p.Dst)
+		}
+	}
+
+	// One heartbeat per connection, not per identity.
+	s.broadcastHeartbeat()
+	if p := a.recv(); p.Typ != TypeHeartbeat {
+		t.Fatalf("got typ %d, want a heartbeat", p.Typ)
+	}
+	expectNothing(t, a)
+
+	// Another connection under the same key takes one role over; the first
+	// keeps the other instead of being retired.
+	b := dialAgent(t, addr, "bot:multi-news")
+	b.priv = a.priv
+	if resp := b.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("takeover: got %q", resp.Body)
+	}
+	other.send(&Packet{Dst: "bot:multi-weather", Body: "still here?"})
+	if p := a.recv(); p.Body != "still here?" {
+		t.Fatalf("first connection received %q", p.Body)
+	}
+
+	a.conn.Close()
+	waitFor(t, "identities to be released", func() bool { return !registered(s, "bot:multi-weather") })
+	if !registered(s, "bot:multi-news") {
+		t.Error("the identity taken over was released with the old connection")
+	}
+	s.routeMu.RLock()
+	defer s.routeMu.RUnlock()
+	for ci, ids := range s.connSrc {
+		if _, ok := ids["bot:multi-weather"]; ok {
+			t.Errorf("connection %s still lists bot:multi-weather", ci.addr)
+		}
+	}
+}
+
+func TestReplySrc(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.ReplySrc = "keep:relay-1" })
+
+	impostor := dialAgent(t, addr, "keep:relay-1")
+	if resp := impostor.call(&Packet{Dst: "server"}); resp.Body != "error:reserved_identity" {
+		t.Fatalf("registering the reply src: got %q", resp.Body)
+	}
+
+	a := dialAgent(t, addr, "bot:reply-src")
+	replies := map[string]*Packet{
+		"done":     a.call(&Packet{Dst: "server"}),
+		"discover": a.call(&Packet{Dst: "discover:info"}),
+		"error":    a.call(&Packet{Dst: "bot:reply-src"}),
+	}
+	s.broadcastHeartbeat()
+	replies["heartbeat"] = a.recv()
+	for kind, p := range replies {
+		if p.Src != "keep:relay-1" {
+			t.Errorf("%s reply %q has src %q", kind, p.Body, p.Src)
+		}
+	}
+	if replies["error"].Body != "error:self_route" || replies["heartbeat"].Typ != TypeHeartbeat {
+		t.Errorf("unexpected replies: %q, typ %d", replies["error"].Body, replies["heartbeat"].Typ)
+	}
+}
+
+func TestSigningCoversEveryField(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	fields := (&Packet{}).ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.Name() == "sig" || fd.Name() == "pk" || fd.Name() == "seq" {
+			continue // seq is stamped by the server after signing
+		}
+		t.Run(string(fd.Name()), func(t *testing.T) {
+			p := &Packet{Src: "bot:fields"}
+			m := p.ProtoReflect()
+			switch {
+			case fd.IsMap():
+				m.Mutable(fd).Map().Set(protoreflect.ValueOfString("k").MapKey(), protoreflect.ValueOfString("v"))
+			case fd.Name() == "alg":
+				m.Set(fd, protoreflect.ValueOfString(wire.AlgEd25519))
+			case fd.Kind() == protoreflect.StringKind:
+				m.Set(fd, protoreflect.ValueOfString("set"))
+			case fd.Kind() == protoreflect.BytesKind:
+				m.Set(fd, protoreflect.ValueOfBytes([]byte("set")))
+			case fd.Kind() == protoreflect.Uint32Kind:
+				m.Set(fd, protoreflect.ValueOfUint32(7))
+			case fd.Kind() == protoreflect.Uint64Kind:
+				m.Set(fd, protoreflect.ValueOfUint64(7))
+			default:
+				t.Fatalf("no test value for a %v field", fd.Kind())
+			}
+			if err := wire.Sign(p, priv); err != nil {
+				t.Fatal(err)
+			}
+			if wire.Verify(p) != nil {
+				t.Fatal("signed packet does not verify")
+			}
+			m.Clear(fd)
+			if wire.Verify(p) == nil {
+				t.Error("clearing the field after signing went unnoticed")
+			}
+		})
+	}
+}
+
+func TestVerifyFieldUnknownToServer(t *testing.T) {
+	// A newer client signs a field, 99 here, that this build's Packet lacks.
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	signed, err := proto.MarshalOptions{Deterministic: true}.Marshal(&Packet{Src: "bot:newer", Dst: "bot:older", Body: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed = protowire.AppendTag(signed, 99, protowire.VarintType)
+	signed = protowire.AppendVarint(signed, 7)
+	var p Packet
+	if err := proto.Unmarshal(signed, &p); err != nil {
+		t.Fatal(err)
+	}
+	p.Sig, p.Pk = ed25519.Sign(priv, signed), pub
+
+	// As the server reads it off the wire.
+	data, err := proto.Marshal(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Packet
+	if err := proto.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Verify(&got) != nil {
+		t.Fatal("packet with a field unknown to the server does not verify")
+	}
+	got.ProtoReflect().SetUnknown(nil)
+	if wire.Verify(&got) == nil {
+		t.Error("dropping the unknown field went unnoticed")
+	}
+}
+
+// TestPacketTypeWireValues pins the PacketType numbers to the typ values
+// clients have always sent and expected; renumbering one breaks them all.
+func TestPacketTypeWireValues(t *testing.T) {
+	for _, tc := range []struct {
+		typ, want uint32
+	}{
+		{TypeData, 0},
+		{TypeReply, 1},
+		{TypeHeartbeat, 2},
+		{TypeGoodbye, 3},
+		{TypePong, 4},
+		{TypeRegister, 5},
+		{TypeDirective, 6},
+	} {
+		if tc.typ != tc.want {
+			t.Errorf("%v = %d, want %d", wire.PacketType(tc.typ), tc.typ, tc.want)
+		}
+	}
+	if n := len(wire.PacketType_name); n != 7 {
+		t.Errorf("PacketType has %d values; pin the new one here", n)
+	}
+	for name, n := range wire.PacketType_value {
+		if wire.PacketType(n).String() != name {
+			t.Errorf("%s = %d names %v", name, n, wire.PacketType(n))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt reads an integer socket option from a TCP connection.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := raw.Control(func(fd uintptr) { v, serr = syscall.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+// acceptedConn returns the server side of identity's connection.
+func acceptedConn(t *testing.T, s *Server, identity string) net.Conn {
+	t.Helper()
+	s.routeMu.RLock()
+	defer s.routeMu.RUnlock()
+	ci, ok := s.agents[identity]
+	if !ok {
+		t.Fatalf("%s not registered", identity)
+	}
+	return ci.Conn
+}
+
+func TestAcceptedConnKeepAlive(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.KeepAlive = 7 * time.Second
+	})
+	dialAgent(t, addr, "bot:ka").call(&Packet{Dst: "server"})
+	conn := acceptedConn(t, s, "bot:ka")
+	if sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Fatal("SO_KEEPALIVE not set on accepted connection")
+	}
+	for _, opt := range []struct {
+		name string
+		opt  int
+		want int
+	}{
+		{"TCP_KEEPIDLE", syscall.TCP_KEEPIDLE, 7},
+		{"TCP_KEEPINTVL", syscall.TCP_KEEPINTVL, 7},
+		{"TCP_KEEPCNT", syscall.TCP_KEEPCNT, keepAliveProbes},
+	} {
+		if got := sockopt(t, conn, syscall.IPPROTO_TCP, opt.opt); got != opt.want {
+			t.Errorf("%s = %d, want %d", opt.name, got, opt.want)
+		}
+	}
+
+	s, addr = startServer(t, func(c *Config) {
+		c.KeepAlive = 0
+	})
+	dialAgent(t, addr, "bot:noka").call(&Packet{Dst: "server"})
+	if sockopt(t, acceptedConn(t, s, "bot:noka"), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Error("SO_KEEPALIVE set with -keepalive 0")
+	}
+}
+
+func TestAcceptedConnSocketOptions(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.SocketRecvBuffer = 96 << 10
+		c.SocketSendBuffer = 80 << 10
+	})
+	dialAgent(t, addr, "bot:tuned").call(&Packet{Dst: "server"})
+	conn := acceptedConn(t, s, "bot:tuned")
+	if sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("TCP_NODELAY not set by default")
+	}
+	// Linux doubles the requested size to leave room for its bookkeeping.
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got != 2*96<<10 {
+		t.Errorf("SO_RCVBUF = %d, want %d", got, 2*96<<10)
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got != 2*80<<10 {
+		t.Errorf("SO_SNDBUF = %d, want %d", got, 2*80<<10)
+	}
+
+	s, addr = startServer(t, func(c *Config) {
+		c.NoDelay = false
+	})
+	dialAgent(t, addr, "bot:nagle").call(&Packet{Dst: "server"})
+	if sockopt(t, acceptedConn(t, s, "bot:nagle"), syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Error("TCP_NODELAY set with -nodelay=false")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"maps"
+	"net/url"
+	"strings"
+)
+
+// Labels tag a connection with metadata such as region, version or role.
+// A registration packet (typ TypeRegister) sets them: its labels replace
+// whatever the connection had, and one without labels clears them. Labels
+// on other packets are carried but not stored. Being packet fields, they are
+// signed, so only the holder of the connection's key can set them.
+//
+// discover:agents lists the labels of every labeled agent, and
+// discover:agents?label=<key>:<value> lists only the agents carrying that
+// label; repeat label= to require several. discover:agent, with an identity
+// as its body, answers for one agent.
+
+const (
+	MaxLabels     = 16  // labels per connection
+	MaxLabelBytes = 512 // total bytes of label keys and values
+)
+
+// checkLabels enforces the label limits, returning "error:labels_too_large"
+// for an oversize set, "error:invalid_labels" for a key that is empty or
+// contains ':', which a filter could not name, or "" if p is within policy.
+func checkLabels(p *Packet) string {
+	if len(p.Labels) > MaxLabels {
+		return "error:labels_too_large"
+	}
+	n := 0
+	for k, v := range p.Labels {
+		if k == "" || strings.Contains(k, ":") {
+			return "error:invalid_labels"
+		}
+		n += len(k) + len(v)
+	}
+	if n > MaxLabelBytes {
+		return "error:labels_too_large"
+	}
+	return ""
+}
+
+// setLabels replaces the connection's labels with a copy of labels.
+func (ci *connInfo) setLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		ci.labels.Store(nil)
+		return
+	}
+	m := maps.Clone(labels)
+	ci.labels.Store(&m)
+}
+
+// getLabels returns the connection's labels, which must not be modified,
+// or nil if it has none.
+func (ci *connInfo) getLabels() map[string]string {
+	if m := ci.labels.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// labelFilter maps each label key a discover:agents query names to the
+// values asked for. An agent matches if its label equals every one, so
+// asking for two values of one key matches no agent.
+type labelFilter map[string][]string
+
+// parseLabelFilter parses the query of discover:agents?label=<key>:<value>.
+func parseLabelFilter(query string) (labelFilter, bool) {
+	values, err := url.ParseQuery(query)
+	if err != nil || len(values) != 1 || len(values["label"]) == 0 {
+		return nil, false
+	}
+	filter := make(labelFilter, len(values["label"]))
+	for _, label := range values["label"] {
+		k, v, ok := strings.Cut(label, ":")
+		if !ok || k == "" {
+			return nil, false
+		}
+		filter[k] = append(filter[k], v)
+	}
+	return filter, true
+}
+
+// match reports whether labels carry every label f asks for.
+func (f labelFilter) match(labels map[string]string) bool {
+	for k, want := range f {
+		got, ok := labels[k]
+		if !ok {
+			return false
+		}
+		for _, v := range want {
+			if got != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// agentBody is the discover:agent reply for identity.
+func (s *Server) agentBody(identity string) (string, error) {
+	state := map[string]any{"identity": identity, "online": false}
+	if ci := s.lookupAgent(identity); ci != nil {
+		labels := ci.getLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		state["online"], state["labels"] = true, labels
+		if limit := ci.maxPacketSize.Load(); limit > 0 {
+			state["max_packet_size"] = limit
+		}
+	}
+	return marshalDiscovery(state)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestLabelsInDiscovery(t *testing.T) {
+	s, addr := startServer(t)
+	eu := dialAgent(t, addr, "bot:label-eu")
+	us := dialAgent(t, addr, "bot:label-us")
+	plain := dialAgent(t, addr, "bot:label-none")
+	for _, r := range []struct {
+		a      *testAgent
+		labels map[string]string
+	}{
+		{eu, map[string]string{"region": "eu", "role": "worker"}},
+		{us, map[string]string{"region": "us", "role": "worker"}},
+		{plain, nil},
+	} {
+		if resp := r.a.call(&Packet{Typ: TypeRegister, Dst: "server", Labels: r.labels}); status(resp) != "done" {
+			t.Fatalf("%s: register got %q", r.a.src, resp.Body)
+		}
+	}
+	// Labels on an ordinary packet are not stored.
+	plain.call(&Packet{Dst: "server", Labels: map[string]string{"region": "eu"}})
+
+	agents := func(suffix string) ([]string, map[string]map[string]string) {
+		t.Helper()
+		var out struct {
+			Agents []string                     `json:"agents"`
+			Labels map[string]map[string]string `json:"labels"`
+		}
+		resp := eu.call(&Packet{Dst: "discover:" + suffix})
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil || out.Agents == nil {
+			t.Fatalf("%s: got %q", suffix, resp.Body)
+		}
+		slices.Sort(out.Agents)
+		return out.Agents, out.Labels
+	}
+
+	list, labels := agents("agents")
+	if len(list) != 3 || len(labels) != 2 || labels["bot:label-eu"]["region"] != "eu" || labels["bot:label-none"] != nil {
+		t.Fatalf("agents %v, labels %v", list, labels)
+	}
+	for query, want := range map[string][]string{
+		"label=region:eu":                   {"bot:label-eu"},
+		"label=role:worker":                 {"bot:label-eu", "bot:label-us"},
+		"label=role:worker&label=region:us": {"bot:label-us"},
+		"label=region:eu&label=region:us":   {},
+		"label=region:mars":                 {},
+	} {
+		if got, _ := agents("agents?" + query); !slices.Equal(got, want) {
+			t.Errorf("agents?%s = %v, want %v", query, got, want)
+		}
+	}
+	for _, query := range []string{"region=eu", "label=region", "label=:eu", "label=region:eu&x=1"} {
+		resp := eu.call(&Packet{Dst: "discover:agents?" + query})
+		if !strings.Contains(resp.Body, `"error":"invalid_filter"`) {
+			t.Errorf("agents?%s: got %q, want invalid_filter", query, resp.Body)
+		}
+	}
+	if resp := eu.call(&Packet{Dst: "discover:info?label=region:eu"}); !strings.Contains(resp.Body, "unknown_discovery") {
+		t.Errorf("info with a query: got %q", resp.Body)
+	}
+
+	agent := func(identity string) map[string]any {
+		t.Helper()
+		return discoverJSONBody(t, eu, "agent", identity)
+	}
+	if got := agent("bot:label-us"); got["online"] != true || got["labels"].(map[string]any)["region"] != "us" {
+		t.Fatalf("agent bot:label-us: %v", got)
+	}
+	if got := agent("bot:label-none"); got["online"] != true || len(got["labels"].(map[string]any)) != 0 {
+		t.Fatalf("agent bot:label-none: %v", got)
+	}
+	if got := agent("bot:nobody"); got["online"] != false || got["labels"] != nil {
+		t.Fatalf("agent bot:nobody: %v", got)
+	}
+
+	// A later registration replaces the labels; one without any clears them.
+	us.call(&Packet{Typ: TypeRegister, Dst: "server", Labels: map[string]string{"region": "eu"}})
+	if got, _ := agents("agents?label=region:eu"); len(got) != 2 {
+		t.Fatalf("after relabeling, region:eu = %v", got)
+	}
+	if l := s.lookupAgent("bot:label-us").getLabels(); !maps.Equal(l, map[string]string{"region": "eu"}) {
+		t.Fatalf("relabeled to %v", l)
+	}
+	us.call(&Packet{Typ: TypeRegister, Dst: "server"})
+	if l := s.lookupAgent("bot:label-us").getLabels(); l != nil {
+		t.Fatalf("labels %v after registering without any", l)
+	}
+}
+
+// discoverJSONBody sends a discovery query with a body from a and decodes
+// the reply.
+func discoverJSONBody(t *testing.T, a *testAgent, suffix, body string) map[string]any {
+	t.Helper()
+	resp := a.call(&Packet{Dst: "discover:" + suffix, Body: body})
+	var out map[string]any
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatalf("discover:%s %q: got %q", suffix, body, resp.Body)
+	}
+	return out
+}
+
+func TestLabelLimits(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:labeler")
+
+	many := make(map[string]string)
+	for i := 0; i <= MaxLabels; i++ {
+		many[fmt.Sprintf("k%d", i)] = "v"
+	}
+	cases := []struct {
+		labels map[string]string
+		want   string
+	}{
+		{labels: map[string]string{"region": "eu"}, want: "done"},
+		{labels: many, want: "error:labels_too_large"},
+		{labels: map[string]string{"big": strings.Repeat("x", MaxLabelBytes-3)}, want: "done"},
+		{labels: map[string]string{"big": strings.Repeat("x", MaxLabelBytes-2)}, want: "error:labels_too_large"},
+		{labels: map[string]string{"": "eu"}, want: "error:invalid_labels"},
+		{labels: map[string]string{"geo:region": "eu"}, want: "error:invalid_labels"},
+	}
+	for _, tc := range cases {
+		resp := a.call(&Packet{Id: "x", Typ: TypeRegister, Dst: "server", Labels: tc.labels})
+		if status(resp) != tc.want || resp.Id != "x" {
+			t.Errorf("labels %.40v: got %q (id %q), want %q", tc.labels, resp.Body, resp.Id, tc.want)
+		}
+	}
+	// A refused set leaves the last accepted one in place.
+	if l := s.lookupAgent("bot:labeler").getLabels(); len(l["big"]) != MaxLabelBytes-3 {
+		t.Errorf("labels after refusals: %.40v", l)
+	}
+
+	// Labels are signed: changing one breaks the signature.
+	p := a.sign(&Packet{Typ: TypeRegister, Dst: "server", Labels: map[string]string{"role": "worker"}})
+	p.Labels["role"] = "admin"
+	if wire.Verify(p) == nil {
+		t.Fatal("signature still verifies after a label was changed")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenerOpts are the limits applied to connections from one protocol
+// listener, so the TCP and Unix listeners can differ.
+type listenerOpts struct {
+	readCap int  // largest frame accepted, below wire.MaxPacketSize; 0 means wire.MaxPacketSize
+	json    bool // one JSON packet per line instead of protobuf frames
+	proxy   bool // connections open with a PROXY protocol header (see proxyproto.go)
+	trusted bool // unsigned packets are routed unverified instead of dropped
+}
+
+// listenProtocol opens the protocol listener on cfg.ListenAddr, applying
+// -reuseport and -listen-backlog.
+func listenProtocol(cfg *Config) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if cfg.ReusePort {
+		if !reusePortSupported {
+			return nil, fmt.Errorf("-reuseport is not supported on this platform")
+		}
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) { serr = setReusePort(fd) }); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	l, err := lc.Listen(context.Background(), "tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ListenBacklog > 0 {
+		if err := setBacklog(l, cfg.ListenBacklog); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listen backlog: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// listenUnix opens the protocol listener on a Unix socket at path. A socket
+// left behind by a previous run is removed first; any other file is not.
+func listenUnix(path string) (net.Listener, error) {
+	if st, err := os.Lstat(path); err == nil && st.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// netConn returns the socket under a TLS or PROXY protocol connection, or
+// conn itself.
+func netConn(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.NetConn()
+	}
+	return conn
+}
+
+// handshake completes the TLS handshake on a connection from a TLS listener
+// within Config.TLSHandshakeTimeout, so a client that stalls mid-handshake does
+// not hold a handler until the idle timeout. Other connections need none. It
+// reports whether conn is ready for handleConnection.
+func (s *Server) handshake(conn net.Conn) bool {
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	ctx := context.Background()
+	if d := s.cfg.TLSHandshakeTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.log.Printf("TLS handshake timeout from %s after %v", conn.RemoteAddr(), s.cfg.TLSHandshakeTimeout)
+		} else {
+			s.log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+		}
+		return false
+	}
+	return true
+}
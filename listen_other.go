@@ -0,0 +1,22 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func setReusePort(fd uintptr) error {
+	return errors.ErrUnsupported
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	return errors.ErrUnsupported
+}
+
+func checkListening(fd int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestReusePortSharesAddress(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT not supported on this platform")
+	}
+	first, err := listenProtocol(&Config{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := first.Addr().String()
+	if l, err := listenProtocol(&Config{ListenAddr: addr}); err == nil {
+		l.Close()
+		first.Close()
+		t.Fatal("second listener bound without -reuseport")
+	}
+	first.Close()
+
+	reuse := &Config{ListenAddr: addr, ReusePort: true, ListenBacklog: 16}
+	var accepted [2]atomic.Int64
+	for i := range accepted {
+		l, err := listenProtocol(reuse)
+		if err != nil {
+			t.Fatalf("listener %d: %v", i, err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted[i].Add(1)
+				c.Close()
+			}
+		}()
+	}
+
+	// The kernel hashes each connection's 4-tuple to a listener, so keep
+	// dialing until both have had a turn.
+	waitFor(t, "both listeners to accept", func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		return accepted[0].Load() > 0 && accepted[1].Load() > 0
+	})
+}
+
+func TestReadCapPerListener(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.ReadCap = 1024
+	})
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tcp)
+	path := filepath.Join(t.TempDir(), "keep.sock")
+	unix, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(unix) // -unix-read-cap is unset
+
+	big := strings.Repeat("x", 4096) // over the cap, well under wire.MaxPacketSize
+
+	// The uncapped Unix listener takes the frame.
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, priv, _ := ed25519.GenerateKey(nil)
+	local := &testAgent{t: t, conn: conn, src: "bot:local", priv: priv}
+	if resp := local.call(&Packet{Dst: "server", Body: big}); status(resp) != "done" {
+		t.Fatalf("unix listener: got %q", resp.Body)
+	}
+
+	// The capped TCP listener takes small frames and drops the connection
+	// on a large one.
+	logs := captureLog(t, s)
+	edge := dialAgent(t, tcp.Addr().String(), "bot:edge")
+	if resp := edge.call(&Packet{Dst: "server", Body: "small"}); status(resp) != "done" {
+		t.Fatalf("tcp listener, small frame: got %q", resp.Body)
+	}
+	edge.send(&Packet{Dst: "server", Body: big})
+	edge.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// The unread frame may turn the close into a reset, losing the notice.
+	p, err := wire.ReadPacket(edge.conn)
+	if err == nil {
+		if p.Typ != TypeGoodbye || p.Body != closeFrameTooLarge {
+			t.Fatalf("tcp listener, large frame: got %v, want a frame_too_large close notice", p)
+		}
+		_, err = wire.ReadPacket(edge.conn)
+	}
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("tcp listener, large frame: read %v, want the connection closed", err)
+	}
+	waitFor(t, "read cap log", func() bool { return strings.Contains(logs.String(), "packet exceeds read cap") })
+}
+
+func TestRequireSignaturePerListener(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.UnixRequireSignature = false
+	})
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tcp)
+	path := filepath.Join(t.TempDir(), "keep.sock")
+	unix, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(unix)
+
+	receiver := dialAgent(t, tcp.Addr().String(), "bot:receiver")
+	receiver.call(&Packet{Dst: "server"})
+	internal, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { internal.Close() })
+	public := dialAgent(t, tcp.Addr().String(), "bot:internal")
+
+	unsigned := &Packet{Id: "u1", Src: "bot:internal", Dst: "bot:receiver", Body: "unsigned"}
+
+	// The strict TCP listener drops it without a reply.
+	before := s.droppedUnsigned.Load()
+	wire.WritePacket(public.conn, unsigned)
+	waitFor(t, "unsigned drop", func() bool { return s.droppedUnsigned.Load() == before+1 })
+	expectNothing(t, receiver)
+
+	// The trusted Unix listener routes it, and answers it.
+	wire.WritePacket(internal, unsigned)
+	if p := receiver.recv(); p.Body != "unsigned" || p.Src != "bot:internal" || len(p.Sig) != 0 {
+		t.Fatalf("receiver got %v", p)
+	}
+	wire.WritePacket(internal, &Packet{Id: "u2", Src: "bot:internal", Dst: "server"})
+	internal.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if resp, err := wire.ReadPacket(internal); err != nil || status(resp) != "done" {
+		t.Fatalf("trusted listener reply: %v, %v", resp, err)
+	}
+	if !registered(s, "bot:internal") {
+		t.Fatal("unsigned sender not registered")
+	}
+
+	// A signature it does carry must still be valid.
+	_, priv, _ := ed25519.GenerateKey(nil)
+	forged := (&testAgent{t: t, priv: priv, src: "bot:internal"}).sign(&Packet{Dst: "bot:receiver", Body: "forged"})
+	forged.Body = "tampered"
+	wire.WritePacket(internal, forged)
+	waitFor(t, "invalid sig drop", func() bool { return s.droppedInvalidSig.Load() == 1 })
+	expectNothing(t, receiver)
+}
+
+func TestReadFrameCapped(t *testing.T) {
+	var buf strings.Builder
+	wire.WriteFrame(&buf, make([]byte, 2000))
+	frame := buf.String()
+
+	if _, err := wire.ReadFrameCapped(strings.NewReader(frame), 1000); !errors.Is(err, wire.ErrReadCap) {
+		t.Errorf("over the cap: got %v, want wire.ErrReadCap", err)
+	}
+	for _, readCap := range []int{0, 2000} {
+		if data, err := wire.ReadFrameCapped(strings.NewReader(frame), readCap); err != nil || len(data) != 2000 {
+			t.Errorf("cap %d: got %d bytes, %v", readCap, len(data), err)
+		}
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keep.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	l.Close()
+}
+
+// selfSignedTLS returns a server TLS config with a throwaway certificate.
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.TLSHandshakeTimeout = 200 * time.Millisecond
+		c.IdleTimeout = time.Minute // the handshake has its own, shorter limit
+	})
+	logs := captureLog(t, s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tls.NewListener(l, selfSignedTLS(t)))
+	addr := l.Addr().String()
+
+	// A client that finishes the handshake is served as usual.
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, priv, _ := ed25519.GenerateKey(nil)
+	secure := &testAgent{t: t, conn: conn, src: "bot:tls", priv: priv}
+	if resp := secure.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("tls agent: got %q", resp.Body)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if resp := secure.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("tls agent past the handshake timeout: got %q", resp.Body)
+	}
+
+	// One that connects and never says hello is dropped.
+	stall, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stall.Close()
+	start := time.Now()
+	stall.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stall.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("stalled handshake: read %v, want the connection closed", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("stalled handshake dropped after %v", d)
+	}
+	waitFor(t, "handshake timeout log", func() bool {
+		return strings.Contains(logs.String(), "TLS handshake timeout from "+stall.LocalAddr().String())
+	})
+	if !registered(s, "bot:tls") {
+		t.Error("tls agent lost its registration")
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+// setReusePort lets several processes bind the same address; the kernel
+// spreads incoming connections across them.
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+// setBacklog re-issues listen(2) on l's socket with the given backlog. The
+// kernel applies the new queue length to an already-listening socket (capped
+// by e.g. net.core.somaxconn on Linux).
+func setBacklog(l net.Listener, backlog int) error {
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) { serr = syscall.Listen(int(fd), backlog) }); err != nil {
+		return err
+	}
+	return serr
+}
+
+// checkListening returns an error unless fd is a socket in the listening
+// state.
+func checkListening(fd int) error {
+	v, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return err
+	}
+	if v == 0 {
+		return errors.New("socket is not listening")
+	}
+	return nil
+}
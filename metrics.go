@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedTyp bounds the per-typ counters; typ values at or above it are
+// counted together as "other" so a client can't grow the metric set.
+const maxTrackedTyp = 8
+
+// counters are a server's hot-path counters, embedded in Server. Fixed
+// arrays of atomics keep recording lock-free.
+type counters struct {
+	totalPackets atomic.Int64
+	packetsByTyp [maxTrackedTyp + 1]atomic.Int64 // index maxTrackedTyp is "other"
+
+	droppedUnsigned   atomic.Int64
+	droppedInvalidSig atomic.Int64
+	routedPackets     atomic.Int64
+	offlinePackets    atomic.Int64
+	queuedPackets     atomic.Int64 // forwards that waited for a busy connection, and packets held for deliver_at
+	forwardRetries    atomic.Int64
+	pongTimeouts      atomic.Int64
+	selfRoutes        atomic.Int64
+	aclDenied         atomic.Int64
+	expiredPackets    atomic.Int64
+	discoverCacheHits atomic.Int64
+	discoverThrottled atomic.Int64
+	secpRefused       atomic.Int64 // secp256k1 packets dropped unverified: no verify pool, or over -secp256k1-rate
+	streams           atomic.Int64
+	streamedPackets   atomic.Int64
+	liveHandlers      atomic.Int64 // connection handler goroutines that have not returned
+	handlerLeakAlerts atomic.Int64
+	proxyRejected     atomic.Int64
+	inflightPauses    atomic.Int64
+	dedupHits         atomic.Int64
+	scarLimited       atomic.Int64
+	errorReplies      atomic.Int64
+	resumed           atomic.Int64
+
+	// Receipt-to-written latency of forwarded packets, by delivery path.
+	routeLatencyLocal      *histogram
+	routeLatencyFederation *histogram
+
+	// How long connections stayed open and how many packets they sent,
+	// observed as each closes.
+	connLifetime *histogram
+	connPackets  *histogram
+
+	// Compressed frames by codec name; the map is fixed by newCounters.
+	codecs map[string]*codecCounters
+}
+
+func newCounters() counters {
+	return counters{
+		routeLatencyLocal:      newHistogram(latencyBuckets),
+		routeLatencyFederation: newHistogram(latencyBuckets),
+		connLifetime:           newHistogram(lifetimeBuckets),
+		connPackets:            newCountHistogram(packetCountBuckets),
+		codecs:                 newCodecCounters(),
+	}
+}
+
+// latencyBuckets are histogram upper bounds in seconds, 10µs to 5s.
+var latencyBuckets = []float64{
+	10e-6, 50e-6, 100e-6, 500e-6,
+	1e-3, 5e-3, 10e-3, 50e-3, 100e-3, 500e-3,
+	1, 5,
+}
+
+// lifetimeBuckets are connection lifetime bounds in seconds, 100ms to a day.
+var lifetimeBuckets = []float64{
+	0.1, 1, 10, 60, 300, 600, 1800,
+	3600, 6 * 3600, 24 * 3600,
+}
+
+// packetCountBuckets are packets-per-connection bounds, 1 to 10 million.
+var packetCountBuckets = []float64{1, 10, 100, 1e3, 1e4, 1e5, 1e6, 1e7}
+
+// histogram is a fixed-bucket histogram safe for concurrent use. observe
+// touches only atomics and never allocates.
+type histogram struct {
+	bounds []float64      // upper bounds, ascending
+	counts []atomic.Int64 // per bucket; the extra last slot is +Inf
+	sum    atomic.Int64   // observed units: nanoseconds or a count
+	per    float64        // observed units per bound unit: 1e9 for durations, 1 for counts
+}
+
+// newHistogram returns a histogram of durations with bounds in seconds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1), per: float64(time.Second)}
+}
+
+// newCountHistogram returns a histogram of counts.
+func newCountHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1), per: 1}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.observeN(int64(d))
+}
+
+// observeN records n units: nanoseconds for a duration histogram.
+func (h *histogram) observeN(n int64) {
+	v := float64(n) / h.per
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(n)
+}
+
+// write renders h as Prometheus cumulative buckets under name, with labels
+// (e.g. `path="local"`, or none) applied to every series.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	le, set := "", ""
+	if labels != "" {
+		le, set = labels+",", "{"+labels+"}"
+	}
+	var cum int64
+	for i, b := range h.bounds {
+		cum += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, le, b, cum)
+	}
+	cum += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, le, cum)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, set, float64(h.sum.Load())/h.per)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, set, cum)
+}
+
+// countTyp records a verified packet of the given typ.
+func (c *counters) countTyp(typ uint32) {
+	if typ >= maxTrackedTyp {
+		typ = maxTrackedTyp
+	}
+	c.packetsByTyp[typ].Add(1)
+}
+
+func typLabel(i int) string {
+	if i == maxTrackedTyp {
+		return "other"
+	}
+	return strconv.Itoa(i)
+}
+
+// typCounts snapshots the non-zero per-typ counters, keyed by typ label.
+func (c *counters) typCounts() map[string]int64 {
+	out := make(map[string]int64)
+	for i := range c.packetsByTyp {
+		if n := c.packetsByTyp[i].Load(); n > 0 {
+			out[typLabel(i)] = n
+		}
+	}
+	return out
+}
+
+// writeMetrics renders all counters in the Prometheus text exposition format.
+func (s *Server) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP keep_packets_total Verified packets received.")
+	fmt.Fprintln(w, "# TYPE keep_packets_total counter")
+	fmt.Fprintf(w, "keep_packets_total %d\n", s.totalPackets.Load())
+
+	fmt.Fprintln(w, "# HELP keep_packets_by_typ_total Verified packets received, by typ.")
+	fmt.Fprintln(w, "# TYPE keep_packets_by_typ_total counter")
+	for i := range s.packetsByTyp {
+		fmt.Fprintf(w, "keep_packets_by_typ_total{typ=%q} %d\n", typLabel(i), s.packetsByTyp[i].Load())
+	}
+
+	fmt.Fprintln(w, "# HELP keep_dropped_total Packets dropped before routing, by reason.")
+	fmt.Fprintln(w, "# TYPE keep_dropped_total counter")
+	fmt.Fprintf(w, "keep_dropped_total{reason=\"unsigned\"} %d\n", s.droppedUnsigned.Load())
+	fmt.Fprintf(w, "keep_dropped_total{reason=\"invalid_sig\"} %d\n", s.droppedInvalidSig.Load())
+
+	fmt.Fprintln(w, "# HELP keep_routed_total Packets forwarded to another agent.")
+	fmt.Fprintln(w, "# TYPE keep_routed_total counter")
+	fmt.Fprintf(w, "keep_routed_total %d\n", s.routedPackets.Load())
+
+	fmt.Fprintln(w, "# HELP keep_offline_total Packets addressed to an identity that was not online.")
+	fmt.Fprintln(w, "# TYPE keep_offline_total counter")
+	fmt.Fprintf(w, "keep_offline_total %d\n", s.offlinePackets.Load())
+
+	fmt.Fprintln(w, "# HELP keep_queued_total Packets that waited before delivery: forwards queued behind another write to the same connection, and packets held for deliver_at.")
+	fmt.Fprintln(w, "# TYPE keep_queued_total counter")
+	fmt.Fprintf(w, "keep_queued_total %d\n", s.queuedPackets.Load())
+
+	fmt.Fprintln(w, "# HELP keep_self_routes_total Packets rejected for being addressed to their own src.")
+	fmt.Fprintln(w, "# TYPE keep_self_routes_total counter")
+	fmt.Fprintf(w, "keep_self_routes_total %d\n", s.selfRoutes.Load())
+
+	fmt.Fprintln(w, "# HELP keep_acl_denied_total Packets refused by the route ACL.")
+	fmt.Fprintln(w, "# TYPE keep_acl_denied_total counter")
+	fmt.Fprintf(w, "keep_acl_denied_total %d\n", s.aclDenied.Load())
+
+	fmt.Fprintln(w, "# HELP keep_expired_total Packets discarded because their expires_at passed before delivery.")
+	fmt.Fprintln(w, "# TYPE keep_expired_total counter")
+	fmt.Fprintf(w, "keep_expired_total %d\n", s.expiredPackets.Load())
+
+	fmt.Fprintln(w, "# HELP keep_discover_cache_hits_total Discovery queries answered from -discover-cache-ttl's cache.")
+	fmt.Fprintln(w, "# TYPE keep_discover_cache_hits_total counter")
+	fmt.Fprintf(w, "keep_discover_cache_hits_total %d\n", s.discoverCacheHits.Load())
+
+	fmt.Fprintln(w, "# HELP keep_discover_throttled_total Discovery queries refused by -discover-rate.")
+	fmt.Fprintln(w, "# TYPE keep_discover_throttled_total counter")
+	fmt.Fprintf(w, "keep_discover_throttled_total %d\n", s.discoverThrottled.Load())
+
+	fmt.Fprintln(w, "# HELP keep_secp256k1_refused_total secp256k1 packets dropped unverified, without -verify-workers or past -secp256k1-rate.")
+	fmt.Fprintln(w, "# TYPE keep_secp256k1_refused_total counter")
+	fmt.Fprintf(w, "keep_secp256k1_refused_total %d\n", s.secpRefused.Load())
+
+	fmt.Fprintln(w, "# HELP keep_connection_handlers Connection handler goroutines running.")
+	fmt.Fprintln(w, "# TYPE keep_connection_handlers gauge")
+	fmt.Fprintf(w, "keep_connection_handlers %d\n", s.liveHandlers.Load())
+
+	fmt.Fprintln(w, "# HELP keep_open_connections Connections with a running handler that are not yet closed.")
+	fmt.Fprintln(w, "# TYPE keep_open_connections gauge")
+	fmt.Fprintf(w, "keep_open_connections %d\n", s.openConns())
+
+	fmt.Fprintln(w, "# HELP keep_handler_leak_alerts_total Times connection handlers outnumbered open connections by more than -handler-leak-threshold.")
+	fmt.Fprintln(w, "# TYPE keep_handler_leak_alerts_total counter")
+	fmt.Fprintf(w, "keep_handler_leak_alerts_total %d\n", s.handlerLeakAlerts.Load())
+
+	fmt.Fprintln(w, "# HELP keep_proxy_rejected_total Connections closed for a missing or malformed PROXY protocol header.")
+	fmt.Fprintln(w, "# TYPE keep_proxy_rejected_total counter")
+	fmt.Fprintf(w, "keep_proxy_rejected_total %d\n", s.proxyRejected.Load())
+
+	fmt.Fprintln(w, "# HELP keep_inflight_pauses_total Times a connection's reads paused with -max-inflight packets queued or being routed.")
+	fmt.Fprintln(w, "# TYPE keep_inflight_pauses_total counter")
+	fmt.Fprintf(w, "keep_inflight_pauses_total %d\n", s.inflightPauses.Load())
+
+	fmt.Fprintln(w, "# HELP keep_dedup_hits_total Packets not routed because they repeated a (pk, src, id) within -dedup-window.")
+	fmt.Fprintln(w, "# TYPE keep_dedup_hits_total counter")
+	fmt.Fprintf(w, "keep_dedup_hits_total %d\n", s.dedupHits.Load())
+
+	fmt.Fprintln(w, "# HELP keep_scar_limited_total Scars rejected for taking their source past -scar-limit-file.")
+	fmt.Fprintln(w, "# TYPE keep_scar_limited_total counter")
+	fmt.Fprintf(w, "keep_scar_limited_total %d\n", s.scarLimited.Load())
+
+	fmt.Fprintln(w, "# HELP keep_error_replies_total Packets answered with an error:* reply.")
+	fmt.Fprintln(w, "# TYPE keep_error_replies_total counter")
+	fmt.Fprintf(w, "keep_error_replies_total %d\n", s.errorReplies.Load())
+
+	fmt.Fprintln(w, "# HELP keep_resumed_total Connections that took back a dropped session with a resumption token.")
+	fmt.Fprintln(w, "# TYPE keep_resumed_total counter")
+	fmt.Fprintf(w, "keep_resumed_total %d\n", s.resumed.Load())
+
+	fmt.Fprintln(w, "# HELP keep_scheduled Packets held for a future deliver_at.")
+	fmt.Fprintln(w, "# TYPE keep_scheduled gauge")
+	fmt.Fprintf(w, "keep_scheduled %d\n", s.sched.held())
+
+	fmt.Fprintln(w, "# HELP keep_streams_total Agent pairs switched to streaming.")
+	fmt.Fprintln(w, "# TYPE keep_streams_total counter")
+	fmt.Fprintf(w, "keep_streams_total %d\n", s.streams.Load())
+
+	fmt.Fprintln(w, "# HELP keep_streamed_total Packets piped between streaming agents.")
+	fmt.Fprintln(w, "# TYPE keep_streamed_total counter")
+	fmt.Fprintf(w, "keep_streamed_total %d\n", s.streamedPackets.Load())
+
+	fmt.Fprintln(w, "# HELP keep_forward_retries_total Forward attempts retried because the destination's buffer was full.")
+	fmt.Fprintln(w, "# TYPE keep_forward_retries_total counter")
+	fmt.Fprintf(w, "keep_forward_retries_total %d\n", s.forwardRetries.Load())
+
+	fmt.Fprintln(w, "# HELP keep_pong_timeouts_total Agents closed for leaving -pong-misses heartbeats unanswered.")
+	fmt.Fprintln(w, "# TYPE keep_pong_timeouts_total counter")
+	fmt.Fprintf(w, "keep_pong_timeouts_total %d\n", s.pongTimeouts.Load())
+
+	fmt.Fprintln(w, "# HELP keep_route_latency_seconds Time from packet receipt to the forwarded write completing.")
+	fmt.Fprintln(w, "# TYPE keep_route_latency_seconds histogram")
+	s.routeLatencyLocal.write(w, "keep_route_latency_seconds", `path="local"`)
+	s.routeLatencyFederation.write(w, "keep_route_latency_seconds", `path="federation"`)
+
+	fmt.Fprintln(w, "# HELP keep_connection_lifetime_seconds How long closed connections stayed open.")
+	fmt.Fprintln(w, "# TYPE keep_connection_lifetime_seconds histogram")
+	s.connLifetime.write(w, "keep_connection_lifetime_seconds", "")
+	fmt.Fprintln(w, "# HELP keep_connection_packets Packets read from each closed connection.")
+	fmt.Fprintln(w, "# TYPE keep_connection_packets histogram")
+	s.connPackets.write(w, "keep_connection_packets", "")
+
+	s.writeCodecMetrics(w)
+
+	if st := s.scars.snapshot(); st != nil {
+		fmt.Fprintln(w, "# HELP keep_scar_store_bytes Scar payload bytes held in the scar store.")
+		fmt.Fprintln(w, "# TYPE keep_scar_store_bytes gauge")
+		fmt.Fprintf(w, "keep_scar_store_bytes %d\n", st.Bytes)
+		fmt.Fprintln(w, "# HELP keep_scar_store_entries Scar payloads held in the scar store.")
+		fmt.Fprintln(w, "# TYPE keep_scar_store_entries gauge")
+		fmt.Fprintf(w, "keep_scar_store_entries %d\n", st.Entries)
+		fmt.Fprintln(w, "# HELP keep_scar_store_evictions_total Scar payloads evicted to stay under -scar-store-bytes.")
+		fmt.Fprintln(w, "# TYPE keep_scar_store_evictions_total counter")
+		fmt.Fprintf(w, "keep_scar_store_evictions_total %d\n", st.Evictions)
+		fmt.Fprintln(w, "# HELP keep_scar_store_lookups_total Scar store lookups, by result.")
+		fmt.Fprintln(w, "# TYPE keep_scar_store_lookups_total counter")
+		fmt.Fprintf(w, "keep_scar_store_lookups_total{result=\"hit\"} %d\n", st.Hits)
+		fmt.Fprintf(w, "keep_scar_store_lookups_total{result=\"miss\"} %d\n", st.Misses)
+	}
+
+	s.writeUsageMetrics(w)
+	writeRuntimeMetrics(w)
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+// startMetrics serves /metrics and the health probes on addr. It is separate
+// from the protocol port, which stays TCP + Protobuf only.
+func (s *Server) startMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	s.log.Printf("Metrics on http://%s/metrics (probes /livez, /readyz)", l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.log.Printf("Metrics server: %v", err)
+		}
+	}()
+	return nil
+}
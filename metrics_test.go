@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestPacketCounters(t *testing.T) {
+	s, addr := startServer(t)
+
+	type snapshot struct{ typ0, typ5, other, unsigned, invalid, routed, offline int64 }
+	snap := func() snapshot {
+		return snapshot{
+			s.packetsByTyp[0].Load(), s.packetsByTyp[5].Load(), s.packetsByTyp[maxTrackedTyp].Load(),
+			s.droppedUnsigned.Load(), s.droppedInvalidSig.Load(), s.routedPackets.Load(), s.offlinePackets.Load(),
+		}
+	}
+	before := snap()
+
+	a := dialAgent(t, addr, "bot:counter-a")
+	b := dialAgent(t, addr, "bot:counter-b")
+	a.call(&Packet{Typ: 0, Dst: "server"})
+	b.call(&Packet{Typ: 5, Dst: "server"})
+	a.call(&Packet{Typ: 200, Dst: "server"})
+	a.call(&Packet{Dst: "bot:nobody"})
+	a.send(&Packet{Dst: "bot:counter-b"})
+	b.recv()
+
+	// Drops get no reply; wait for the counters instead.
+	wire.WritePacket(a.conn, &Packet{Src: "bot:counter-a", Dst: "server"})
+	bad := a.sign(&Packet{Dst: "server"})
+	bad.Body = "tampered"
+	wire.WritePacket(a.conn, bad)
+	waitFor(t, "drop counters", func() bool {
+		return s.droppedUnsigned.Load() > before.unsigned && s.droppedInvalidSig.Load() > before.invalid
+	})
+
+	after := snap()
+	want := snapshot{
+		typ0:     before.typ0 + 3, // server, offline, routed
+		typ5:     before.typ5 + 1,
+		other:    before.other + 1,
+		unsigned: before.unsigned + 1,
+		invalid:  before.invalid + 1,
+		routed:   before.routed + 1,
+		offline:  before.offline + 1,
+	}
+	if after != want {
+		t.Fatalf("counters = %+v, want %+v", after, want)
+	}
+
+	stats := discoverJSON(t, s, "stats")
+	byTyp, _ := stats["packets_by_typ"].(map[string]any)
+	if byTyp["5"] != float64(after.typ5) || stats["routed"] != float64(after.routed) {
+		t.Fatalf("discover:stats out of sync with counters: %v", stats)
+	}
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`keep_packets_by_typ_total{typ="other"}`,
+		`keep_dropped_total{reason="unsigned"}`,
+		`keep_dropped_total{reason="invalid_sig"}`,
+		`keep_routed_total`,
+		`keep_offline_total`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics missing %s", line)
+		}
+	}
+}
+
+func TestQueuedCounter(t *testing.T) {
+	s, addr := startServer(t)
+
+	// A pipe-backed destination: the first forward's write blocks until we
+	// read, so one from another sender has to wait its turn.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	slow := s.newConnInfo(srv)
+	s.registerConn("bot:queue-slow", slow)
+	a := dialAgent(t, addr, "bot:queue-a")
+	b := dialAgent(t, addr, "bot:queue-b")
+	a.send(&Packet{Dst: "bot:queue-slow", Body: "one"})
+	waitFor(t, "the first forward to start", func() bool {
+		slow.sendQ.mu.Lock()
+		defer slow.sendQ.mu.Unlock()
+		return slow.sendQ.busy
+	})
+	b.send(&Packet{Dst: "bot:queue-slow", Body: "two"})
+	waitFor(t, "the second forward to queue", func() bool { return s.queuedPackets.Load() == 1 })
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for range 2 {
+		if _, err := wire.ReadPacket(cli); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A packet held for deliver_at counts too.
+	at := uint64(time.Now().Add(time.Hour).UnixMilli())
+	a.call(&Packet{Dst: "bot:queue-slow", DeliverAt: at})
+	if n := s.queuedPackets.Load(); n != 2 {
+		t.Fatalf("queued %d, want 2", n)
+	}
+
+	if stats := discoverJSON(t, s, "stats"); stats["queued"] != float64(2) {
+		t.Fatalf("discover:stats queued = %v, want 2", stats["queued"])
+	}
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "keep_queued_total 2\n") {
+		t.Error("metrics missing keep_queued_total 2")
+	}
+}
+
+func TestRouteLatencyHistogram(t *testing.T) {
+	s, addr := startServer(t)
+
+	// A pipe-backed destination: the forward's write blocks until we read.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	s.registerConn("bot:slow", s.newConnInfo(srv))
+
+	before := make([]int64, len(s.routeLatencyLocal.counts))
+	for i := range before {
+		before[i] = s.routeLatencyLocal.counts[i].Load()
+	}
+
+	a := dialAgent(t, addr, "bot:fast")
+	a.send(&Packet{Dst: "bot:slow", Body: "take your time"})
+
+	const delay = 60 * time.Millisecond
+	time.Sleep(delay)
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := wire.ReadPacket(cli); err != nil {
+		t.Fatal(err)
+	}
+
+	// Exactly one new observation, in a bucket above the delay.
+	waitFor(t, "latency observation", func() bool {
+		var n int64
+		for i := range before {
+			n += s.routeLatencyLocal.counts[i].Load() - before[i]
+		}
+		return n == 1
+	})
+	for i, b := range latencyBuckets {
+		if b < delay.Seconds() && s.routeLatencyLocal.counts[i].Load() != before[i] {
+			t.Fatalf("observation landed in le=%g bucket, below the %v delay", b, delay)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `keep_route_latency_seconds_bucket{path="local",le="+Inf"}`) {
+		t.Fatalf("histogram missing from metrics output")
+	}
+}
+
+func TestConnectionHistograms(t *testing.T) {
+	s, addr := startServer(t)
+	closed := func() int64 {
+		n := int64(0)
+		for i := range s.connPackets.counts {
+			n += s.connPackets.counts[i].Load()
+		}
+		return n
+	}
+
+	// A brief connection that sends one packet, and one that stays a
+	// quarter second and sends a dozen.
+	brief := dialAgent(t, addr, "bot:hist-brief")
+	brief.call(&Packet{Dst: "server"})
+	brief.conn.Close()
+	waitFor(t, "brief connection to be observed", func() bool { return closed() == 1 })
+
+	long := dialAgent(t, addr, "bot:hist-long")
+	for range 12 {
+		long.call(&Packet{Dst: "server"})
+	}
+	time.Sleep(250 * time.Millisecond)
+	long.conn.Close()
+	waitFor(t, "long connection to be observed", func() bool { return closed() == 2 })
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`keep_connection_lifetime_seconds_bucket{le="0.1"} 1`,
+		`keep_connection_lifetime_seconds_bucket{le="1"} 2`,
+		"keep_connection_lifetime_seconds_count 2",
+		`keep_connection_packets_bucket{le="1"} 1`,
+		`keep_connection_packets_bucket{le="10"} 1`,
+		`keep_connection_packets_bucket{le="100"} 2`,
+		"keep_connection_packets_sum 13",
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	s, _ := startServer(t)
+	runtime.GC() // at least one pause to count
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	values := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if name, v, ok := strings.Cut(line, " "); ok && strings.HasPrefix(name, "keep_go_") {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("bad sample %q", line)
+			}
+			values[name] = f
+		}
+	}
+	for _, c := range []struct {
+		name     string
+		min, max float64
+	}{
+		{"keep_go_goroutines", 2, 1e5},
+		{"keep_go_heap_bytes", 1 << 10, 1 << 40},
+		{"keep_go_gc_pause_seconds_count", 1, math.MaxFloat64},
+		{"keep_go_gc_pause_seconds_sum", 1e-9, 60},
+		{`keep_go_gc_pause_seconds_bucket{le="+Inf"}`, 1, math.MaxFloat64},
+	} {
+		v, ok := values[c.name]
+		if !ok {
+			t.Errorf("metrics missing %s", c.name)
+		} else if v < c.min || v > c.max {
+			t.Errorf("%s = %g, want between %g and %g", c.name, v, c.min, c.max)
+		}
+	}
+	if values[`keep_go_gc_pause_seconds_bucket{le="+Inf"}`] != values["keep_go_gc_pause_seconds_count"] {
+		t.Errorf("gc pause +Inf bucket and count disagree: %v", values)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A packet to "multi:<identity>,<identity>,..." is forwarded to each listed
+// agent, and instead of an answer per recipient the sender gets one
+// deliveryReport, echoing the packet's id, saying which took it, which
+// failed (the write failed, the route ACL denied it, or it would loop back to
+// the sender) and which are not registered here. The writes run side by
+// side; the report goes out once all have finished or -aggregate-timeout has
+// passed, whichever is first, with recipients still being written to listed
+// as pending. A pending write still completes, or fails, afterwards.
+//
+// Each recipient gets the packet in its place among the sender's other
+// packets to it, as with a direct send. Like anycast and sampling,
+// multicast stays on this server: an identity hosted by a federation peer is
+// offline here.
+
+// MaxMulticastRecipients bounds the identities one multi: packet may name.
+const MaxMulticastRecipients = 256
+
+// deliveryReport is the JSON body of the reply to a multi: packet.
+type deliveryReport struct {
+	Status    string   `json:"status"`
+	Delivered []string `json:"delivered"`
+	Failed    []string `json:"failed"`
+	Offline   []string `json:"offline"`
+	Pending   []string `json:"pending,omitempty"` // still being written at -aggregate-timeout
+}
+
+// multicastRecipients parses the identities of a multi: dst, in order and
+// without repeats.
+func multicastRecipients(dst string) ([]string, string) {
+	list := strings.TrimPrefix(dst, "multi:")
+	if list == "" {
+		return nil, "error:invalid_recipients"
+	}
+	var recipients []string
+	for _, identity := range strings.Split(list, ",") {
+		if identity == "" {
+			return nil, "error:invalid_recipients"
+		}
+		if !slices.Contains(recipients, identity) {
+			recipients = append(recipients, identity)
+		}
+		if len(recipients) > MaxMulticastRecipients {
+			return nil, "error:too_many_recipients"
+		}
+	}
+	return recipients, ""
+}
+
+// routeMulticast forwards a multi: packet from c to each recipient and sends
+// c the aggregated deliveryReport.
+func (s *Server) routeMulticast(c *connInfo, p *Packet, received time.Time) error {
+	recipients, reason := multicastRecipients(p.Dst)
+	if reason != "" {
+		s.auditRecord(p, outcomeRejected, true)
+		s.log.Printf("REJECTED %s from %s (src=%s)", reason, c.addr, p.Src)
+		return reply(c, p, reason)
+	}
+
+	type outcome struct {
+		identity string
+		err      error
+	}
+	done := make(chan outcome, len(recipients))
+	var marshaled []byte // p marshaled once for every recipient
+	if s.cfg.CoalesceBroadcast && len(recipients) > 1 {
+		marshaled, _ = proto.Marshal(p)
+	}
+	state := make(map[string]*[]string, len(recipients)) // the report list each recipient is on
+	report := deliveryReport{Status: "done", Delivered: []string{}, Failed: []string{}, Offline: []string{}}
+	writing := 0
+	for _, identity := range recipients {
+		s.routeMu.RLock()
+		target, ok := s.agents[identity]
+		s.routeMu.RUnlock()
+		switch {
+		case !ok:
+			state[identity] = &report.Offline
+		case target == c && !s.cfg.AllowSelfRoute, !s.routeAllowed(p.Src, identity):
+			state[identity] = &report.Failed
+		default:
+			// Joined here, so the packet keeps its place in the
+			// recipient's line however long the write takes
+			turn := s.joinSendQ(target, p)
+			state[identity] = &report.Pending
+			writing++
+			go func() {
+				done <- outcome{identity, s.forwardInLine(target, p, marshaled, turn)}
+			}()
+		}
+	}
+
+	var timeout <-chan time.Time // nil waits for every write
+	if d := s.cfg.AggregateTimeout; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+wait:
+	for ; writing > 0; writing-- {
+		select {
+		case o := <-done:
+			state[o.identity] = &report.Delivered
+			if o.err != nil {
+				s.log.Printf("Route %s -> %s: %s failed: %v", p.Src, p.Dst, o.identity, o.err)
+				state[o.identity] = &report.Failed
+			}
+		case <-timeout:
+			break wait
+		}
+	}
+	// Each list in the order the recipients were named
+	for _, identity := range recipients {
+		*state[identity] = append(*state[identity], identity)
+	}
+
+	if n := len(report.Delivered); n > 0 {
+		s.routeLatencyLocal.observe(time.Since(received))
+		s.routedPackets.Add(int64(n))
+	}
+	s.offlinePackets.Add(int64(len(report.Offline)))
+	s.auditRecord(p, outcomeRouted, true)
+	if s.routeLog.ok() {
+		s.log.Printf("Routed %s -> %d recipients: %d delivered, %d failed, %d offline, %d pending",
+			p.Src, len(recipients), len(report.Delivered), len(report.Failed), len(report.Offline), len(report.Pending))
+	}
+	body, _ := json.Marshal(report)
+	return reply(c, p, string(body))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestMulticastDeliveryReport(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.AggregateTimeout = 100 * time.Millisecond })
+	sender := dialAgent(t, addr, "bot:multi-sender")
+	sender.call(&Packet{Dst: "server"})
+	a := dialAgent(t, addr, "bot:multi-a")
+	a.call(&Packet{Dst: "server"})
+	b := dialAgent(t, addr, "bot:multi-b")
+	b.call(&Packet{Dst: "server"})
+
+	report := func(resp *Packet, id string) deliveryReport {
+		t.Helper()
+		var r deliveryReport
+		if err := json.Unmarshal([]byte(resp.Body), &r); err != nil || r.Status != "done" || resp.Id != id {
+			t.Fatalf("got %q for id %q, want a delivery report for %q", resp.Body, resp.Id, id)
+		}
+		return r
+	}
+
+	// Online, offline, named twice and the sender itself, each reported in
+	// the order named.
+	const dst = "multi:bot:multi-b,bot:ghost,bot:multi-a,bot:multi-b,bot:multi-sender,bot:gone"
+	resp := sender.call(&Packet{Id: "m-1", Dst: dst, Body: "hello"})
+	r := report(resp, "m-1")
+	if !slices.Equal(r.Delivered, []string{"bot:multi-b", "bot:multi-a"}) ||
+		!slices.Equal(r.Offline, []string{"bot:ghost", "bot:gone"}) ||
+		!slices.Equal(r.Failed, []string{"bot:multi-sender"}) || len(r.Pending) != 0 {
+		t.Fatalf("got %+v", r)
+	}
+	for _, rcv := range []*testAgent{a, b} {
+		if p := rcv.recv(); p.Body != "hello" || p.Dst != dst || wire.Verify(p) != nil {
+			t.Fatalf("%s got %q to %q (verifies: %v)", rcv.src, p.Body, p.Dst, wire.Verify(p) == nil)
+		}
+		expectNothing(t, rcv)
+	}
+
+	// No one online still gets a report.
+	r = report(sender.call(&Packet{Id: "m-2", Dst: "multi:bot:ghost"}), "m-2")
+	if len(r.Delivered) != 0 || !slices.Equal(r.Offline, []string{"bot:ghost"}) {
+		t.Fatalf("got %+v", r)
+	}
+
+	// A recipient whose write is stuck is pending at the timeout, and gets
+	// the packet once it clears.
+	stuck := s.lookupAgent("bot:multi-b")
+	stuck.writeMu.Lock()
+	start := time.Now()
+	r = report(sender.call(&Packet{Id: "m-3", Dst: "multi:bot:multi-a,bot:multi-b", Body: "late"}), "m-3")
+	stuck.writeMu.Unlock()
+	if !slices.Equal(r.Delivered, []string{"bot:multi-a"}) || !slices.Equal(r.Pending, []string{"bot:multi-b"}) {
+		t.Fatalf("got %+v", r)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("report took %v, want about the 100ms timeout", elapsed)
+	}
+	if p := a.recv(); p.Body != "late" {
+		t.Fatalf("a got %q", p.Body)
+	}
+	if p := b.recv(); p.Body != "late" {
+		t.Fatalf("b got %q after its write cleared", p.Body)
+	}
+
+	for _, dst := range []string{"multi:", "multi:bot:multi-a,", "multi:,bot:multi-a", "multi:bot:multi-a,,bot:multi-b"} {
+		if resp := sender.call(&Packet{Dst: dst}); resp.Body != "error:invalid_recipients" {
+			t.Errorf("%s: got %q, want error:invalid_recipients", dst, resp.Body)
+		}
+	}
+	if !s.reserved("multi:bot:multi-a") {
+		t.Error("multi: identities are not reserved")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import "sync"
+
+// Priority classes for Packet.Priority. The zero value is interactive, so
+// traffic that doesn't set a priority sits between control messages and bulk
+// transfers.
+const (
+	PriorityInteractive = 0
+	PriorityControl     = 1
+	PriorityBulk        = 2
+)
+
+// priorityRank orders the classes for sending: lower goes first.
+var priorityRank = [...]int{
+	PriorityControl:     0,
+	PriorityInteractive: 1,
+	PriorityBulk:        2,
+}
+
+// rank is p's place in the sending order. Local packets with an unknown
+// priority are refused with error:bad_priority, but one relayed by a
+// federation peer may still carry one; it waits with bulk.
+func rank(p *Packet) int {
+	if p.Priority < uint32(len(priorityRank)) {
+		return priorityRank[p.Priority]
+	}
+	return priorityRank[PriorityBulk]
+}
+
+// sendQueue admits forwards to one connection a packet at a time. While one
+// is being written, the rest wait in line by class, control ahead of
+// interactive ahead of bulk, and in arrival order within a class, so a
+// control packet overtakes bulk already waiting on a congested destination.
+// Server replies and heartbeats don't queue here; they only take writeMu.
+type sendQueue struct {
+	mu      sync.Mutex
+	busy    bool
+	waiting [len(priorityRank)][]chan struct{}
+}
+
+// acquire waits for p's turn to write.
+func (q *sendQueue) acquire(p *Packet) {
+	if turn := q.join(p); turn != nil {
+		<-turn
+	}
+}
+
+// join takes p's place in line without waiting. It returns a channel that
+// is closed when p's turn comes, or nil if it is p's turn already.
+func (q *sendQueue) join(p *Packet) chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.busy {
+		q.busy = true
+		return nil
+	}
+	turn := make(chan struct{})
+	r := rank(p)
+	q.waiting[r] = append(q.waiting[r], turn)
+	return turn
+}
+
+// joinSendQ is target.sendQ.join, counting p as queued if it has to wait.
+func (s *Server) joinSendQ(target *connInfo, p *Packet) chan struct{} {
+	turn := target.sendQ.join(p)
+	if turn != nil {
+		s.queuedPackets.Add(1)
+	}
+	return turn
+}
+
+// depth returns the number of forwards waiting for their turn.
+func (q *sendQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, line := range q.waiting {
+		n += len(line)
+	}
+	return n
+}
+
+// release hands the turn to the first packet of the highest waiting class.
+func (q *sendQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for r, line := range q.waiting {
+		if len(line) > 0 {
+			q.waiting[r] = line[1:]
+			close(line[0])
+			return
+		}
+	}
+	q.busy = false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestPriorityPreemptsQueuedBulk(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.ForwardAttempts = 1 })
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	target := s.newConnInfo(srv)
+
+	// queued counts forwards holding or waiting for the connection.
+	queued := func() int {
+		target.sendQ.mu.Lock()
+		defer target.sendQ.mu.Unlock()
+		if !target.sendQ.busy {
+			return 0
+		}
+		n := 1
+		for _, line := range target.sendQ.waiting {
+			n += len(line)
+		}
+		return n
+	}
+	// net.Pipe writes block until read, so the first forward holds the
+	// connection and the rest queue behind it, one at a time so their
+	// arrival order is known.
+	sent := make(chan error, 5)
+	for i, p := range []*Packet{
+		{Id: "bulk-1", Priority: PriorityBulk},
+		{Id: "bulk-2", Priority: PriorityBulk},
+		{Id: "interactive"},
+		{Id: "bulk-3", Priority: PriorityBulk},
+		{Id: "control", Priority: PriorityControl},
+	} {
+		go func() { sent <- s.forward(target, p) }()
+		waitFor(t, p.Id+" to queue", func() bool { return queued() == i+1 })
+	}
+
+	for _, want := range []string{"bulk-1", "control", "interactive", "bulk-2", "bulk-3"} {
+		p, err := wire.ReadPacket(cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Id != want {
+			t.Fatalf("got %s, want %s", p.Id, want)
+		}
+	}
+	for range 5 {
+		if err := <-sent; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBadPriorityRejected(t *testing.T) {
+	_, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:prio")
+	if resp := a.call(&Packet{Dst: "server", Priority: 7}); resp.Body != "error:bad_priority" {
+		t.Fatalf("got %q", resp.Body)
+	}
+	if resp := a.call(&Packet{Dst: "server", Priority: PriorityBulk}); status(resp) != "done" {
+		t.Fatalf("bulk: got %q", resp.Body)
+	}
+}
+
+func TestExpiredInSendQueueNacked(t *testing.T) {
+	s, addr := startServer(t)
+	bob := dialAgent(t, addr, "bot:slow-bob")
+	bob.call(&Packet{Dst: "server"})
+	alice := dialAgent(t, addr, "bot:alice")
+	alice.call(&Packet{Dst: "server"})
+
+	// Hold bob's connection so alice's packet waits in its send queue until
+	// after its deadline.
+	target := s.lookupAgent("bot:slow-bob")
+	target.sendQ.acquire(&Packet{})
+	deadline := time.Now().Add(150 * time.Millisecond)
+	alice.send(&Packet{Id: "stale", Dst: "bot:slow-bob", Body: "too late", Channel: "jobs", ExpiresAt: uint64(deadline.UnixMilli())})
+	waitFor(t, "the packet to queue", func() bool {
+		target.sendQ.mu.Lock()
+		defer target.sendQ.mu.Unlock()
+		return len(target.sendQ.waiting[rank(&Packet{})]) == 1
+	})
+	time.Sleep(time.Until(deadline) + 20*time.Millisecond)
+	target.sendQ.release()
+
+	if resp := alice.recv(); resp.Body != "error:expired" || resp.Id != "stale" || resp.Channel != "jobs" {
+		t.Fatalf("alice got %v, want error:expired for stale", resp)
+	}
+	expectNothing(t, bob)
+	if n := s.expiredPackets.Load(); n != 1 {
+		t.Errorf("keep_expired_total = %d, want 1", n)
+	}
+}
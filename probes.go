@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Kubernetes-style probes, served on the metrics listener, never on the
+// protocol port. /livez answers 200 while the process runs. /readyz answers
+// 200 only while the protocol listener is accepting, every configured peer
+// is linked, and no shutdown has begun; otherwise 503 with the reason.
+
+// notReady returns why the server should not receive traffic, or "" if it
+// should.
+func (s *Server) notReady() string {
+	if s.shuttingDown.Load() {
+		return "shutting down"
+	}
+	if s.accepting.Load() == 0 {
+		return "listener not accepting"
+	}
+	// Peers link under their server id, so count links rather than
+	// matching addresses; an inbound link from a listed peer counts too.
+	if want := len(s.cfg.Peers); want > 0 {
+		s.fedMu.RLock()
+		linked := len(s.peers)
+		s.fedMu.RUnlock()
+		if linked < want {
+			return fmt.Sprintf("%d of %d peers linked", linked, want)
+		}
+	}
+	return ""
+}
+
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if reason := s.notReady(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
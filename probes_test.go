@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReadinessWaitsForPeers(t *testing.T) {
+	s, _ := startServer(t)
+	waitFor(t, "listener", func() bool { return s.notReady() == "" })
+
+	s.cfg.Peers = []string{"127.0.0.1:1"}
+	rec := httptest.NewRecorder()
+	s.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "0 of 1 peers linked") {
+		t.Fatalf("readyz = %d %q, want 503 naming unlinked peers", rec.Code, rec.Body)
+	}
+}
+
+func TestReadinessFailsDuringShutdown(t *testing.T) {
+	addr, admin := freeAddr(t), freeAddr(t)
+	cmd := startProcess(t, addr, "-metrics-listen", admin, "-shutdown-delay", "1s")
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + admin + path)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+	waitFor(t, "readyz 200", func() bool { code, _ := get("/readyz"); return code == http.StatusOK })
+
+	a := dialAgent(t, addr, "bot:draining")
+	a.call(&Packet{Dst: "server"})
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "readyz 503", func() bool { code, _ := get("/readyz"); return code == http.StatusServiceUnavailable })
+	if _, body := get("/readyz"); body != "shutting down" {
+		t.Errorf("readyz reason = %q, want shutting down", body)
+	}
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Errorf("livez = %d while draining, want 200", code)
+	}
+
+	// Still serving while it drains; then agents get a goodbye.
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("got %q while draining, want done", resp.Body)
+	}
+	if p := a.recv(); p.Typ != TypeGoodbye {
+		t.Fatalf("got typ %d, want goodbye", p.Typ)
+	}
+	a.conn.Close() // hang up, so the drain ends at once
+	cmd.Wait()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -proxy-protocol, every connection to the TCP protocol listener must
+// open with a PROXY protocol header, as sent by HAProxy, AWS NLB and other
+// TCP load balancers, naming the client the balancer accepted. Version 1
+// (text) and 2 (binary) are both accepted. The client's address then stands
+// in for the balancer's everywhere a connection's address is used: logs,
+// connInfo.addr, the admin snapshot. A connection whose header is missing,
+// malformed or late is closed and counted in keep_proxy_rejected_total.
+// Headers that carry no address (v1 UNKNOWN, v2 LOCAL, or a v2 family other
+// than TCP over IPv4 or IPv6, such as the balancer's own health checks)
+// leave the connection's own address in place.
+//
+// Only enable it on a listener that balancers alone can reach: the header is
+// not authenticated, so any client that connects directly can claim to be
+// anyone.
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY
+// header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLen is the longest v1 header the spec allows, CRLF included.
+const proxyV1MaxLen = 107
+
+// proxyConn is a connection accepted through a load balancer, reporting the
+// client the balancer's PROXY header named as its remote address.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// acceptProxy reads conn's PROXY header and returns conn as seen from the
+// client it names. On a TLS connection the header is read from beneath TLS,
+// before the handshake.
+func (s *Server) acceptProxy(conn net.Conn) (net.Conn, error) {
+	raw := netConn(conn)
+	raw.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	remote, err := readProxyHeader(raw)
+	raw.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: remote}, nil
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from r, consuming nothing
+// past it, and returns the source address it carries, or nil if it carries
+// none.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// The v2 signature is 12 bytes and no v1 header is shorter than that.
+	head := make([]byte, len(proxyV2Sig))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	switch {
+	case bytes.Equal(head, proxyV2Sig):
+		return readProxyV2(r)
+	case bytes.HasPrefix(head, proxyV1Prefix):
+		return readProxyV1(r, head)
+	default:
+		return nil, errors.New("no PROXY header")
+	}
+}
+
+// readProxyV1 reads the rest of a v1 header, of which head was read already.
+// It reads a byte at a time, so the first frame stays in the connection.
+func readProxyV1(r io.Reader, head []byte) (net.Addr, error) {
+	line := head
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("reading PROXY header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") || src.Zone() != "" {
+		return nil, fmt.Errorf("PROXY v1 header: bad source address %q", fields[2])
+	}
+	if _, err := netip.ParseAddr(fields[3]); err != nil {
+		return nil, fmt.Errorf("PROXY v1 header: bad destination address %q", fields[3])
+	}
+	port, err := parseProxyPort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseProxyPort(fields[5]); err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+}
+
+// parseProxyPort parses a v1 port: decimal, without a sign or leading zeros.
+func parseProxyPort(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("PROXY v1 header: bad port %q", s)
+	}
+	return uint16(n), nil
+}
+
+// readProxyV2 reads the rest of a v2 header after its signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var hdr [4]byte // version and command, family and protocol, length
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY v2 header: version %d", hdr[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	switch hdr[0] & 0xf {
+	case 0: // LOCAL: the balancer's own connection
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("PROXY v2 header: command %d", hdr[0]&0xf)
+	}
+
+	var addrLen int
+	switch hdr[1] {
+	case 0x11: // TCP over IPv4
+		addrLen = 4
+	case 0x21: // TCP over IPv6
+		addrLen = 16
+	default: // UNSPEC, UDP, Unix: nothing to use
+		return nil, nil
+	}
+	if len(body) < 2*addrLen+4 {
+		return nil, fmt.Errorf("PROXY v2 header: %d address bytes, want %d", len(body), 2*addrLen+4)
+	}
+	src, _ := netip.AddrFromSlice(body[:addrLen])
+	port := binary.BigEndian.Uint16(body[2*addrLen:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+}
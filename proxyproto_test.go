@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header: command cmd, family fam, carrying src and dst.
+func proxyV2(cmd, fam byte, src, dst netip.AddrPort) []byte {
+	var body []byte
+	if src.IsValid() {
+		body = append(body, src.Addr().AsSlice()...)
+		body = append(body, dst.Addr().AsSlice()...)
+		body = binary.BigEndian.AppendUint16(body, src.Port())
+		body = binary.BigEndian.AppendUint16(body, dst.Port())
+	}
+	h := append([]byte{}, proxyV2Sig...)
+	h = append(h, 0x20|cmd, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.ProxyProtocol = true })
+	lb := netip.MustParseAddrPort("10.0.0.1:9009")
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		want   string // "" means the connection's own address
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 9009\r\n"), "203.0.113.7:51234"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 9009\r\n"), "[2001:db8::7]:40000"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", proxyV2(1, 0x11, netip.MustParseAddrPort("198.51.100.9:6000"), lb), "198.51.100.9:6000"},
+		{"v2 tcp6", proxyV2(1, 0x21, netip.MustParseAddrPort("[2001:db8::9]:6001"), netip.MustParseAddrPort("[2001:db8::1]:9009")), "[2001:db8::9]:6001"},
+		{"v2 local", proxyV2(0, 0x00, netip.AddrPort{}, netip.AddrPort{}), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			identity := "bot:proxied-" + strings.ReplaceAll(tc.name, " ", "-")
+			a := dialAgent(t, addr, identity)
+			if _, err := a.conn.Write(tc.header); err != nil {
+				t.Fatal(err)
+			}
+			if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+				t.Fatalf("got %q", resp.Body)
+			}
+			want := tc.want
+			if want == "" {
+				want = a.conn.LocalAddr().String()
+			}
+			if got := s.lookupAgent(identity).addr; got != want {
+				t.Errorf("addr = %s, want %s", got, want)
+			}
+		})
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n",
+		"PROXY TCP4 2001:db8::7 10.0.0.1 51234 9009\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 99999 9009\r\n",
+		"PROXY " + strings.Repeat("X", 120) + "\r\n",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+		// EOF, or a reset if the server closed with input unread
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%q: read %d bytes, want the server to hang up", header, n)
+		}
+	}
+	if n := s.proxyRejected.Load(); n != 5 {
+		t.Errorf("keep_proxy_rejected_total = %d, want 5", n)
+	}
+}
+
+func TestReadProxyHeaderLeavesFrame(t *testing.T) {
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 9009\r\n"),
+		proxyV2(1, 0x11, netip.MustParseAddrPort("203.0.113.7:51234"), netip.MustParseAddrPort("10.0.0.1:9009")),
+	} {
+		r := bytes.NewReader(append(header, "frame"...))
+		got, err := readProxyHeader(r)
+		if err != nil || got.String() != "203.0.113.7:51234" {
+			t.Fatalf("%q: got %v, %v", header, got, err)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "frame" {
+			t.Errorf("%q: left %q, want the frame untouched", header, rest)
+		}
+	}
+}
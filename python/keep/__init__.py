@@ -1,9 +1,9 @@
 """keep-protocol: Signed agent-to-agent communication over TCP."""
 
-from keep.client import KeepClient
+from keep.client import Channel, KeepClient, is_ack, new_id
 
 __version__ = "0.5.0"
-__all__ = ["KeepClient", "ensure_server"]
+__all__ = ["Channel", "KeepClient", "ensure_server", "is_ack", "new_id"]
 
 
 def ensure_server(
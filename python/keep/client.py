@@ -2,6 +2,7 @@
 
 import json
 import logging
+import os
 import shutil
 import socket
 import struct
@@ -20,6 +21,82 @@ logger = logging.getLogger(__name__)
 
 MAX_PACKET_SIZE = 65536
 
+# Packet types with special meaning to the server and SDK; the PacketType
+# enum in keep.proto.
+TYP_DATA = keep_pb2.PACKET_TYPE_DATA
+TYP_REPLY = keep_pb2.PACKET_TYPE_REPLY
+TYP_HEARTBEAT = keep_pb2.PACKET_TYPE_HEARTBEAT
+TYP_GOODBYE = keep_pb2.PACKET_TYPE_GOODBYE
+TYP_PONG = keep_pb2.PACKET_TYPE_PONG
+TYP_REGISTER = keep_pb2.PACKET_TYPE_REGISTER
+TYP_DIRECTIVE = keep_pb2.PACKET_TYPE_DIRECTIVE
+
+# Delivery classes for send(priority=...); see keep.proto.
+PRIORITY_INTERACTIVE = 0
+PRIORITY_CONTROL = 1
+PRIORITY_BULK = 2
+
+
+def new_id() -> str:
+    """Return a fresh packet id: a UUIDv7 (RFC 9562) string.
+
+    Replies echo the id of the packet they answer, so ids must be unique
+    among a sender's outstanding requests. The first 48 bits are the Unix
+    time in milliseconds, so ids sort by creation time, and 74 bits are
+    random, so ids minted independently by any number of clients don't
+    collide in practice. send() uses this when no msg_id is given.
+    """
+    ms = time.time_ns() // 1_000_000
+    rand = int.from_bytes(os.urandom(10), "big")
+    value = (ms & (1 << 48) - 1) << 80
+    value |= 0x7 << 76  # version 7
+    value |= (rand >> 64 & 0xFFF) << 64  # 12 random bits
+    value |= 0b10 << 62  # RFC 9562 variant
+    value |= rand & (1 << 62) - 1  # 62 random bits
+    return str(uuid.UUID(int=value))
+
+
+def is_ack(reply: Optional[keep_pb2.Packet], server_src: str = "server") -> bool:
+    """Report whether reply is the server's acknowledgement of a packet.
+
+    Servers acknowledge packets addressed to "server" with a JSON body
+    {"status": "done", "id": ..., "ts": ..., "registered": ...}; older
+    servers, and servers run with -legacy-done, reply with a bare "done".
+    server_src is the src the server replies with: "server" unless it runs
+    with -reply-src. KeepClient.is_ack() passes the one the client knows.
+    """
+    if reply is None or reply.src != server_src:
+        return False
+    if reply.body == "done":
+        return True
+    try:
+        return json.loads(reply.body).get("status") == "done"
+    except (ValueError, AttributeError):
+        return False
+
+
+class Channel:
+    """A logical channel multiplexed over a client's connection.
+
+    Packets sent through a channel carry its name in the packet's channel
+    field; packets received with that channel are passed to its handler by
+    KeepClient.listen(). Create one with KeepClient.channel().
+    """
+
+    def __init__(
+        self,
+        client: "KeepClient",
+        name: str,
+        handler: Optional[Callable[[keep_pb2.Packet], None]] = None,
+    ):
+        self.client = client
+        self.name = name
+        self.handler = handler
+
+    def send(self, body: str, dst: str = "server", **kwargs) -> Optional[keep_pb2.Packet]:
+        """Send a packet on this channel. Accepts KeepClient.send() arguments."""
+        return self.client.send(body, dst=dst, channel=self.name, **kwargs)
+
 
 class KeepClient:
     """Client for the keep-protocol server.
@@ -31,6 +108,8 @@ class KeepClient:
       - Ephemeral (default): opens/closes a TCP connection per send() call.
       - Persistent: call connect() or use as context manager to hold a connection
         open for sending and receiving routed messages via listen().
+
+    A persistent connection can carry several logical channels; see channel().
     """
 
     def __init__(
@@ -40,15 +119,31 @@ class KeepClient:
         private_key: Optional[Ed25519PrivateKey] = None,
         timeout: float = 10.0,
         src: Optional[str] = None,
+        server_src: str = "server",
     ):
         self.host = host
         self.port = port
         self.timeout = timeout
         self.src = src or "bot:keep-client"
+        # The src the server's own packets carry: its -reply-src. discover()
+        # learns it from the server's reply.
+        self.server_src = server_src
         self._private_key = private_key or Ed25519PrivateKey.generate()
         self._public_key = self._private_key.public_key()
         self._pk_bytes = self._public_key.public_bytes_raw()
         self._sock: Optional[socket.socket] = None
+        self._channels: dict = {}
+        # Why the server last closed the connection (its goodbye's body,
+        # e.g. "shutdown", "kicked", "replaced"), or None.
+        self.close_reason: Optional[str] = None
+        # Called with the parsed body of each server directive (typ=6), e.g.
+        # {"directive": "throttle", "args": {"rate": 5}, "seq": 1, "ts": ...};
+        # None passes directives to listen()'s callback like other packets.
+        self.on_directive: Optional[Callable[[dict], None]] = None
+        # The server numbers the packets it writes to each connection from 1;
+        # missed counts numbers skipped on the current connection.
+        self.last_seq = 0
+        self.missed = 0
 
     # -- Server bootstrap --
 
@@ -244,6 +339,107 @@ class KeepClient:
         s.settimeout(self.timeout)
         s.connect((self.host, self.port))
         self._sock = s
+        self.last_seq = 0
+        self.missed = 0
+
+    def register(
+        self, labels: Optional[dict] = None, max_packet_size: int = 0
+    ) -> keep_pb2.Packet:
+        """Register this client's identity on the persistent connection.
+
+        Servers run with -require-registration close a connection whose
+        first packet is not a registration, so call this right after
+        connect(). labels, such as {"region": "eu", "role": "worker"}, tag
+        the connection in discover:agents, replacing any set before.
+        max_packet_size, if set, is the largest packet in bytes this client
+        will take: discover:agent shows it, and the server refuses larger
+        packets sent to it with error:dst_too_large. Returns the server's
+        reply; is_ack() tells whether it succeeded.
+        """
+        return self.send(
+            body="",
+            typ=TYP_REGISTER,
+            wait_reply=True,
+            labels=labels,
+            max_packet_size=max_packet_size,
+        )
+
+    def register_many(self, identities: list) -> keep_pb2.Packet:
+        """Register several identities on the persistent connection at once.
+
+        All of them are registered under this client's key, or none is if
+        the server refuses any. The reply body is {"status": "done" or
+        "rejected", "results": [{"identity": ..., "status": ...}, ...]}.
+        Send as one of them afterwards with send(src=...).
+        """
+        return self.send(body=json.dumps(list(identities)), dst="register", wait_reply=True)
+
+    def subscribe(self, group: str) -> keep_pb2.Packet:
+        """Join an anycast group on the persistent connection.
+
+        A packet sent to "any:<group>" is delivered to one member: the
+        longest-subscribed one that can be written to. Membership ends with
+        unsubscribe() or when the connection closes. Returns the server's
+        reply.
+        """
+        return self.send(body="", dst=f"subscribe:{group}", wait_reply=True)
+
+    def unsubscribe(self, group: str) -> keep_pb2.Packet:
+        """Leave an anycast group joined with subscribe()."""
+        return self.send(body="", dst=f"unsubscribe:{group}", wait_reply=True)
+
+    def sample(self, body: str, fraction: float) -> keep_pb2.Packet:
+        """Send body to a random fraction (0 < fraction <= 1) of the agents
+        registered on the server.
+
+        Each packet picks its own sample, every agent but this one equally
+        likely. The reply body is {"status": "done", "delivered": n,
+        "sampled": k, "of": agents}, or error:invalid_fraction.
+        """
+        return self.send(body=body, dst=f"sample:{fraction}", wait_reply=True)
+
+    def multicast(self, body: str, identities: list) -> keep_pb2.Packet:
+        """Send body to each of identities, getting one reply for all.
+
+        The reply body is {"status": "done", "delivered": [...], "failed":
+        [...], "offline": [...]}, plus "pending": [...] for recipients still
+        being written to when the server stopped waiting; or
+        error:invalid_recipients or error:too_many_recipients.
+        """
+        return self.send(body=body, dst="multi:" + ",".join(identities), wait_reply=True)
+
+    def deregister(self, identity: Optional[str] = None) -> keep_pb2.Packet:
+        """Release identity (default: this client's src), keeping the
+        connection open.
+
+        Only the key the identity was registered with may release it;
+        packets to it then get error:offline. Any later packet sent with
+        that src registers it again, so switch src before sending more.
+        Returns the server's reply.
+        """
+        identity = identity or self.src
+        return self.send(body="", dst=f"deregister:{identity}", wait_reply=True)
+
+    def kick(self, identity: str) -> keep_pb2.Packet:
+        """Close every connection holding identity (admin keys only).
+
+        The reply body is {"status": "done", "kicked": ..., "closed": n},
+        or error:forbidden unless this client's key is one of the server's
+        -admin-keys.
+        """
+        return self.send(body="", dst=f"kick:{identity}", wait_reply=True)
+
+    def open_stream(self, peer: str) -> keep_pb2.Packet:
+        """Pair this connection with peer's into a stream.
+
+        Both agents must call open_stream() naming the other; the first
+        offer is delivered to the peer so it knows to answer. Blocks until
+        the stream opens and returns the server's reply, whose body is
+        {"status": "streaming", "peer": ...} on success. From then on every
+        packet sent on the connection goes to peer, whatever its dst, and
+        the stream ends when either side disconnects.
+        """
+        return self.send(body="", dst=f"stream:{peer}", wait_reply=True)
 
     def disconnect(self) -> None:
         """Close the persistent connection."""
@@ -254,12 +450,27 @@ class KeepClient:
                 pass
             self._sock = None
 
+    def goodbye(self) -> None:
+        """Announce a clean disconnect, then close the persistent connection.
+
+        The server unregisters this client's identity and closes quietly
+        instead of logging a read error. Best-effort: if the connection is
+        already broken, it is simply closed.
+        """
+        if self._sock is None:
+            return
+        try:
+            self._send_framed(self._sock, self._sign_packet(body="", typ=TYP_GOODBYE))
+        except OSError:
+            pass
+        self.disconnect()
+
     def __enter__(self) -> "KeepClient":
         self.connect()
         return self
 
     def __exit__(self, *exc) -> None:
-        self.disconnect()
+        self.goodbye()
 
     # -- Framing helpers --
 
@@ -317,9 +528,17 @@ class KeepClient:
         ttl: int = 60,
         msg_id: Optional[str] = None,
         scar: bytes = b"",
+        reply_to: str = "",
+        channel: str = "",
+        tags: Optional[dict] = None,
+        expires_at: int = 0,
+        priority: int = 0,
+        labels: Optional[dict] = None,
+        deliver_at: int = 0,
+        max_packet_size: int = 0,
     ) -> bytes:
         """Build, sign, and serialize a Packet. Returns wire bytes."""
-        msg_id = msg_id or str(uuid.uuid4())
+        msg_id = msg_id or new_id()
         src = src or self.src
 
         p = keep_pb2.Packet()
@@ -331,8 +550,18 @@ class KeepClient:
         p.fee = fee
         p.ttl = ttl
         p.scar = scar
-
-        sign_payload = p.SerializeToString()
+        p.reply_to = reply_to
+        p.channel = channel
+        p.tags.update(tags or {})
+        p.expires_at = expires_at
+        p.priority = priority
+        p.labels.update(labels or {})
+        p.deliver_at = deliver_at
+        p.max_packet_size = max_packet_size
+
+        # Deterministic so tags and labels serialize in key order, as the
+        # server expects
+        sign_payload = p.SerializeToString(deterministic=True)
         sig_bytes = self._private_key.sign(sign_payload)
 
         p.sig = sig_bytes
@@ -352,6 +581,14 @@ class KeepClient:
         msg_id: Optional[str] = None,
         scar: bytes = b"",
         wait_reply: Optional[bool] = None,
+        reply_to: str = "",
+        channel: str = "",
+        tags: Optional[dict] = None,
+        expires_in: float = 0,
+        priority: int = PRIORITY_INTERACTIVE,
+        labels: Optional[dict] = None,
+        deliver_in: float = 0,
+        max_packet_size: int = 0,
     ) -> Optional[keep_pb2.Packet]:
         """Sign and send a packet.
 
@@ -363,7 +600,41 @@ class KeepClient:
           - wait_reply=False: sends without waiting. Returns None.
           - wait_reply=None (default): waits if dst is "server" or "",
             does not wait otherwise.
+
+        reply_to names another identity, registered on the same server with
+        the same key, that replies to this packet's id should be routed to.
+        Server replies go there too, so pass wait_reply=False with it.
+
+        channel tags the packet with a logical channel (see channel()). Server
+        replies echo it. While waiting for a reply, packets that arrive for
+        other channels with a handler are dispatched to that handler.
+
+        tags is a dict of string tracing tags, such as {"trace_id": ...},
+        signed with the packet and carried end to end.
+
+        expires_in, in seconds, sets the packet's wall-clock deadline: if it
+        is still waiting to be routed that long after signing, the server
+        discards it and replies error:expired. 0 means no deadline. This is
+        separate from ttl, which limits federation hops.
+
+        priority is the delivery class: PRIORITY_CONTROL, PRIORITY_INTERACTIVE
+        (the default) or PRIORITY_BULK. When packets queue for a congested
+        destination, control goes first and bulk last.
+
+        labels is a dict of string connection labels, such as {"region":
+        "eu"}. The server stores them only from a registration packet (see
+        register()).
+
+        deliver_in, in seconds, asks the server to hold the packet and deliver
+        it that long after signing, to whoever holds dst then. The server
+        replies at once with {"status": "scheduled", ...}; pass
+        wait_reply=True to read it. 0 delivers immediately.
+
+        max_packet_size is stored, like labels, only from a registration
+        packet (see register()).
         """
+        expires_at = int((time.time() + expires_in) * 1000) if expires_in > 0 else 0
+        deliver_at = int((time.time() + deliver_in) * 1000) if deliver_in > 0 else 0
         wire_data = self._sign_packet(
             body=body,
             src=src,
@@ -373,6 +644,14 @@ class KeepClient:
             ttl=ttl,
             msg_id=msg_id,
             scar=scar,
+            reply_to=reply_to,
+            channel=channel,
+            tags=tags,
+            expires_at=expires_at,
+            priority=priority,
+            labels=labels,
+            deliver_at=deliver_at,
+            max_packet_size=max_packet_size,
         )
 
         if self._sock is not None:
@@ -384,7 +663,7 @@ class KeepClient:
                 should_wait = dst in ("server", "") or dst.startswith("discover:")
 
             if should_wait:
-                return self._read_packet(self._sock)
+                return self._await_reply(channel)
             return None
 
         # Ephemeral mode — open/close per call
@@ -401,20 +680,86 @@ class KeepClient:
         resp.ParseFromString(reply_data)
         return resp
 
+    # -- Channels --
+
+    def channel(
+        self,
+        name: str,
+        handler: Optional[Callable[[keep_pb2.Packet], None]] = None,
+    ) -> Channel:
+        """Return the logical channel called name, creating it if needed.
+
+        Channels multiplex independent conversations (per topic, say) over
+        one persistent connection. If handler is given it replaces the
+        channel's handler; listen() passes it every packet received on the
+        channel. The empty name is the default channel and cannot be used.
+        """
+        if not name:
+            raise ValueError("channel name must not be empty")
+        ch = self._channels.get(name)
+        if ch is None:
+            ch = self._channels[name] = Channel(self, name)
+        if handler is not None:
+            ch.handler = handler
+        return ch
+
+    def _dispatch(
+        self,
+        p: keep_pb2.Packet,
+        fallback: Optional[Callable[[keep_pb2.Packet], None]],
+    ) -> None:
+        """Pass p to its channel's handler, or to fallback if it has none."""
+        ch = self._channels.get(p.channel) if p.channel else None
+        if ch is not None and ch.handler is not None:
+            ch.handler(p)
+        elif fallback is not None:
+            fallback(p)
+
+    def _read_persistent(self) -> keep_pb2.Packet:
+        """Read the next packet from the persistent connection, noting in
+        missed any sequence numbers it skips."""
+        p = self._read_packet(self._sock)
+        if p.seq:
+            if p.seq > self.last_seq + 1:
+                self.missed += p.seq - self.last_seq - 1
+            self.last_seq = p.seq
+        return p
+
+    def _await_reply(self, channel: str) -> keep_pb2.Packet:
+        """Read the reply to a packet sent on channel.
+
+        Packets for other channels that have a handler are dispatched on the
+        way; anything else is returned as the reply, as without channels.
+        """
+        while True:
+            p = self._read_persistent()
+            if p.channel != channel:
+                ch = self._channels.get(p.channel)
+                if ch is not None and ch.handler is not None:
+                    ch.handler(p)
+                    continue
+            return p
+
     # -- Listen --
 
     def listen(
         self,
-        callback: Callable[[keep_pb2.Packet], None],
+        callback: Optional[Callable[[keep_pb2.Packet], None]] = None,
         timeout: Optional[float] = None,
     ) -> None:
         """Block and read packets from the persistent connection.
 
-        Invokes callback(packet) for each received packet.
-        Heartbeat packets (typ=2) are silently filtered.
+        Packets on a channel with a handler (see channel()) go to that
+        handler; callback(packet) is invoked for every other packet.
+        Heartbeat packets (typ=2) are answered with a pong (typ=4) and not
+        passed on, so the server knows the client is alive. A server goodbye
+        (typ=3) ends listening and closes the connection; its reason code is
+        left in close_reason. Server directives (typ=6) go to on_directive,
+        if set.
 
         Args:
-            callback: Called with each received Packet.
+            callback: Called with each received Packet not taken by a
+                      channel handler. May be None when only channels listen.
             timeout: Seconds to listen before returning. None = listen until
                      the connection closes or an error occurs.
 
@@ -429,17 +774,25 @@ class KeepClient:
 
         try:
             while True:
-                p = self._read_packet(self._sock)
-                # Filter heartbeat packets
-                if p.typ == 2:
+                p = self._read_persistent()
+                # Answer and filter heartbeat packets
+                if p.typ == TYP_HEARTBEAT:
+                    self._send_framed(self._sock, self._sign_packet(body=p.body, typ=TYP_PONG))
                     continue
-                callback(p)
+                if p.typ == TYP_GOODBYE and p.src == self.server_src:
+                    self.close_reason = p.body or None
+                    self.disconnect()
+                    return
+                if p.typ == TYP_DIRECTIVE and p.src == self.server_src and self.on_directive is not None:
+                    self.on_directive(json.loads(p.body))
+                    continue
+                self._dispatch(p, callback)
         except socket.timeout:
             return
         except ConnectionError:
             return
         finally:
-            if timeout is not None:
+            if timeout is not None and self._sock is not None:
                 self._sock.settimeout(self.timeout)
 
     # -- Discovery --
@@ -451,11 +804,18 @@ class KeepClient:
             query: Discovery type — "info", "agents", or "stats".
 
         Returns:
-            Parsed JSON dict from the server's response body.
+            Parsed JSON dict from the server's response body. An unknown
+            query returns {"error": "unknown_discovery", "query": query}.
         """
         reply = self.send(body="", dst=f"discover:{query}")
+        if reply.src:
+            self.server_src = reply.src  # only the server answers discovery
         return json.loads(reply.body)
 
+    def is_ack(self, reply: Optional[keep_pb2.Packet]) -> bool:
+        """Report whether reply acknowledges a packet, from this server's src."""
+        return is_ack(reply, self.server_src)
+
     def discover_agents(self) -> list:
         """Return list of currently connected agent identities."""
         info = self.discover("agents")
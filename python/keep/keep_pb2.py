@@ -13,14 +13,24 @@ _sym_db = _symbol_database.Default()
 
 
 
-DESCRIPTOR = _descriptor_pool.Default().AddSerializedFile(b'\n\nkeep.proto\"\x8a\x01\n\x06Packet\x12\x0b\n\x03sig\x18\x01 \x01(\x0c\x12\n\n\x02pk\x18\x02 \x01(\x0c\x12\x0b\n\x03typ\x18\x03 \x01(\r\x12\n\n\x02id\x18\x04 \x01(\t\x12\x0b\n\x03src\x18\x05 \x01(\t\x12\x0b\n\x03\x64st\x18\x06 \x01(\t\x12\x0c\n\x04\x62ody\x18\x07 \x01(\t\x12\x0b\n\x03\x66\x65\x65\x18\x08 \x01(\x04\x12\x0b\n\x03ttl\x18\t \x01(\r\x12\x0c\n\x04scar\x18\n \x01(\x0c\x42\x08Z\x06.;mainb\x06proto3')
+DESCRIPTOR = _descriptor_pool.Default().AddSerializedFile(b'\n\nkeep.proto\"\xbc\x03\n\x06Packet\x12\x0b\n\x03sig\x18\x01 \x01(\x0c\x12\n\n\x02pk\x18\x02 \x01(\x0c\x12\x0b\n\x03typ\x18\x03 \x01(\r\x12\n\n\x02id\x18\x04 \x01(\t\x12\x0b\n\x03src\x18\x05 \x01(\t\x12\x0b\n\x03\x64st\x18\x06 \x01(\t\x12\x0c\n\x04\x62ody\x18\x07 \x01(\t\x12\x0b\n\x03\x66\x65\x65\x18\x08 \x01(\x04\x12\x0b\n\x03ttl\x18\t \x01(\r\x12\x0c\n\x04scar\x18\n \x01(\x0c\x12\x10\n\x08reply_to\x18\x0b \x01(\t\x12\x0f\n\x07\x63hannel\x18\x0c \x01(\t\x12\x1f\n\x04tags\x18\r \x03(\x0b\x32\x11.Packet.TagsEntry\x12\x0b\n\x03\x61lg\x18\x0e \x01(\t\x12\x12\n\nexpires_at\x18\x0f \x01(\x04\x12\x10\n\x08priority\x18\x10 \x01(\r\x12\x0b\n\x03seq\x18\x11 \x01(\x04\x12#\n\x06labels\x18\x12 \x03(\x0b\x32\x13.Packet.LabelsEntry\x12\x12\n\ndeliver_at\x18\x13 \x01(\x04\x12\x17\n\x0fmax_packet_size\x18\x14 \x01(\r\x1a+\n\tTagsEntry\x12\x0b\n\x03key\x18\x01 \x01(\t\x12\r\n\x05value\x18\x02 \x01(\t:\x02\x38\x01\x1a-\n\x0bLabelsEntry\x12\x0b\n\x03key\x18\x01 \x01(\t\x12\r\n\x05value\x18\x02 \x01(\t:\x02\x38\x01*\xb8\x01\n\nPacketType\x12\x14\n\x10PACKET_TYPE_DATA\x10\x00\x12\x15\n\x11PACKET_TYPE_REPLY\x10\x01\x12\x19\n\x15PACKET_TYPE_HEARTBEAT\x10\x02\x12\x17\n\x13PACKET_TYPE_GOODBYE\x10\x03\x12\x14\n\x10PACKET_TYPE_PONG\x10\x04\x12\x18\n\x14PACKET_TYPE_REGISTER\x10\x05\x12\x19\n\x15PACKET_TYPE_DIRECTIVE\x10\x06\x42+Z)github.com/teacrawford/keep-protocol/wireb\x06proto3')
 
 _builder.BuildMessageAndEnumDescriptors(DESCRIPTOR, globals())
 _builder.BuildTopDescriptorsAndMessages(DESCRIPTOR, 'keep_pb2', globals())
 if _descriptor._USE_C_DESCRIPTORS == False:
 
   DESCRIPTOR._options = None
-  DESCRIPTOR._serialized_options = b'Z\006.;main'
+  DESCRIPTOR._serialized_options = b'Z)github.com/teacrawford/keep-protocol/wire'
+  _PACKET_TAGSENTRY._options = None
+  _PACKET_TAGSENTRY._serialized_options = b'8\001'
+  _PACKET_LABELSENTRY._options = None
+  _PACKET_LABELSENTRY._serialized_options = b'8\001'
+  _PACKETTYPE._serialized_start=462
+  _PACKETTYPE._serialized_end=646
   _PACKET._serialized_start=15
-  _PACKET._serialized_end=153
+  _PACKET._serialized_end=459
+  _PACKET_TAGSENTRY._serialized_start=369
+  _PACKET_TAGSENTRY._serialized_end=412
+  _PACKET_LABELSENTRY._serialized_start=414
+  _PACKET_LABELSENTRY._serialized_end=459
 # @@protoc_insertion_point(module_scope)
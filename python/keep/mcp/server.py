@@ -47,7 +47,8 @@ def keep_send(
         scar: Optional scar/memory data to share (as string)
 
     Returns:
-        Response body from the destination, or "done" if server acknowledged.
+        Response body from the destination, or the server's JSON
+        acknowledgement ({"status": "done", ...}) for dst 'server'.
     """
     client = _get_client()
     scar_bytes = scar.encode("utf-8") if scar else b""
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Quotas cap what each identity may send per window, loaded from the JSON
+// file named by -quota-file:
+//
+//	{
+//	  "window": "1m",
+//	  "default": {"bytes": 1048576, "packets": 600},
+//	  "identities": {"bot:bulk": {"bytes": 0, "packets": 6000}}
+//	}
+//
+// Bytes are framed wire bytes, as counted for discover:usage. A zero limit is
+// unlimited, and an identity's override replaces the default entirely.
+//
+// Windows are fixed and per identity: one opens at the identity's first
+// packet and lasts "window". A packet that would take the identity past a
+// limit is rejected with error:quota_exceeded and not counted; the counters
+// reset with the first packet after the window ends.
+
+// quotaLimit is one identity's per-window allowance.
+type quotaLimit struct {
+	Bytes   int64 `json:"bytes"`
+	Packets int64 `json:"packets"`
+}
+
+type quotaConfig struct {
+	Window     string                `json:"window"`
+	Default    quotaLimit            `json:"default"`
+	Identities map[string]quotaLimit `json:"identities"`
+
+	window time.Duration
+}
+
+func (q *quotaConfig) limitFor(identity string) quotaLimit {
+	if l, ok := q.Identities[identity]; ok {
+		return l
+	}
+	return q.Default
+}
+
+// quotaWindow is an identity's usage in its current window.
+type quotaWindow struct {
+	start          time.Time
+	bytes, packets int64
+}
+
+// loadQuotaFile reads and validates a quota file.
+func loadQuotaFile(path string) (*quotaConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var q quotaConfig
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if q.window, err = time.ParseDuration(q.Window); err != nil {
+		return nil, fmt.Errorf("%s: window: %w", path, err)
+	}
+	if q.window <= 0 {
+		return nil, fmt.Errorf("%s: window must be positive", path)
+	}
+	return &q, nil
+}
+
+// reloadQuotas (re)reads -quota-file. On error the previous quotas stay in
+// force. Current windows and their counts carry over.
+func (s *Server) reloadQuotas() error {
+	if s.cfg.QuotaFile == "" {
+		return nil
+	}
+	q, err := loadQuotaFile(s.cfg.QuotaFile)
+	if err != nil {
+		return err
+	}
+	s.quotas.Store(q)
+	s.log.Printf("Quotas loaded from %s: window %v, default %+v, %d overrides", s.cfg.QuotaFile, q.window, q.Default, len(q.Identities))
+	return nil
+}
+
+// chargeQuota counts a packet of size framed bytes against identity's quota.
+// It reports false, counting nothing, if the packet would exceed it.
+func (s *Server) chargeQuota(identity string, size int64, now time.Time) bool {
+	q := s.quotas.Load()
+	if q == nil {
+		return true
+	}
+	return s.quotaUse.charge(identity, q.limitFor(identity), q.window, size, now)
+}
+
+// quotaTable holds each identity's usage in its current window, for quotas
+// or scar limits.
+type quotaTable struct {
+	mu  sync.Mutex
+	use map[string]*quotaWindow
+}
+
+// charge counts a packet of size bytes against identity's limit in windows
+// of the given length. It reports false, counting nothing, if the packet
+// would exceed it.
+func (t *quotaTable) charge(identity string, limit quotaLimit, window time.Duration, size int64, now time.Time) bool {
+	if limit.Bytes == 0 && limit.Packets == 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := t.use[identity]
+	if w == nil || now.Sub(w.start) >= window {
+		if w == nil && len(t.use) >= MaxUsageEntries {
+			t.sweep(now, window)
+			if len(t.use) >= MaxUsageEntries {
+				t.evictOldest()
+			}
+		}
+		w = &quotaWindow{start: now}
+		t.use[identity] = w
+	}
+	if (limit.Packets > 0 && w.packets+1 > limit.Packets) || (limit.Bytes > 0 && w.bytes+size > limit.Bytes) {
+		return false
+	}
+	w.packets++
+	w.bytes += size
+	return true
+}
+
+// evictOldest drops the window that started first, the one closest to
+// ending, to make room when every window is still open. Its identity starts
+// a fresh window on its next packet. t.mu must be held.
+func (t *quotaTable) evictOldest() {
+	var oldest string
+	var start time.Time
+	for identity, w := range t.use {
+		if start.IsZero() || w.start.Before(start) {
+			oldest, start = identity, w.start
+		}
+	}
+	delete(t.use, oldest)
+}
+
+// sweep drops windows that have ended. t.mu must be held.
+func (t *quotaTable) sweep(now time.Time, window time.Duration) {
+	for identity, w := range t.use {
+		if now.Sub(w.start) >= window {
+			delete(t.use, identity)
+		}
+	}
+}
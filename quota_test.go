@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useQuotas writes body to a quota file and loads it for the test.
+func useQuotas(t *testing.T, s *Server, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.QuotaFile = path
+	if err := s.reloadQuotas(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaExceededAndWindowReset(t *testing.T) {
+	s := newTestServer(t)
+	useQuotas(t, s, `{
+		"window": "300ms",
+		"default": {"packets": 2},
+		"identities": {"bot:vip": {"packets": 4}, "bot:small": {"bytes": 200}}
+	}`)
+	addr := serveLoopback(t, s)
+
+	expect := func(a *testAgent, body, want string) {
+		t.Helper()
+		if resp := a.call(&Packet{Id: "q", Dst: "server", Body: body}); status(resp) != want {
+			t.Fatalf("%s: got %q, want %q", a.src, resp.Body, want)
+		}
+	}
+
+	a := dialAgent(t, addr, "bot:quota")
+	expect(a, "1", "done")
+	expect(a, "2", "done")
+	expect(a, "3", "error:quota_exceeded")
+
+	vip := dialAgent(t, addr, "bot:vip")
+	for i := 0; i < 4; i++ {
+		expect(vip, "", "done")
+	}
+	expect(vip, "", "error:quota_exceeded")
+
+	// A signed packet is ~150 framed bytes, so the second one doesn't fit.
+	small := dialAgent(t, addr, "bot:small")
+	expect(small, "", "done")
+	expect(small, "", "error:quota_exceeded")
+
+	// Rejections don't count, so the next window starts fresh.
+	time.Sleep(350 * time.Millisecond)
+	expect(a, "4", "done")
+	expect(a, "5", "done")
+	expect(a, "6", "error:quota_exceeded")
+
+	// A reload raises the default; the current window's count carries over.
+	useQuotas(t, s, `{"window": "300ms", "default": {"packets": 3}}`)
+	expect(a, "7", "done")
+	expect(a, "8", "error:quota_exceeded")
+
+	// A bad file leaves the previous quotas in force.
+	if err := os.WriteFile(s.cfg.QuotaFile, []byte(`{"window": "soon"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadQuotas(); err == nil {
+		t.Fatal("reload accepted an invalid window")
+	}
+	expect(a, "9", "error:quota_exceeded")
+}
+
+func TestQuotaTableBounded(t *testing.T) {
+	qt := quotaTable{use: make(map[string]*quotaWindow)}
+	limit := quotaLimit{Packets: 1}
+	start := time.Now()
+	// Every window is still open, so the sweep frees nothing; the oldest
+	// goes instead.
+	for i := range MaxUsageEntries + 50 {
+		if !qt.charge(fmt.Sprint("bot:q-", i), limit, time.Hour, 1, start.Add(time.Duration(i))) {
+			t.Fatalf("identity %d refused", i)
+		}
+	}
+	if n := len(qt.use); n != MaxUsageEntries {
+		t.Fatalf("%d windows, want %d", n, MaxUsageEntries)
+	}
+	if qt.use["bot:q-0"] != nil || qt.use[fmt.Sprint("bot:q-", MaxUsageEntries+49)] == nil {
+		t.Fatal("evicted the wrong windows")
+	}
+}
+
+func TestQuotaChargedAfterRegistration(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.IdentityPattern = `bot:[a-z-]+` })
+	useQuotas(t, s, `{"window": "1h", "default": {"packets": 2}}`)
+	useScarLimits(t, s, `{"window": "1h", "default": {"packets": 2}}`)
+	addr := serveLoopback(t, s)
+
+	victim := dialAgent(t, addr, "bot:victim")
+	if resp := victim.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("victim: got %q", resp.Body)
+	}
+	// Packets naming the victim under another key are refused before they
+	// cost the victim anything.
+	impostor := dialAgent(t, addr, "bot:victim")
+	for range 3 {
+		if resp := impostor.call(&Packet{Dst: "server", Scar: []byte("x")}); resp.Body != "error:key_mismatch" {
+			t.Fatalf("impostor: got %q, want error:key_mismatch", resp.Body)
+		}
+	}
+	if resp := victim.call(&Packet{Dst: "server", Scar: []byte("x")}); status(resp) != "done" {
+		t.Fatalf("victim after impostor: got %q, want done", resp.Body)
+	}
+
+	// Nor does an identity the server refuses get a window.
+	bad := dialAgent(t, addr, "bot:Nope_1")
+	if resp := bad.call(&Packet{Dst: "server", Scar: []byte("x")}); resp.Body != "error:bad_identity" {
+		t.Fatalf("bad identity: got %q", resp.Body)
+	}
+	for _, qt := range []*quotaTable{&s.quotaUse, &s.scarUse} {
+		qt.mu.Lock()
+		_, ok := qt.use["bot:Nope_1"]
+		qt.mu.Unlock()
+		if ok {
+			t.Error("refused identity was charged")
+		}
+	}
+}
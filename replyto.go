@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// A packet with ReplyTo set asks that replies to its Id go to another
+// identity, such as a gateway fronting the sender. Two kinds of reply are
+// redirected: the server's own replies to the packet (done, errors), and the
+// first packets the destination sends back to the sender with the same Id,
+// for up to ReplyRouteTTL. Discovery and handshake replies always go back on
+// the querying connection.
+//
+// The sender may only designate an identity registered on this server and
+// bound to the same key, i.e. one it controls.
+const (
+	ReplyRouteTTL  = 5 * time.Minute
+	MaxReplyRoutes = 10000
+)
+
+// replyKey identifies a request by its sender and Id.
+type replyKey struct{ requester, id string }
+
+type replyRoute struct {
+	responder string // the request's dst; only its replies are redirected
+	replyTo   string
+	expires   time.Time
+}
+
+// validReplyTo reports whether p's sender may designate p.ReplyTo.
+func (s *Server) validReplyTo(p *Packet) bool {
+	if p.ReplyTo == p.Src {
+		return true
+	}
+	s.routeMu.RLock()
+	defer s.routeMu.RUnlock()
+	target, ok := s.agents[p.ReplyTo]
+	if !ok {
+		return false
+	}
+	pk, ok := s.connSrc[target][p.ReplyTo]
+	return ok && bytes.Equal(pk, p.Pk)
+}
+
+// recordReplyRoute remembers that replies from p.Dst to p's Id belong to
+// p.ReplyTo. Once the table is full, expired routes are swept; if it is
+// still full the route is not recorded.
+func (s *Server) recordReplyRoute(p *Packet, now time.Time) {
+	if p.ReplyTo == "" || p.ReplyTo == p.Src || p.Id == "" {
+		return
+	}
+	s.replyMu.Lock()
+	defer s.replyMu.Unlock()
+	key := replyKey{requester: p.Src, id: p.Id}
+	if _, exists := s.replyRoutes[key]; !exists && len(s.replyRoutes) >= MaxReplyRoutes {
+		for k, r := range s.replyRoutes {
+			if now.After(r.expires) {
+				delete(s.replyRoutes, k)
+			}
+		}
+		if len(s.replyRoutes) >= MaxReplyRoutes {
+			return
+		}
+	}
+	s.replyRoutes[key] = replyRoute{responder: p.Dst, replyTo: p.ReplyTo, expires: now.Add(ReplyRouteTTL)}
+}
+
+// redirectReply returns the identity p should be delivered to if it is a
+// reply to a request that named a ReplyTo, or "" to deliver it to p.Dst.
+func (s *Server) redirectReply(p *Packet, now time.Time) string {
+	if p.Id == "" {
+		return ""
+	}
+	s.replyMu.Lock()
+	defer s.replyMu.Unlock()
+	key := replyKey{requester: p.Dst, id: p.Id}
+	r, ok := s.replyRoutes[key]
+	if !ok || r.responder != p.Src {
+		return ""
+	}
+	if now.After(r.expires) {
+		delete(s.replyRoutes, key)
+		return ""
+	}
+	return r.replyTo
+}
+
+// lookupAgent returns the connection registered as identity, or nil.
+func (s *Server) lookupAgent(identity string) *connInfo {
+	s.routeMu.RLock()
+	defer s.routeMu.RUnlock()
+	return s.agents[identity]
+}
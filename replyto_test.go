@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// expectNothing asserts that no packet arrives at a for a short while.
+func expectNothing(t *testing.T, a *testAgent) {
+	t.Helper()
+	a.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	p, err := wire.ReadPacket(a.conn)
+	if err == nil {
+		t.Fatalf("%s got unexpected packet %v", a.src, p)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("%s read: %v", a.src, err)
+	}
+}
+
+func TestReplyToRedirectsReplies(t *testing.T) {
+	_, addr := startServer(t)
+
+	client := dialAgent(t, addr, "bot:rt-client")
+	gateway := dialAgent(t, addr, "bot:rt-gateway")
+	gateway.priv = client.priv // same owner, same key
+	responder := dialAgent(t, addr, "bot:rt-responder")
+	for _, a := range []*testAgent{client, gateway, responder} {
+		a.call(&Packet{Dst: "server"})
+	}
+
+	// The responder's reply to r1 goes to the gateway, not the client.
+	client.send(&Packet{Id: "r1", Dst: "bot:rt-responder", Body: "ping", ReplyTo: "bot:rt-gateway"})
+	if req := responder.recv(); req.ReplyTo != "bot:rt-gateway" || wire.Verify(req) != nil {
+		t.Fatalf("request not forwarded intact: %v", req)
+	}
+	responder.send(&Packet{Id: "r1", Dst: "bot:rt-client", Body: "pong"})
+	if got := gateway.recv(); got.Id != "r1" || got.Body != "pong" || got.Src != "bot:rt-responder" {
+		t.Fatalf("gateway got %v, want the pong for r1", got)
+	}
+	expectNothing(t, client)
+
+	// Other ids, and other senders using the same id, still reach the client.
+	responder.send(&Packet{Id: "r2", Dst: "bot:rt-client", Body: "unsolicited"})
+	if got := client.recv(); got.Id != "r2" {
+		t.Fatalf("client got %v, want r2", got)
+	}
+	gateway.send(&Packet{Id: "r1", Dst: "bot:rt-client", Body: "from gateway"})
+	if got := client.recv(); got.Src != "bot:rt-gateway" {
+		t.Fatalf("client got %v, want the gateway's own packet", got)
+	}
+
+	// Server replies follow ReplyTo too.
+	client.send(&Packet{Id: "s1", Dst: "server", ReplyTo: "bot:rt-gateway"})
+	if got := gateway.recv(); got.Id != "s1" || status(got) != "done" {
+		t.Fatalf("gateway got %v, want done for s1", got)
+	}
+	expectNothing(t, client)
+}
+
+func TestReplyToRejectsInvalidTarget(t *testing.T) {
+	_, addr := startServer(t)
+
+	client := dialAgent(t, addr, "bot:rt2-client")
+	stranger := dialAgent(t, addr, "bot:rt2-stranger") // different key
+	client.call(&Packet{Dst: "server"})
+	stranger.call(&Packet{Dst: "server"})
+
+	for _, to := range []string{"bot:rt2-stranger", "bot:rt2-nobody"} {
+		resp := client.call(&Packet{Id: "x", Dst: "server", ReplyTo: to})
+		if resp.Body != "error:invalid_reply_to" || resp.Id != "x" {
+			t.Errorf("reply_to %s: got %q (id %q), want error:invalid_reply_to", to, resp.Body, resp.Id)
+		}
+	}
+	expectNothing(t, stranger)
+
+	// ReplyTo is covered by the signature, so it can't be rewritten in flight.
+	p := client.sign(&Packet{Dst: "server"})
+	p.ReplyTo = "bot:rt2-stranger"
+	wire.WritePacket(client.conn, p)
+	expectNothing(t, client)
+	expectNothing(t, stranger)
+}
+
+func TestReplyToChecksTheBoundKey(t *testing.T) {
+	_, addr := startServer(t)
+
+	// One connection holds two identities under different keys, and its
+	// latest packet is signed with the second.
+	gw := dialAgent(t, addr, "bot:rt3-gw")
+	gw.call(&Packet{Dst: "server"})
+	gwKey := gw.priv
+	_, gw.priv, _ = ed25519.GenerateKey(nil)
+	gw.call(&Packet{Src: "bot:rt3-other", Dst: "server"})
+
+	// The key bot:rt3-gw is bound to may designate it, whatever the
+	// connection signed last.
+	owner := dialAgent(t, addr, "bot:rt3-owner")
+	owner.priv = gwKey
+	owner.call(&Packet{Dst: "server"})
+	owner.send(&Packet{Id: "o", Dst: "server", ReplyTo: "bot:rt3-gw"})
+	if got := gw.recv(); got.Id != "o" || status(got) != "done" {
+		t.Fatalf("gateway got %v, want done for o", got)
+	}
+
+	// The key the connection signed with last is not bot:rt3-gw's.
+	impostor := dialAgent(t, addr, "bot:rt3-impostor")
+	impostor.priv = gw.priv
+	impostor.call(&Packet{Dst: "server"})
+	if resp := impostor.call(&Packet{Id: "i", Dst: "server", ReplyTo: "bot:rt3-gw"}); resp.Body != "error:invalid_reply_to" {
+		t.Fatalf("other key: got %q, want error:invalid_reply_to", resp.Body)
+	}
+	expectNothing(t, gw)
+}
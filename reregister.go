@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Re-registration policies decide what happens when an identity registered
+// on one connection registers again, under the same key, from another:
+//
+//   - replace (the default): the new connection takes the identity over and
+//     the old one stops receiving its routes, closing if that was its last
+//     identity.
+//   - reject-new: the old connection keeps the identity and the new one is
+//     refused with error:identity_in_use, so a flaky client reconnecting in a
+//     loop can't thrash a connection that still works.
+//   - allow-both: both connections hold the identity and may send as it.
+//     Routes go to the newest; when it goes, the newest of the others takes
+//     over.
+//
+// -reregister sets the policy for every identity and -reregister-overrides
+// sets it for particular ones.
+const (
+	reregReplace   = "replace"
+	reregRejectNew = "reject-new"
+	reregAllowBoth = "allow-both"
+)
+
+// validReregister reports whether policy names a re-registration policy.
+func validReregister(policy string) bool {
+	return policy == reregReplace || policy == reregRejectNew || policy == reregAllowBoth
+}
+
+// parseReregisterOverrides parses -reregister-overrides entries of the form
+// identity=policy.
+func parseReregisterOverrides(list []string) (map[string]string, error) {
+	policies := make(map[string]string, len(list))
+	for _, item := range list {
+		identity, policy, ok := strings.Cut(item, "=")
+		if !ok || identity == "" {
+			return nil, fmt.Errorf("%q: want identity=policy", item)
+		}
+		if !validReregister(policy) {
+			return nil, fmt.Errorf("%q: policy must be replace, reject-new or allow-both", item)
+		}
+		policies[identity] = policy
+	}
+	return policies, nil
+}
+
+// reregisterPolicy is the re-registration policy for identity.
+func (s *Server) reregisterPolicy(identity string) string {
+	if policy, ok := s.reregOverrides[identity]; ok {
+		return policy
+	}
+	return s.cfg.Reregister
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReregisterPolicy(t *testing.T) {
+	// Each case registers bot:rereg on a first connection, then again from a
+	// second under the same key.
+	setup := func(t *testing.T, configure ...func(*Config)) (s *Server, first, second, other *testAgent, resp *Packet) {
+		s, addr := startServer(t, configure...)
+		first = dialAgent(t, addr, "bot:rereg")
+		first.call(&Packet{Dst: "server"})
+		other = dialAgent(t, addr, "bot:rereg-other")
+		other.call(&Packet{Dst: "server"})
+		second = dialAgent(t, addr, "bot:rereg")
+		second.priv = first.priv
+		return s, first, second, other, second.call(&Packet{Dst: "server"})
+	}
+	routedTo := func(t *testing.T, other, want *testAgent, body string) {
+		t.Helper()
+		other.send(&Packet{Dst: "bot:rereg", Body: body})
+		if p := want.recv(); p.Body != body {
+			t.Fatalf("got %q, want %q", p.Body, body)
+		}
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		_, first, second, other, resp := setup(t)
+		if status(resp) != "done" {
+			t.Fatalf("new connection got %q", resp.Body)
+		}
+		expectClosedWith(t, first.conn, closeReplaced)
+		routedTo(t, other, second, "to the new one")
+	})
+
+	t.Run("reject-new", func(t *testing.T) {
+		s, first, second, other, resp := setup(t, func(c *Config) { c.Reregister = "reject-new" })
+		if resp.Body != "error:identity_in_use" {
+			t.Fatalf("new connection got %q", resp.Body)
+		}
+		routedTo(t, other, first, "to the old one")
+		expectNothing(t, second)
+
+		// Once the old connection goes, the new one may have it.
+		first.conn.Close()
+		waitFor(t, "bot:rereg to be released", func() bool { return !registered(s, "bot:rereg") })
+		if resp := second.call(&Packet{Dst: "server"}); status(resp) != "done" {
+			t.Fatalf("after the old connection left: got %q", resp.Body)
+		}
+	})
+
+	t.Run("allow-both", func(t *testing.T) {
+		s, first, second, other, resp := setup(t, func(c *Config) {
+			c.Reregister = "reject-new"
+			c.ReregisterOverrides = []string{"bot:rereg=allow-both"}
+		})
+		if status(resp) != "done" {
+			t.Fatalf("new connection got %q", resp.Body)
+		}
+		routedTo(t, other, second, "to the newest")
+		if resp := first.call(&Packet{Dst: "server"}); status(resp) != "done" {
+			t.Fatalf("old connection sending: got %q", resp.Body)
+		}
+		expectNothing(t, second)
+
+		// The old connection takes the routes back when the new one goes,
+		// and the identity is released with the last of them.
+		newest := s.lookupAgent("bot:rereg")
+		second.conn.Close()
+		waitFor(t, "the old connection to take over", func() bool { return s.lookupAgent("bot:rereg") != newest })
+		routedTo(t, other, first, "back to the old one")
+		first.conn.Close()
+		waitFor(t, "bot:rereg to be released", func() bool { return !registered(s, "bot:rereg") })
+		s.routeMu.RLock()
+		defer s.routeMu.RUnlock()
+		if n := len(s.standby); n != 0 {
+			t.Errorf("%d identities still have standbys", n)
+		}
+	})
+}
+
+func TestParseReregisterOverrides(t *testing.T) {
+	got, err := parseReregisterOverrides([]string{"bot:a=allow-both", "bot:b=replace"})
+	if err != nil || got["bot:a"] != "allow-both" || got["bot:b"] != "replace" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	for _, bad := range []string{"bot:a", "=replace", "bot:a=keep-old"} {
+		if _, err := parseReregisterOverrides([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if _, err := New(Config{Reregister: "newest"}); err == nil {
+		t.Error("New accepted an unknown -reregister policy")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A connection that negotiates FeatureResume is issued a resumption token in
+// the handshake reply. If it drops, the server keeps what it had set up, its
+// identities, group subscriptions and labels, for -resume-window. A client
+// reconnecting within the window puts the token in its next handshake, and
+// the new connection takes all of that back at once instead of registering
+// and subscribing again. The handshake reply lists the identities restored,
+// or says why it could not resume, and carries a fresh token either way.
+//
+// The token is signed with the server key and bound to the key that signed
+// the handshake it was issued in: only that key can resume with it, and only
+// identities still bound to that key come back. A token can be used once.
+// A client may also resume before the server notices the old connection has
+// gone; the old connection then loses its identities as on re-registration.
+// Packets routed while neither connection held an identity were answered
+// error:offline as usual; they are not held for the resumed session.
+
+// resumeClaims is the signed part of a resumption token.
+type resumeClaims struct {
+	Session string `json:"session"`
+	PK      []byte `json:"pk"`  // the client key the token is bound to
+	Issued  int64  `json:"iat"` // Unix milliseconds
+}
+
+// resumeSession is what a resumed connection takes back.
+type resumeSession struct {
+	identities []string
+	groups     []string
+	labels     map[string]string
+	maxSize    uint32    // the advertised max_packet_size
+	expires    time.Time // zero while the connection is open
+}
+
+// resumeTable holds the sessions tokens have been issued for: those of open
+// connections, and those of closed ones until their window ends.
+type resumeTable struct {
+	mu        sync.Mutex
+	live      map[string]*connInfo
+	suspended map[string]*resumeSession
+}
+
+// Resume refusals, reported in the handshake reply.
+const (
+	resumeInvalid     = "error:invalid_resume"
+	resumeExpired     = "error:resume_expired"
+	resumeKeyMismatch = "error:resume_key_mismatch"
+	resumeUnsupported = "error:resume_unsupported" // FeatureResume was not granted
+)
+
+// issueResume starts a session for c, bound to pk, and returns its token.
+func (s *Server) issueResume(c *connInfo, pk []byte) (string, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	claims, err := json.Marshal(resumeClaims{Session: hex.EncodeToString(id), PK: pk, Issued: time.Now().UnixMilli()})
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(s.key, claims)
+
+	t := &s.resumes
+	t.mu.Lock()
+	if old := c.resumeID; old != "" {
+		delete(t.live, old) // a second handshake replaces the first token
+	}
+	c.resumeID, c.resumePK = hex.EncodeToString(id), pk
+	t.live[c.resumeID] = c
+	t.mu.Unlock()
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(claims) + "." + enc.EncodeToString(sig), nil
+}
+
+// parseResume checks token's signature and returns its claims.
+func (s *Server) parseResume(token string) (resumeClaims, bool) {
+	var claims resumeClaims
+	enc := base64.RawURLEncoding
+	c, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, false
+	}
+	data, err1 := enc.DecodeString(c)
+	sigBytes, err2 := enc.DecodeString(sig)
+	if err1 != nil || err2 != nil || !ed25519.Verify(s.key.Public().(ed25519.PublicKey), data, sigBytes) {
+		return claims, false
+	}
+	return claims, json.Unmarshal(data, &claims) == nil
+}
+
+// takeResume claims the session token names for a client signing with pk,
+// returning the session or the refusal.
+func (s *Server) takeResume(token string, pk []byte, now time.Time) (*resumeSession, string) {
+	claims, ok := s.parseResume(token)
+	if !ok {
+		return nil, resumeInvalid
+	}
+	if !bytes.Equal(claims.PK, pk) {
+		return nil, resumeKeyMismatch
+	}
+	t := &s.resumes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.live[claims.Session]; ok {
+		// The old connection has not been seen to close yet
+		delete(t.live, claims.Session)
+		return s.captureSession(old), ""
+	}
+	sess, ok := t.suspended[claims.Session]
+	delete(t.suspended, claims.Session)
+	if !ok || now.After(sess.expires) {
+		return nil, resumeExpired
+	}
+	return sess, ""
+}
+
+// captureSession records what c holds under the key its token is bound to.
+func (s *Server) captureSession(c *connInfo) *resumeSession {
+	sess := &resumeSession{labels: c.getLabels(), maxSize: c.maxPacketSize.Load()}
+	s.routeMu.RLock()
+	for identity, pk := range s.connSrc[c] {
+		if bytes.Equal(pk, c.resumePK) {
+			sess.identities = append(sess.identities, identity)
+		}
+	}
+	s.routeMu.RUnlock()
+	s.groupsMu.RLock()
+	for group, members := range s.groups {
+		for _, m := range members {
+			if m == c {
+				sess.groups = append(sess.groups, group)
+				break
+			}
+		}
+	}
+	s.groupsMu.RUnlock()
+	slices.Sort(sess.identities)
+	slices.Sort(sess.groups)
+	return sess
+}
+
+// suspendSession keeps c's session for -resume-window after it closes, if
+// it was issued a token and holds anything to resume. It must run before c
+// leaves its groups and identities.
+func (s *Server) suspendSession(c *connInfo) {
+	t := &s.resumes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.resumeID == "" || t.live[c.resumeID] != c {
+		return // never issued, or resumed elsewhere already
+	}
+	delete(t.live, c.resumeID)
+	now := time.Now()
+	for id, sess := range t.suspended {
+		if now.After(sess.expires) {
+			delete(t.suspended, id)
+		}
+	}
+	sess := s.captureSession(c)
+	if len(sess.identities) == 0 && len(sess.groups) == 0 {
+		return
+	}
+	sess.expires = now.Add(s.cfg.ResumeWindow)
+	t.suspended[c.resumeID] = sess
+}
+
+// resume gives c the identities, groups and labels of sess, and returns the
+// identities it took back. An identity c may no longer register, such as one
+// bound to another key meanwhile, is skipped.
+func (s *Server) resume(c *connInfo, sess *resumeSession) []string {
+	var restored []string
+	for _, identity := range sess.identities {
+		if reg := s.registerConn(identity, c); rejectReason[reg] == "" {
+			restored = append(restored, identity)
+		}
+	}
+	if len(restored) == 0 {
+		return nil
+	}
+	for _, group := range sess.groups {
+		s.subscribe(group, c)
+	}
+	c.setLabels(sess.labels)
+	c.maxPacketSize.Store(sess.maxSize)
+	s.resumed.Add(1)
+	s.log.Printf("Resumed %s at %s: identities %v, groups %v", restored[0], c.addr, restored, sess.groups)
+	return restored
+}
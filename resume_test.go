@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resumeHandshake handshakes for FeatureResume, presenting token if set.
+func resumeHandshake(a *testAgent, token string) handshakeReply {
+	a.t.Helper()
+	body, _ := json.Marshal(handshakeRequest{Version: ServerVersion, Features: FeatureResume, Resume: token})
+	resp := a.call(&Packet{Id: "hs", Dst: "handshake", Body: string(body)})
+	var hr handshakeReply
+	if err := json.Unmarshal([]byte(resp.Body), &hr); err != nil {
+		a.t.Fatalf("handshake reply %q: %v", resp.Body, err)
+	}
+	return hr
+}
+
+func TestResumeWithinWindow(t *testing.T) {
+	s, addr := startServer(t)
+	first := dialAgent(t, addr, "bot:resume-a")
+	hr := resumeHandshake(first, "")
+	if hr.Features&FeatureResume == 0 || hr.Resume == "" || hr.ResumeError != "" {
+		t.Fatalf("first handshake: %+v", hr)
+	}
+	// A second identity, a group and labels, all to come back.
+	first.call(&Packet{Src: "bot:resume-b", Dst: "server"})
+	first.call(&Packet{Dst: "subscribe:resume-workers"})
+	first.call(&Packet{Typ: TypeRegister, Dst: "server", Labels: map[string]string{"region": "eu"}})
+
+	first.conn.Close()
+	waitFor(t, "the connection to drop", func() bool { return !registered(s, "bot:resume-a") })
+
+	second := dialAgent(t, addr, "bot:resume-a")
+	second.priv = first.priv
+	hr2 := resumeHandshake(second, hr.Resume)
+	if !slices.Equal(hr2.Resumed, []string{"bot:resume-a", "bot:resume-b"}) || hr2.ResumeError != "" {
+		t.Fatalf("resume: %+v", hr2)
+	}
+	if hr2.Resume == "" || hr2.Resume == hr.Resume {
+		t.Fatalf("resume issued token %q, want a fresh one", hr2.Resume)
+	}
+	ci := s.lookupAgent("bot:resume-b")
+	if ci == nil || s.lookupAgent("bot:resume-a") != ci {
+		t.Fatal("identities not restored to the new connection")
+	}
+	if l := ci.getLabels(); !maps.Equal(l, map[string]string{"region": "eu"}) {
+		t.Fatalf("labels %v", l)
+	}
+	if m := s.groupMembers("resume-workers"); len(m) != 1 || m[0] != ci {
+		t.Fatalf("group members %v", m)
+	}
+
+	// Nothing else had to be sent: packets for either identity arrive.
+	other := dialAgent(t, addr, "bot:resume-other")
+	other.call(&Packet{Dst: "server"})
+	other.send(&Packet{Dst: "bot:resume-b", Body: "welcome back"})
+	if p := second.recv(); p.Body != "welcome back" {
+		t.Fatalf("got %q", p.Body)
+	}
+
+	// A token is good for one resume.
+	third := dialAgent(t, addr, "bot:resume-a")
+	third.priv = first.priv
+	if hr3 := resumeHandshake(third, hr.Resume); hr3.ResumeError != resumeExpired || hr3.Resumed != nil {
+		t.Fatalf("reused token: %+v", hr3)
+	}
+	if n := s.resumed.Load(); n != 1 {
+		t.Fatalf("keep_resumed_total %d, want 1", n)
+	}
+}
+
+func TestResumeRejected(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) { c.ResumeWindow = 50 * time.Millisecond })
+
+	drop := func(a *testAgent) string {
+		t.Helper()
+		hr := resumeHandshake(a, "")
+		a.conn.Close()
+		waitFor(t, "the connection to drop", func() bool { return !registered(s, a.src) })
+		return hr.Resume
+	}
+
+	// Another key can't use the token, even within the window.
+	owner := dialAgent(t, addr, "bot:resume-owner")
+	token := drop(owner)
+	thief := dialAgent(t, addr, "bot:resume-thief")
+	if hr := resumeHandshake(thief, token); hr.ResumeError != resumeKeyMismatch || hr.Resumed != nil {
+		t.Fatalf("wrong key: %+v", hr)
+	}
+	if registered(s, "bot:resume-owner") {
+		t.Fatal("wrong key took the identity")
+	}
+
+	// Past the window the session is gone.
+	late := dialAgent(t, addr, "bot:resume-late")
+	token = drop(late)
+	time.Sleep(100 * time.Millisecond)
+	again := dialAgent(t, addr, "bot:resume-late")
+	again.priv = late.priv
+	if hr := resumeHandshake(again, token); hr.ResumeError != resumeExpired || hr.Resumed != nil {
+		t.Fatalf("expired: %+v", hr)
+	}
+
+	// A token that was tampered with, or not issued by this server, fails
+	// its signature.
+	i := strings.IndexByte(token, '.') + 1
+	forged := []byte(token)
+	forged[i] ^= 3 // the signature's first character
+	if hr := resumeHandshake(again, string(forged)); hr.ResumeError != resumeInvalid {
+		t.Fatalf("forged: %+v", hr)
+	}
+}
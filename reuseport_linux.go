@@ -0,0 +1,7 @@
+//go:build linux && (386 || amd64 || arm)
+
+package main
+
+// soReusePort is SO_REUSEPORT from <asm-generic/socket.h>; package syscall
+// predates it and only defines it for newer Linux ports.
+const soReusePort = 0xf
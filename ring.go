@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// hashRing maps identities to servers by consistent hashing. Each server is
+// placed on the ring at vnodes pseudo-random points; an identity belongs to
+// the server owning the first point at or after the identity's hash. Adding
+// or removing a server only moves the identities adjacent to its points.
+type hashRing struct {
+	mu     sync.RWMutex
+	vnodes int
+	points []uint64          // sorted
+	owner  map[uint64]string // point -> server id
+	nodes  map[string]bool
+}
+
+func newHashRing(vnodes int) *hashRing {
+	return &hashRing{
+		vnodes: vnodes,
+		owner:  make(map[uint64]string),
+		nodes:  make(map[string]bool),
+	}
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// add places node on the ring. It reports false if node was already present.
+func (r *hashRing) add(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return false
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.vnodes; i++ {
+		h := ringHash(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owner[h]; taken {
+			continue // astronomically unlikely; first node keeps the point
+		}
+		r.owner[h] = node
+		r.points = append(r.points, h)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return true
+}
+
+// remove takes node off the ring. It reports false if node was not present.
+func (r *hashRing) remove(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return false
+	}
+	delete(r.nodes, node)
+	kept := r.points[:0]
+	for _, h := range r.points {
+		if r.owner[h] == node {
+			delete(r.owner, h)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	r.points = kept
+	return true
+}
+
+// lookup returns the server owning identity, or "" if the ring is empty.
+func (r *hashRing) lookup(identity string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(identity)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owner[r.points[i]]
+}
+
+// members returns the servers on the ring, sorted.
+func (r *hashRing) members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]string, 0, len(r.nodes))
+	for n := range r.nodes {
+		list = append(list, n)
+	}
+	sort.Strings(list)
+	return list
+}
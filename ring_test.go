@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingOwnershipStable(t *testing.T) {
+	r1 := newHashRing(64)
+	r2 := newHashRing(64)
+	for _, n := range []string{"a", "b", "c"} {
+		r1.add(n)
+	}
+	// Insertion order must not matter.
+	for _, n := range []string{"c", "a", "b"} {
+		r2.add(n)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		id := fmt.Sprintf("bot:%d", i)
+		o1, o2 := r1.lookup(id), r2.lookup(id)
+		if o1 != o2 {
+			t.Fatalf("%s: owner %q vs %q", id, o1, o2)
+		}
+		if o1 != r1.lookup(id) {
+			t.Fatalf("%s: lookup not deterministic", id)
+		}
+		counts[o1]++
+	}
+	for n, c := range counts {
+		if c < 500 {
+			t.Errorf("node %s owns only %d/3000 identities", n, c)
+		}
+	}
+}
+
+func TestHashRingRebalance(t *testing.T) {
+	r := newHashRing(64)
+	for _, n := range []string{"a", "b", "c"} {
+		r.add(n)
+	}
+	before := map[string]string{}
+	for i := 0; i < 4000; i++ {
+		id := fmt.Sprintf("bot:%d", i)
+		before[id] = r.lookup(id)
+	}
+
+	if !r.add("d") || r.add("d") {
+		t.Fatalf("add should report whether the node was new")
+	}
+	moved := 0
+	for id, owner := range before {
+		now := r.lookup(id)
+		if now == owner {
+			continue
+		}
+		if now != "d" {
+			t.Fatalf("%s moved %s -> %s; only moves to the new node are allowed", id, owner, now)
+		}
+		moved++
+	}
+	// Ideal is 1/4; allow generous slack for vnode variance.
+	if frac := float64(moved) / float64(len(before)); frac < 0.1 || frac > 0.4 {
+		t.Fatalf("adding a 4th node moved %.2f of identities", frac)
+	}
+
+	// Removing the node restores the original assignment exactly.
+	r.remove("d")
+	for id, owner := range before {
+		if got := r.lookup(id); got != owner {
+			t.Fatalf("%s: owner %s after remove, want %s", id, got, owner)
+		}
+	}
+	if got := r.members(); len(got) != 3 {
+		t.Fatalf("members = %v", got)
+	}
+}
+
+func TestDiscoverRing(t *testing.T) {
+	s := newTestServer(t)
+	defer func(r *hashRing) { s.ring = r }(s.ring)
+
+	s.ring = nil
+	if got := discoverJSON(t, s, "ring"); got["enabled"] != false {
+		t.Fatalf("ring should report disabled: %v", got)
+	}
+
+	s.ring = newHashRing(16)
+	s.ring.add(s.cfg.ServerID)
+	s.ring.add("peer-x")
+	got := discoverJSON(t, s, "ring")
+	nodes, _ := got["nodes"].([]any)
+	if got["enabled"] != true || len(nodes) != 2 || got["vnodes"] != float64(16) {
+		t.Fatalf("unexpected ring state: %v", got)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Router decides what happens to a verified packet from a registered
+// connection. Route is called once per packet with from the connection it
+// arrived on; ctx is cancelled when that connection closes and carries the
+// receipt time (see receivedAt). An error means a reply to from could not be
+// written and from should be closed.
+//
+// Calls for one source never overlap: the connection's reader, or the fair
+// queue's one-item-in-flight rule, runs them one at a time, and send writes
+// whole frames under writeMu. That is what keeps packets from one source to
+// one destination in order; a Router must not hand a source's packets to
+// other goroutines.
+type Router interface {
+	Route(ctx context.Context, p *Packet, from *connInfo) error
+}
+
+// RouterFunc adapts a function to Router, so a policy can wrap another:
+//
+//	s.router = RouterFunc(func(ctx context.Context, p *Packet, from *connInfo) error {
+//		if strings.HasPrefix(p.Dst, "internal:") {
+//			return reply(from, p, "error:forbidden")
+//		}
+//		return defaultRouter{}.Route(ctx, p, from)
+//	})
+type RouterFunc func(ctx context.Context, p *Packet, from *connInfo) error
+
+func (f RouterFunc) Route(ctx context.Context, p *Packet, from *connInfo) error {
+	return f(ctx, p, from)
+}
+
+// defaultRouter is the protocol's standard routing. It keeps no state of its
+// own; everything it consults belongs to the connection's server.
+type defaultRouter struct{}
+
+type receivedKey struct{}
+
+// withReceived returns ctx carrying the time a packet was read.
+func withReceived(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, receivedKey{}, t)
+}
+
+// receivedAt returns the receipt time stored by withReceived, or now if
+// there is none.
+func receivedAt(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(receivedKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// Route delivers p according to its dst: discovery, handshake, bulk
+// registration, group subscription, anycast, sampling and multicast,
+// deregistration, a kick or directive, a stream offer, an acknowledgement
+// from the server, or forwarding to the agent or federation peer hosting dst.
+func (defaultRouter) Route(ctx context.Context, p *Packet, c *connInfo) error {
+	s := c.srv
+	received := receivedAt(ctx)
+	switch {
+	case strings.HasPrefix(p.Dst, "discover:"):
+		if err := s.handleDiscover(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeDiscover, true)
+
+	case p.Dst == "handshake":
+		if err := s.handleHandshake(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeHandshake, true)
+
+	case p.Dst == "register":
+		if err := s.handleBulkRegister(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeDone, true)
+
+	case strings.HasPrefix(p.Dst, "subscribe:"), strings.HasPrefix(p.Dst, "unsubscribe:"):
+		if err := s.handleSubscription(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeDone, true)
+
+	case strings.HasPrefix(p.Dst, "deregister:"):
+		if err := s.handleDeregister(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeDone, true)
+
+	case strings.HasPrefix(p.Dst, "kick:"):
+		if err := s.handleKick(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeDone, true)
+
+	case strings.HasPrefix(p.Dst, "directive:"):
+		if err := s.handleDirective(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+		s.auditRecord(p, outcomeDone, true)
+
+	case strings.HasPrefix(p.Dst, "any:"):
+		return s.routeAnycast(c, p, received)
+
+	case strings.HasPrefix(p.Dst, "sample:"):
+		if err := s.routeSample(c, p, received); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+
+	case strings.HasPrefix(p.Dst, "multi:"):
+		if err := s.routeMulticast(c, p, received); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+
+	case strings.HasPrefix(p.Dst, "stream:"):
+		s.auditRecord(p, outcomeStream, true)
+		if err := s.handleStreamOffer(c, p); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+
+	case p.Dst == "server":
+		s.auditRecord(p, outcomeDone, true)
+		if err := reply(c, p, s.serverAck(p, c)); err != nil {
+			s.log.Printf("Write error to %s: %v", c.addr, err)
+			return err
+		}
+
+	case p.Dst == p.Src && !s.cfg.AllowSelfRoute:
+		return s.rejectSelfRoute(c, p)
+
+	default:
+		// Forward to registered agent, or to the identity a request
+		// this packet answers asked its replies to go to
+		dst := p.Dst
+		if to := s.redirectReply(p, received); to != "" {
+			dst = to
+		}
+		if !s.routeAllowed(p.Src, dst) {
+			s.aclDenied.Add(1)
+			s.auditRecord(p, outcomeRejected, true)
+			s.log.Printf("REJECTED error:forbidden from %s (src=%s dst=%s): denied by ACL", c.addr, p.Src, dst)
+			if err := reply(c, p, "error:forbidden"); err != nil {
+				s.log.Printf("Write error to %s: %v", c.addr, err)
+				return err
+			}
+			return nil
+		}
+		// Held until its delivery time, then sent to whoever holds dst
+		if p.DeliverAt > uint64(received.UnixMilli()) {
+			if err := s.schedule(c, p, dst, received); err != nil {
+				s.log.Printf("Write error to %s: %v", c.addr, err)
+				return err
+			}
+			return nil
+		}
+		s.routeMu.RLock()
+		target, exists := s.agents[dst]
+		s.routeMu.RUnlock()
+		// Another identity held by the sending connection, or a reply
+		// redirected to one, loops back all the same
+		if exists && target == c && !s.cfg.AllowSelfRoute {
+			return s.rejectSelfRoute(c, p)
+		}
+		s.recordReplyRoute(p, received)
+
+		if !exists {
+			// Not hosted here: relay to the federated peer hosting it, if any
+			if ok, err := s.forwardToPeer(p, dst); ok {
+				if err != nil {
+					s.auditRecord(p, outcomeDeliveryFailed, true)
+					if writeErr := reply(c, p, "error:delivery_failed"); writeErr != nil {
+						s.log.Printf("Write error to %s: %v", c.addr, writeErr)
+						return writeErr
+					}
+					s.log.Printf("Route %s -> %s: peer delivery failed: %v", p.Src, p.Dst, err)
+					return nil
+				}
+				s.routeLatencyFederation.observe(time.Since(received))
+				s.routedPackets.Add(1)
+				s.auditRecord(p, outcomeRouted, true)
+				if s.routeLog.ok() {
+					s.log.Printf("Routed %s -> %s via federation", p.Src, p.Dst)
+				}
+				return nil
+			}
+
+			return s.routeOffline(c, p, "offline")
+		}
+
+		// Forward original signed packet (preserving signature)
+		if err := s.forward(target, p); err != nil {
+			if errors.Is(err, errExpired) {
+				return s.dropExpired(c, p, received)
+			}
+			// More than the destination said it will accept
+			if errors.Is(err, errDstTooLarge) {
+				return s.rejectDstTooLarge(c, p, dst)
+			}
+			// Closed between the lookup and the write: the destination went
+			// offline, no write to it failed
+			if errors.Is(err, net.ErrClosed) {
+				return s.routeOffline(c, p, "offline (closed while routing)")
+			}
+			s.auditRecord(p, outcomeDeliveryFailed, true)
+			if writeErr := reply(c, p, "error:delivery_failed"); writeErr != nil {
+				s.log.Printf("Write error to %s: %v", c.addr, writeErr)
+				return writeErr
+			}
+			s.log.Printf("Route %s -> %s: delivery failed: %v", p.Src, p.Dst, err)
+			return nil
+		}
+		s.routeLatencyLocal.observe(time.Since(received))
+		s.routedPackets.Add(1)
+		s.auditRecord(p, outcomeRouted, true)
+		switch {
+		case !s.routeLog.ok():
+		case dst != p.Dst:
+			s.log.Printf("Routed %s -> %s (reply for %s)", p.Src, dst, p.Dst)
+		default:
+			s.log.Printf("Routed %s -> %s%s", p.Src, p.Dst, s.tagFields(p))
+		}
+	}
+	return nil
+}
+
+// ack is the reply body for a packet addressed to the server.
+type ack struct {
+	Status     string `json:"status"` // always "done"
+	ID         string `json:"id"`
+	TS         int64  `json:"ts"`         // server time, Unix milliseconds
+	Registered bool   `json:"registered"` // p.Src is registered to the sending connection
+}
+
+// serverAck returns the reply body acknowledging p from c: an ack as JSON,
+// or the bare "done" of older servers with -legacy-done.
+func (s *Server) serverAck(p *Packet, c *connInfo) string {
+	if s.cfg.LegacyDone {
+		return "done"
+	}
+	data, _ := json.Marshal(ack{
+		Status:     "done",
+		ID:         p.Id,
+		TS:         time.Now().UnixMilli(),
+		Registered: s.lookupAgent(p.Src) == c,
+	})
+	return string(data)
+}
+
+// forward sends p to target, retrying while the write stalls before any of
+// the frame goes out: the destination is alive but its receive buffer is
+// full. Up to -forward-attempts minus one attempts each wait only the current
+// backoff, which doubles after each; the last is an ordinary send with the
+// full write timeout. Any other error, such as a closed destination, fails
+// at once. Forwards to a busy target wait their turn by priority; see
+// sendQueue. A packet whose expires_at passes while it waits is not written
+// and errExpired is returned.
+func (s *Server) forward(target *connInfo, p *Packet) error {
+	return s.forwardWire(target, p, nil)
+}
+
+// forwardWire is forward for a packet going to many connections, with
+// marshaled holding it marshaled already (see sendWire), or nil.
+func (s *Server) forwardWire(target *connInfo, p *Packet, marshaled []byte) error {
+	return s.forwardInLine(target, p, marshaled, s.joinSendQ(target, p))
+}
+
+// forwardInLine is forwardWire for a packet that has joined target's
+// sendQueue already: it waits for turn, unless it is nil, then writes. A
+// packet over target's max_packet_size is not written (errDstTooLarge).
+func (s *Server) forwardInLine(target *connInfo, p *Packet, marshaled []byte, turn chan struct{}) error {
+	if turn != nil {
+		<-turn
+	}
+	defer target.sendQ.release()
+	if expired(p, time.Now()) {
+		return errExpired
+	}
+	if _, over := overDstLimit(target, p); over {
+		return errDstTooLarge
+	}
+	backoff := s.cfg.ForwardBackoff
+	for attempt := 1; attempt < s.cfg.ForwardAttempts && backoff > 0; attempt++ {
+		err := target.trySend(p, marshaled, backoff)
+		if !isTransientWrite(err) {
+			return err
+		}
+		s.forwardRetries.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return target.sendWire(p, marshaled)
+}
+
+// routeOffline answers p, whose destination has no open connection here,
+// with error:offline.
+func (s *Server) routeOffline(c *connInfo, p *Packet, why string) error {
+	s.offlinePackets.Add(1)
+	s.auditRecord(p, outcomeOffline, true)
+	if err := reply(c, p, "error:offline"); err != nil {
+		s.log.Printf("Write error to %s: %v", c.addr, err)
+		return err
+	}
+	s.log.Printf("Route %s -> %s: %s", p.Src, p.Dst, why)
+	return nil
+}
+
+// rejectSelfRoute refuses a packet from c that would be forwarded back to c.
+// Looping a packet back to its sender is almost always a client bug.
+func (s *Server) rejectSelfRoute(c *connInfo, p *Packet) error {
+	s.selfRoutes.Add(1)
+	s.auditRecord(p, outcomeRejected, true)
+	s.log.Printf("REJECTED error:self_route from %s (src=%s dst=%s)", c.addr, p.Src, p.Dst)
+	if err := reply(c, p, "error:self_route"); err != nil {
+		s.log.Printf("Write error to %s: %v", c.addr, err)
+		return err
+	}
+	return nil
+}
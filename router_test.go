@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// pipeAgent returns the server side of an in-memory connection and the
+// client side to read what the server writes to it.
+func pipeAgent(t *testing.T, s *Server) (*connInfo, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return s.newConnInfo(a), b
+}
+
+// route runs the default router for p from c in the background, since a
+// pipe write blocks until it is read, and returns its result channel.
+func route(p *Packet, c *connInfo) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- defaultRouter{}.Route(withReceived(context.Background(), time.Now()), p, c)
+	}()
+	return errc
+}
+
+func recvWithin(t *testing.T, c net.Conn) *Packet {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := wire.ReadPacket(c)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return p
+}
+
+func TestDefaultRouter(t *testing.T) {
+	s := newTestServer(t)
+
+	t.Run("discover", func(t *testing.T) {
+		srv, cli := pipeAgent(t, s)
+		errc := route(&Packet{Id: "d1", Src: "bot:r", Dst: "discover:info"}, srv)
+		resp := recvWithin(t, cli)
+		if resp.Src != "server" || !strings.Contains(resp.Body, `"version"`) {
+			t.Errorf("got src=%q body=%q, want discover:info JSON from server", resp.Src, resp.Body)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Route: %v", err)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		srv, cli := pipeAgent(t, s)
+		errc := route(&Packet{Id: "s1", Src: "bot:r", Dst: "server"}, srv)
+		if resp := recvWithin(t, cli); status(resp) != "done" {
+			t.Errorf("got %q, want done", resp.Body)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Route: %v", err)
+		}
+	})
+
+	t.Run("offline", func(t *testing.T) {
+		srv, cli := pipeAgent(t, s)
+		before := s.offlinePackets.Load()
+		errc := route(&Packet{Id: "o1", Src: "bot:r", Dst: "bot:nowhere"}, srv)
+		if resp := recvWithin(t, cli); resp.Body != "error:offline" {
+			t.Errorf("got %q, want error:offline", resp.Body)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Route: %v", err)
+		}
+		if got := s.offlinePackets.Load(); got != before+1 {
+			t.Errorf("offline packets %d, want %d", got, before+1)
+		}
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		srv, _ := pipeAgent(t, s)
+		target, inbox := pipeAgent(t, s)
+		s.registerConn("bot:target", target)
+
+		p := &Packet{Id: "f1", Src: "bot:r", Dst: "bot:target", Body: "hi", Sig: []byte("sig")}
+		errc := route(p, srv)
+		got := recvWithin(t, inbox)
+		if got.Body != "hi" || got.Src != "bot:r" || string(got.Sig) != "sig" {
+			t.Errorf("target got %+v, want the original packet", got)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Route: %v", err)
+		}
+	})
+}
+
+func TestRouterPolicy(t *testing.T) {
+	s := newTestServer(t)
+	s.router = RouterFunc(func(ctx context.Context, p *Packet, from *connInfo) error {
+		if strings.HasPrefix(p.Dst, "internal:") {
+			return reply(from, p, "error:forbidden")
+		}
+		return defaultRouter{}.Route(ctx, p, from)
+	})
+	addr := serveLoopback(t, s)
+
+	a := dialAgent(t, addr, "bot:policy")
+	if resp := a.call(&Packet{Dst: "internal:billing"}); resp.Body != "error:forbidden" {
+		t.Errorf("got %q, want error:forbidden", resp.Body)
+	}
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Errorf("got %q, want done", resp.Body)
+	}
+}
+
+func TestServerAck(t *testing.T) {
+	s, addr := startServer(t)
+
+	a := dialAgent(t, addr, "bot:acked")
+	resp := a.call(&Packet{Id: "a1", Dst: "server"})
+	var got ack
+	if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+		t.Fatalf("ack %q: %v", resp.Body, err)
+	}
+	if resp.Id != "a1" || got.Status != "done" || got.ID != "a1" || !got.Registered {
+		t.Errorf("got id %q, ack %+v; want a1, done, registered", resp.Id, got)
+	}
+	if age := time.Since(time.UnixMilli(got.TS)); age < 0 || age > time.Second {
+		t.Errorf("ack ts %d is %v old", got.TS, age)
+	}
+
+	// A connection that hasn't registered the src is told so.
+	srv, cli := pipeAgent(t, s)
+	errc := route(&Packet{Id: "a2", Src: "bot:stranger", Dst: "server"}, srv)
+	if err := json.Unmarshal([]byte(recvWithin(t, cli).Body), &got); err != nil || got.Registered {
+		t.Errorf("unregistered sender: ack %+v (%v)", got, err)
+	}
+	<-errc
+
+	s.cfg.LegacyDone = true
+	if resp := a.call(&Packet{Id: "a3", Dst: "server"}); resp.Body != "done" || resp.Id != "a3" {
+		t.Errorf("legacy: got %q (id %q), want done (id a3)", resp.Body, resp.Id)
+	}
+}
+
+func TestSelfRoute(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:narcissus")
+	a.call(&Packet{Dst: "server"})
+
+	before := s.selfRoutes.Load()
+	if resp := a.call(&Packet{Id: "s", Dst: "bot:narcissus", Body: "hello me"}); resp.Body != "error:self_route" || resp.Id != "s" {
+		t.Fatalf("got %q (id %q), want error:self_route", resp.Body, resp.Id)
+	}
+	if got := s.selfRoutes.Load(); got != before+1 {
+		t.Errorf("self routes %d, want %d", got, before+1)
+	}
+
+	s.cfg.AllowSelfRoute = true
+	a.send(&Packet{Dst: "bot:narcissus", Body: "ping myself"})
+	if got := a.recv(); got.Body != "ping myself" || got.Src != "bot:narcissus" {
+		t.Fatalf("opted in: got %v, want own packet back", got)
+	}
+	if got := s.selfRoutes.Load(); got != before+1 {
+		t.Errorf("allowed self route counted: %d", got)
+	}
+}
+
+func TestSelfRouteViaOtherIdentity(t *testing.T) {
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:echo")
+	a.call(&Packet{Dst: "server"})
+	// The same connection also registers a second identity.
+	a.call(&Packet{Src: "bot:echo-2", Dst: "server"})
+
+	before := s.selfRoutes.Load()
+	for _, p := range []*Packet{
+		{Id: "s1", Dst: "bot:echo-2", Body: "hello other me"},
+		{Id: "s2", Src: "bot:echo-2", Dst: "bot:echo", Body: "and back"},
+	} {
+		if resp := a.call(p); resp.Body != "error:self_route" || resp.Id != p.Id {
+			t.Fatalf("%s: got %q (id %q), want error:self_route", p.Id, resp.Body, resp.Id)
+		}
+	}
+	if got := s.selfRoutes.Load(); got != before+2 {
+		t.Errorf("self routes %d, want %d", got, before+2)
+	}
+
+	s.cfg.AllowSelfRoute = true
+	a.send(&Packet{Dst: "bot:echo-2", Body: "loop"})
+	if got := a.recv(); got.Body != "loop" || got.Dst != "bot:echo-2" {
+		t.Fatalf("opted in: got %v, want own packet back", got)
+	}
+}
+
+func TestForwardRacesClose(t *testing.T) {
+	s, addr := startServer(t)
+	sender := dialAgent(t, addr, "bot:race-sender")
+	sender.call(&Packet{Dst: "server"})
+
+	// A connection closed while still registered, as when its reader has
+	// not yet unregistered it, is offline to a forwarder that finds it.
+	srv, cli := pipeAgent(t, s)
+	gone, _ := pipeAgent(t, s)
+	s.registerConn("bot:race-gone", gone)
+	gone.Close()
+	if err := s.forward(gone, &Packet{Dst: "bot:race-gone"}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("forward to a closed connection: got %v, want net.ErrClosed", err)
+	}
+	errc := route(&Packet{Id: "g1", Src: "bot:race-sender", Dst: "bot:race-gone"}, srv)
+	if resp := recvWithin(t, cli); resp.Body != "error:offline" {
+		t.Fatalf("route to a closed connection: got %q, want error:offline", resp.Body)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Route: %v", err)
+	}
+
+	// Packets stream to agents whose connections the server closes as they
+	// arrive. Each one closed before its write is offline, never a failed
+	// delivery: nothing is written to a connection once it is closed.
+	const agents, packets = 10, 500
+	var wg sync.WaitGroup
+	for i := range agents {
+		a := dialAgent(t, addr, fmt.Sprintf("bot:race-%d", i))
+		a.call(&Packet{Dst: "server"})
+		wg.Add(1)
+		go func() { // drain until the server closes it
+			defer wg.Done()
+			for {
+				if _, err := wire.ReadPacket(a.conn); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for j := range packets {
+		// Close one agent every so often, with packets to it still in flight
+		if j%(packets/agents) == 0 {
+			s.lookupAgent(fmt.Sprintf("bot:race-%d", j/(packets/agents))).Close()
+		}
+		sender.send(&Packet{Id: fmt.Sprint(j), Dst: fmt.Sprintf("bot:race-%d", j%agents)})
+	}
+	sender.send(&Packet{Id: "barrier", Dst: "server"})
+	offline := 0
+	for {
+		p := sender.recv()
+		if status(p) == "done" && p.Id == "barrier" {
+			break
+		}
+		if p.Body != "error:offline" {
+			t.Fatalf("packet %s: got %q, want error:offline", p.Id, p.Body)
+		}
+		offline++
+	}
+	if offline == 0 {
+		t.Fatal("no packet was routed to a closed agent")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime/metrics"
+)
+
+// Go runtime statistics, read from runtime/metrics when /metrics is scraped
+// so they cost nothing between scrapes. Unlike runtime.ReadMemStats, reading
+// them does not stop the world.
+const (
+	rtGoroutines = "/sched/goroutines:goroutines"
+	rtHeapBytes  = "/memory/classes/heap/objects:bytes"
+	rtGCPauses   = "/sched/pauses/total/gc:seconds"
+)
+
+// writeRuntimeMetrics renders the runtime statistics for /metrics.
+func writeRuntimeMetrics(w io.Writer) {
+	samples := []metrics.Sample{{Name: rtGoroutines}, {Name: rtHeapBytes}, {Name: rtGCPauses}}
+	metrics.Read(samples)
+
+	if v := samples[0].Value; v.Kind() == metrics.KindUint64 {
+		fmt.Fprintln(w, "# HELP keep_go_goroutines Goroutines that currently exist.")
+		fmt.Fprintln(w, "# TYPE keep_go_goroutines gauge")
+		fmt.Fprintf(w, "keep_go_goroutines %d\n", v.Uint64())
+	}
+	if v := samples[1].Value; v.Kind() == metrics.KindUint64 {
+		fmt.Fprintln(w, "# HELP keep_go_heap_bytes Bytes of heap objects, live or not yet swept.")
+		fmt.Fprintln(w, "# TYPE keep_go_heap_bytes gauge")
+		fmt.Fprintf(w, "keep_go_heap_bytes %d\n", v.Uint64())
+	}
+	if v := samples[2].Value; v.Kind() == metrics.KindFloat64Histogram {
+		fmt.Fprintln(w, "# HELP keep_go_gc_pause_seconds Stop-the-world pauses for garbage collection; the sum is estimated from bucket midpoints.")
+		fmt.Fprintln(w, "# TYPE keep_go_gc_pause_seconds histogram")
+		writeRuntimeHistogram(w, "keep_go_gc_pause_seconds", v.Float64Histogram(), latencyBuckets)
+	}
+}
+
+// writeRuntimeHistogram renders h, whose fine-grained buckets the runtime
+// chooses, as a Prometheus histogram with the given upper bounds. Each
+// runtime bucket is counted under the first bound at or above its top.
+func writeRuntimeHistogram(w io.Writer, name string, h *metrics.Float64Histogram, bounds []float64) {
+	counts := make([]uint64, len(bounds)+1) // the extra last slot is +Inf
+	var sum float64
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		j := 0
+		for j < len(bounds) && hi > bounds[j] {
+			j++
+		}
+		counts[j] += n
+		switch {
+		case math.IsInf(lo, -1):
+			sum += float64(n) * hi
+		case math.IsInf(hi, 1):
+			sum += float64(n) * lo
+		default:
+			sum += float64(n) * (lo + hi) / 2
+		}
+	}
+	var cum uint64
+	for i, b := range bounds {
+		cum += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, cum)
+	}
+	cum += counts[len(bounds)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cum)
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, cum)
+}
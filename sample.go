@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A packet to "sample:<fraction>" is forwarded to a random sample of the
+// agents registered on this server, for telemetry and gossip that need not
+// reach everyone. fraction is a number in (0, 1]. Every agent other than the
+// sender that the route ACL lets it reach is equally likely to be picked,
+// and each packet draws its own sample. Of n such agents, fraction*n are
+// picked, rounded up or down at random in proportion to the remainder, so
+// the expected share is exactly fraction. The sender gets a sampleAck saying
+// how many took the packet.
+//
+// An agent holding several identities on one connection is one agent and
+// gets one copy. Like anycast, sampling stays on this server.
+
+// sampleAck is the JSON body of a sample:<fraction> reply.
+type sampleAck struct {
+	Status    string `json:"status"`
+	Delivered int    `json:"delivered"` // agents whose write succeeded
+	Sampled   int    `json:"sampled"`   // agents picked
+	Of        int    `json:"of"`        // agents that could have been picked
+}
+
+// parseSampleFraction parses the fraction of a sample:<fraction> dst.
+func parseSampleFraction(dst string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimPrefix(dst, "sample:"), 64)
+	if err != nil || !(f > 0 && f <= 1) {
+		return 0, false
+	}
+	return f, true
+}
+
+// sampleSize is how many of n agents a fraction picks: fraction*n rounded
+// down, plus one with probability equal to what was rounded off.
+func sampleSize(fraction float64, n int) int {
+	whole, rest := math.Modf(fraction * float64(n))
+	k := int(whole)
+	if rand.Float64() < rest {
+		k++
+	}
+	return min(k, n)
+}
+
+// sampleTargets returns the agents a packet from c may be sampled to: one
+// connection per agent, c excluded, each reached through an identity the
+// route ACL allows src to send to.
+func (s *Server) sampleTargets(c *connInfo, src string) []*connInfo {
+	type route struct {
+		identity string
+		ci       *connInfo
+	}
+	s.routeMu.RLock()
+	routes := make([]route, 0, len(s.agents))
+	for identity, ci := range s.agents {
+		if ci != c {
+			routes = append(routes, route{identity, ci})
+		}
+	}
+	s.routeMu.RUnlock()
+
+	picked := make(map[*connInfo]bool, len(routes))
+	targets := make([]*connInfo, 0, len(routes))
+	for _, r := range routes {
+		if !picked[r.ci] && s.routeAllowed(src, r.identity) {
+			picked[r.ci] = true
+			targets = append(targets, r.ci)
+		}
+	}
+	return targets
+}
+
+// routeSample forwards a sample:<fraction> packet from c to a fresh random
+// sample of agents and tells c how many took it.
+func (s *Server) routeSample(c *connInfo, p *Packet, received time.Time) error {
+	fraction, ok := parseSampleFraction(p.Dst)
+	if !ok {
+		s.auditRecord(p, outcomeRejected, true)
+		s.log.Printf("REJECTED error:invalid_fraction from %s (src=%s dst=%s)", c.addr, p.Src, p.Dst)
+		return reply(c, p, "error:invalid_fraction")
+	}
+
+	targets := s.sampleTargets(c, p.Src)
+	k := sampleSize(fraction, len(targets))
+	// A partial Fisher-Yates shuffle: targets[:k] is a uniform sample
+	for i := 0; i < k; i++ {
+		j := i + rand.IntN(len(targets)-i)
+		targets[i], targets[j] = targets[j], targets[i]
+	}
+	var marshaled []byte // p marshaled once for every target
+	if s.cfg.CoalesceBroadcast && k > 1 {
+		marshaled, _ = proto.Marshal(p)
+	}
+	delivered := 0
+	for _, ci := range targets[:k] {
+		if err := s.forwardWire(ci, p, marshaled); err != nil {
+			s.log.Printf("Route %s -> %s: %s failed: %v", p.Src, p.Dst, ci.addr, err)
+			continue
+		}
+		delivered++
+	}
+	if delivered > 0 {
+		s.routeLatencyLocal.observe(time.Since(received))
+		s.routedPackets.Add(int64(delivered))
+	}
+	s.auditRecord(p, outcomeRouted, true)
+	if s.routeLog.ok() {
+		s.log.Printf("Routed %s -> %s to %d of %d agents", p.Src, p.Dst, delivered, len(targets))
+	}
+	body, _ := json.Marshal(sampleAck{Status: "done", Delivered: delivered, Sampled: k, Of: len(targets)})
+	return reply(c, p, string(body))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestSampleBroadcast(t *testing.T) {
+	_, addr := startServer(t)
+	const agents = 20
+	receivers := make([]*testAgent, agents)
+	for i := range receivers {
+		receivers[i] = dialAgent(t, addr, fmt.Sprintf("bot:sample-%d", i))
+		receivers[i].call(&Packet{Dst: "server"})
+	}
+	sender := dialAgent(t, addr, "bot:sample-sender")
+	sender.call(&Packet{Dst: "server"})
+
+	sample := func(dst string) sampleAck {
+		t.Helper()
+		resp := sender.call(&Packet{Dst: dst, Body: "gossip"})
+		var a sampleAck
+		if err := json.Unmarshal([]byte(resp.Body), &a); err != nil || a.Status != "done" {
+			t.Fatalf("%s: got %q", dst, resp.Body)
+		}
+		return a
+	}
+	// drain counts the packets each receiver got.
+	drain := func() []int {
+		counts := make([]int, agents)
+		for i, r := range receivers {
+			for {
+				r.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				if _, err := wire.ReadPacket(r.conn); err != nil {
+					break
+				}
+				counts[i]++
+			}
+		}
+		return counts
+	}
+
+	// Everyone but the sender.
+	if a := sample("sample:1"); a.Delivered != agents || a.Of != agents {
+		t.Fatalf("sample:1 got %+v, want all %d agents", a, agents)
+	}
+	for i, n := range drain() {
+		if n != 1 {
+			t.Fatalf("receiver %d got %d copies of sample:1, want 1", i, n)
+		}
+	}
+
+	// 0.33 of 20 is 6.6 agents: 6 or 7 per packet, 6.6 on average, with
+	// every agent picked about as often.
+	const sends, fraction = 300, 0.33
+	delivered := 0
+	for i := 0; i < sends; i++ {
+		a := sample(fmt.Sprintf("sample:%g", fraction))
+		if a.Delivered != 6 && a.Delivered != 7 {
+			t.Fatalf("send %d delivered to %d agents, want 6 or 7", i, a.Delivered)
+		}
+		delivered += a.Delivered
+	}
+	if got := float64(delivered) / (sends * agents); math.Abs(got-fraction) > 0.02 {
+		t.Errorf("delivered to %.3f of agents on average, want %.2f", got, fraction)
+	}
+	total := 0
+	for i, n := range drain() {
+		total += n
+		// Expect 99 each; this is more than six standard deviations out.
+		if n < 50 || n > 150 {
+			t.Errorf("receiver %d got %d of %d sends, want about %d", i, n, sends, int(sends*fraction))
+		}
+	}
+	if total != delivered {
+		t.Errorf("receivers got %d packets, acks counted %d", total, delivered)
+	}
+
+	for _, dst := range []string{"sample:0", "sample:1.5", "sample:-0.5", "sample:NaN", "sample:half", "sample:"} {
+		if resp := sender.call(&Packet{Dst: dst}); resp.Body != "error:invalid_fraction" {
+			t.Errorf("%s: got %q, want error:invalid_fraction", dst, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// Scar limits cap the scars each source may barter per window, apart from
+// its general quota, loaded from the JSON file named by -scar-limit-file in
+// the quota file's format:
+//
+//	{
+//	  "window": "1m",
+//	  "default": {"bytes": 65536, "packets": 10},
+//	  "identities": {"bot:archivist": {"bytes": 0, "packets": 100}}
+//	}
+//
+// Here bytes counts len(scar) and packets counts packets carrying a scar;
+// packets without one are never charged. A scar that would take its source
+// past a limit is rejected with error:scar_limit, counted in
+// keep_scar_limited_total and not charged. -max-scar still bounds each
+// scar on its own.
+
+// reloadScarLimits (re)reads -scar-limit-file. On error the previous limits
+// stay in force. Current windows and their counts carry over.
+func (s *Server) reloadScarLimits() error {
+	if s.cfg.ScarLimitFile == "" {
+		return nil
+	}
+	q, err := loadQuotaFile(s.cfg.ScarLimitFile)
+	if err != nil {
+		return err
+	}
+	s.scarLimits.Store(q)
+	s.log.Printf("Scar limits loaded from %s: window %v, default %+v, %d overrides", s.cfg.ScarLimitFile, q.window, q.Default, len(q.Identities))
+	return nil
+}
+
+// chargeScar counts p's scar against its source's scar limit. It reports
+// false, counting nothing, if the scar would exceed it.
+func (s *Server) chargeScar(p *Packet, now time.Time) bool {
+	q := s.scarLimits.Load()
+	if q == nil || len(p.Scar) == 0 {
+		return true
+	}
+	return s.scarUse.charge(p.Src, q.limitFor(p.Src), q.window, int64(len(p.Scar)), now)
+}
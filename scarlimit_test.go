@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useScarLimits writes body to a scar limit file and loads it for the test.
+func useScarLimits(t *testing.T, s *Server, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "scar-limits.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.ScarLimitFile = path
+	if err := s.reloadScarLimits(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScarLimits(t *testing.T) {
+	s := newTestServer(t)
+	useScarLimits(t, s, `{
+		"window": "300ms",
+		"default": {"packets": 2},
+		"identities": {"bot:hoarder": {"bytes": 100}}
+	}`)
+	addr := serveLoopback(t, s)
+
+	expect := func(a *testAgent, scar int, want string) {
+		t.Helper()
+		p := &Packet{Id: "s", Dst: "server"}
+		if scar > 0 {
+			p.Scar = []byte(strings.Repeat("x", scar))
+		}
+		if resp := a.call(p); status(resp) != want {
+			t.Fatalf("%s, %d byte scar: got %q, want %q", a.src, scar, resp.Body, want)
+		}
+	}
+
+	// Two scars a window by default; packets without one don't count.
+	a := dialAgent(t, addr, "bot:barter")
+	expect(a, 10, "done")
+	expect(a, 0, "done")
+	expect(a, 10, "done")
+	expect(a, 10, "error:scar_limit")
+	expect(a, 0, "done")
+
+	// The override allows 100 scar bytes however many packets carry them.
+	h := dialAgent(t, addr, "bot:hoarder")
+	for range 4 {
+		expect(h, 25, "done")
+	}
+	expect(h, 1, "error:scar_limit")
+
+	if n := s.scarLimited.Load(); n != 2 {
+		t.Errorf("keep_scar_limited_total = %d, want 2", n)
+	}
+	// Rejected scars aren't counted as exchanges.
+	s.scarCountMu.Lock()
+	got := s.scarCount["bot:barter"]
+	s.scarCountMu.Unlock()
+	if got != 2 {
+		t.Errorf("bot:barter scar exchanges = %d, want 2", got)
+	}
+
+	// Both reset when the window ends.
+	time.Sleep(350 * time.Millisecond)
+	expect(a, 10, "done")
+	expect(h, 100, "done")
+}
+
+func TestScarLimitsReload(t *testing.T) {
+	s := newTestServer(t)
+	useScarLimits(t, s, `{"window": "1h", "default": {"bytes": 8}}`)
+	addr := serveLoopback(t, s)
+	a := dialAgent(t, addr, "bot:reload")
+	if resp := a.call(&Packet{Dst: "server", Scar: []byte("0123456789")}); resp.Body != "error:scar_limit" {
+		t.Fatalf("over the byte limit: got %q", resp.Body)
+	}
+
+	// A broken file keeps the old limits.
+	os.WriteFile(s.cfg.ScarLimitFile, []byte(`{"window": "soon"}`), 0o600)
+	if s.reloadScarLimits() == nil {
+		t.Fatal("reload of an invalid file succeeded")
+	}
+	if resp := a.call(&Packet{Dst: "server", Scar: []byte("0123456789")}); resp.Body != "error:scar_limit" {
+		t.Fatalf("after a failed reload: got %q", resp.Body)
+	}
+
+	// A good one replaces them; the current window carries over.
+	os.WriteFile(s.cfg.ScarLimitFile, []byte(`{"window": "1h", "default": {"bytes": 16}}`), 0o600)
+	if err := s.reloadScarLimits(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := a.call(&Packet{Dst: "server", Scar: []byte("0123456789")}); status(resp) != "done" {
+		t.Fatalf("after raising the limit: got %q", resp.Body)
+	}
+	if resp := a.call(&Packet{Dst: "server", Scar: []byte("0123456789")}); resp.Body != "error:scar_limit" {
+		t.Fatalf("past the raised limit: got %q", resp.Body)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// With -scar-store-bytes set, the server keeps the scar payloads it relays,
+// keyed by their SHA-256, so a scar seen again is recognised as a repeat
+// exchange rather than counted as new. The store holds at most that many
+// payload bytes and evicts the least recently used payloads to make room.
+
+// scarStoreStats is the scar store's section of discover:stats.
+type scarStoreStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+type scarEntry struct {
+	key     [sha256.Size]byte
+	payload []byte
+}
+
+// scarStore is a byte-bounded LRU of scar payloads. A nil *scarStore is
+// valid and stores nothing.
+type scarStore struct {
+	mu    sync.Mutex
+	lru   *list.List // of *scarEntry, most recently used at the front
+	items map[[sha256.Size]byte]*list.Element
+	stats scarStoreStats
+}
+
+func newScarStore(maxBytes int64) *scarStore {
+	return &scarStore{
+		lru:   list.New(),
+		items: make(map[[sha256.Size]byte]*list.Element),
+		stats: scarStoreStats{MaxBytes: maxBytes},
+	}
+}
+
+// get returns the payload stored under key and marks it recently used.
+func (s *scarStore) get(key [sha256.Size]byte) ([]byte, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		s.stats.Misses++
+		return nil, false
+	}
+	s.stats.Hits++
+	s.lru.MoveToFront(el)
+	return el.Value.(*scarEntry).payload, true
+}
+
+// put stores a copy of payload under key, its hash, evicting least recently
+// used payloads until it fits. A payload larger than the whole store is not
+// kept.
+func (s *scarStore) put(key [sha256.Size]byte, payload []byte) {
+	if s == nil {
+		return
+	}
+	size := int64(len(payload))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.lru.MoveToFront(el)
+		return
+	}
+	if size > s.stats.MaxBytes {
+		return
+	}
+	for s.stats.Bytes+size > s.stats.MaxBytes {
+		oldest := s.lru.Back()
+		e := s.lru.Remove(oldest).(*scarEntry)
+		delete(s.items, e.key)
+		s.stats.Bytes -= int64(len(e.payload))
+		s.stats.Evictions++
+	}
+	s.items[key] = s.lru.PushFront(&scarEntry{key: key, payload: bytes.Clone(payload)})
+	s.stats.Bytes += size
+}
+
+// seen reports whether payload was already stored, storing it if not.
+func (s *scarStore) seen(payload []byte) bool {
+	key := sha256.Sum256(payload)
+	if _, ok := s.get(key); ok {
+		return true
+	}
+	s.put(key, payload)
+	return false
+}
+
+// snapshot returns the store's current stats, or nil for a nil store.
+func (s *scarStore) snapshot() *scarStoreStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	st.Entries = s.lru.Len()
+	return &st
+}
+
+// add accumulates o into st, for discover:cluster-stats totals.
+func (st *scarStoreStats) add(o scarStoreStats) {
+	st.Entries += o.Entries
+	st.Bytes += o.Bytes
+	st.MaxBytes += o.MaxBytes
+	st.Hits += o.Hits
+	st.Misses += o.Misses
+	st.Evictions += o.Evictions
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScarStoreEvictsOldest(t *testing.T) {
+	s := newScarStore(100)
+	payload := func(c byte) []byte { return bytes.Repeat([]byte{c}, 30) }
+	for _, c := range []byte("abc") {
+		s.put(sha256.Sum256(payload(c)), payload(c))
+	}
+	// Touch a so that b is now the least recently used.
+	if _, ok := s.get(sha256.Sum256(payload('a'))); !ok {
+		t.Fatal("a missing before the store is full")
+	}
+	s.put(sha256.Sum256(payload('d')), payload('d'))
+
+	for c, want := range map[byte]bool{'a': true, 'b': false, 'c': true, 'd': true} {
+		if _, ok := s.get(sha256.Sum256(payload(c))); ok != want {
+			t.Errorf("%c stored = %v, want %v", c, ok, want)
+		}
+	}
+	st := s.snapshot()
+	want := scarStoreStats{Entries: 3, Bytes: 90, MaxBytes: 100, Hits: 4, Misses: 1, Evictions: 1}
+	if *st != want {
+		t.Errorf("stats = %+v, want %+v", *st, want)
+	}
+
+	// A payload bigger than the store is not kept and evicts nothing.
+	big := bytes.Repeat([]byte{'x'}, 101)
+	s.put(sha256.Sum256(big), big)
+	if st := s.snapshot(); st.Entries != 3 || st.Evictions != 1 {
+		t.Errorf("oversized put changed the store: %+v", *st)
+	}
+}
+
+func TestScarStoreConcurrent(t *testing.T) {
+	s := newScarStore(1000)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				s.seen([]byte(strings.Repeat(strconv.Itoa(g*1000+i), 10)))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	st := s.snapshot()
+	var held int64
+	for _, el := range s.items {
+		held += int64(len(el.Value.(*scarEntry).payload))
+	}
+	if st.Bytes > st.MaxBytes || st.Bytes != held || st.Entries != len(s.items) {
+		t.Errorf("stats %+v disagree with contents (%d entries, %d bytes)", *st, len(s.items), held)
+	}
+	if st.Misses != 1600 || st.Evictions == 0 {
+		t.Errorf("stats = %+v, want 1600 misses and some evictions", *st)
+	}
+}
+
+func TestScarStoreStats(t *testing.T) {
+	s, addr := startServer(t, func(c *Config) {
+		c.ScarStoreBytes = 64
+	})
+	logs := captureLog(t, s)
+
+	a := dialAgent(t, addr, "bot:barter")
+	for _, scar := range []string{"first", "first", strings.Repeat("z", 60)} {
+		a.call(&Packet{Dst: "server", Scar: []byte(scar)})
+	}
+	if !strings.Contains(logs.String(), "(5 bytes, repeat)") {
+		t.Errorf("repeat scar not logged as such:\n%s", logs)
+	}
+
+	st, _ := discoverJSON(t, s, "stats")["scar_store"].(map[string]any)
+	for k, want := range map[string]float64{"entries": 1, "bytes": 60, "hits": 1, "misses": 2, "evictions": 1} {
+		if st[k] != want {
+			t.Errorf("scar_store.%s = %v, want %v", k, st[k], want)
+		}
+	}
+
+	var m bytes.Buffer
+	s.writeMetrics(&m)
+	for _, line := range []string{
+		"keep_scar_store_bytes 60\n",
+		"keep_scar_store_evictions_total 1\n",
+		`keep_scar_store_lookups_total{result="hit"} 1` + "\n",
+	} {
+		if !strings.Contains(m.String(), line) {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A packet to an agent whose deliver_at is in the future is held by the
+// server and forwarded when that time comes, for reminders and timed offers.
+// The sender gets a scheduleAck at once. The destination is looked up at
+// delivery, so the packet goes to whichever connection holds the identity
+// then, or to the federation peer hosting it; if it is offline then, the
+// packet is dropped and counted offline. A deliver_at already past is
+// ignored and the packet routed at once. Packets that fall due together are
+// written concurrently, so a slow destination holds up only its own, and
+// each keeps its place in its destination's line.
+//
+// At most -max-scheduled packets are held per src, none more than
+// -schedule-horizon ahead; past either the sender gets error:schedule_full
+// or error:schedule_too_far. Held packets live only in memory and are lost
+// if the server stops. expires_at still applies: a packet that expires
+// before its delivery time is dropped when that time comes, and its sender
+// gets error:expired as for any packet (see notifyExpired).
+
+// scheduleAck is the reply to a packet the server holds for later delivery.
+type scheduleAck struct {
+	Status    string `json:"status"` // always "scheduled"
+	ID        string `json:"id"`
+	DeliverAt uint64 `json:"deliver_at"` // Unix milliseconds, as sent
+}
+
+// scheduledPacket is a packet held until at. It names its sender only by
+// p.Src, so holding it doesn't keep the sending connection alive, and the
+// loop-back check applies to whichever connection holds p.Src at delivery.
+type scheduledPacket struct {
+	at  time.Time
+	n   uint64 // arrival order, so packets due together go out as received
+	p   *Packet
+	dst string // identity to deliver to, fixed at receipt
+}
+
+// scheduleHeap orders scheduled packets by due time, then arrival.
+type scheduleHeap []*scheduledPacket
+
+func (h scheduleHeap) Len() int { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].n < h[j].n
+}
+func (h scheduleHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *scheduleHeap) Push(x any)   { *h = append(*h, x.(*scheduledPacket)) }
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	sp := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return sp
+}
+
+// scheduler holds packets for later delivery.
+type scheduler struct {
+	mu    sync.Mutex
+	q     scheduleHeap
+	n     uint64
+	bySrc map[string]int // packets held per src
+	wake  chan struct{}  // signalled when a packet joins the front of q
+}
+
+var errScheduleFull = errors.New("schedule full")
+
+// add holds sp, unless max packets from its src are held already.
+func (sc *scheduler) add(sp *scheduledPacket, max int) error {
+	sc.mu.Lock()
+	if sc.bySrc[sp.p.Src] >= max {
+		sc.mu.Unlock()
+		return errScheduleFull
+	}
+	if sc.bySrc == nil {
+		sc.bySrc = make(map[string]int)
+	}
+	sc.bySrc[sp.p.Src]++
+	sc.n++
+	sp.n = sc.n
+	heap.Push(&sc.q, sp)
+	first := sc.q[0] == sp
+	sc.mu.Unlock()
+	if first {
+		select {
+		case sc.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// due removes and returns the packets due at now, in order, and when the
+// next one is due (zero if none is held).
+func (sc *scheduler) due(now time.Time) ([]*scheduledPacket, time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	var out []*scheduledPacket
+	for len(sc.q) > 0 && !sc.q[0].at.After(now) {
+		sp := heap.Pop(&sc.q).(*scheduledPacket)
+		if sc.bySrc[sp.p.Src]--; sc.bySrc[sp.p.Src] == 0 {
+			delete(sc.bySrc, sp.p.Src)
+		}
+		out = append(out, sp)
+	}
+	if len(sc.q) == 0 {
+		return out, time.Time{}
+	}
+	return out, sc.q[0].at
+}
+
+// held returns the number of packets waiting.
+func (sc *scheduler) held() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.q)
+}
+
+// schedule holds p from c for delivery to dst at its deliver_at and tells c.
+func (s *Server) schedule(c *connInfo, p *Packet, dst string, received time.Time) error {
+	at := time.UnixMilli(int64(p.DeliverAt))
+	reason := ""
+	if at.Sub(received) > s.cfg.ScheduleHorizon {
+		reason = "error:schedule_too_far"
+	} else if err := s.sched.add(&scheduledPacket{at: at, p: p, dst: dst}, s.cfg.MaxScheduled); err != nil {
+		reason = "error:schedule_full"
+	}
+	if reason != "" {
+		s.auditRecord(p, outcomeRejected, true)
+		s.log.Printf("REJECTED %s from %s (src=%s dst=%s deliver_at=%d)", reason, c.addr, p.Src, dst, p.DeliverAt)
+		return reply(c, p, reason)
+	}
+	s.queuedPackets.Add(1)
+	s.auditRecord(p, outcomeScheduled, true)
+	if s.routeLog.ok() {
+		s.log.Printf("Scheduled %s -> %s in %v", p.Src, dst, at.Sub(received).Round(time.Millisecond))
+	}
+	body, _ := json.Marshal(scheduleAck{Status: "scheduled", ID: p.Id, DeliverAt: p.DeliverAt})
+	return reply(c, p, string(body))
+}
+
+// runSchedule delivers held packets as they fall due until the server shuts
+// down.
+func (s *Server) runSchedule() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		ready, next := s.sched.due(time.Now())
+		for _, sp := range ready {
+			s.deliverScheduled(sp)
+		}
+		if len(ready) > 0 {
+			continue // more may have fallen due meanwhile
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.sched.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// deliverScheduled forwards a held packet to whichever connection holds its
+// destination now. The packet joins the destination's line before it
+// returns, so packets due together keep their order, but the write happens
+// on its own goroutine. An expired packet gets its sender error:expired;
+// other failures are only logged and counted.
+func (s *Server) deliverScheduled(sp *scheduledPacket) {
+	p := sp.p
+	if expired(p, time.Now()) {
+		s.expireScheduled(sp)
+		return
+	}
+	if !s.routeAllowed(p.Src, sp.dst) {
+		s.aclDenied.Add(1)
+		s.auditRecord(p, outcomeRejected, true)
+		s.log.Printf("Scheduled %s -> %s: denied by ACL", p.Src, sp.dst)
+		return
+	}
+	s.routeMu.RLock()
+	target, from := s.agents[sp.dst], s.agents[p.Src]
+	s.routeMu.RUnlock()
+	if target == nil {
+		if s.peerFor(sp.dst) == nil {
+			s.offlinePackets.Add(1)
+			s.auditRecord(p, outcomeOffline, true)
+			s.log.Printf("Scheduled %s -> %s: offline", p.Src, sp.dst)
+			return
+		}
+		go func() {
+			if ok, err := s.forwardToPeer(p, sp.dst); !ok || err != nil {
+				s.auditRecord(p, outcomeDeliveryFailed, true)
+				s.log.Printf("Scheduled %s -> %s: peer delivery failed: %v", p.Src, sp.dst, err)
+				return
+			}
+			s.routedPackets.Add(1)
+			s.auditRecord(p, outcomeRouted, true)
+		}()
+		return
+	}
+	if target == from && !s.cfg.AllowSelfRoute {
+		s.selfRoutes.Add(1)
+		s.auditRecord(p, outcomeRejected, true)
+		s.log.Printf("Scheduled %s -> %s: loops back to the sender", p.Src, sp.dst)
+		return
+	}
+	turn := s.joinSendQ(target, p)
+	go func() {
+		if err := s.forwardInLine(target, p, nil, turn); err != nil {
+			if errors.Is(err, errExpired) {
+				s.expireScheduled(sp)
+				return
+			}
+			if errors.Is(err, errDstTooLarge) {
+				s.auditRecord(p, outcomeRejected, true)
+				s.log.Printf("Scheduled %s -> %s: %d bytes, over its max_packet_size", p.Src, sp.dst, proto.Size(p))
+				return
+			}
+			s.auditRecord(p, outcomeDeliveryFailed, true)
+			s.log.Printf("Scheduled %s -> %s: delivery failed: %v", p.Src, sp.dst, err)
+			return
+		}
+		s.routedPackets.Add(1)
+		s.auditRecord(p, outcomeRouted, true)
+		if s.routeLog.ok() {
+			s.log.Printf("Routed %s -> %s (scheduled, %v late)", p.Src, sp.dst, time.Since(sp.at).Round(time.Millisecond))
+		}
+	}()
+}
+
+// expireScheduled drops a held packet that expired before it could be
+// delivered and tells its sender, wherever it is connected now.
+func (s *Server) expireScheduled(sp *scheduledPacket) {
+	s.expiredPackets.Add(1)
+	s.auditRecord(sp.p, outcomeExpired, true)
+	s.log.Printf("EXPIRED %s -> %s (id=%s, scheduled)", sp.p.Src, sp.dst, sp.p.Id)
+	s.notifyExpired(sp.p, MaxFederationHops)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestScheduledDelivery(t *testing.T) {
+	s, addr := startServer(t)
+	sender := dialAgent(t, addr, "bot:sched-sender")
+	sender.call(&Packet{Dst: "server"})
+	rcv := dialAgent(t, addr, "bot:sched-rcv")
+	rcv.call(&Packet{Dst: "server"})
+
+	// A future time is acknowledged at once and delivered when it arrives.
+	at := time.Now().Add(300 * time.Millisecond)
+	resp := sender.call(&Packet{Id: "s-1", Dst: "bot:sched-rcv", Body: "later", DeliverAt: uint64(at.UnixMilli())})
+	var ack scheduleAck
+	if err := json.Unmarshal([]byte(resp.Body), &ack); err != nil || ack.Status != "scheduled" || ack.ID != "s-1" || ack.DeliverAt != uint64(at.UnixMilli()) {
+		t.Fatalf("got %q, want a schedule ack", resp.Body)
+	}
+	if n := s.sched.held(); n != 1 {
+		t.Fatalf("%d packets held, want 1", n)
+	}
+	p := rcv.recv()
+	if late := time.Since(at); p.Body != "later" || wire.Verify(p) != nil || late < -5*time.Millisecond || late > time.Second {
+		t.Fatalf("got %q %v after its time (verifies: %v)", p.Body, late, wire.Verify(p) == nil)
+	}
+	if n := s.sched.held(); n != 0 {
+		t.Fatalf("%d packets held after delivery", n)
+	}
+
+	// A time already past delivers immediately, with no ack.
+	sender.send(&Packet{Dst: "bot:sched-rcv", Body: "now", DeliverAt: uint64(time.Now().Add(-time.Minute).UnixMilli())})
+	if p := rcv.recv(); p.Body != "now" {
+		t.Fatalf("got %q", p.Body)
+	}
+	expectNothing(t, sender)
+}
+
+func TestScheduledDeliveryFollowsRegistration(t *testing.T) {
+	_, addr := startServer(t)
+	sender := dialAgent(t, addr, "bot:sched-from")
+	sender.call(&Packet{Dst: "server"})
+	first := dialAgent(t, addr, "bot:sched-to")
+	first.call(&Packet{Dst: "server"})
+
+	at := time.Now().Add(400 * time.Millisecond)
+	if resp := sender.call(&Packet{Dst: "bot:sched-to", Body: "hi", DeliverAt: uint64(at.UnixMilli())}); scheduleStatus(resp) != "scheduled" {
+		t.Fatalf("got %q", resp.Body)
+	}
+	// The agent reconnects before the packet is due.
+	second := dialAgent(t, addr, "bot:sched-to")
+	second.priv = first.priv
+	second.call(&Packet{Dst: "server"})
+	if p := second.recv(); p.Body != "hi" {
+		t.Fatalf("got %q", p.Body)
+	}
+}
+
+// scheduleStatus returns the status of a schedule ack, or the body of any
+// other reply.
+func scheduleStatus(p *Packet) string {
+	var ack scheduleAck
+	if json.Unmarshal([]byte(p.Body), &ack) == nil && ack.ID == p.Id {
+		return ack.Status
+	}
+	return p.Body
+}
+
+func TestScheduleLimits(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) {
+		c.MaxScheduled = 1
+		c.ScheduleHorizon = time.Hour
+	})
+	a := dialAgent(t, addr, "bot:sched-limits")
+	a.call(&Packet{Dst: "server"})
+
+	in := func(d time.Duration) uint64 { return uint64(time.Now().Add(d).UnixMilli()) }
+	for _, tc := range []struct {
+		deliverAt uint64
+		want      string
+	}{
+		{in(2 * time.Hour), "error:schedule_too_far"},
+		{in(time.Minute), "scheduled"},
+		{in(time.Minute), "error:schedule_full"},
+	} {
+		if resp := a.call(&Packet{Dst: "bot:sched-none", DeliverAt: tc.deliverAt}); scheduleStatus(resp) != tc.want {
+			t.Errorf("deliver_at %d: got %q, want %q", tc.deliverAt, resp.Body, tc.want)
+		}
+	}
+	// The cap is per src: another sender still has room.
+	b := dialAgent(t, addr, "bot:sched-other")
+	if resp := b.call(&Packet{Dst: "bot:sched-none", DeliverAt: in(time.Minute)}); scheduleStatus(resp) != "scheduled" {
+		t.Errorf("other src got %q, want scheduled", resp.Body)
+	}
+}
+
+func TestScheduledExpiryNack(t *testing.T) {
+	s, addr := startServer(t)
+	sender := dialAgent(t, addr, "bot:sched-stale")
+	rcv := dialAgent(t, addr, "bot:sched-stale-rcv")
+	rcv.call(&Packet{Dst: "server"})
+
+	now := time.Now()
+	p := &Packet{Id: "st-1", Dst: "bot:sched-stale-rcv", Body: "too late",
+		DeliverAt: uint64(now.Add(200 * time.Millisecond).UnixMilli()), ExpiresAt: uint64(now.Add(50 * time.Millisecond).UnixMilli())}
+	if resp := sender.call(p); scheduleStatus(resp) != "scheduled" {
+		t.Fatalf("got %q", resp.Body)
+	}
+	// The sender hears that it expired; the recipient gets nothing.
+	if resp := sender.recv(); resp.Id != "st-1" || resp.Body != "error:expired" {
+		t.Fatalf("sender got %v, want error:expired for st-1", resp)
+	}
+	expectNothing(t, rcv)
+	if n := s.expiredPackets.Load(); n != 1 {
+		t.Errorf("keep_expired_total = %d, want 1", n)
+	}
+}
+
+func TestScheduledPeerDelivery(t *testing.T) {
+	fed := freeAddr(t)
+	s, _ := startServer(t, func(c *Config) {
+		c.ServerID = "hub"
+		c.FederationAddr = fed
+	})
+	peer, err := net.Dial("tcp", fed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+	wire.ReadPacket(peer) // the hub's hello
+	wire.WritePacket(peer, &Packet{Src: "spoke", Dst: "fed:hello"})
+	wire.WritePacket(peer, &Packet{Src: "spoke", Dst: "fed:register", Body: "bot:spoke-gw"})
+	waitFor(t, "the spoke's route", func() bool { return s.peerFor("bot:spoke-gw") != nil })
+
+	// A held reply redirected to an identity the spoke hosts goes there,
+	// not to the packet's own dst.
+	_, priv, _ := ed25519.GenerateKey(nil)
+	p := &Packet{Id: "r1", Src: "bot:hub-responder", Dst: "bot:hub-client", Body: "pong"}
+	wire.Sign(p, priv)
+	s.deliverScheduled(&scheduledPacket{at: time.Now(), p: p, dst: "bot:spoke-gw"})
+	for {
+		env, err := wire.ReadPacket(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Dst != "fed:forward" {
+			continue // gossip
+		}
+		var got Packet
+		if err := proto.Unmarshal(env.Scar, &got); err != nil || got.Id != "r1" || env.Body != "bot:spoke-gw" {
+			t.Fatalf("spoke got %v for %q (%v), want r1 for bot:spoke-gw", &got, env.Body, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestConnectionSeq(t *testing.T) {
+	_, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:seq-a")
+	b := dialAgent(t, addr, "bot:seq-b")
+	if p := a.call(&Packet{Dst: "server"}); p.Seq != 1 {
+		t.Fatalf("first packet to a has seq %d, want 1", p.Seq)
+	}
+	for i := 0; i < 3; i++ {
+		if p := b.call(&Packet{Dst: "server"}); p.Seq != uint64(i+1) {
+			t.Fatalf("packet %d to b has seq %d, want %d", i, p.Seq, i+1)
+		}
+	}
+
+	// Forwards count on the receiving connection, whatever seq the sender
+	// put on them, and still verify.
+	b.send(&Packet{Dst: "bot:seq-a", Body: "one", Seq: 99})
+	b.send(&Packet{Dst: "bot:seq-a", Body: "two"})
+	for want := uint64(2); want <= 3; want++ {
+		p := a.recv()
+		if p.Seq != want || wire.Verify(p) != nil {
+			t.Fatalf("forward %q has seq %d (verifies: %v), want %d", p.Body, p.Seq, wire.Verify(p) == nil, want)
+		}
+	}
+
+	// One packet to many connections gets each connection's own next seq.
+	c := dialAgent(t, addr, "bot:seq-c")
+	c.call(&Packet{Dst: "server"})
+	c.call(&Packet{Dst: "sample:1", Body: "all"})
+	if p := a.recv(); p.Body != "all" || p.Seq != 4 {
+		t.Fatalf("a got %q with seq %d, want all with 4", p.Body, p.Seq)
+	}
+	if p := b.recv(); p.Body != "all" || p.Seq != 4 {
+		t.Fatalf("b got %q with seq %d, want all with 4", p.Body, p.Seq)
+	}
+
+	// A new connection starts again at 1.
+	a.conn.Close()
+	again := dialAgent(t, addr, "bot:seq-a")
+	again.priv = a.priv
+	if p := again.call(&Packet{Dst: "server"}); p.Seq != 1 {
+		t.Fatalf("first packet after reconnecting has seq %d, want 1", p.Seq)
+	}
+}
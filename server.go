@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is one keep server. It owns its configuration, routing table,
+// counters, and the state of every subsystem, so servers in one process
+// share nothing and can run side by side. main is a thin wrapper:
+//
+//	s, err := New(cfg)
+//	...
+//	go s.Serve(l)
+//	...
+//	s.Shutdown(ctx)
+type Server struct {
+	cfg    Config
+	log    *log.Logger
+	key    ed25519.PrivateKey // signs server-originated packets such as heartbeats
+	router Router             // routes every verified packet; replace it before Serve
+	start  time.Time
+
+	identityRE     *regexp.Regexp    // -identity-pattern, anchored; nil accepts any identity
+	reregOverrides map[string]string // -reregister-overrides
+
+	agents  map[string]*connInfo            // "bot:weather" -> conn
+	connSrc map[*connInfo]map[string][]byte // conn -> its identities, each with the key it is bound to
+	standby map[string][]*connInfo          // identity -> connections besides agents' sharing it under allow-both, oldest first
+	routeMu sync.RWMutex
+
+	counters
+	receiptLog, routeLog logSampler
+	heartbeatSeq         atomic.Uint64
+	directiveSeq         atomic.Uint64
+	discoverTimeout      time.Duration // DiscoverWriteTimeout, shortened by tests
+
+	// Scar/barter tracking
+	scarCount   map[string]int64 // src -> count of scar-bearing packets
+	scarCountMu sync.Mutex
+	scars       *scarStore // nil unless -scar-store-bytes is set
+
+	dedup      map[dedupKey]*dedupEntry // -dedup-window: packets handled recently
+	dedupOrder []dedupRef               // dedup keys, oldest first
+	dedupMu    sync.Mutex
+
+	audit    *auditLog   // nil unless -audit-log is set
+	fair     *fairQueue  // nil unless -fair-workers is set
+	verifier *verifyPool // nil unless -verify-workers is set
+
+	secpMu     sync.Mutex
+	secpWindow time.Time // start of the current -secp256k1-rate second
+	secpCount  int       // secp256k1 verifications in it
+
+	quotas     atomic.Pointer[quotaConfig] // nil disables quotas
+	scarLimits atomic.Pointer[quotaConfig] // nil leaves scars unlimited
+	acl        atomic.Pointer[aclConfig]   // nil allows every route
+	quotaUse   quotaTable
+	scarUse    quotaTable
+
+	sched  scheduler   // packets held for their deliver_at (see schedule.go)
+	health healthState // see health.go
+
+	resumes resumeTable // see resume.go
+
+	discoverCache map[string]cachedReply // by query; see discovercache.go
+	discoverUse   map[string]*discoverWindow
+	discoverMu    sync.Mutex
+
+	usage   map[string]identityUsage // totals from closed connections
+	usageMu sync.Mutex
+
+	replyRoutes map[replyKey]replyRoute
+	replyMu     sync.Mutex
+
+	groups   map[string][]*connInfo // group -> members in join order
+	groupsMu sync.RWMutex
+
+	streamOffers map[[2]string]streamOffer // {src, target} -> offer
+	streamsMu    sync.Mutex
+
+	taps     map[*connInfo]*logTap // discover:tail subscribers
+	tapsMu   sync.Mutex
+	tapCount atomic.Int32 // len(taps), read without the lock on every log line
+
+	// Federation
+	peers      map[string]*peerLink // server id -> link
+	peerRoutes map[string]*peerLink // agent identity -> hosting peer
+	fedMu      sync.RWMutex
+	ring       *hashRing // nil unless -ring-vnodes is set
+
+	statsWaiters map[string]chan statsReply // request id -> collector
+	statsMu      sync.Mutex
+	statsSeq     atomic.Uint64
+	knownPeers   map[string]bool // every peer that has ever linked
+	knownPeersMu sync.Mutex
+
+	accepting    atomic.Int32 // protocol listeners Serve is accepting on
+	shuttingDown atomic.Bool  // Shutdown has begun
+	handlerLeak  atomic.Bool  // checkHandlers last found handlers over the threshold
+
+	mu        sync.Mutex // guards the fields below
+	closing   bool
+	done      chan struct{} // closed when Shutdown closes the listeners
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	handlers  sync.WaitGroup // connection handlers started by Serve
+}
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("keep: server closed")
+
+// New returns a server configured by cfg. It loads the server key, quotas,
+// and audit log, and starts what runs without a protocol listener: the fair
+// queue's workers, heartbeats, federation, and the metrics listener. Accept
+// protocol connections with Serve.
+func New(cfg Config) (*Server, error) {
+	s := &Server{
+		cfg:             cfg,
+		router:          defaultRouter{},
+		discoverTimeout: DiscoverWriteTimeout,
+		start:           time.Now(),
+		agents:          make(map[string]*connInfo),
+		connSrc:         make(map[*connInfo]map[string][]byte),
+		standby:         make(map[string][]*connInfo),
+		counters:        newCounters(),
+		scarCount:       make(map[string]int64),
+		quotaUse:        quotaTable{use: make(map[string]*quotaWindow)},
+		scarUse:         quotaTable{use: make(map[string]*quotaWindow)},
+		sched:           scheduler{wake: make(chan struct{}, 1)},
+		resumes:         resumeTable{live: make(map[string]*connInfo), suspended: make(map[string]*resumeSession)},
+		dedup:           make(map[dedupKey]*dedupEntry),
+		discoverCache:   make(map[string]cachedReply),
+		discoverUse:     make(map[string]*discoverWindow),
+		usage:           make(map[string]identityUsage),
+		replyRoutes:     make(map[replyKey]replyRoute),
+		groups:          make(map[string][]*connInfo),
+		streamOffers:    make(map[[2]string]streamOffer),
+		taps:            make(map[*connInfo]*logTap),
+		peers:           make(map[string]*peerLink),
+		peerRoutes:      make(map[string]*peerLink),
+		statsWaiters:    make(map[string]chan statsReply),
+		knownPeers:      make(map[string]bool),
+		done:            make(chan struct{}),
+		listeners:       make(map[net.Listener]bool),
+		conns:           make(map[net.Conn]bool),
+	}
+	out := cfg.Logger
+	if out == nil {
+		out = log.Default()
+	}
+	s.log = log.New(tapWriter{s, out}, "", 0)
+	s.setLogSample(cfg.LogSample)
+
+	if s.cfg.ReplySrc == "" {
+		s.cfg.ReplySrc = DefaultReplySrc
+	}
+	if err := s.loadServerKey(); err != nil {
+		return nil, fmt.Errorf("server key: %w", err)
+	}
+	if cfg.IdentityPattern != "" {
+		re, err := regexp.Compile(`^(?:` + cfg.IdentityPattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("identity pattern: %w", err)
+		}
+		s.identityRE = re
+	}
+	if s.cfg.Reregister == "" {
+		s.cfg.Reregister = reregReplace
+	}
+	if !validReregister(s.cfg.Reregister) {
+		return nil, fmt.Errorf("reregister: %q is not replace, reject-new or allow-both", s.cfg.Reregister)
+	}
+	var err error
+	if s.reregOverrides, err = parseReregisterOverrides(cfg.ReregisterOverrides); err != nil {
+		return nil, fmt.Errorf("reregister overrides: %w", err)
+	}
+	if err := s.reloadQuotas(); err != nil {
+		return nil, fmt.Errorf("quotas: %w", err)
+	}
+	if err := s.reloadScarLimits(); err != nil {
+		return nil, fmt.Errorf("scar limits: %w", err)
+	}
+	if err := s.reloadACL(); err != nil {
+		return nil, fmt.Errorf("acl: %w", err)
+	}
+	if cfg.ScarStoreBytes > 0 {
+		s.scars = newScarStore(cfg.ScarStoreBytes)
+	}
+	if s.health.thresholds, err = parseHealthThresholds(cfg.HealthThresholds); err != nil {
+		return nil, fmt.Errorf("health thresholds: %w", err)
+	}
+	s.health.prev = healthSample{at: s.start}
+	s.health.cur = s.health.prev
+	var weights map[string]int
+	if cfg.FairWorkers > 0 {
+		var err error
+		if weights, err = parseFairWeights(cfg.FairWeights); err != nil {
+			return nil, fmt.Errorf("fair weights: %w", err)
+		}
+	}
+	if cfg.AuditLogPath != "" {
+		// An ephemeral key would sign entries no later start could check.
+		if cfg.ServerKeyPath == "" {
+			return nil, errors.New("audit log: -server-key is required to sign its entries")
+		}
+		a, err := openAuditLog(cfg.AuditLogPath, cfg.AuditMaxBytes, s.key)
+		if err != nil {
+			return nil, fmt.Errorf("open audit log: %w", err)
+		}
+		s.audit = a
+		if a.torn > 0 {
+			s.log.Printf("Audit log: dropped a torn last entry (%d bytes)", a.torn)
+		}
+		s.log.Printf("Audit log: %s", cfg.AuditLogPath)
+	}
+
+	// Nothing below may fail once goroutines are running except the
+	// listeners, which close everything started so far.
+	if err := s.startFederation(); err != nil {
+		s.close()
+		return nil, fmt.Errorf("federation: %w", err)
+	}
+	if cfg.MetricsAddr != "" {
+		if err := s.startMetrics(cfg.MetricsAddr); err != nil {
+			s.close()
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+	}
+	if cfg.AdminAddr != "" {
+		if err := s.startAdmin(cfg.AdminAddr); err != nil {
+			s.close()
+			return nil, fmt.Errorf("admin: %w", err)
+		}
+	}
+	if cfg.FairWorkers > 0 {
+		s.fair = newFairQueue(weights, cfg.FairDefaultWeight)
+		s.fair.start(cfg.FairWorkers)
+		s.log.Printf("Fair queue: %d workers", cfg.FairWorkers)
+	}
+	if cfg.VerifyWorkers > 0 {
+		s.verifier = newVerifyPool(cfg.VerifyWorkers)
+		s.log.Printf("Signature verification: %d workers", cfg.VerifyWorkers)
+	}
+	go s.heartbeat()
+	go s.runSchedule()
+	if cfg.HandlerLeakThreshold > 0 {
+		go s.watchHandlers()
+	}
+	return s, nil
+}
+
+// Serve accepts protocol connections on l and handles each on its own
+// goroutine until l is closed or Shutdown is called, when it returns
+// ErrServerClosed. Frames from a Unix socket listener are capped by
+// -unix-read-cap and all others by -read-cap, and likewise unsigned packets
+// are accepted from it only with -unix-require-signature=false and from the
+// others only with -require-signature=false. With -proxy-protocol, TCP
+// connections must open with a PROXY header (see proxyproto.go).
+func (s *Server) Serve(l net.Listener) error {
+	opts := listenerOpts{readCap: s.cfg.ReadCap, proxy: s.cfg.ProxyProtocol, trusted: !s.cfg.RequireSignature}
+	if l.Addr().Network() == "unix" {
+		opts.readCap = s.cfg.UnixReadCap
+		opts.proxy = false
+		opts.trusted = !s.cfg.UnixRequireSignature
+	}
+	return s.serve(l, opts)
+}
+
+// ServeJSON is Serve for a debugging listener whose clients send and receive
+// one JSON packet per line instead of protobuf frames (see jsonmode.go).
+// Packets are handled exactly as from Serve, signatures included.
+func (s *Server) ServeJSON(l net.Listener) error {
+	return s.serve(l, listenerOpts{json: true})
+}
+
+// serve is Serve with explicit listener options.
+func (s *Server) serve(l net.Listener, opts listenerOpts) error {
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	s.accepting.Add(1)
+	defer s.accepting.Add(-1)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+		s.tuneConn(conn)
+		if !s.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+		s.liveHandlers.Add(1)
+		go func() {
+			defer s.liveHandlers.Add(-1)
+			defer s.untrackConn(conn)
+			c := conn
+			if opts.proxy {
+				var err error
+				if c, err = s.acceptProxy(conn); err != nil {
+					s.proxyRejected.Add(1)
+					s.log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+			}
+			if !s.handshake(c) {
+				c.Close()
+				return
+			}
+			s.handleConnection(c, opts)
+		}()
+	}
+}
+
+// Shutdown stops the server. Readiness fails at once; after -shutdown-delay
+// (cut short if ctx ends) the listeners close and registered agents are sent
+// a goodbye. Connections still open after -drain-timeout (or when ctx ends)
+// are closed. Shutdown returns once the connection handlers have exited, or
+// with ctx's error if ctx ends first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.shuttingDown.Swap(true) {
+		return nil
+	}
+	if d := s.cfg.ShutdownDelay; d > 0 {
+		// Keep serving while /readyz turns orchestrators away.
+		s.log.Printf("Draining for %v", d)
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		t.Stop()
+	}
+	s.stopAccepting()
+	s.sayGoodbye()
+
+	exited := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(exited)
+	}()
+	// Agents that got a goodbye hang up on their own; give them
+	// -drain-timeout to, then close what's left, which unblocks the reads
+	// of their handlers.
+	drain := time.NewTimer(s.cfg.DrainTimeout)
+	select {
+	case <-exited:
+	case <-drain.C:
+	case <-ctx.Done():
+	}
+	drain.Stop()
+	if n := s.closeConns(); n > 0 {
+		s.log.Printf("Forced %d connections closed after draining", n)
+	}
+
+	var err error
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if s.fair != nil {
+		s.fair.stop()
+	}
+	if s.verifier != nil {
+		s.verifier.stop()
+	}
+	s.close()
+	return err
+}
+
+// closeConns closes every connection that still has a handler and returns
+// how many there were.
+func (s *Server) closeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return len(s.conns)
+}
+
+// close releases what New opened: it stops accepting and closes the audit
+// log. New calls it when a later step fails, and Shutdown once the
+// connections have drained.
+func (s *Server) close() {
+	s.stopAccepting()
+	s.audit.Close()
+}
+
+// stopAccepting closes every listener (protocol, federation, and metrics)
+// and the links to federation peers, and ends the background loops.
+func (s *Server) stopAccepting() {
+	s.mu.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.done)
+		for l := range s.listeners {
+			l.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	s.fedMu.RLock()
+	for _, link := range s.peers {
+		link.Close()
+	}
+	s.fedMu.RUnlock()
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// track adds l to the listeners Shutdown closes, or reports false, closing
+// l, if the server is already closing.
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		l.Close()
+		return false
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+}
+
+// trackConn registers a connection handler, or reports false if the server
+// is closing. Adding to handlers under mu, before closing is set, keeps every
+// Add ahead of Shutdown's Wait.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = true
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
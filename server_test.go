@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestTwoServersIndependent(t *testing.T) {
+	t.Parallel()
+	servers := make([]*Server, 2)
+	addrs := make([]string, 2)
+	for i := range servers {
+		servers[i], addrs[i] = startServer(t, func(c *Config) {
+			c.DrainTimeout = 0 // the agents never hang up
+		})
+	}
+
+	// The same identities register on both servers; each routes only
+	// between its own agents.
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		sink := dialAgent(t, addr, "bot:sink")
+		sink.call(&Packet{Dst: "server"})
+		src := dialAgent(t, addr, "bot:source")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				body := strconv.Itoa(i) + ":" + strconv.Itoa(n)
+				src.send(&Packet{Dst: "bot:sink", Body: body})
+				if got := sink.recv(); got.Body != body {
+					t.Errorf("server %d: sink got %q, want %q", i, got.Body, body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, s := range servers {
+		if got := s.routedPackets.Load(); got != 50 {
+			t.Errorf("server %d routed %d packets, want 50", i, got)
+		}
+	}
+
+	// Shutting one down leaves the other serving.
+	if err := servers[0].Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if registered(servers[0], "bot:sink") {
+		t.Error("agent still registered on the stopped server")
+	}
+	a := dialAgent(t, addrs[1], "bot:after")
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Errorf("second server after the first stopped: got %q", resp.Body)
+	}
+}
+
+// TestServersIsolated runs several servers in parallel, each routing a
+// different number of packets between its own agents, and checks that no
+// counter, routing table entry, or log line crosses over.
+func TestServersIsolated(t *testing.T) {
+	t.Parallel()
+	const n = 4
+	for i := 0; i < n; i++ {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+			s, addr := startServer(t)
+			logs := captureLog(t, s)
+
+			// Every server hosts bot:shared; the rest are its own.
+			sink := dialAgent(t, addr, "bot:shared")
+			sink.call(&Packet{Dst: "server"})
+			own := fmt.Sprintf("bot:only-%d", i)
+			src := dialAgent(t, addr, own)
+			src.call(&Packet{Dst: "server"})
+
+			packets := 10 * (i + 1)
+			for k := 0; k < packets; k++ {
+				body := fmt.Sprintf("%d:%d", i, k)
+				src.send(&Packet{Dst: "bot:shared", Body: body})
+				if got := sink.recv(); got.Body != body {
+					t.Fatalf("sink got %q, want %q", got.Body, body)
+				}
+			}
+
+			if got := s.routedPackets.Load(); got != int64(packets) {
+				t.Errorf("routed %d packets, want %d", got, packets)
+			}
+			// Two registrations plus the routed packets.
+			if got := s.totalPackets.Load(); got != int64(packets+2) {
+				t.Errorf("total packets %d, want %d", got, packets+2)
+			}
+			s.routeMu.RLock()
+			var ids []string
+			for id := range s.agents {
+				ids = append(ids, id)
+			}
+			s.routeMu.RUnlock()
+			if len(ids) != 2 || !registered(s, "bot:shared") || !registered(s, own) {
+				t.Errorf("routing table %v, want bot:shared and %s", ids, own)
+			}
+			for j := 0; j < n; j++ {
+				other := fmt.Sprintf("bot:only-%d", j)
+				if j != i && strings.Contains(logs.String(), other) {
+					t.Errorf("log mentions %s from another server", other)
+				}
+			}
+		})
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(l) }()
+	waitFor(t, "listener", func() bool { return s.accepting.Load() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+	if err := s.Serve(l); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve after Shutdown = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestShutdownForcesStubbornConnections(t *testing.T) {
+	t.Parallel()
+	s, addr := startServer(t, func(c *Config) {
+		c.DrainTimeout = 300 * time.Millisecond
+	})
+	logs := captureLog(t, s)
+	polite := dialAgent(t, addr, "bot:polite")
+	polite.call(&Packet{Dst: "server"})
+	stubborn := dialAgent(t, addr, "bot:stubborn")
+	stubborn.call(&Packet{Dst: "server"})
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	// One hangs up on its goodbye; the other ignores it.
+	for _, a := range []*testAgent{polite, stubborn} {
+		if p := a.recv(); p.Typ != TypeGoodbye {
+			t.Fatalf("%s got typ %d, want goodbye", a.src, p.Typ)
+		}
+	}
+	polite.conn.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the drain timeout")
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("Shutdown returned after %v, before the drain timeout", d)
+	}
+	stubborn.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := wire.ReadFrame(stubborn.conn); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("stubborn connection: read %v, want it closed", err)
+	}
+	if !strings.Contains(logs.String(), "Forced 1 connections closed after draining") {
+		t.Errorf("forced close not logged:\n%s", logs)
+	}
+}
+
+func TestShutdownDrainEndsWhenAgentsHangUp(t *testing.T) {
+	t.Parallel()
+	s, addr := startServer(t) // the default 10s drain
+	logs := captureLog(t, s)
+	a := dialAgent(t, addr, "bot:leaving")
+	a.call(&Packet{Dst: "server"})
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	if p := a.recv(); p.Typ != TypeGoodbye {
+		t.Fatalf("got typ %d, want goodbye", p.Typ)
+	}
+	a.conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Shutdown took %v with every agent gone", d)
+	}
+	if strings.Contains(logs.String(), "Forced") {
+		t.Errorf("connections forced closed:\n%s", logs)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// The server only verifies secp256k1, so these packets were signed ahead of
+// time, with the test signer in package wire, by the key secpPK.
+var (
+	secpPK   = mustHex("0331f059a1a3d2c6ad4b4f3b86747ba3fcbb78e5bf365819ad1aa3fbc58a63598a")
+	secpSigs = map[string]string{ // by id and body
+		"k1":         "aaa7c809a76f45f61c1f94021d282baca55bc8cec3a17f96052dd44e53f174df5491790bbb4aa386ef979111e545334b1a95bfa9cca95c5dba303aa890e1ffdc",
+		"from secp":  "5fa7d5a4fe213d915fcee09b9d818bb4bdb4c8a732a7f9c4f8df046bcc0a82c90f133f60ecf36e6371a7974e149f7c74feab6b6284ad4e4756f164f38f06420e",
+		"secp as ed": "d735dfd3dafaa9b8f33e55ea08a45e093084061283e3d2db8756732c87d83d35639b3299f385d7cfe1d4e58170d2ada37350b650081df4ddeb8d48559cf9a011",
+	}
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// secpSigned gives p, which must be one of the packets in secpSigs, its
+// secp256k1 signature.
+func secpSigned(t *testing.T, p *Packet) *Packet {
+	t.Helper()
+	sig, ok := secpSigs[p.Id+p.Body]
+	if !ok {
+		t.Fatalf("no secp256k1 signature for %q", p.Id+p.Body)
+	}
+	p.Alg, p.Sig, p.Pk = wire.AlgSecp256k1, mustHex(sig), secpPK
+	return p
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) { c.VerifyWorkers = 2 })
+	sink := dialAgent(t, addr, "bot:alg-sink")
+	sink.call(&Packet{Dst: "server"})
+
+	a := dialAgent(t, addr, "bot:alg-secp")
+	p := secpSigned(t, &Packet{Id: "k1", Src: a.src, Dst: "server"})
+	if err := wire.WritePacket(a.conn, p); err != nil {
+		t.Fatal(err)
+	}
+	if resp := a.recv(); status(resp) != "done" {
+		t.Fatalf("secp256k1 packet: got %q, want done", resp.Body)
+	}
+	p = secpSigned(t, &Packet{Src: a.src, Dst: "bot:alg-sink", Body: "from secp"})
+	wire.WritePacket(a.conn, p)
+	if got := sink.recv(); got.Body != "from secp" || got.Alg != wire.AlgSecp256k1 || wire.Verify(got) != nil {
+		t.Fatalf("sink got %v, want the secp256k1-signed packet intact", got)
+	}
+
+	// ed25519 is the default whether alg is empty or named.
+	e := dialAgent(t, addr, "bot:alg-ed")
+	if resp := e.call(&Packet{Id: "e1", Dst: "server", Alg: wire.AlgEd25519}); status(resp) != "done" {
+		t.Fatalf("explicit ed25519: got %q", resp.Body)
+	}
+
+	// A signature or key for one algorithm under the other's name, an
+	// unknown algorithm, and an alg changed after signing are all dropped.
+	mismatched := e.sign(&Packet{Dst: "bot:alg-sink", Body: "ed as secp"})
+	mismatched.Alg = wire.AlgSecp256k1
+	swapped := secpSigned(t, &Packet{Src: a.src, Dst: "bot:alg-sink", Body: "secp as ed"})
+	swapped.Alg = wire.AlgEd25519
+	unknown := e.sign(&Packet{Dst: "bot:alg-sink", Body: "rsa", Alg: "rsa"})
+	for _, p := range []*Packet{mismatched, swapped, unknown} {
+		if wire.Verify(p) == nil {
+			t.Errorf("%q verified", p.Body)
+		}
+	}
+	wire.WritePacket(e.conn, mismatched)
+	wire.WritePacket(a.conn, swapped)
+	wire.WritePacket(e.conn, unknown)
+	expectNothing(t, sink)
+}
+
+func TestSecp256k1NeedsPoolAndRate(t *testing.T) {
+	k1 := func() *Packet { return secpSigned(t, &Packet{Id: "k1", Src: "bot:alg-secp", Dst: "server"}) }
+
+	// Without the verify pool secp256k1 isn't offered or checked.
+	s, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:alg-secp")
+	if info := discoverJSON(t, s, "info"); fmt.Sprint(info["sig_algs"]) != "[ed25519]" {
+		t.Errorf("sig_algs without -verify-workers = %v", info["sig_algs"])
+	}
+	wire.WritePacket(a.conn, k1())
+	expectNothing(t, a)
+	if n := s.secpRefused.Load(); n != 1 {
+		t.Errorf("keep_secp256k1_refused_total = %d, want 1", n)
+	}
+
+	// With it, at most -secp256k1-rate a second are verified.
+	s, addr = startServer(t, func(c *Config) { c.VerifyWorkers = 1; c.Secp256k1Rate = 1 })
+	a = dialAgent(t, addr, "bot:alg-secp")
+	if info := discoverJSON(t, s, "info"); fmt.Sprint(info["sig_algs"]) != "[ed25519 secp256k1]" {
+		t.Errorf("sig_algs with -verify-workers = %v", info["sig_algs"])
+	}
+	s.secpMu.Lock()
+	s.secpWindow = time.Now().Add(time.Hour) // hold the window open
+	s.secpMu.Unlock()
+	wire.WritePacket(a.conn, k1())
+	if resp := a.recv(); status(resp) != "done" {
+		t.Fatalf("first secp256k1 packet: got %q", resp.Body)
+	}
+	wire.WritePacket(a.conn, k1())
+	expectNothing(t, a)
+	if n := s.secpRefused.Load(); n != 1 {
+		t.Errorf("keep_secp256k1_refused_total = %d, want 1", n)
+	}
+}
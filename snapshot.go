@@ -0,0 +1,100 @@
+package main
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// routingSnapshot is the live routing state served at /admin/snapshot, for
+// capturing the topology during an incident.
+type routingSnapshot struct {
+	Time        time.Time          `json:"time"`
+	ServerID    string             `json:"server_id"`
+	Connections int                `json:"connections"` // open, registered or not
+	Identities  []identitySnapshot `json:"identities"`
+	PeerRoutes  map[string]string  `json:"peer_routes,omitempty"` // identity -> hosting peer
+}
+
+// identitySnapshot is one identity held by one connection. An identity
+// shared under -reregister allow-both appears once per connection, all but
+// the one receiving its routes marked standby. The counters are the
+// connection's, so identities sharing one connection show the same numbers.
+type identitySnapshot struct {
+	Identity   string    `json:"identity"`
+	Addr       string    `json:"addr"`
+	Connected  time.Time `json:"connected"`
+	PublicKey  string    `json:"pk"`
+	Standby    bool      `json:"standby,omitempty"`
+	PacketsIn  int64     `json:"packets_in"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	SlowWrites int64     `json:"slow_writes,omitempty"`
+}
+
+// snapshot captures the routing table. The tables are copied under their
+// read locks, which routing only contends with briefly; the counters are
+// read and everything is formatted after the locks are released.
+func (s *Server) snapshot() routingSnapshot {
+	type held struct {
+		identity string
+		ci       *connInfo
+		pk       []byte
+		standby  bool
+	}
+	s.routeMu.RLock()
+	var all []held
+	for ci, ids := range s.connSrc {
+		for identity, pk := range ids {
+			all = append(all, held{identity, ci, pk, s.agents[identity] != ci})
+		}
+	}
+	s.routeMu.RUnlock()
+
+	s.fedMu.RLock()
+	var peerRoutes map[string]string
+	if len(s.peerRoutes) > 0 {
+		peerRoutes = make(map[string]string, len(s.peerRoutes))
+		for identity, link := range s.peerRoutes {
+			peerRoutes[identity] = link.name
+		}
+	}
+	s.fedMu.RUnlock()
+
+	s.mu.Lock()
+	conns := len(s.conns)
+	s.mu.Unlock()
+
+	snap := routingSnapshot{
+		Time:        time.Now().UTC(),
+		ServerID:    s.cfg.ServerID,
+		Connections: conns,
+		Identities:  make([]identitySnapshot, 0, len(all)),
+		PeerRoutes:  peerRoutes,
+	}
+	for _, h := range all {
+		snap.Identities = append(snap.Identities, identitySnapshot{
+			Identity:   h.identity,
+			Addr:       h.ci.addr,
+			Connected:  h.ci.connected.UTC(),
+			PublicKey:  hex.EncodeToString(h.pk),
+			Standby:    h.standby,
+			PacketsIn:  h.ci.packetsIn.Load(),
+			BytesIn:    h.ci.bytesIn.Load(),
+			BytesOut:   h.ci.bytesOut.Load(),
+			SlowWrites: h.ci.slowWrites.Load(),
+		})
+	}
+	slices.SortFunc(snap.Identities, func(a, b identitySnapshot) int {
+		return cmp.Or(cmp.Compare(a.Identity, b.Identity), a.Connected.Compare(b.Connected))
+	})
+	return snap
+}
+
+func (s *Server) adminSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshot())
+}
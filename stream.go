@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Two agents that exchange a lot of traffic with each other can pin the pair
+// into a stream. Each sends a packet to "stream:<the other's identity>": the
+// first offer is forwarded to its target so it knows to answer, and the
+// matching counter-offer pairs the two connections. Both offers are then
+// answered with {"status":"streaming","peer":...}.
+//
+// From then on every packet either connection sends goes straight to the
+// other, skipping routing, quotas, the audit log, and per-packet logging.
+// Signatures are still verified, and src and pk must be the streaming
+// identity and the key it registered with, unless -stream-skip-verify
+// trusts the pair after the offers were verified.
+// When either connection closes, the other is closed too.
+//
+// Packets a client sends before it reads the streaming answer may still be
+// routed normally.
+
+// stream is one side of a paired connection.
+type stream struct {
+	src  string    // identity this side streams as
+	pk   []byte    // key src is registered under
+	peer *connInfo // the other side
+}
+
+// streamOffer is an unanswered request from c, as src, to stream with a
+// target identity.
+type streamOffer struct {
+	c *connInfo
+	p *Packet
+}
+
+// streamReply is the body that tells each side its stream is open.
+type streamReply struct {
+	Status string `json:"status"` // always "streaming"
+	Peer   string `json:"peer"`
+}
+
+// handleStreamOffer answers a stream:<target> packet from c: it pairs c with
+// target if target has already offered to stream with p.Src, and otherwise
+// records the offer and forwards it to target.
+func (s *Server) handleStreamOffer(c *connInfo, p *Packet) error {
+	target := strings.TrimPrefix(p.Dst, "stream:")
+	if target == "" || target == p.Src {
+		return reply(c, p, "error:invalid_stream")
+	}
+	// A stream carries packets from p.Src to target, so the ACL must allow
+	// that route whether this offer opens the stream or accepts one.
+	if !s.routeAllowed(p.Src, target) {
+		s.aclDenied.Add(1)
+		s.log.Printf("REJECTED error:forbidden from %s (src=%s dst=%s): stream denied by ACL", c.addr, p.Src, target)
+		return reply(c, p, "error:forbidden")
+	}
+
+	s.streamsMu.Lock()
+	offer, ok := s.streamOffers[[2]string{target, p.Src}]
+	if ok && s.lookupAgent(target) == offer.c && offer.c.stream.Load() == nil {
+		delete(s.streamOffers, [2]string{target, p.Src})
+		c.stream.Store(&stream{src: p.Src, pk: p.Pk, peer: offer.c})
+		offer.c.stream.Store(&stream{src: target, pk: offer.p.Pk, peer: c})
+		s.streamsMu.Unlock()
+
+		s.log.Printf("Streaming %s <-> %s", target, p.Src)
+		s.streams.Add(1)
+		mine, _ := json.Marshal(streamReply{Status: "streaming", Peer: target})
+		theirs, _ := json.Marshal(streamReply{Status: "streaming", Peer: p.Src})
+		if err := reply(offer.c, offer.p, string(theirs)); err != nil {
+			s.log.Printf("Write error to %s: %v", offer.c.addr, err)
+		}
+		return reply(c, p, string(mine))
+	}
+
+	to := s.lookupAgent(target)
+	if to == nil {
+		s.streamsMu.Unlock()
+		s.offlinePackets.Add(1)
+		return reply(c, p, "error:offline")
+	}
+	s.streamOffers[[2]string{p.Src, target}] = streamOffer{c: c, p: p}
+	s.streamsMu.Unlock()
+
+	if err := s.forward(to, p); errors.Is(err, errDstTooLarge) {
+		s.dropStreamOffers(c)
+		return s.rejectDstTooLarge(c, p, target)
+	} else if err != nil {
+		s.dropStreamOffers(c)
+		s.log.Printf("Stream offer %s -> %s: delivery failed: %v", p.Src, target, err)
+		return reply(c, p, "error:delivery_failed")
+	}
+	return nil
+}
+
+// dropStreamOffers forgets the offers c has made.
+func (s *Server) dropStreamOffers(c *connInfo) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	for k, o := range s.streamOffers {
+		if o.c == c {
+			delete(s.streamOffers, k)
+		}
+	}
+}
+
+// endStream tears down c's side when its connection closes: its offers are
+// dropped and, if it was streaming, its peer is closed.
+func (s *Server) endStream(c *connInfo) {
+	s.dropStreamOffers(c)
+	if st := c.stream.Load(); st != nil {
+		s.log.Printf("Stream %s -> %s closed", st.src, st.peer.addr)
+		st.peer.Close()
+	}
+}
+
+// pipeStream passes p, read from a streaming connection c, to its peer. A
+// packet that fails verification is dropped. An error means the peer could
+// not be written and the stream is over.
+func (s *Server) pipeStream(c *connInfo, st *stream, p *Packet) error {
+	if !s.cfg.StreamSkipVerify {
+		err := fmt.Errorf("not signed by %s", st.src)
+		if p.Src == st.src && bytes.Equal(p.Pk, st.pk) {
+			err = s.verify(p)
+		}
+		if err != nil {
+			s.log.Printf("DROPPED stream packet from %s (src=%s): %v", c.addr, p.Src, err)
+			s.droppedInvalidSig.Add(1)
+			return nil
+		}
+	}
+	if err := st.peer.send(p); err != nil {
+		s.log.Printf("Stream %s -> %s: %v", st.src, st.peer.addr, err)
+		return err
+	}
+	s.streamedPackets.Add(1)
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+	"google.golang.org/protobuf/proto"
+)
+
+// pairStream registers two agents on addr and streams them together.
+func pairStream(t *testing.T, addr string) (a, b *testAgent) {
+	t.Helper()
+	a = dialAgent(t, addr, "bot:stream-a")
+	b = dialAgent(t, addr, "bot:stream-b")
+	a.call(&Packet{Dst: "server"})
+	b.call(&Packet{Dst: "server"})
+
+	a.send(&Packet{Id: "offer", Dst: "stream:bot:stream-b"})
+	if got := b.recv(); got.Dst != "stream:bot:stream-b" || got.Src != "bot:stream-a" {
+		t.Fatalf("target got %v, want the forwarded offer", got)
+	}
+	for _, tc := range []struct {
+		resp *Packet
+		id   string
+		peer string
+	}{
+		{b.call(&Packet{Id: "accept", Dst: "stream:bot:stream-a"}), "accept", "bot:stream-a"},
+		{a.recv(), "offer", "bot:stream-b"},
+	} {
+		var got streamReply
+		if err := json.Unmarshal([]byte(tc.resp.Body), &got); err != nil || tc.resp.Id != tc.id ||
+			got != (streamReply{Status: "streaming", Peer: tc.peer}) {
+			t.Fatalf("got %q (id %q), want streaming with %s", tc.resp.Body, tc.resp.Id, tc.peer)
+		}
+	}
+	return a, b
+}
+
+func TestStreamPipesBothWays(t *testing.T) {
+	s, addr := startServer(t)
+	a, b := pairStream(t, addr)
+
+	before := s.streamedPackets.Load()
+	for i := 0; i < 3; i++ {
+		// dst no longer matters: everything goes to the peer
+		a.send(&Packet{Dst: "server", Body: "to b"})
+		if got := b.recv(); got.Body != "to b" || got.Src != "bot:stream-a" || wire.Verify(got) != nil {
+			t.Fatalf("b got %v", got)
+		}
+		b.send(&Packet{Dst: "bot:anyone", Body: "to a"})
+		if got := a.recv(); got.Body != "to a" || got.Src != "bot:stream-b" {
+			t.Fatalf("a got %v", got)
+		}
+	}
+	if got := s.streamedPackets.Load(); got != before+6 {
+		t.Errorf("streamed %d packets, want %d", got-before, 6)
+	}
+
+	// Each packet is still checked against the streaming identity and the
+	// key it registered with.
+	a.send(&Packet{Src: "bot:someone-else", Body: "forged"})
+	rekeyed := &testAgent{t: t, conn: a.conn, src: a.src}
+	_, rekeyed.priv, _ = ed25519.GenerateKey(nil)
+	rekeyed.send(&Packet{Body: "another key"})
+	bad := a.sign(&Packet{Body: "tampered"})
+	bad.Body = "changed"
+	data, _ := proto.Marshal(bad)
+	wire.WriteFrame(a.conn, data)
+	expectNothing(t, b)
+}
+
+func TestStreamSkipVerify(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.StreamSkipVerify = true
+	})
+	addr := serveLoopback(t, s)
+	a, b := pairStream(t, addr)
+
+	data, _ := proto.Marshal(&Packet{Src: "bot:stream-a", Body: "unsigned"})
+	wire.WriteFrame(a.conn, data)
+	if got := b.recv(); got.Body != "unsigned" {
+		t.Fatalf("b got %v", got)
+	}
+}
+
+func TestStreamTearsDown(t *testing.T) {
+	for _, closer := range []string{"a", "b"} {
+		t.Run(closer+" closes", func(t *testing.T) {
+			s, addr := startServer(t)
+			a, b := pairStream(t, addr)
+			gone, other := a, b
+			if closer == "b" {
+				gone, other = b, a
+			}
+			gone.conn.Close()
+
+			other.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := wire.ReadFrame(other.conn); err != io.EOF {
+				t.Fatalf("peer read: got %v, want EOF", err)
+			}
+			waitFor(t, "both identities to unregister", func() bool {
+				return s.lookupAgent("bot:stream-a") == nil && s.lookupAgent("bot:stream-b") == nil
+			})
+		})
+	}
+}
+
+func TestStreamOfferErrors(t *testing.T) {
+	_, addr := startServer(t)
+	a := dialAgent(t, addr, "bot:lonely")
+	a.call(&Packet{Dst: "server"})
+
+	for dst, want := range map[string]string{
+		"stream:bot:nobody": "error:offline",
+		"stream:":           "error:invalid_stream",
+		"stream:bot:lonely": "error:invalid_stream",
+	} {
+		if resp := a.call(&Packet{Id: "s", Dst: dst}); resp.Body != want || resp.Id != "s" {
+			t.Errorf("%s: got %q (id %q), want %q", dst, resp.Body, resp.Id, want)
+		}
+	}
+
+	// An unanswered offer leaves both sides routing normally.
+	b := dialAgent(t, addr, "bot:busy")
+	b.call(&Packet{Dst: "server"})
+	a.send(&Packet{Dst: "stream:bot:busy"})
+	b.recv()
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Errorf("after offer: got %q, want done", resp.Body)
+	}
+}
+
+func TestStreamOfferACL(t *testing.T) {
+	s := newTestServer(t)
+	addr := serveLoopback(t, s)
+	useACL(t, s, `{"rules": [{"src": "bot:stream-a", "dst": "bot:stream-b", "action": "deny"}]}`)
+	a := dialAgent(t, addr, "bot:stream-a")
+	b := dialAgent(t, addr, "bot:stream-b")
+	a.call(&Packet{Dst: "server"})
+	b.call(&Packet{Dst: "server"})
+
+	// A denied offer is neither forwarded nor recorded.
+	if resp := a.call(&Packet{Id: "offer", Dst: "stream:bot:stream-b"}); resp.Body != "error:forbidden" || resp.Id != "offer" {
+		t.Fatalf("denied offer: got %q (id %q), want error:forbidden", resp.Body, resp.Id)
+	}
+	expectNothing(t, b)
+
+	// b may offer, but a can't accept: the stream would carry a to b.
+	b.send(&Packet{Dst: "stream:bot:stream-a"})
+	if got := a.recv(); got.Dst != "stream:bot:stream-a" {
+		t.Fatalf("allowed offer: a got %v", got)
+	}
+	if resp := a.call(&Packet{Dst: "stream:bot:stream-b"}); resp.Body != "error:forbidden" {
+		t.Fatalf("denied accept: got %q, want error:forbidden", resp.Body)
+	}
+	expectNothing(t, b)
+	if s.lookupAgent("bot:stream-a").stream.Load() != nil {
+		t.Fatal("denied accept opened a stream")
+	}
+	if n := s.aclDenied.Load(); n != 2 {
+		t.Errorf("aclDenied = %d, want 2", n)
+	}
+}
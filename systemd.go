@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service; see sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// systemdListener returns the protocol listener systemd passed in with the
+// LISTEN_FDS protocol, or nil if the process was not socket-activated, in
+// which case the caller listens as usual. It takes exactly one socket, which
+// must already be listening; the unit's ListenStream= decides the address,
+// so -listen, -reuseport and -listen-backlog don't apply. The LISTEN_*
+// variables are cleared so child processes don't inherit them.
+func systemdListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil // not activated, or the sockets were meant for another process
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS=%q is not a positive count", fds)
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets; want 1, for the protocol listener", n)
+	}
+	return listenerFromFD(sdListenFDsStart)
+}
+
+// listenerFromFD makes a listener from an inherited file descriptor, which
+// must be a listening socket.
+func listenerFromFD(fd int) (net.Listener, error) {
+	if err := checkListening(fd); err != nil {
+		return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(fd), "systemd-socket")
+	defer f.Close() // FileListener works on a dup
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+	}
+	return l, nil
+}
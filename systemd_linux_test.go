@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestSystemdSocketActivation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	l.Close() // the child holds its own copy
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	addr := l.Addr().String()
+
+	// As systemd would: the socket as fd 3 and LISTEN_PID naming the
+	// server's own pid, which the shell keeps by exec'ing it. -listen
+	// points somewhere else to show it is ignored.
+	cmd := exec.Command("sh", "-c", `LISTEN_PID=$$ LISTEN_FDS=1 exec "$0" -listen 127.0.0.1:1`, os.Args[0])
+	cmd.Env = append(os.Environ(), "KEEP_TEST_SERVER=1")
+	cmd.ExtraFiles = []*os.File{f}
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	a := dialAgent(t, addr, "bot:activated")
+	if resp := a.call(&Packet{Dst: "server"}); status(resp) != "done" {
+		t.Fatalf("got %q", resp.Body)
+	}
+}
+
+func TestInheritedFDMustBeListening(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := c.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range map[string]*os.File{"connected socket": conn, "regular file": file} {
+		if l, err := listenerFromFD(int(f.Fd())); err == nil {
+			l.Close()
+			t.Errorf("%s accepted as a listener", name)
+		}
+	}
+}
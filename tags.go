@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tags carry application tracing context, such as a trace or span id, end
+// to end. They are signed like every other field, so a relay can't alter
+// them, and are bounded by -max-tags and -max-tag-bytes. The server only
+// reads the keys named in -log-tags, which it adds to its receipt and route
+// log lines and to audit entries.
+
+// checkTags enforces the tag count and size limits, returning
+// "error:tags_too_large" for an oversize set or "" if p is within policy.
+func (s *Server) checkTags(p *Packet) string {
+	if s.cfg.MaxTags > 0 && len(p.Tags) > s.cfg.MaxTags {
+		return "error:tags_too_large"
+	}
+	if s.cfg.MaxTagBytes > 0 {
+		n := 0
+		for k, v := range p.Tags {
+			n += len(k) + len(v)
+		}
+		if n > s.cfg.MaxTagBytes {
+			return "error:tags_too_large"
+		}
+	}
+	return ""
+}
+
+// loggedTags returns the tags of p named in -log-tags, or nil if it has none.
+func (s *Server) loggedTags(p *Packet) map[string]string {
+	if len(p.Tags) == 0 {
+		return nil
+	}
+	var out map[string]string
+	for _, k := range s.cfg.LogTags {
+		if v, ok := p.Tags[k]; ok {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// tagFields renders the logged tags of p as ` key="value"` pairs in -log-tags
+// order, for appending to a log line.
+func (s *Server) tagFields(p *Packet) string {
+	if len(p.Tags) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, k := range s.cfg.LogTags {
+		if v, ok := p.Tags[k]; ok {
+			fmt.Fprintf(&b, " %s=%q", k, v)
+		}
+	}
+	return b.String()
+}
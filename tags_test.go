@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestTagsRoundTrip(t *testing.T) {
+	_, addr := startServer(t)
+	to := dialAgent(t, addr, "bot:traced-to")
+	to.call(&Packet{Dst: "server"})
+	from := dialAgent(t, addr, "bot:traced-from")
+
+	tags := map[string]string{"trace_id": "4bf92f35", "span_id": "00f067aa", "tenant": "acme"}
+	from.send(&Packet{Dst: "bot:traced-to", Body: "hi", Tags: tags})
+	got := to.recv()
+	if wire.Verify(got) != nil {
+		t.Fatal("tagged packet no longer verifies")
+	}
+	if len(got.Tags) != len(tags) {
+		t.Fatalf("got tags %v, want %v", got.Tags, tags)
+	}
+	for k, v := range tags {
+		if got.Tags[k] != v {
+			t.Errorf("tag %s = %q, want %q", k, got.Tags[k], v)
+		}
+	}
+
+	// The tags are signed: changing one breaks the signature.
+	got.Tags["tenant"] = "other"
+	if wire.Verify(got) == nil {
+		t.Error("signature still verifies after a tag was changed")
+	}
+}
+
+func TestTagsLoggedAndAudited(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.LogTags = []string{"trace_id", "span_id"}
+	})
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	if s.audit, err = openAuditLog(path, 0, s.key); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.audit.Close(); s.audit = nil }()
+	addr := serveLoopback(t, s)
+	logs := captureLog(t, s)
+
+	a := dialAgent(t, addr, "bot:traced")
+	a.call(&Packet{Dst: "server", Body: "tagged", Tags: map[string]string{"trace_id": "4bf92f35", "secret": "x"}})
+	if !strings.Contains(logs.String(), `-> server trace_id="4bf92f35"`) {
+		t.Errorf("trace_id missing from receipt line:\n%s", logs)
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("unselected tag logged:\n%s", logs)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var tagged []map[string]string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Tags != nil {
+			tagged = append(tagged, e.Tags)
+		}
+	}
+	if len(tagged) != 1 || len(tagged[0]) != 1 || tagged[0]["trace_id"] != "4bf92f35" {
+		t.Errorf("audit tags = %v, want one entry with only trace_id", tagged)
+	}
+	if _, err := verifyAuditLog(s.key.Public().(ed25519.PublicKey), path); err != nil {
+		t.Errorf("audit chain with tags: %v", err)
+	}
+}
+
+func TestTagLimits(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) {
+		c.MaxTags = 2
+		c.MaxTagBytes = 16
+	})
+
+	a := dialAgent(t, addr, "bot:tagger")
+	cases := []struct {
+		tags map[string]string
+		want string
+	}{
+		{tags: map[string]string{"a": "1", "b": "2"}, want: "done"},
+		{tags: map[string]string{"a": "1", "b": "2", "c": "3"}, want: "error:tags_too_large"},
+		{tags: map[string]string{"trace": "123456789ab"}, want: "done"},
+		{tags: map[string]string{"trace": "123456789abc"}, want: "error:tags_too_large"},
+	}
+	for _, tc := range cases {
+		resp := a.call(&Packet{Id: "x", Dst: "server", Tags: tc.tags})
+		if status(resp) != tc.want || resp.Id != "x" {
+			t.Errorf("tags %v: got %q (id %q), want %q", tc.tags, resp.Body, resp.Id, tc.want)
+		}
+	}
+}
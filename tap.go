@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// tapBuffer is how many log records a discover:tail subscriber may fall
+// behind by before records are dropped.
+const tapBuffer = 256
+
+// tapRecord is one packet to a tap subscriber: a log line, or the count of
+// lines dropped since the last one it was sent.
+type tapRecord struct {
+	Time    time.Time `json:"time"`
+	Line    string    `json:"line,omitempty"`
+	Dropped int       `json:"dropped,omitempty"`
+}
+
+// logTap is one discover:tail subscription.
+type logTap struct {
+	c       *connInfo
+	req     *Packet // the subscription, whose id and channel records echo
+	records chan tapRecord
+	pending int           // guarded by tapsMu; lines dropped and not yet reported
+	done    chan struct{} // closed when the subscription ends
+}
+
+// tapWriter is the output of the server's logger. It writes each line to
+// the configured logger and copies it to the discover:tail subscribers.
+type tapWriter struct {
+	s   *Server
+	out *log.Logger
+}
+
+func (w tapWriter) Write(b []byte) (int, error) {
+	line := string(b)
+	w.out.Print(line)
+	if w.s.tapCount.Load() > 0 {
+		w.s.publishTap(strings.TrimSuffix(line, "\n"))
+	}
+	return len(b), nil
+}
+
+// publishTap hands line to every tap without blocking. A tap whose buffer is
+// full loses the line; the loss is reported, as a dropped count, ahead of the
+// next line it has room for.
+func (s *Server) publishTap(line string) {
+	now := time.Now()
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	for _, t := range s.taps {
+		if t.pending > 0 {
+			select {
+			case t.records <- tapRecord{Time: now, Dropped: t.pending}:
+				t.pending = 0
+			default:
+				t.pending++
+				continue
+			}
+		}
+		select {
+		case t.records <- tapRecord{Time: now, Line: line}:
+		default:
+			t.pending++
+		}
+	}
+}
+
+// startTap subscribes c to the server's log, as requested by p. A connection
+// has at most one tap; asking again changes nothing.
+func (s *Server) startTap(c *connInfo, p *Packet) {
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	if _, ok := s.taps[c]; ok {
+		return
+	}
+	t := &logTap{c: c, req: p, records: make(chan tapRecord, tapBuffer), done: make(chan struct{})}
+	s.taps[c] = t
+	s.tapCount.Add(1)
+	go s.runTap(t)
+}
+
+// stopTap ends c's subscription, if any.
+func (s *Server) stopTap(c *connInfo) {
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	if t, ok := s.taps[c]; ok {
+		delete(s.taps, c)
+		s.tapCount.Add(-1)
+		close(t.done)
+	}
+}
+
+// runTap writes t's records to its connection until the subscription ends or
+// a write fails.
+func (s *Server) runTap(t *logTap) {
+	for {
+		var rec tapRecord
+		select {
+		case rec = <-t.records:
+		case <-t.done:
+			return
+		}
+		data, _ := json.Marshal(rec)
+		p := &Packet{Id: t.req.Id, Typ: TypeReply, Src: s.cfg.ReplySrc, Body: string(data), Channel: t.req.Channel}
+		t.c.signReply(p)
+		if err := t.c.send(p); err != nil {
+			s.stopTap(t.c)
+			return
+		}
+	}
+}
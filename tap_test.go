@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverTail(t *testing.T) {
+	s, addr := startServer(t)
+	logs := captureLog(t, s)
+	admin := dialAgent(t, addr, "bot:tap-admin")
+	s.cfg.AdminKeys = []string{hex.EncodeToString(admin.priv.Public().(ed25519.PublicKey))}
+
+	other := dialAgent(t, addr, "bot:tap-other")
+	if resp := other.call(&Packet{Dst: "discover:tail"}); resp.Body != "error:forbidden" {
+		t.Fatalf("non-admin got %q", resp.Body)
+	}
+	if resp := admin.call(&Packet{Id: "t1", Dst: "discover:tail", Channel: "ops"}); !strings.Contains(resp.Body, `"tail":"subscribed"`) {
+		t.Fatalf("subscribe: got %q", resp.Body)
+	}
+
+	// Routing between two other connections shows up on the tap.
+	a := dialAgent(t, addr, "bot:tap-a")
+	b := dialAgent(t, addr, "bot:tap-b")
+	b.call(&Packet{Dst: "server"})
+	a.send(&Packet{Dst: "bot:tap-b", Body: "watched"})
+	b.recv()
+
+	for want := "Routed bot:tap-a -> bot:tap-b"; ; {
+		p := admin.recv()
+		if p.Id != "t1" || p.Channel != "ops" {
+			t.Fatalf("record %q has id %q channel %q, want the subscription's", p.Body, p.Id, p.Channel)
+		}
+		var rec tapRecord
+		if err := json.Unmarshal([]byte(p.Body), &rec); err != nil {
+			t.Fatalf("decode %q: %v", p.Body, err)
+		}
+		if strings.Contains(rec.Line, want) {
+			break
+		}
+	}
+	if !strings.Contains(logs.String(), "Routed bot:tap-a -> bot:tap-b") {
+		t.Error("tapped line missing from the server log")
+	}
+
+	// Disconnecting ends the subscription.
+	admin.conn.Close()
+	waitFor(t, "tap to stop", func() bool { return s.tapCount.Load() == 0 })
+}
+
+func TestTapDropsWhenBehind(t *testing.T) {
+	s := newTestServer(t)
+	tap := &logTap{records: make(chan tapRecord, tapBuffer)}
+	s.taps[nil] = tap
+	s.tapCount.Add(1)
+
+	for i := range tapBuffer + 3 {
+		s.publishTap(fmt.Sprint("line ", i))
+	}
+	for i := range tapBuffer {
+		if rec := <-tap.records; rec.Line != fmt.Sprint("line ", i) {
+			t.Fatalf("record %d = %+v", i, rec)
+		}
+	}
+	s.publishTap("caught up")
+	if rec := <-tap.records; rec.Dropped != 3 || rec.Line != "" {
+		t.Fatalf("got %+v, want a gap of 3", rec)
+	}
+	if rec := <-tap.records; rec.Line != "caught up" {
+		t.Fatalf("got %+v after the gap", rec)
+	}
+	if len(tap.records) != 0 || tap.pending != 0 {
+		t.Errorf("%d records queued, %d pending after catching up", len(tap.records), tap.pending)
+	}
+}
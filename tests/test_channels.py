@@ -0,0 +1,96 @@
+#!/usr/bin/env python3
+"""Tests for logical channels multiplexed over one persistent connection.
+
+Unit tests use a socketpair in place of the server; no server required.
+
+Usage:
+    pytest tests/test_channels.py -v
+"""
+
+import socket
+import sys
+from pathlib import Path
+
+# Add the Python SDK to path
+sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
+
+from keep import keep_pb2
+from keep.client import KeepClient
+
+
+def _pair_client():
+    """Return a client whose persistent socket is one end of a socketpair."""
+    ours, theirs = socket.socketpair()
+    client = KeepClient(src="bot:channel-test")
+    client._sock = ours
+    return client, theirs
+
+
+def _push(server, body, channel=""):
+    p = keep_pb2.Packet(typ=0, src="bot:peer", dst="bot:channel-test", body=body, channel=channel)
+    KeepClient._send_framed(server, p.SerializeToString())
+
+
+class TestChannels:
+    def test_send_tags_packets_with_channel(self):
+        client, server = _pair_client()
+        client.channel("orders").send("buy", dst="bot:peer")
+        client.channel("chat").send("hi", dst="bot:peer")
+
+        first = KeepClient._read_packet(server)
+        second = KeepClient._read_packet(server)
+        assert (first.channel, first.body) == ("orders", "buy")
+        assert (second.channel, second.body) == ("chat", "hi")
+        server.close()
+
+    def test_listen_demultiplexes_two_channels_on_one_socket(self):
+        client, server = _pair_client()
+        orders, chat, other = [], [], []
+        client.channel("orders", orders.append)
+        client.channel("chat", chat.append)
+
+        _push(server, "o1", "orders")
+        _push(server, "c1", "chat")
+        _push(server, "plain")
+        _push(server, "o2", "orders")
+        _push(server, "x", "unclaimed")
+        server.close()
+
+        client.listen(other.append, timeout=2)
+        assert [p.body for p in orders] == ["o1", "o2"]
+        assert [p.body for p in chat] == ["c1"]
+        assert [p.body for p in other] == ["plain", "x"]
+
+    def test_reply_wait_dispatches_other_channels(self):
+        client, server = _pair_client()
+        chat = []
+        client.channel("chat", chat.append)
+
+        # Chat traffic arrives before the server's reply on "orders".
+        _push(server, "c1", "chat")
+        reply = keep_pb2.Packet(typ=1, src="server", body="done", channel="orders")
+        KeepClient._send_framed(server, reply.SerializeToString())
+
+        resp = client.channel("orders").send("ping")
+        assert (resp.body, resp.channel) == ("done", "orders")
+        assert [p.body for p in chat] == ["c1"]
+        assert KeepClient._read_packet(server).channel == "orders"
+        server.close()
+
+    def test_without_channels_behaviour_is_unchanged(self):
+        client, server = _pair_client()
+        _push(server, "plain")
+        resp = client.send("ping")
+        assert resp.body == "plain"
+        assert KeepClient._read_packet(server).channel == ""
+        server.close()
+
+    def test_channel_is_reused_and_named(self):
+        client = KeepClient()
+        assert client.channel("a") is client.channel("a")
+        try:
+            client.channel("")
+        except ValueError:
+            pass
+        else:
+            raise AssertionError("empty channel name accepted")
@@ -0,0 +1,54 @@
+#!/usr/bin/env python3
+"""Tests for handling server directives (typ=6) in listen().
+
+Unit tests use a socketpair in place of the server; no server required.
+
+Usage:
+    pytest tests/test_directive.py -v
+"""
+
+import json
+import socket
+import sys
+from pathlib import Path
+
+# Add the Python SDK to path
+sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
+
+from keep import keep_pb2
+from keep.client import TYP_DIRECTIVE, KeepClient
+
+
+def _pair_client():
+    """Return a client whose persistent socket is one end of a socketpair."""
+    ours, theirs = socket.socketpair()
+    client = KeepClient(src="bot:directive-test")
+    client._sock = ours
+    return client, theirs
+
+
+def _push(server, body):
+    d = keep_pb2.Packet(typ=TYP_DIRECTIVE, src="server", body=json.dumps(body))
+    KeepClient._send_framed(server, d.SerializeToString())
+
+
+class TestDirectives:
+    def test_listen_hands_directives_to_on_directive(self):
+        client, server = _pair_client()
+        directives, received = [], []
+        client.on_directive = directives.append
+        _push(server, {"directive": "throttle", "args": {"rate": 5}, "seq": 1})
+        server.close()
+
+        client.listen(received.append, timeout=2)
+        assert directives == [{"directive": "throttle", "args": {"rate": 5}, "seq": 1}]
+        assert received == []
+
+    def test_without_on_directive_the_callback_gets_them(self):
+        client, server = _pair_client()
+        received = []
+        _push(server, {"directive": "rotate_key", "seq": 1})
+        server.close()
+
+        client.listen(received.append, timeout=2)
+        assert [p.typ for p in received] == [TYP_DIRECTIVE]
@@ -23,7 +23,7 @@ import pytest
 # Add the Python SDK to path
 sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
 
-from keep.client import KeepClient
+from keep.client import KeepClient, is_ack
 
 
 class TestIsPortOpen:
@@ -246,7 +246,7 @@ class TestEnsureServerIntegration:
             # Verify we can connect
             client = KeepClient()
             reply = client.send("ping")
-            assert reply.body == "done"
+            assert is_ack(reply)
         finally:
             # Cleanup
             subprocess.run(
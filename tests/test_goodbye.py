@@ -0,0 +1,73 @@
+#!/usr/bin/env python3
+"""Tests for the goodbye (typ=3) clean-disconnect helpers.
+
+Unit tests use a socketpair in place of the server; no server required.
+
+Usage:
+    pytest tests/test_goodbye.py -v
+"""
+
+import socket
+import sys
+from pathlib import Path
+
+# Add the Python SDK to path
+sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
+
+from keep import keep_pb2
+from keep.client import TYP_GOODBYE, KeepClient
+
+
+def _pair_client():
+    """Return a client whose persistent socket is one end of a socketpair."""
+    ours, theirs = socket.socketpair()
+    client = KeepClient(src="bot:goodbye-test")
+    client._sock = ours
+    return client, theirs
+
+
+class TestGoodbye:
+    def test_goodbye_sends_signed_typ3_and_disconnects(self):
+        client, server = _pair_client()
+        client.goodbye()
+
+        p = KeepClient._read_packet(server)
+        assert p.typ == TYP_GOODBYE
+        assert p.src == "bot:goodbye-test"
+        assert len(p.sig) == 64 and len(p.pk) == 32
+        assert client._sock is None
+        server.close()
+
+    def test_goodbye_without_connection_is_noop(self):
+        client = KeepClient()
+        client.goodbye()
+        assert client._sock is None
+
+    def test_context_manager_exit_says_goodbye(self):
+        client, server = _pair_client()
+        client.__exit__(None, None, None)
+
+        p = KeepClient._read_packet(server)
+        assert p.typ == TYP_GOODBYE
+        server.close()
+
+    def test_listen_stops_on_server_goodbye(self):
+        client, server = _pair_client()
+        bye = keep_pb2.Packet(typ=TYP_GOODBYE, src="server")
+        KeepClient._send_framed(server, bye.SerializeToString())
+
+        received = []
+        client.listen(received.append, timeout=2)
+        assert received == []
+        assert client._sock is None
+        server.close()
+
+    def test_listen_records_close_reason(self):
+        client, server = _pair_client()
+        bye = keep_pb2.Packet(typ=TYP_GOODBYE, src="server", body="kicked")
+        KeepClient._send_framed(server, bye.SerializeToString())
+
+        client.listen(lambda p: None, timeout=2)
+        assert client.close_reason == "kicked"
+        assert client._sock is None
+        server.close()
@@ -0,0 +1,59 @@
+#!/usr/bin/env python3
+"""Tests for new_id(), the SDK's packet id generator.
+
+No server required.
+
+Usage:
+    pytest tests/test_ids.py -v
+"""
+
+import sys
+import threading
+import time
+import uuid
+from pathlib import Path
+
+# Add the Python SDK to path
+sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
+
+from keep import keep_pb2, new_id
+from keep.client import KeepClient
+
+
+class TestNewId:
+    def test_uuid_v7(self):
+        u = uuid.UUID(new_id())
+        assert u.version == 7
+        assert u.variant == uuid.RFC_4122
+        # The leading 48 bits are the creation time in milliseconds.
+        assert abs((u.int >> 80) - time.time_ns() // 1_000_000) < 5000
+
+    def test_unique_across_threads(self):
+        ids = []
+        lock = threading.Lock()
+
+        def mint():
+            batch = [new_id() for _ in range(2000)]
+            with lock:
+                ids.extend(batch)
+
+        threads = [threading.Thread(target=mint) for _ in range(8)]
+        for t in threads:
+            t.start()
+        for t in threads:
+            t.join()
+        assert len(ids) == 16000
+        assert len(set(ids)) == len(ids)
+
+    def test_sorted_by_creation_time(self):
+        seq = []
+        for _ in range(3):
+            seq.append(new_id())
+            time.sleep(0.002)
+        assert seq == sorted(seq)
+
+    def test_signed_packets_get_an_id(self):
+        client = KeepClient(src="bot:ids")
+        p = keep_pb2.Packet()
+        p.ParseFromString(client._sign_packet("hi"))
+        assert uuid.UUID(p.id).version == 7
@@ -21,7 +21,7 @@ from pathlib import Path
 # Add the Python SDK to path
 sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
 
-from keep.client import KeepClient
+from keep.client import KeepClient, is_ack
 
 # Test configuration
 HOST = os.environ.get("KEEP_HOST", "localhost")
@@ -57,7 +57,7 @@ def main():
     try:
         client = KeepClient(HOST, PORT, timeout=5.0)
         reply = client.send(body="ping", dst="server")
-        if reply.body != "done":
+        if not is_ack(reply):
             print(f"\n{FAIL} Server not responding correctly (got: {reply.body})")
             return 1
     except Exception as e:
@@ -282,7 +282,7 @@ def main():
         scar_client = KeepClient(HOST, PORT, src="bot:kp10-scar-test")
         reply = scar_client.send(body="scar test", dst="server", scar=test_scar)
 
-        if test("Scar packet accepted (reply=done)", reply.body == "done"):
+        if test("Scar packet accepted (reply=done)", is_ack(reply)):
             results["passed"] += 1
         else:
             results["failed"] += 1
@@ -317,10 +317,11 @@ def main():
     try:
         bad_response = client.discover("invalid_type_xyz")
 
-        # Should return error:unknown_discovery
+        # Should return {"error": "unknown_discovery", "query": ...}
         if test("Unknown type returns error",
-                bad_response == "error:unknown_discovery" or
-                (isinstance(bad_response, dict) and "error" in str(bad_response))):
+                isinstance(bad_response, dict) and
+                bad_response.get("error") == "unknown_discovery" and
+                bad_response.get("query") == "invalid_type_xyz"):
             results["passed"] += 1
         else:
             print(f"        Got: {bad_response}")
@@ -0,0 +1,58 @@
+#!/usr/bin/env python3
+"""Tests for acknowledgements from a server run with -reply-src.
+
+Unit tests use a socketpair in place of the server; no server required.
+
+Usage:
+    pytest tests/test_reply_src.py -v
+"""
+
+import socket
+import sys
+from pathlib import Path
+
+# Add the Python SDK to path
+sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
+
+from keep import keep_pb2
+from keep.client import TYP_GOODBYE, TYP_REPLY, KeepClient, is_ack
+
+ACK = '{"status":"done","id":"x","ts":1,"registered":true}'
+
+
+class TestIsAck:
+    def test_default_server_src(self):
+        assert is_ack(keep_pb2.Packet(typ=TYP_REPLY, src="server", body=ACK))
+        assert not is_ack(keep_pb2.Packet(typ=TYP_REPLY, src="keepd", body=ACK))
+
+    def test_configured_server_src(self):
+        reply = keep_pb2.Packet(typ=TYP_REPLY, src="keepd", body=ACK)
+        assert is_ack(reply, server_src="keepd")
+        assert KeepClient(server_src="keepd").is_ack(reply)
+        # An agent posing as the server by name is not it.
+        assert not KeepClient(server_src="keepd").is_ack(
+            keep_pb2.Packet(typ=TYP_REPLY, src="server", body=ACK)
+        )
+
+    def test_discover_learns_server_src(self):
+        client = KeepClient()
+        info = keep_pb2.Packet(typ=TYP_REPLY, src="keepd", body='{"version":"x"}')
+        client.send = lambda **kwargs: info
+        assert client.discover("info") == {"version": "x"}
+        assert client.server_src == "keepd"
+        assert client.is_ack(keep_pb2.Packet(typ=TYP_REPLY, src="keepd", body="done"))
+
+    def test_listen_takes_goodbye_from_server_src_only(self):
+        ours, theirs = socket.socketpair()
+        client = KeepClient(src="bot:reply-src-test", server_src="keepd")
+        client._sock = ours
+        forged = keep_pb2.Packet(typ=TYP_GOODBYE, src="server", body="kicked")
+        bye = keep_pb2.Packet(typ=TYP_GOODBYE, src="keepd", body="shutdown")
+        KeepClient._send_framed(theirs, forged.SerializeToString())
+        KeepClient._send_framed(theirs, bye.SerializeToString())
+
+        received = []
+        client.listen(received.append, timeout=2)
+        assert [p.body for p in received] == ["kicked"]
+        assert client.close_reason == "shutdown"
+        theirs.close()
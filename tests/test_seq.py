@@ -0,0 +1,36 @@
+#!/usr/bin/env python3
+"""Tests for tracking the server's per-connection sequence numbers.
+
+Unit tests use a socketpair in place of the server; no server required.
+
+Usage:
+    pytest tests/test_seq.py -v
+"""
+
+import socket
+import sys
+from pathlib import Path
+
+# Add the Python SDK to path
+sys.path.insert(0, str(Path(__file__).parent.parent / "python"))
+
+from keep import keep_pb2
+from keep.client import TYP_GOODBYE, KeepClient
+
+
+def test_listen_counts_skipped_sequence_numbers():
+    ours, server = socket.socketpair()
+    client = KeepClient(src="bot:seq-test")
+    client._sock = ours
+    for seq in (1, 2, 5, 6):
+        p = keep_pb2.Packet(src="bot:peer", body=str(seq), seq=seq)
+        KeepClient._send_framed(server, p.SerializeToString())
+    bye = keep_pb2.Packet(typ=TYP_GOODBYE, src="server", seq=7)
+    KeepClient._send_framed(server, bye.SerializeToString())
+
+    received = []
+    client.listen(received.append, timeout=2)
+    assert [p.body for p in received] == ["1", "2", "5", "6"]
+    assert client.last_seq == 7
+    assert client.missed == 2
+    server.close()
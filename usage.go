@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MaxUsageEntries bounds the per-identity usage table, as MaxScarEntries does
+// for scar counts: once full, only identities already present accumulate.
+const MaxUsageEntries = 10000
+
+// identityUsage is cumulative wire bytes (length prefix included) for one
+// identity, from the identity's side: Sent is what it wrote to the server,
+// Received is what the server wrote to it. SlowWrites counts writes to it
+// that took longer than -slow-write-threshold.
+type identityUsage struct {
+	Sent       int64 `json:"sent"`
+	Received   int64 `json:"received"`
+	SlowWrites int64 `json:"slow_writes,omitempty"`
+}
+
+// foldUsage adds a closed connection's byte counters to the total of the
+// identity it was last registered as.
+func (s *Server) foldUsage(identity string, c *connInfo) {
+	if identity == "" {
+		return
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	u, exists := s.usage[identity]
+	if !exists && len(s.usage) >= MaxUsageEntries {
+		return
+	}
+	u.Sent += c.bytesIn.Load()
+	u.Received += c.bytesOut.Load()
+	u.SlowWrites += c.slowWrites.Load()
+	s.usage[identity] = u
+}
+
+// usageSnapshot returns per-identity totals, including the bytes of
+// connections that are still open.
+func (s *Server) usageSnapshot() map[string]identityUsage {
+	out := make(map[string]identityUsage)
+	s.usageMu.Lock()
+	for identity, u := range s.usage {
+		out[identity] = u
+	}
+	s.usageMu.Unlock()
+
+	s.routeMu.RLock()
+	for c := range s.connSrc {
+		id := c.usageName()
+		u := out[id]
+		u.Sent += c.bytesIn.Load()
+		u.Received += c.bytesOut.Load()
+		u.SlowWrites += c.slowWrites.Load()
+		out[id] = u
+	}
+	s.routeMu.RUnlock()
+	return out
+}
+
+// writeUsageMetrics renders per-identity byte counters for /metrics.
+func (s *Server) writeUsageMetrics(w io.Writer) {
+	snap := s.usageSnapshot()
+	ids := make([]string, 0, len(snap))
+	for identity := range snap {
+		ids = append(ids, identity)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintln(w, "# HELP keep_identity_bytes_total Framed bytes exchanged with each identity, by direction as seen by the identity.")
+	fmt.Fprintln(w, "# TYPE keep_identity_bytes_total counter")
+	for _, identity := range ids {
+		u := snap[identity]
+		fmt.Fprintf(w, "keep_identity_bytes_total{identity=%q,direction=\"sent\"} %d\n", identity, u.Sent)
+		fmt.Fprintf(w, "keep_identity_bytes_total{identity=%q,direction=\"received\"} %d\n", identity, u.Received)
+	}
+
+	fmt.Fprintln(w, "# HELP keep_slow_writes_total Writes to each identity that took longer than -slow-write-threshold.")
+	fmt.Fprintln(w, "# TYPE keep_slow_writes_total counter")
+	for _, identity := range ids {
+		if n := snap[identity].SlowWrites; n > 0 {
+			fmt.Fprintf(w, "keep_slow_writes_total{identity=%q} %d\n", identity, n)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// countingConn counts the bytes a test client puts on and takes off the wire.
+type countingConn struct {
+	net.Conn
+	in, out atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+func countingAgent(t *testing.T, addr, src string) (*testAgent, *countingConn) {
+	a := dialAgent(t, addr, src)
+	cc := &countingConn{Conn: a.conn}
+	a.conn = cc
+	return a, cc
+}
+
+func TestUsageMatchesFramedBytes(t *testing.T) {
+	s, addr := startServer(t)
+
+	a, ca := countingAgent(t, addr, "bot:usage-a")
+	b, cb := countingAgent(t, addr, "bot:usage-b")
+	a.call(&Packet{Dst: "server", Body: "hello"})
+	b.call(&Packet{Dst: "server"})
+	a.send(&Packet{Dst: "bot:usage-b", Body: strings.Repeat("x", 300), Scar: []byte("memo")})
+	b.recv()
+	a.call(&Packet{Dst: "bot:nobody"})
+
+	// Live connection: the query is counted before the reply is built.
+	resp := b.call(&Packet{Dst: "discover:usage", Body: "bot:usage-b"})
+	var got struct{ Usage map[string]identityUsage }
+	if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := proto.Marshal(resp)
+	replyLen := int64(4 + len(raw))
+	if want := (identityUsage{Sent: cb.out.Load(), Received: cb.in.Load() - replyLen}); got.Usage["bot:usage-b"] != want || len(got.Usage) != 1 {
+		t.Errorf("live usage = %+v, want only bot:usage-b %+v", got.Usage, want)
+	}
+
+	// Closed connection: its counters fold into the identity's total.
+	a.send(&Packet{Typ: TypeGoodbye})
+	want := identityUsage{Sent: ca.out.Load(), Received: ca.in.Load()}
+	waitFor(t, "bot:usage-a usage to be folded", func() bool {
+		return !registered(s, "bot:usage-a") && s.usageSnapshot()["bot:usage-a"] == want
+	})
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	line := fmt.Sprintf(`keep_identity_bytes_total{identity="bot:usage-a",direction="sent"} %d`, want.Sent)
+	if !strings.Contains(rec.Body.String(), line) {
+		t.Errorf("metrics missing %s", line)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+// Signature verification is most of the CPU a packet costs. By default each
+// connection's handler verifies its own packets, so with thousands of busy
+// connections thousands of goroutines contend for the cores at once. With
+// -verify-workers set, handlers hand their packets to a fixed pool of that
+// many verifiers instead and wait for the verdict. A handler has one packet
+// out at a time, so its packets are still verified, and routed, in the order
+// they arrived; the pool only bounds how many are verified at once.
+//
+// secp256k1 is verified on math/big (see wire/secp256k1.go), at some fifty
+// times the CPU of ed25519 (BenchmarkVerifyAlg), and anyone can send
+// signatures before registering. So it is accepted only on the pool, where
+// it can't take more cores than -verify-workers, and at most -secp256k1-rate
+// times a second across the server; the rest are dropped as invalid.
+
+// verifyQueueSize is how many packets may wait for a verifier, per worker,
+// before handlers block handing them over.
+const verifyQueueSize = 64
+
+type verifyJob struct {
+	p      *Packet
+	result chan<- error
+}
+
+// verifyPool runs wire.Verify on a fixed number of goroutines.
+type verifyPool struct {
+	jobs chan verifyJob
+	quit chan struct{}
+}
+
+// newVerifyPool starts n verifiers, which run until stop is called.
+func newVerifyPool(n int) *verifyPool {
+	q := &verifyPool{
+		jobs: make(chan verifyJob, n*verifyQueueSize),
+		quit: make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				select {
+				case j := <-q.jobs:
+					j.result <- wire.Verify(j.p)
+				case <-q.quit:
+					return
+				}
+			}
+		}()
+	}
+	return q
+}
+
+// stop makes the verifiers exit. Later calls to verify check inline.
+func (q *verifyPool) stop() {
+	close(q.quit)
+}
+
+// verify checks p's signature on a verifier, returning wire.Verify's error.
+func (q *verifyPool) verify(p *Packet) error {
+	result := make(chan error, 1)
+	select {
+	case q.jobs <- verifyJob{p, result}:
+	case <-q.quit:
+		return wire.Verify(p)
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-q.quit: // the job may have been dropped with the verifiers
+		return wire.Verify(p)
+	}
+}
+
+// errSecp256k1Refused is verify's error for a secp256k1 signature refused
+// by allowSecp256k1.
+var errSecp256k1Refused = errors.New("secp256k1 refused: no verify pool or over -secp256k1-rate")
+
+// allowSecp256k1 counts a secp256k1 verification against -secp256k1-rate and
+// reports whether it may go ahead. Without the verify pool it never may.
+func (s *Server) allowSecp256k1(now time.Time) bool {
+	if s.verifier == nil || s.cfg.Secp256k1Rate <= 0 {
+		s.secpRefused.Add(1)
+		return false
+	}
+	s.secpMu.Lock()
+	defer s.secpMu.Unlock()
+	if now.Sub(s.secpWindow) >= time.Second {
+		s.secpWindow, s.secpCount = now, 0
+	}
+	if s.secpCount >= s.cfg.Secp256k1Rate {
+		s.secpRefused.Add(1)
+		return false
+	}
+	s.secpCount++
+	return true
+}
+
+// sigAlgs lists the signature algorithms this server accepts, for
+// discover:info.
+func (s *Server) sigAlgs() []string {
+	if s.verifier == nil || s.cfg.Secp256k1Rate <= 0 {
+		return []string{wire.AlgEd25519}
+	}
+	return wire.SigAlgs
+}
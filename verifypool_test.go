@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/teacrawford/keep-protocol/wire"
+)
+
+func TestVerifyWorkersKeepOrder(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) { c.VerifyWorkers = 2 })
+	sink := dialAgent(t, addr, "bot:verify-sink")
+	sink.call(&Packet{Dst: "server"})
+	senders := make([]*testAgent, 4)
+	for i := range senders {
+		senders[i] = dialAgent(t, addr, fmt.Sprintf("bot:verify-%d", i))
+		senders[i].call(&Packet{Dst: "server"})
+	}
+
+	// Each sender's packets arrive in the order it sent them, and a forged
+	// one among them is still dropped.
+	const n = 50
+	for _, a := range senders {
+		go func() {
+			for i := 0; i < n; i++ {
+				a.send(&Packet{Dst: "bot:verify-sink", Body: strconv.Itoa(i)})
+				if i == n/2 {
+					forged := a.sign(&Packet{Dst: "bot:verify-sink", Body: "forged"})
+					forged.Body = "tampered"
+					wire.WritePacket(a.conn, forged)
+				}
+			}
+		}()
+	}
+	next := make(map[string]int)
+	for i := 0; i < n*len(senders); i++ {
+		p := sink.recv()
+		if want := strconv.Itoa(next[p.Src]); p.Body != want {
+			t.Fatalf("from %s got %q, want %q", p.Src, p.Body, want)
+		}
+		next[p.Src]++
+	}
+	expectNothing(t, sink)
+}
+
+// BenchmarkVerify verifies packets from many goroutines at once, as many
+// connection handlers would, inline and through verifier pools.
+func BenchmarkVerify(b *testing.B) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	p := &Packet{Src: "bot:bench", Dst: "bot:other", Body: "hello"}
+	if err := wire.Sign(p, priv); err != nil {
+		b.Fatal(err)
+	}
+	const conns = 1000
+	procs := runtime.GOMAXPROCS(0)
+	for _, workers := range []int{0, procs, 4 * procs} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			verify := wire.Verify
+			if workers > 0 {
+				q := newVerifyPool(workers)
+				defer q.stop()
+				verify = q.verify
+			}
+			b.SetParallelism(max(1, conns/procs))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if verify(p) != nil {
+						b.Error("valid signature rejected")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestVerifyWorkersCheckStreams(t *testing.T) {
+	_, addr := startServer(t, func(c *Config) { c.VerifyWorkers = 2 })
+	a, b := pairStream(t, addr)
+
+	forged := a.sign(&Packet{Body: "forged"})
+	forged.Body = "tampered"
+	wire.WritePacket(a.conn, forged)
+	a.send(&Packet{Body: "signed"})
+	if got := b.recv(); got.Body != "signed" {
+		t.Fatalf("b got %q, want only the signed packet", got.Body)
+	}
+}
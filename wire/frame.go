@@ -0,0 +1,120 @@
+// Package wire is the keep protocol as both server binaries speak it: the
+// Packet message generated from keep.proto, its length-prefixed framing on a
+// stream, and packet signatures. Anything about what a packet looks like on
+// the wire or how its signature is checked belongs here, so a fix reaches
+// every binary that serves the protocol.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxPacketSize is the largest frame payload either side may send.
+const MaxPacketSize = 65536
+
+// ErrPacketTooLarge reports a frame over MaxPacketSize.
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// ErrReadCap reports a frame over the cap passed to ReadFrameCapped, such as
+// a listener's -read-cap, which may be well under MaxPacketSize.
+var ErrReadCap = errors.New("packet exceeds read cap")
+
+// ErrMalformedFrame reports a frame that was read whole but could not be
+// decoded into a packet.
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// ReadPacket reads a length-prefixed protobuf Packet from r.
+// Wire format: [4 bytes big-endian uint32 length][length bytes protobuf].
+func ReadPacket(r io.Reader) (*Packet, error) {
+	payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalPacket(payload)
+}
+
+// ReadFrame reads one length-prefixed frame from r and returns its payload.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	return ReadFrameCapped(r, 0)
+}
+
+// ReadFrameCapped is ReadFrame for a listener that accepts frames of at most
+// readCap bytes; readCap <= 0 leaves only the MaxPacketSize limit.
+func ReadFrameCapped(r io.Reader, readCap int) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint32(lenBuf[:])
+
+	if msgLen == 0 {
+		return nil, fmt.Errorf("zero-length packet")
+	}
+	if msgLen > MaxPacketSize {
+		return nil, fmt.Errorf("%w: %d > %d", ErrPacketTooLarge, msgLen, MaxPacketSize)
+	}
+	if readCap > 0 && msgLen > uint32(readCap) {
+		return nil, fmt.Errorf("%w: %d > %d", ErrReadCap, msgLen, readCap)
+	}
+
+	payload := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// UnmarshalPacket decodes a frame payload into a Packet.
+func UnmarshalPacket(payload []byte) (*Packet, error) {
+	var p Packet
+	if err := proto.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("%w: unmarshal: %w", ErrMalformedFrame, err)
+	}
+	return &p, nil
+}
+
+// WritePacket serializes a Packet with a 4-byte big-endian length prefix and writes it to w.
+func WritePacket(w io.Writer, p *Packet) error {
+	data, err := proto.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return WriteFrame(w, data)
+}
+
+// WriteFrame writes data to w with a 4-byte big-endian length prefix, in a
+// single Write so a failure can't strand a prefix without its payload
+// between two calls. A short write is an error like any other: part of the
+// frame may be on the wire, and the caller must not write to w again.
+func WriteFrame(w io.Writer, data []byte) error {
+	frame, err := FrameBytes(data)
+	if err != nil {
+		return err
+	}
+	return WriteWhole(w, frame)
+}
+
+// FrameBytes returns data with its 4-byte big-endian length prefix.
+func FrameBytes(data []byte) ([]byte, error) {
+	if len(data) > MaxPacketSize {
+		return nil, fmt.Errorf("%w: %d > %d", ErrPacketTooLarge, len(data), MaxPacketSize)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame, nil
+}
+
+// WriteWhole writes b in one call, reporting a short write as an error.
+func WriteWhole(w io.Writer, b []byte) error {
+	n, err := w.Write(b)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
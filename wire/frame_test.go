@@ -0,0 +1,92 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// frame returns a length prefix of n followed by payload.
+func frame(n uint32, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, n)
+	return append(b, payload...)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	p := &Packet{Typ: uint32(PacketType_PACKET_TYPE_REPLY), Id: "r1", Src: "server", Dst: "bot:a", Body: "done", Tags: map[string]string{"trace": "t1"}}
+	var buf bytes.Buffer
+	if err := WritePacket(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(buf.Bytes()); int(n) != buf.Len()-4 {
+		t.Fatalf("prefix %d for a %d-byte payload", n, buf.Len()-4)
+	}
+	got, err := ReadPacket(&buf)
+	if err != nil || !proto.Equal(got, p) {
+		t.Fatalf("read back %v, %v; want %v", got, err, p)
+	}
+	if _, err := ReadPacket(&buf); err != io.EOF {
+		t.Fatalf("at end of stream: got %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      []byte
+		readCap int
+		want    error
+	}{
+		{"zero length", frame(0, nil), 0, nil},
+		{"over MaxPacketSize", frame(MaxPacketSize+1, nil), 0, ErrPacketTooLarge},
+		{"over the read cap", frame(101, make([]byte, 101)), 100, ErrReadCap},
+		{"truncated prefix", []byte{0, 0}, 0, io.ErrUnexpectedEOF},
+		{"truncated payload", frame(10, []byte("short")), 0, io.ErrUnexpectedEOF},
+	} {
+		_, err := ReadFrameCapped(bytes.NewReader(tc.in), tc.readCap)
+		if err == nil || tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// A frame at the cap is read whole.
+	payload, err := ReadFrameCapped(bytes.NewReader(frame(100, make([]byte, 100))), 100)
+	if err != nil || len(payload) != 100 {
+		t.Fatalf("at the cap: %d bytes, %v", len(payload), err)
+	}
+
+	// A whole frame that is not a Packet is malformed, not a stream error.
+	if _, err := ReadPacket(bytes.NewReader(frame(2, []byte{0xff, 0xff}))); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("garbage payload: got %v, want ErrMalformedFrame", err)
+	}
+}
+
+// shortWriter accepts at most n bytes per Write without an error.
+type shortWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	return w.Buffer.Write(b[:min(len(b), w.n)])
+}
+
+func TestWriteFrameErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, make([]byte, MaxPacketSize+1)); !errors.Is(err, ErrPacketTooLarge) || buf.Len() != 0 {
+		t.Fatalf("oversized frame: got %v with %d bytes written", err, buf.Len())
+	}
+	if err := WriteFrame(&buf, make([]byte, MaxPacketSize)); err != nil {
+		t.Fatalf("frame at MaxPacketSize: %v", err)
+	}
+
+	// The whole frame goes in one Write, and a short one is an error.
+	w := &shortWriter{n: 6}
+	if err := WriteFrame(w, []byte("payload")); err != io.ErrShortWrite {
+		t.Fatalf("short write: got %v, want io.ErrShortWrite", err)
+	}
+}
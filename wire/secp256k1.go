@@ -0,0 +1,217 @@
+package wire
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// secp256k1 is the curve y² = x³ + 7 over the prime field p, with generator
+// (gx, gy) of prime order n. The standard library has no implementation and
+// the project takes no crypto dependencies beyond ed25519, so verification
+// is done here with math/big. Only public data is involved, so it need not
+// be constant time.
+var secp256k1 = struct {
+	p, n, gx, gy *big.Int
+	sqrtExp      *big.Int // (p+1)/4: p ≡ 3 mod 4, so a square root is a^sqrtExp
+	halfN        *big.Int // n/2, the largest s accepted
+}{
+	p:  hexInt("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f"),
+	n:  hexInt("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141"),
+	gx: hexInt("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"),
+	gy: hexInt("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"),
+}
+
+func init() {
+	e := new(big.Int).Add(secp256k1.p, big.NewInt(1))
+	secp256k1.sqrtExp = e.Rsh(e, 2)
+	secp256k1.halfN = new(big.Int).Rsh(secp256k1.n, 1)
+}
+
+func hexInt(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("bad hex constant " + s)
+	}
+	return n
+}
+
+const (
+	secp256k1CompressedSize   = 33 // 0x02 or 0x03, then x
+	secp256k1UncompressedSize = 65 // 0x04, then x and y
+	secp256k1SignatureSize    = 64 // r and s, 32 bytes each, big-endian
+)
+
+// jacobian is a curve point in Jacobian coordinates: (x/z², y/z³). z = 0 is
+// the point at infinity.
+type jacobian struct{ x, y, z *big.Int }
+
+func (a jacobian) infinity() bool { return a.z.Sign() == 0 }
+
+func feMod(v *big.Int) *big.Int { return v.Mod(v, secp256k1.p) }
+
+func feMul(a, b *big.Int) *big.Int { return feMod(new(big.Int).Mul(a, b)) }
+
+func feSub(a, b *big.Int) *big.Int { return feMod(new(big.Int).Sub(a, b)) }
+
+// double returns 2a (dbl-2009-l, for a curve with a = 0).
+func (a jacobian) double() jacobian {
+	if a.infinity() || a.y.Sign() == 0 {
+		return jacobian{new(big.Int), new(big.Int), new(big.Int)}
+	}
+	xx := feMul(a.x, a.x)
+	yy := feMul(a.y, a.y)
+	yyyy := feMul(yy, yy)
+	t := new(big.Int).Add(a.x, yy)
+	d := feSub(feMul(t, t), new(big.Int).Add(xx, yyyy))
+	d = feMod(d.Lsh(d, 1))
+	e := feMod(new(big.Int).Mul(xx, big.NewInt(3)))
+	x3 := feSub(feMul(e, e), new(big.Int).Lsh(d, 1))
+	y3 := feSub(feMul(e, feSub(d, x3)), new(big.Int).Lsh(yyyy, 3))
+	z3 := feMul(a.y, a.z)
+	z3 = feMod(z3.Lsh(z3, 1))
+	return jacobian{x3, y3, z3}
+}
+
+// add returns a + b (add-2007-bl).
+func (a jacobian) add(b jacobian) jacobian {
+	if a.infinity() {
+		return b
+	}
+	if b.infinity() {
+		return a
+	}
+	z1z1 := feMul(a.z, a.z)
+	z2z2 := feMul(b.z, b.z)
+	u1 := feMul(a.x, z2z2)
+	u2 := feMul(b.x, z1z1)
+	s1 := feMul(feMul(a.y, b.z), z2z2)
+	s2 := feMul(feMul(b.y, a.z), z1z1)
+	if u1.Cmp(u2) == 0 {
+		if s1.Cmp(s2) != 0 {
+			return jacobian{new(big.Int), new(big.Int), new(big.Int)}
+		}
+		return a.double()
+	}
+	h := feSub(u2, u1)
+	i := new(big.Int).Lsh(h, 1)
+	i = feMul(i, i)
+	j := feMul(h, i)
+	r := feSub(s2, s1)
+	r = feMod(r.Lsh(r, 1))
+	v := feMul(u1, i)
+	x3 := feSub(feSub(feMul(r, r), j), new(big.Int).Lsh(v, 1))
+	y3 := feSub(feMul(r, feSub(v, x3)), new(big.Int).Lsh(feMul(s1, j), 1))
+	zs := new(big.Int).Add(a.z, b.z)
+	z3 := feMul(feSub(feMul(zs, zs), new(big.Int).Add(z1z1, z2z2)), h)
+	return jacobian{x3, y3, z3}
+}
+
+// affineX returns the affine x coordinate of a, which must not be infinity.
+func (a jacobian) affineX() *big.Int {
+	zinv := new(big.Int).ModInverse(a.z, secp256k1.p)
+	return feMul(a.x, feMul(zinv, zinv))
+}
+
+// affine returns the affine coordinates of a, which must not be infinity.
+func (a jacobian) affine() (x, y *big.Int) {
+	zinv := new(big.Int).ModInverse(a.z, secp256k1.p)
+	zinv2 := feMul(zinv, zinv)
+	return feMul(a.x, zinv2), feMul(a.y, feMul(zinv2, zinv))
+}
+
+func affinePoint(x, y *big.Int) jacobian {
+	return jacobian{new(big.Int).Set(x), new(big.Int).Set(y), big.NewInt(1)}
+}
+
+// twoScalarMult returns u1·G + u2·q, sharing one doubling chain (Shamir's
+// trick).
+func twoScalarMult(u1, u2 *big.Int, q jacobian) jacobian {
+	g := affinePoint(secp256k1.gx, secp256k1.gy)
+	gq := g.add(q)
+	acc := jacobian{new(big.Int), new(big.Int), new(big.Int)}
+	bits := max(u1.BitLen(), u2.BitLen())
+	for i := bits - 1; i >= 0; i-- {
+		acc = acc.double()
+		switch b1, b2 := u1.Bit(i), u2.Bit(i); {
+		case b1 == 1 && b2 == 1:
+			acc = acc.add(gq)
+		case b1 == 1:
+			acc = acc.add(g)
+		case b2 == 1:
+			acc = acc.add(q)
+		}
+	}
+	return acc
+}
+
+var errSecp256k1Key = errors.New("pk: not a secp256k1 public key")
+
+// parseSecp256k1Key decodes a compressed or uncompressed SEC 1 public key
+// and checks that it is on the curve.
+func parseSecp256k1Key(pk []byte) (jacobian, error) {
+	p := secp256k1.p
+	switch {
+	case len(pk) == secp256k1CompressedSize && (pk[0] == 2 || pk[0] == 3):
+		x := new(big.Int).SetBytes(pk[1:])
+		if x.Cmp(p) >= 0 {
+			return jacobian{}, errSecp256k1Key
+		}
+		y2 := feMod(new(big.Int).Add(feMul(feMul(x, x), x), big.NewInt(7)))
+		y := new(big.Int).Exp(y2, secp256k1.sqrtExp, p)
+		if feMul(y, y).Cmp(y2) != 0 {
+			return jacobian{}, errSecp256k1Key
+		}
+		if y.Bit(0) != uint(pk[0]&1) {
+			y.Sub(p, y)
+		}
+		return affinePoint(x, y), nil
+
+	case len(pk) == secp256k1UncompressedSize && pk[0] == 4:
+		x := new(big.Int).SetBytes(pk[1:33])
+		y := new(big.Int).SetBytes(pk[33:])
+		if x.Cmp(p) >= 0 || y.Cmp(p) >= 0 {
+			return jacobian{}, errSecp256k1Key
+		}
+		rhs := feMod(new(big.Int).Add(feMul(feMul(x, x), x), big.NewInt(7)))
+		if feMul(y, y).Cmp(rhs) != 0 {
+			return jacobian{}, errSecp256k1Key
+		}
+		return affinePoint(x, y), nil
+	}
+	return jacobian{}, errSecp256k1Key
+}
+
+// verifySecp256k1 reports whether sig, r then s, is an ECDSA signature by pk
+// of the SHA-256 digest of msg. Only low s (s ≤ n/2) is accepted, as in
+// libsecp256k1: if (r, s) verifies then so does (r, n-s), and accepting both
+// would let anyone give a signed packet a second valid sig without the key.
+// A signer whose library does not normalize s replaces a high s with n-s.
+func verifySecp256k1(pk, msg, sig []byte) (bool, error) {
+	q, err := parseSecp256k1Key(pk)
+	if err != nil {
+		return false, err
+	}
+	if len(sig) != secp256k1SignatureSize {
+		return false, errSigSize(secp256k1SignatureSize, len(sig))
+	}
+	n := secp256k1.n
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Sign() == 0 || s.Sign() == 0 || r.Cmp(n) >= 0 || s.Cmp(secp256k1.halfN) > 0 {
+		return false, nil
+	}
+	digest := sha256.Sum256(msg)
+	e := new(big.Int).SetBytes(digest[:])
+	w := new(big.Int).ModInverse(s, n)
+	u1 := e.Mul(e, w)
+	u1.Mod(u1, n)
+	u2 := w.Mul(r, w)
+	u2.Mod(u2, n)
+	pt := twoScalarMult(u1, u2, q)
+	if pt.infinity() {
+		return false, nil
+	}
+	v := pt.affineX()
+	return v.Mod(v, n).Cmp(r) == 0, nil
+}
@@ -0,0 +1,73 @@
+package wire
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSignVerify(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	p := &Packet{Id: "s1", Src: "bot:a", Dst: "bot:b", Body: "hello", Fee: 3, Tags: map[string]string{"b": "2", "a": "1"}}
+	if err := Verify(p); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("unsigned packet: got %v, want ErrUnsigned", err)
+	}
+	if err := Sign(p, priv); err != nil {
+		t.Fatal(err)
+	}
+	if Verify(p) != nil {
+		t.Fatal("signed packet does not verify")
+	}
+
+	// The server stamps seq after signing, so it is left out.
+	stamped := proto.Clone(p).(*Packet)
+	stamped.Seq = 42
+	if Verify(stamped) != nil {
+		t.Error("seq broke the signature")
+	}
+
+	// Every other field is signed.
+	for name, change := range map[string]func(*Packet){
+		"body":  func(p *Packet) { p.Body = "goodbye" },
+		"dst":   func(p *Packet) { p.Dst = "bot:c" },
+		"fee":   func(p *Packet) { p.Fee = 0 },
+		"tags":  func(p *Packet) { p.Tags["a"] = "9" },
+		"alg":   func(p *Packet) { p.Alg = AlgSecp256k1 },
+		"pk":    func(p *Packet) { p.Pk = p.Pk[:16] },
+		"label": func(p *Packet) { p.Labels = map[string]string{"region": "eu"} },
+	} {
+		q := proto.Clone(p).(*Packet)
+		change(q)
+		if Verify(q) == nil {
+			t.Errorf("changed %s still verifies", name)
+		}
+	}
+
+	tampered := proto.Clone(p).(*Packet)
+	tampered.Body = "goodbye"
+	if err := Verify(tampered); !errors.Is(err, ErrBadSig) {
+		t.Errorf("tampered packet: got %v, want ErrBadSig", err)
+	}
+
+	// A packet that can't be checked at all says why.
+	unknown := proto.Clone(p).(*Packet)
+	unknown.Alg = "rsa"
+	if err := Verify(unknown); err == nil || errors.Is(err, ErrBadSig) || !strings.Contains(err.Error(), `"rsa"`) {
+		t.Errorf("unknown alg: got %v", err)
+	}
+}
+
+func TestVerifySecp256k1Packet(t *testing.T) {
+	key := newSecpKey(t)
+	p := key.signPacket(t, &Packet{Src: "bot:secp", Dst: "server", Body: "hi"})
+	if Verify(p) != nil {
+		t.Fatal("secp256k1 packet does not verify")
+	}
+	p.Alg = AlgEd25519
+	if Verify(p) == nil {
+		t.Fatal("secp256k1 signature verified as ed25519")
+	}
+}